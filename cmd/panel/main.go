@@ -1,22 +1,40 @@
 package main
 
 import (
+	"cmp"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
 	"net/url"
 	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
+	"filippo.io/age"
 	"github.com/cordialsys/panel/pkg/bak"
 	"github.com/cordialsys/panel/pkg/client"
 	"github.com/cordialsys/panel/pkg/paths"
 	"github.com/cordialsys/panel/pkg/plog"
+	"github.com/cordialsys/panel/pkg/s3client"
 	"github.com/cordialsys/panel/pkg/secret"
 	"github.com/cordialsys/panel/server"
+	"github.com/cordialsys/panel/server/audit"
+	"github.com/cordialsys/panel/server/auth"
 	"github.com/cordialsys/panel/server/panel"
+	"github.com/cordialsys/panel/server/schedule"
 	"github.com/pelletier/go-toml/v2"
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 )
 
 func StartCmd() *cobra.Command {
@@ -35,24 +53,47 @@ func StartCmd() *cobra.Command {
 	var treasuryUser string
 	var webDir string
 
+	var tlsCert string
+	var tlsKey string
+	var clientCA string
+	var noTls bool
+	var secretsInEnv bool
+	var secretCacheTtl time.Duration
+	var secretCacheStaleOnError bool
+	var secretCacheMaxStale time.Duration
+
 	var cmd = &cobra.Command{
 		Use:          "start",
 		Short:        "Start the panel server",
 		SilenceUsage: true,
 
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if !cmd.Flags().Changed("api-key") && secret.HasCredential(panel.CredentialApiKey) {
+				apiKeyRef = string(panel.ApiKeyCredentialRef())
+			}
 			apiSecret := secret.Secret(apiKeyRef)
 			apiKey, err := apiSecret.Load()
 			if err != nil {
 				return fmt.Errorf("failed to load API key: %v", err)
 			}
+			// Keys passed directly are stored in the panel directory, otherwise only the reference is kept.
+			var apiKeyValue string
+			var apiKeyStoredRef secret.Secret
+			if apiKey != "" {
+				if apiSecret.IsType(secret.Env) || apiSecret.IsType(secret.Raw) {
+					apiKeyValue = apiKey
+				} else {
+					apiKeyStoredRef = apiSecret
+				}
+			}
 
 			srv := server.New(server.Options{
 				ListenAddr:     listenAddr,
 				TreasuryHome:   treasuryHome,
 				BinaryDir:      binaryDir,
 				PanelDir:       panelDir,
-				ApiKey:         apiKey,
+				ApiKey:         apiKeyValue,
+				ApiKeyRef:      apiKeyStoredRef,
 				SupervisorHome: supervisorHome,
 				Triples:        triples,
 				BackupDir:      backupDir,
@@ -60,6 +101,15 @@ func StartCmd() *cobra.Command {
 				ApiNode:        apiNode,
 				TreasuryUser:   treasuryUser,
 				WebDir:         webDir,
+				TlsCert:        tlsCert,
+				TlsKey:         tlsKey,
+				ClientCA:       clientCA,
+				NoTls:          noTls,
+				SecretsInEnv:   secretsInEnv,
+
+				SecretCacheTtl:          secretCacheTtl,
+				SecretCacheStaleOnError: secretCacheStaleOnError,
+				SecretCacheMaxStale:     secretCacheMaxStale,
 			})
 			return srv.Start()
 		},
@@ -82,6 +132,15 @@ func StartCmd() *cobra.Command {
 	cmd.Flags().BoolVar(&apiNode, "api-node", false, "Run as an API node")
 	cmd.Flags().StringVar(&webDir, "web-dir", "./web/out", "Web directory override")
 
+	cmd.Flags().StringVar(&tlsCert, "tls-cert", "", "TLS certificate to serve, defaults to a self-signed certificate in the panel directory")
+	cmd.Flags().StringVar(&tlsKey, "tls-key", "", "TLS key for --tls-cert")
+	cmd.Flags().StringVar(&clientCA, "client-ca", "", "Require client certificates signed by this CA (mutual TLS)")
+	cmd.Flags().BoolVar(&noTls, "no-tls", false, "Serve plain HTTP")
+	cmd.Flags().BoolVar(&secretsInEnv, "secrets-in-env", false, "Pass secrets to cord/signer in environment variables instead of over a pipe (for older versions)")
+	cmd.Flags().DurationVar(&secretCacheTtl, "secret-cache-ttl", 5*time.Minute, "Cache secrets loaded from vault, gcp and aws for this long (0 to disable)")
+	cmd.Flags().BoolVar(&secretCacheStaleOnError, "secret-cache-stale-on-error", false, "Use cached secrets past their TTL while the secret manager cannot be reached")
+	cmd.Flags().DurationVar(&secretCacheMaxStale, "secret-cache-max-stale", secret.DefaultMaxStale, "With --secret-cache-stale-on-error, stop using a cached secret this long after its TTL")
+
 	return cmd
 }
 
@@ -102,6 +161,9 @@ func ActivateAllCmd() *cobra.Command {
 		SilenceUsage: true,
 
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := ensureInitialToken(); err != nil {
+				return err
+			}
 
 			var apiKey string
 			var err error
@@ -271,7 +333,7 @@ func ActivateAllCmd() *cobra.Command {
 	}
 
 	cmd.Flags().StringVar(&apiKeyRef, "api-key", "", "API key secret reference")
-	cmd.Flags().StringVar(&remote, "url", "http://localhost:7666", "URL of the panel server")
+	cmd.Flags().StringVar(&remote, "url", "https://localhost:7666", "URL of the panel server")
 	cmd.Flags().BoolVar(&connector, "connector", false, "Enable connector")
 	cmd.Flags().StringSliceVar(&baks, "bak", []string{}, "Backup key(s)")
 	cmd.Flags().StringVar(&version, "version", "latest", "Version of production binaries to install")
@@ -282,6 +344,7 @@ func ActivateAllCmd() *cobra.Command {
 
 func ActivateApiKeyCmd() *cobra.Command {
 	var apiKeyRef string
+	var storeRef bool
 	var connector bool
 	var remote string
 
@@ -291,10 +354,19 @@ func ActivateApiKeyCmd() *cobra.Command {
 		SilenceUsage: true,
 
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := ensureInitialToken(); err != nil {
+				return err
+			}
 			var apiKey string
 			var err error
 
-			if apiKeyRef == "" {
+			if storeRef {
+				// the panel resolves the reference itself
+				secretMaybe := secret.Secret(apiKeyRef)
+				if _, ok := secretMaybe.Type(); !ok {
+					return fmt.Errorf("--store-ref requires --api-key to be a secret reference")
+				}
+			} else if apiKeyRef == "" {
 				var input string
 				for input == "" {
 					fmt.Print("Enter Activation API key: ")
@@ -325,7 +397,11 @@ func ActivateApiKeyCmd() *cobra.Command {
 				// only pass if specified on CLI, so panel will otherwise default to the admin API.
 				connectorInput = &connector
 			}
-			err = panelClient.ActivateApiKey(apiKey, connectorInput)
+			if storeRef {
+				err = panelClient.ActivateApiKeyRef(secret.Secret(apiKeyRef), connectorInput)
+			} else {
+				err = panelClient.ActivateApiKey(apiKey, connectorInput)
+			}
 			if err != nil {
 				return err
 			}
@@ -336,7 +412,8 @@ func ActivateApiKeyCmd() *cobra.Command {
 	}
 
 	cmd.Flags().StringVar(&apiKeyRef, "api-key", "", "API key secret reference")
-	cmd.Flags().StringVar(&remote, "url", "http://localhost:7666", "URL of the panel server")
+	cmd.Flags().BoolVar(&storeRef, "store-ref", false, "Store only the --api-key reference on the panel, which resolves it when needed (e.g. vault, gcp, aws)")
+	cmd.Flags().StringVar(&remote, "url", "https://localhost:7666", "URL of the panel server")
 	cmd.Flags().BoolVar(&connector, "connector", false, "Enable connector")
 	return cmd
 }
@@ -351,6 +428,9 @@ func ActivateBinariesCmd() *cobra.Command {
 		SilenceUsage: true,
 
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := ensureInitialToken(); err != nil {
+				return err
+			}
 			fmt.Println("Installing production binaries...")
 			err := panelClient.ActivateBinaries(client.ActivateBinariesOptions{
 				Version: version,
@@ -364,7 +444,7 @@ func ActivateBinariesCmd() *cobra.Command {
 		},
 	}
 
-	cmd.Flags().StringVar(&remote, "url", "http://localhost:7666", "URL of the panel server")
+	cmd.Flags().StringVar(&remote, "url", "https://localhost:7666", "URL of the panel server")
 	cmd.Flags().StringVar(&version, "version", "latest", "Version of production binaries to install")
 	return cmd
 }
@@ -379,6 +459,9 @@ func ActivateBakCmd() *cobra.Command {
 		SilenceUsage: true,
 
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := ensureInitialToken(); err != nil {
+				return err
+			}
 			panelInfo, err := panelClient.GetPanel()
 			if err != nil {
 				return err
@@ -431,7 +514,7 @@ func ActivateBakCmd() *cobra.Command {
 		},
 	}
 
-	cmd.Flags().StringVar(&remote, "url", "http://localhost:7666", "URL of the panel server")
+	cmd.Flags().StringVar(&remote, "url", "https://localhost:7666", "URL of the panel server")
 	cmd.Flags().StringSliceVar(&baks, "bak", []string{}, "Backup key(s)")
 	return cmd
 }
@@ -450,266 +533,1508 @@ func ActivateCmd() *cobra.Command {
 	return cmd
 }
 
-func ResetCmd() *cobra.Command {
-	var force bool
-	var panelHome string
+// Activation is the first thing run on a new VM, so create the initial admin token
+// locally if the panel server has not done so already.
+func ensureInitialToken() error {
+	if panelClient.HasToken() {
+		return nil
+	}
+	panelDir := panel.New().PanelDir
+	created, err := auth.EnsureInitial(panelDir)
+	if err != nil {
+		return fmt.Errorf("no admin token configured, and failed to create the initial token: %v", err)
+	}
+	if created {
+		fmt.Println("Created initial admin token:", panelDir.AdminTokenFile())
+	}
+	token, err := auth.LoadLocal(panelDir)
+	if err != nil {
+		return fmt.Errorf("no admin token configured; pass --token or set %s: %v", ENV_PANEL_TOKEN, err)
+	}
+	panelClient.SetToken(token)
+	return nil
+}
+
+func TokenCreateCmd() *cobra.Command {
+	var _panelDir string
+	var name string
+	var principal string
+	var role string
 	var cmd = &cobra.Command{
-		Use:          "reset",
-		Short:        "Reset the panel server",
-		Long:         "This is required if you want to change the backup keys for this node.",
+		Use:          "create",
+		Short:        "Create a new admin token for the panel API",
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			fmt.Println("Resetting panel server...")
-			if !force {
-				fmt.Println("This will delete the panel server backup keys and API keys, do you want to continue? (y/n)")
-				var confirm string
-				fmt.Scanln(&confirm)
-				if strings.ToLower(strings.TrimSpace(confirm)) != "y" {
-					return fmt.Errorf("cancelled")
-				}
+			if len(args) > 0 {
+				name = args[0]
 			}
-			err := os.RemoveAll(panelHome)
+			tokenRole, err := auth.ParseRole(role)
 			if err != nil {
 				return err
 			}
-			fmt.Println("Panel server reset.")
+			token, _, err := auth.Create(paths.PanelHome(_panelDir), name, principal, tokenRole)
+			if err != nil {
+				return fmt.Errorf("failed to create token: %v", err)
+			}
+			fmt.Println("# You must save this somewhere safe, it will not be shown again")
+			fmt.Println(token)
 			return nil
 		},
 	}
-	cmd.Flags().BoolVar(&force, "force", false, "Force reset")
-	cmd.Flags().StringVar(&panelHome, "panel-home", "/etc/panel", "Panel home directory")
+	cmd.Flags().StringVar(&_panelDir, "panel-dir", string(panel.New().PanelDir), "Panel directory override")
+	cmd.Flags().StringVar(&name, "name", "", "Name of the token")
+	cmd.Flags().StringVar(&principal, "principal", "", "Person holding the token, who may not approve their own requests with any of their tokens (default the token name)")
+	cmd.Flags().StringVar(&role, "role", string(auth.RoleViewer), fmt.Sprintf("Role of the token, one of %v", auth.Roles))
 	return cmd
 }
 
-func DeleteTreasuryCmd() *cobra.Command {
-	var remote string
-	var force bool
-	var includeSupervisor bool
+func TokenListCmd() *cobra.Command {
+	var _panelDir string
 	var cmd = &cobra.Command{
-		Use:          "delete-treasury",
-		Short:        "Delete the treasury node",
-		Long:         "This is required to recreate the treasury node.",
+		Use:          "list",
+		Aliases:      []string{"ls"},
+		Short:        "List the admin tokens",
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			if !force {
-				fmt.Println("This will permanently delete the treasury node locally, do you want to continue? (y/n)")
-				var confirm string
-				fmt.Scanln(&confirm)
-				if strings.ToLower(strings.TrimSpace(confirm)) != "y" {
-					return fmt.Errorf("cancelled")
-				}
-			}
-			fmt.Println("Stopping treasury...")
-			_ = panelClient.UpdateService("treasury.service", "stop")
-			_ = panelClient.UpdateService("start-treasury.service", "stop")
-
-			fmt.Println("Deleting treasury...")
-			err := panelClient.DeleteTreasury(includeSupervisor)
+			tokens, err := auth.Load(paths.PanelHome(_panelDir))
 			if err != nil {
-				return err
+				return fmt.Errorf("failed to load tokens: %v", err)
+			}
+			for _, token := range tokens {
+				fmt.Printf("%s\t%s\t%s\t%s\t%s\n", token.Id, token.Name, token.PrincipalName(), token.EffectiveRole(), token.CreateTime.Format(time.RFC3339))
 			}
-
 			return nil
 		},
 	}
-
-	cmd.Flags().StringVar(&remote, "url", "http://localhost:7666", "URL of the panel server")
-	cmd.Flags().BoolVar(&force, "force", false, "Skip any confirmation")
-	cmd.Flags().BoolVar(&includeSupervisor, "supervisor", false, "Include deleting supervisor config (reset to using initial image, no EAR)")
+	cmd.Flags().StringVar(&_panelDir, "panel-dir", string(panel.New().PanelDir), "Panel directory override")
 	return cmd
 }
 
-func SyncTreasuryPeersCmd() *cobra.Command {
-	var remote string
+func TokenRevokeCmd() *cobra.Command {
+	var _panelDir string
 	var cmd = &cobra.Command{
-		Use:          "sync-peers",
-		Short:        "Sync the treasury peers",
-		Long:         "In case DNS names change, you can re-sync the configured peers.",
+		Use:          "revoke <id-or-name>",
+		Aliases:      []string{"rm"},
+		Short:        "Revoke an admin token",
+		Args:         cobra.ExactArgs(1),
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			err := panelClient.SyncTreasuryPeers()
+			token, err := auth.Revoke(paths.PanelHome(_panelDir), args[0])
 			if err != nil {
-				return err
+				return fmt.Errorf("failed to revoke token: %v", err)
 			}
-
+			fmt.Println("Revoked token", token.Id, token.Name)
 			return nil
 		},
 	}
-
-	cmd.Flags().StringVar(&remote, "url", "http://localhost:7666", "URL of the panel server")
+	cmd.Flags().StringVar(&_panelDir, "panel-dir", string(panel.New().PanelDir), "Panel directory override")
 	return cmd
 }
 
-func DoTreasuryConfigSync(panelInfo *panel.Panel, treasuryHome paths.TreasuryHome) error {
-	treasuryConfig := map[string]interface{}{}
-
-	treasuryConfigFile, err := os.Open(treasuryHome.TreasuryConfig())
-	if err != nil {
-		return fmt.Errorf("failed to open treasury config: %v", err)
-	}
-	defer treasuryConfigFile.Close()
-
-	treasuryConfigBz, err := io.ReadAll(treasuryConfigFile)
-	if err != nil {
-		return fmt.Errorf("failed to read treasury config: %v", err)
-	}
-	treasuryConfigFileStat, err := treasuryConfigFile.Stat()
-	if err != nil {
-		return fmt.Errorf("failed to stat treasury config: %v", err)
+func TokenCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "token",
+		Short: "Manage admin tokens for the panel API (must be run on the panel host)",
 	}
-	_ = treasuryConfigFile.Close()
 
-	err = toml.Unmarshal(treasuryConfigBz, &treasuryConfig)
-	if err != nil {
-		return fmt.Errorf("failed to unmarshal treasury config: %v", err)
-	}
+	cmd.AddCommand(TokenCreateCmd())
+	cmd.AddCommand(TokenListCmd())
+	cmd.AddCommand(TokenRevokeCmd())
 
-	// Modify only the backup.bak entry
-	backupConfig, ok := treasuryConfig["backup"].(map[string]interface{})
-	if !ok {
-		// add backup section if not present
-		treasuryConfig["backup"] = map[string]interface{}{}
-	}
-	backupConfig = treasuryConfig["backup"].(map[string]interface{})
+	return cmd
+}
 
-	backupConfig["bak"] = panelInfo.Baks
-	treasuryConfigBz, err = toml.Marshal(treasuryConfig)
-	if err != nil {
-		return fmt.Errorf("failed to marshal treasury config: %v", err)
-	}
-	err = os.WriteFile(treasuryHome.TreasuryConfig(), treasuryConfigBz, treasuryConfigFileStat.Mode())
-	if err != nil {
-		return fmt.Errorf("failed to write treasury config: %v", err)
+func AuditVerifyCmd() *cobra.Command {
+	var _panelDir string
+	var cmd = &cobra.Command{
+		Use:          "verify",
+		Short:        "Verify the hash chain of the audit log",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			count, err := audit.Verify(paths.PanelHome(_panelDir))
+			if err != nil {
+				return fmt.Errorf("audit log verification failed after %d entries: %v", count, err)
+			}
+			fmt.Printf("audit log OK, %d entries verified\n", count)
+			return nil
+		},
 	}
-	return nil
+	cmd.Flags().StringVar(&_panelDir, "panel-dir", string(panel.New().PanelDir), "Panel directory override")
+	return cmd
 }
 
-func DoSupervisorConfigSync(panelInfo *panel.Panel, supervisorHome paths.SupervisorHome) error {
-	supervisorConfig := map[string]interface{}{}
-
-	// create file if it doesn't exist
-	if _, err := os.Stat(supervisorHome.ConfigFile()); os.IsNotExist(err) {
-		f, err := os.Create(supervisorHome.ConfigFile())
-		if err != nil {
-			return fmt.Errorf("failed to create supervisor config: %v", err)
-		}
-		_ = f.Close()
+func AuditCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "audit",
+		Short: "Inspect the panel audit log (must be run on the panel host)",
 	}
 
-	supervisorConfigFile, err := os.Open(supervisorHome.ConfigFile())
-	if err != nil {
-		return fmt.Errorf("failed to open supervisor config: %v", err)
-	}
-	defer supervisorConfigFile.Close()
+	cmd.AddCommand(AuditVerifyCmd())
 
-	supervisorConfigBz, err := io.ReadAll(supervisorConfigFile)
-	if err != nil {
-		return fmt.Errorf("failed to read supervisor config: %v", err)
-	}
-	supervisorConfigFileStat, err := supervisorConfigFile.Stat()
-	if err != nil {
-		return fmt.Errorf("failed to stat treasury config: %v", err)
-	}
-	err = toml.Unmarshal(supervisorConfigBz, &supervisorConfig)
-	if err != nil {
-		return fmt.Errorf("failed to unmarshal supervisor config: %v", err)
-	}
+	return cmd
+}
 
-	supervisorConfig["ear_secret"] = panelInfo.EarSecret
-	supervisorConfigBz, err = toml.Marshal(supervisorConfig)
-	if err != nil {
-		return fmt.Errorf("failed to marshal supervisor config: %v", err)
-	}
-	err = os.WriteFile(supervisorHome.ConfigFile(), supervisorConfigBz, supervisorConfigFileStat.Mode())
-	if err != nil {
-		return fmt.Errorf("failed to write supervisor config: %v", err)
+// Explain how to proceed if the request requires a second admin to approve.
+func approvalError(err error, command string) error {
+	if approvalErr, ok := err.(*client.ApprovalRequiredError); ok {
+		return fmt.Errorf("%v\n\nOnce approved, re-run: panel %s --approval %s", approvalErr, command, approvalErr.ApprovalId)
 	}
-	return nil
+	return err
 }
 
-func SyncConfigCmd() *cobra.Command {
-	var _panelDir string
-	var _treasuryHome string
-	var _supervisorHome string
+func ApprovalsListCmd() *cobra.Command {
 	var cmd = &cobra.Command{
-		Use:          "sync-config",
-		Aliases:      []string{"sync-backup-keys", "sync-config"},
-		Short:        "Write the configured backup keys in the panel to the current Treasury config",
+		Use:          "list",
+		Aliases:      []string{"ls"},
+		Short:        "List approval requests",
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			panelDir := paths.PanelHome(_panelDir)
-			treasuryHome := paths.TreasuryHome(_treasuryHome)
-			supervisorHome := paths.SupervisorHome(_supervisorHome)
-			panelInfo, err := panel.Load(panelDir)
+			list, err := panelClient.ListApprovals()
 			if err != nil {
-				return fmt.Errorf("failed to load panel data: %v", err)
+				return err
 			}
-			if len(panelInfo.Baks) == 0 {
-				return fmt.Errorf("no backup keys configured on panel")
+			for _, approval := range list {
+				approvedBy := ""
+				if approval.ApprovedBy != nil {
+					approvedBy = approval.ApprovedBy.Name
+				}
+				fmt.Printf("%s\t%s\t%s\trequested by %s\tapproved by %s\texpires %s\n",
+					approval.Id, approval.State, approval.Action, approval.RequestedBy.Name, approvedBy,
+					approval.ExpireTime.Format(time.RFC3339))
 			}
+			return nil
+		},
+	}
+	return cmd
+}
 
-			err = DoTreasuryConfigSync(panelInfo, treasuryHome)
+func ApprovalsApproveCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:          "approve <id>",
+		Short:        "Approve a request created by another admin",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			approval, err := panelClient.Approve(args[0])
 			if err != nil {
-				return fmt.Errorf("failed to sync treasury config: %v", err)
+				return err
 			}
+			fmt.Printf("approved %s (%s), it may now be executed by %s until %s\n",
+				approval.Id, approval.Action, approval.RequestedBy.Name, approval.ExpireTime.Format(time.RFC3339))
+			return nil
+		},
+	}
+	return cmd
+}
 
-			err = DoSupervisorConfigSync(panelInfo, supervisorHome)
+func ApprovalsCancelCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:          "cancel <id>",
+		Short:        "Cancel an approval request",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			approval, err := panelClient.CancelApproval(args[0])
 			if err != nil {
-				return fmt.Errorf("failed to sync supervisor config: %v", err)
+				return err
 			}
-
+			fmt.Printf("cancelled %s (%s)\n", approval.Id, approval.Action)
 			return nil
 		},
 	}
-	cmd.Flags().StringVar(&_panelDir, "panel-dir", string(panel.New().PanelDir), "Panel directory override")
-	cmd.Flags().StringVar(&_treasuryHome, "treasury-home", string(panel.New().TreasuryHome), "Treasury home directory override")
-	cmd.Flags().StringVar(&_supervisorHome, "supervisor-home", string(panel.New().SupervisorHome), "Supervisor home directory override")
 	return cmd
 }
 
-func GenerateCmd() *cobra.Command {
+func EarRotateCmd() *cobra.Command {
+	var secretRef string
 	var cmd = &cobra.Command{
-		Use:          "bak",
-		Short:        "Generate a backup key",
+		Use:          "rotate",
+		Short:        "Generate a new EAR phrase, store it as a new secret version, and re-encrypt signer.db with it",
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			fmt.Println("# You must save this somewhere safe")
-			sk := bak.GenerateEncryptionKey()
-			recipient := sk.Recipient()
-
-			fmt.Println(strings.Join(sk.Words(), " "))
-			fmt.Println(recipient.String())
-
+			var target secret.Ref
+			if secretRef != "" {
+				var err error
+				if target, err = secret.ParseRef(secretRef); err != nil {
+					return fmt.Errorf("invalid --secret: %v", err)
+				}
+			}
+			err := panelClient.RotateEncryptionAtRest(target)
+			if err != nil {
+				return err
+			}
+			fmt.Println("rotated encryption at rest phrase")
 			return nil
 		},
 	}
+	cmd.Flags().StringVar(&secretRef, "secret", "", fmt.Sprintf("Store the new phrase in this secret instead of the current one (one of %v)", secret.WritableTypes))
 	return cmd
 }
 
-func HealthyCmd() *cobra.Command {
+func EarCmd() *cobra.Command {
 	var cmd = &cobra.Command{
-		Use:          "health",
-		Aliases:      []string{"healthy"},
-		Short:        "Check if the treasury node is healthy",
+		Use:   "ear",
+		Short: "Manage encryption at rest of the treasury signer",
+	}
+
+	cmd.AddCommand(EarRotateCmd())
+
+	return cmd
+}
+
+func formatOptionalTime(t *time.Time) string {
+	if t == nil {
+		return "never"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func BackupScheduleCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:          "schedule",
+		Short:        "Show the snapshot schedules and the status of their last run",
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			health, err := panelClient.TreasuryHealth()
+			schedules, err := panelClient.ListSchedules()
 			if err != nil {
 				return err
 			}
-			fmt.Println(string(health))
+			for _, s := range schedules {
+				last := string(s.Status.LastResult)
+				if s.Status.LastError != "" {
+					last += ": " + s.Status.LastError
+				} else if s.Status.LastSnapshot != "" {
+					last += fmt.Sprintf(" (%s, pruned %d)", s.Status.LastSnapshot, s.Status.Pruned)
+				}
+				fmt.Printf("%s\t%q\tjitter %s\t%s\tnext %s\tlast run %s %s\n",
+					s.Bak, s.Cron, s.Jitter(), s.Retention, formatOptionalTime(s.Status.NextRun),
+					formatOptionalTime(s.Status.LastRun), last)
+			}
 			return nil
 		},
 	}
+
+	cmd.AddCommand(BackupScheduleSetCmd())
+	cmd.AddCommand(BackupScheduleRemoveCmd())
+
 	return cmd
 }
 
-var panelClient *client.Client
+// The backup key to act on, defaulting to the only one configured.
+func selectBak(bak string) (string, error) {
+	if bak != "" {
+		return bak, nil
+	}
+	panelInfo, err := panelClient.GetPanel()
+	if err != nil {
+		return "", err
+	}
+	if len(panelInfo.Baks) != 1 {
+		return "", fmt.Errorf("%d backup keys are configured, select one with --bak", len(panelInfo.Baks))
+	}
+	return panelInfo.Baks[0].Key, nil
+}
 
-func main() {
+func BackupScheduleSetCmd() *cobra.Command {
+	var bak string
+	var jitter time.Duration
+	var retention schedule.Retention
+	var cmd = &cobra.Command{
+		Use:          "set <cron>",
+		Short:        "Take snapshots on a cron schedule (in UTC), e.g. \"0 3 * * *\" or @daily",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			bak, err := selectBak(bak)
+			if err != nil {
+				return err
+			}
+			updated, err := panelClient.PutSchedule(schedule.Schedule{
+				Bak:           bak,
+				Cron:          args[0],
+				JitterSeconds: uint64(jitter.Seconds()),
+				Retention:     retention,
+			})
+			if err != nil {
+				return approvalError(err, "backup schedule set")
+			}
+			fmt.Printf("scheduled snapshots for %s at %q, retention: %s\n", updated.Bak, updated.Cron, updated.Retention)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&bak, "bak", "", "Backup key to snapshot, defaults to the only configured key")
+	cmd.Flags().DurationVar(&jitter, "jitter", 0, "Delay each run by a random amount up to this")
+	cmd.Flags().IntVar(&retention.KeepLast, "keep-last", 0, "Keep the most recent N scheduled snapshots")
+	cmd.Flags().IntVar(&retention.KeepDaily, "keep-daily", 0, "Keep the newest scheduled snapshot of each of the last N days")
+	cmd.Flags().IntVar(&retention.KeepWeekly, "keep-weekly", 0, "Keep the newest scheduled snapshot of each of the last N weeks")
+	cmd.Flags().IntVar(&retention.KeepMonthly, "keep-monthly", 0, "Keep the newest scheduled snapshot of each of the last N months")
+	return cmd
+}
+
+func BackupScheduleRemoveCmd() *cobra.Command {
+	var bak string
+	var cmd = &cobra.Command{
+		Use:          "rm",
+		Short:        "Stop taking scheduled snapshots, existing snapshots are kept",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			bak, err := selectBak(bak)
+			if err != nil {
+				return err
+			}
+			if err := panelClient.DeleteSchedule(bak); err != nil {
+				return approvalError(err, "backup schedule rm")
+			}
+			fmt.Printf("removed snapshot schedule for %s\n", bak)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&bak, "bak", "", "Backup key of the schedule, defaults to the only configured key")
+	return cmd
+}
+
+func printTestResult(result *s3client.TestResult) {
+	for _, check := range result.Checks {
+		if check.Ok {
+			fmt.Printf("%s\tok\n", check.Name)
+		} else {
+			fmt.Printf("%s\tfailed: %s\n", check.Name, check.Error)
+		}
+	}
+}
+
+func backupDestinationFlags(cmd *cobra.Command, destination *panel.BackupDestination) {
+	cmd.Flags().StringVar(&destination.Endpoint, "endpoint", "", "S3 API url (e.g. https://storage.googleapis.com or a MinIO url), defaults to AWS S3")
+	cmd.Flags().StringVar(&destination.Bucket, "bucket", "", "Bucket name")
+	cmd.Flags().StringVar(&destination.Region, "region", "", "Bucket region, required for AWS S3")
+	cmd.Flags().StringVar((*string)(&destination.Credentials), "credentials", "", "Secret reference to <access-key-id>:<secret-access-key>[:<session-token>], defaults to the panel's environment")
+}
+
+func BackupDestinationSetCmd() *cobra.Command {
+	var destination panel.BackupDestination
+	var force bool
+	var cmd = &cobra.Command{
+		Use:          "set",
+		Short:        "Keep snapshots and key backups in an S3-compatible bucket instead of the backup service",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			result, err := panelClient.SetBackupDestination(destination, force)
+			if err != nil {
+				return approvalError(err, "backup destination set")
+			}
+			printTestResult(result)
+			fmt.Printf("backups now go to bucket %s\n", destination.Bucket)
+			return nil
+		},
+	}
+	backupDestinationFlags(cmd, &destination)
+	cmd.Flags().BoolVar(&force, "force", false, "Use the destination even if it fails its checks")
+	return cmd
+}
+
+func BackupDestinationTestCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:          "test",
+		Short:        "Check connectivity and permissions of the current backup destination",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			result, err := panelClient.TestBackupDestination()
+			if err != nil {
+				return err
+			}
+			printTestResult(result)
+			if !result.Ok {
+				return fmt.Errorf("backup destination failed its checks")
+			}
+			return nil
+		},
+	}
+	return cmd
+}
+
+func BackupDestinationRemoveCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:          "rm",
+		Short:        "Go back to the Cordial Systems backup service, objects in the bucket are kept",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := panelClient.DeleteBackupDestination(); err != nil {
+				return approvalError(err, "backup destination rm")
+			}
+			fmt.Println("backups now go to the backup service")
+			return nil
+		},
+	}
+	return cmd
+}
+
+func BackupDestinationCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:          "destination",
+		Short:        "Show where snapshots and key backups are kept",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			panelInfo, err := panelClient.GetPanel()
+			if err != nil {
+				return err
+			}
+			destination := panelInfo.BackupDestination
+			if destination == nil {
+				fmt.Println("backup service")
+				return nil
+			}
+			fmt.Printf("endpoint\t%s\nbucket\t%s\nregion\t%s\ncredentials\t%s\n",
+				destination.Endpoint, destination.Bucket, destination.Region, destination.Credentials)
+			return nil
+		},
+	}
+
+	cmd.AddCommand(BackupDestinationSetCmd())
+	cmd.AddCommand(BackupDestinationTestCmd())
+	cmd.AddCommand(BackupDestinationRemoveCmd())
+
+	return cmd
+}
+
+func backupReplicaTarget(replica panel.BackupReplica) string {
+	if replica.S3 != nil && replica.S3.Endpoint == "" {
+		return "s3://" + replica.S3.Bucket
+	}
+	if replica.S3 != nil {
+		return strings.TrimSuffix(replica.S3.Endpoint, "/") + "/" + replica.S3.Bucket
+	}
+	return replica.Dir
+}
+
+func BackupReplicasAddCmd() *cobra.Command {
+	var replica panel.BackupReplica
+	var destination panel.BackupDestination
+	var force bool
+	var cmd = &cobra.Command{
+		Use:          "add <name>",
+		Short:        "Copy uploaded snapshots and key backups to a directory (e.g. an NFS mount) or another bucket",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			replica.Name = args[0]
+			if destination.Bucket != "" {
+				replica.S3 = &destination
+			}
+			result, err := panelClient.PutBackupReplica(replica, force)
+			if err != nil {
+				return approvalError(err, "backup replicas add")
+			}
+			printTestResult(result)
+			fmt.Printf("uploads are now copied to %s, run `panel backup reconcile` to copy existing backups\n", replica.Name)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&replica.Dir, "dir", "", "Absolute path of a local directory or NFS mount")
+	cmd.Flags().BoolVar(&replica.Prune, "prune", false, "Also delete the scheduled snapshots that retention prunes from the bucket")
+	backupDestinationFlags(cmd, &destination)
+	cmd.Flags().BoolVar(&force, "force", false, "Use the replica even if it fails its checks")
+	return cmd
+}
+
+func BackupReplicasRemoveCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:          "rm <name>",
+		Short:        "Stop copying backups to a replica, objects already there are kept",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := panelClient.DeleteBackupReplica(args[0]); err != nil {
+				return approvalError(err, "backup replicas rm "+args[0])
+			}
+			return nil
+		},
+	}
+	return cmd
+}
+
+func BackupReplicasCmd() *cobra.Command {
+	var pending bool
+	var cmd = &cobra.Command{
+		Use:          "replicas",
+		Short:        "Show the backup replicas and how many objects have been replicated to each",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			panelInfo, err := panelClient.GetPanel()
+			if err != nil {
+				return err
+			}
+			summary, err := panelClient.GetReplication()
+			if err != nil {
+				return err
+			}
+			targets := map[string]string{s3client.PrimaryName: "backup service"}
+			if panelInfo.BackupDestination != nil {
+				targets[s3client.PrimaryName] = backupReplicaTarget(panel.BackupReplica{S3: panelInfo.BackupDestination})
+			}
+			for _, replica := range panelInfo.BackupReplicas {
+				targets[replica.Name] = backupReplicaTarget(replica)
+			}
+			fmt.Printf("name\ttarget\treplicated\tfailed\tmissing\n")
+			for _, destination := range summary.Destinations {
+				fmt.Printf("%s\t%s\t%d\t%d\t%d\n", destination.Name, targets[destination.Name],
+					destination.Replicated, destination.Failed, destination.Missing)
+			}
+			if pending {
+				for _, key := range slices.Sorted(maps.Keys(summary.Pending)) {
+					for _, destination := range summary.Destinations {
+						state, ok := summary.Pending[key][destination.Name]
+						switch {
+						case !ok:
+							fmt.Printf("%s\t%s\tmissing\n", key, destination.Name)
+						case state.Status != s3client.ReplicaStatusReplicated:
+							fmt.Printf("%s\t%s\t%s: %s\n", key, destination.Name, state.Status, state.Error)
+						}
+					}
+				}
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&pending, "pending", false, "Also list the objects not yet at every destination")
+
+	cmd.AddCommand(BackupReplicasAddCmd())
+	cmd.AddCommand(BackupReplicasRemoveCmd())
+
+	return cmd
+}
+
+func BackupReconcileCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:          "reconcile",
+		Short:        "Copy any of this node's backups that are missing from the bucket or a replica",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			result, err := panelClient.ReconcileBackups()
+			if err != nil {
+				return err
+			}
+			for _, copied := range result.Copied {
+				fmt.Printf("%s\t%s -> %s\n", copied.Key, copied.From, copied.To)
+			}
+			for _, failed := range result.Failed {
+				fmt.Printf("%s\t%s\tfailed: %s\n", cmp.Or(failed.Key, "(list)"), failed.Destination, failed.Error)
+			}
+			fmt.Printf("%d objects, %d copies made\n", result.Objects, len(result.Copied))
+			if len(result.Failed) > 0 {
+				return fmt.Errorf("%d copies failed", len(result.Failed))
+			}
+			return nil
+		},
+	}
+	return cmd
+}
+
+func BackupBackfillCmd() *cobra.Command {
+	var force bool
+	var cmd = &cobra.Command{
+		Use:          "backfill",
+		Short:        "Write signed sidecars for this node's snapshots that do not have one",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			result, err := panelClient.BackfillSidecars(force)
+			if err != nil {
+				return err
+			}
+			for _, key := range result.Written {
+				fmt.Printf("%s\twritten\n", key)
+			}
+			for _, failed := range result.Failed {
+				fmt.Printf("%s\tfailed: %s\n", failed.Key, failed.Error)
+			}
+			fmt.Printf("%d snapshots, %d sidecars written\n", result.Snapshots, len(result.Written))
+			if len(result.Failed) > 0 {
+				return fmt.Errorf("%d sidecars failed", len(result.Failed))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&force, "force", false, "Also write the sidecars this panel signed again, if the snapshot still matches them")
+	return cmd
+}
+
+func BackupEndorseCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:          "endorse",
+		Short:        "Endorse the panel's sidecar signing key with a bak, read from stdin, so a rebuilt panel trusts its sidecars",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			phrase, err := readSecretValue("secret phrase of the bak: ")
+			if err != nil {
+				return fmt.Errorf("failed to read secret phrase: %v", err)
+			}
+			endorsed, err := panelClient.EndorseSigningKey(phrase)
+			if err != nil {
+				return err
+			}
+			for _, key := range endorsed {
+				fmt.Println(key)
+			}
+			return nil
+		},
+	}
+	return cmd
+}
+
+func BackupListCmd() *cobra.Command {
+	var opts client.ListBackupSnapshotsOptions
+	var asJson bool
+	var cmd = &cobra.Command{
+		Use:          "list",
+		Short:        "List the snapshots in the backup bucket, with their height and create time",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			entries, err := panelClient.ListBackupSnapshots(opts)
+			if err != nil {
+				return err
+			}
+			if asJson {
+				entriesBz, err := json.MarshalIndent(entries, "", "  ")
+				if err != nil {
+					return err
+				}
+				fmt.Println(string(entriesBz))
+				return nil
+			}
+			table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintf(table, "node\tbak\tid\theight\tcreated\tsize\tuploaded\tverified\n")
+			for _, entry := range entries {
+				height, created := "-", "-"
+				if entry.Info != nil {
+					height = fmt.Sprint(entry.Info.Height)
+					created = entry.Info.CreateTime.UTC().Format(time.RFC3339)
+				} else if entry.InfoError != "" {
+					height = "error: " + entry.InfoError
+				}
+				fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%t\n", entry.Node, entry.BakShortId, entry.Id,
+					height, created, entry.Size, entry.UploadTime.UTC().Format(time.RFC3339), entry.Verified)
+			}
+			return table.Flush()
+		},
+	}
+	cmd.Flags().StringVar(&opts.Node, "node", "", "Node to list the snapshots of, or \"all\", defaults to the panel's node")
+	cmd.Flags().StringVar(&opts.Bak, "bak", "", "Only list the snapshots of this backup key")
+	cmd.Flags().BoolVar(&opts.SkipInfo, "no-info", false, "Do not read the info of snapshots the panel has not seen before")
+	cmd.Flags().BoolVar(&opts.Latest, "latest", false, "Only list the snapshot with the greatest height, among those with a verified sidecar")
+	cmd.Flags().BoolVar(&asJson, "json", false, "Print as JSON")
+	return cmd
+}
+
+func BackupCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "backup",
+		Short: "Manage treasury snapshots and backups",
+	}
+
+	cmd.AddCommand(BackupListCmd())
+	cmd.AddCommand(BackupScheduleCmd())
+	cmd.AddCommand(BackupDestinationCmd())
+	cmd.AddCommand(BackupReplicasCmd())
+	cmd.AddCommand(BackupReconcileCmd())
+	cmd.AddCommand(BackupBackfillCmd())
+	cmd.AddCommand(BackupEndorseCmd())
+
+	return cmd
+}
+
+func ApprovalsCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "approvals",
+		Short: "Manage two-person approvals for irreversible operations",
+	}
+
+	cmd.AddCommand(ApprovalsListCmd())
+	cmd.AddCommand(ApprovalsApproveCmd())
+	cmd.AddCommand(ApprovalsCancelCmd())
+
+	return cmd
+}
+
+func StateSealCmd() *cobra.Command {
+	var _panelDir string
+	var secretRef string
+	var useEar bool
+	var cmd = &cobra.Command{
+		Use:          "seal",
+		Short:        "Encrypt panel.json and blueprint.csl at rest (migrates existing files)",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			panelDir := paths.PanelHome(_panelDir)
+			if useEar == (secretRef != "") {
+				return fmt.Errorf("exactly one of --secret or --ear must be set")
+			}
+			stateSecret := secret.Secret(secretRef)
+			if useEar {
+				panelInfo, err := panel.Load(panelDir)
+				if err != nil {
+					return fmt.Errorf("failed to load panel: %v", err)
+				}
+				if panelInfo.EarSecret.IsZero() {
+					return fmt.Errorf("encryption at rest is not configured")
+				}
+				stateSecret = panelInfo.EarSecret.Secret()
+			}
+			if _, ok := stateSecret.Type(); !ok {
+				return fmt.Errorf("invalid secret reference, must be one of %v", secret.Types)
+			}
+			files, err := panel.MigrateState(panelDir, &panel.StateConfig{Sealed: true, Secret: stateSecret})
+			if err != nil {
+				return err
+			}
+			for _, file := range files {
+				fmt.Println("sealed", file)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&_panelDir, "panel-dir", string(panel.New().PanelDir), "Panel directory override")
+	cmd.Flags().StringVar(&secretRef, "secret", "", "Secret reference for the state key (not raw, file, envfile or env)")
+	cmd.Flags().BoolVar(&useEar, "ear", false, "Use the same secret as the treasury encryption at rest")
+	return cmd
+}
+
+func StateUnsealCmd() *cobra.Command {
+	var _panelDir string
+	var cmd = &cobra.Command{
+		Use:          "unseal",
+		Short:        "Decrypt the panel state files and disable sealed-state",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			files, err := panel.MigrateState(paths.PanelHome(_panelDir), &panel.StateConfig{})
+			if err != nil {
+				return err
+			}
+			for _, file := range files {
+				fmt.Println("unsealed", file)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&_panelDir, "panel-dir", string(panel.New().PanelDir), "Panel directory override")
+	return cmd
+}
+
+func StateStatusCmd() *cobra.Command {
+	var _panelDir string
+	var cmd = &cobra.Command{
+		Use:          "status",
+		Short:        "Show whether the panel state is sealed",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			panelDir := paths.PanelHome(_panelDir)
+			config, err := panel.LoadStateConfig(panelDir)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("sealed: %t\n", config.Sealed)
+			if config.Secret != "" {
+				secretType, _ := config.Secret.Type()
+				fmt.Printf("secret: %s\n", secretType.Name())
+			}
+			for _, file := range panel.StateFiles(panelDir) {
+				data, err := os.ReadFile(file)
+				if err != nil {
+					continue
+				}
+				fmt.Printf("%s: encrypted=%t\n", file, panel.IsSealedData(data))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&_panelDir, "panel-dir", string(panel.New().PanelDir), "Panel directory override")
+	return cmd
+}
+
+func StateDecryptCmd() *cobra.Command {
+	var _panelDir string
+	var out string
+	var owner string
+	var cmd = &cobra.Command{
+		Use:          "decrypt <file>",
+		Short:        "Write a plaintext copy of a (possibly sealed) state file, e.g. for systemd units",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			data, err := panel.ReadStateFile(paths.PanelHome(_panelDir), args[0])
+			if err != nil {
+				return err
+			}
+			if out == "" {
+				_, err = os.Stdout.Write(data)
+				return err
+			}
+			err = os.WriteFile(out, data, 0600)
+			if err != nil {
+				return err
+			}
+			if owner != "" {
+				u, err := user.Lookup(owner)
+				if err != nil {
+					return err
+				}
+				uid, _ := strconv.Atoi(u.Uid)
+				gid, _ := strconv.Atoi(u.Gid)
+				return os.Chown(out, uid, gid)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&_panelDir, "panel-dir", string(panel.New().PanelDir), "Panel directory override")
+	cmd.Flags().StringVar(&out, "out", "", "Output file (mode 0600), defaults to stdout")
+	cmd.Flags().StringVar(&owner, "owner", "", "User to own the output file")
+	return cmd
+}
+
+func StateCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "state",
+		Short: "Manage encryption of the panel's own state (must be run on the panel host)",
+	}
+
+	cmd.AddCommand(StateSealCmd())
+	cmd.AddCommand(StateUnsealCmd())
+	cmd.AddCommand(StateStatusCmd())
+	cmd.AddCommand(StateDecryptCmd())
+
+	return cmd
+}
+
+// Read a secret value from the terminal without echo, or from piped stdin.
+func readSecretValue(prompt string) (string, error) {
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprint(os.Stderr, prompt)
+		value, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return strings.TrimSpace(string(value)), err
+	}
+	value, err := io.ReadAll(os.Stdin)
+	return strings.TrimSpace(string(value)), err
+}
+
+func KeyringAddCmd() *cobra.Command {
+	var _panelDir string
+	var keyRef string
+	var fromRef string
+	var cmd = &cobra.Command{
+		Use:          "add <id>",
+		Short:        "Add (or replace) a secret in the keyring, read from stdin unless --from is set",
+		Long:         "Add a secret to the keyring, to be referenced as keyring:<id>.  The keyring is created on first use, unlocked by --key.",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			panelDir := paths.PanelHome(_panelDir)
+			if keyRef != "" {
+				if err := secret.InitKeyring(panelDir, secret.Secret(keyRef)); err != nil {
+					return err
+				}
+			}
+			var value string
+			var err error
+			if fromRef != "" {
+				value, err = secret.Secret(fromRef).Load()
+			} else {
+				value, err = readSecretValue(fmt.Sprintf("value for %s: ", args[0]))
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read secret value: %v", err)
+			}
+			if err := secret.AddKeyringEntry(panelDir, args[0], value); err != nil {
+				return err
+			}
+			fmt.Printf("added %s:%s\n", secret.Keyring, args[0])
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&_panelDir, "panel-dir", string(panel.New().PanelDir), "Panel directory override")
+	cmd.Flags().StringVar(&keyRef, "key", "", "Secret reference for the keyring key (an age identity or passphrase, not raw, file, envfile or env), required to create the keyring")
+	cmd.Flags().StringVar(&fromRef, "from", "", "Copy the value from this secret reference")
+	return cmd
+}
+
+func KeyringListCmd() *cobra.Command {
+	var _panelDir string
+	var cmd = &cobra.Command{
+		Use:          "list",
+		Aliases:      []string{"ls"},
+		Short:        "List the ids in the keyring",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			entries, err := secret.ListKeyring(paths.PanelHome(_panelDir))
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				fmt.Printf("%s\t%s\t%s\n", entry.Id, entry.CreateTime.Format(time.RFC3339), entry.UpdateTime.Format(time.RFC3339))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&_panelDir, "panel-dir", string(panel.New().PanelDir), "Panel directory override")
+	return cmd
+}
+
+func KeyringRemoveCmd() *cobra.Command {
+	var _panelDir string
+	var cmd = &cobra.Command{
+		Use:          "rm <id>",
+		Aliases:      []string{"remove"},
+		Short:        "Remove a secret from the keyring",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := secret.RemoveKeyringEntry(paths.PanelHome(_panelDir), args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Println("removed", args[0])
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&_panelDir, "panel-dir", string(panel.New().PanelDir), "Panel directory override")
+	return cmd
+}
+
+func KeyringCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "keyring",
+		Short: "Manage the local keyring of secrets, referenced as keyring:<id> (must be run on the panel host)",
+	}
+
+	cmd.AddCommand(KeyringAddCmd())
+	cmd.AddCommand(KeyringListCmd())
+	cmd.AddCommand(KeyringRemoveCmd())
+
+	return cmd
+}
+
+func SecretSplitCmd() *cobra.Command {
+	var fromRef string
+	var threshold int
+	var shares []string
+	var cmd = &cobra.Command{
+		Use:   "split",
+		Short: "Split a secret into k-of-n Shamir shares, stored in other secrets",
+		Long: "Split a secret (read from stdin unless --from is set) into Shamir shares, store one in each --share " +
+			"secret, and print the shamir: reference that reconstructs it, e.g. for use as the ear_secret.",
+		Example:      "  panel secret split --from file:/root/ear -k 2 --share aws:panel-share-1 --share gcp:project,panel-share-2 --share vault:https://vault:8200,secret/panel/share-3",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			shareRefs := []secret.Secret{}
+			for _, share := range shares {
+				shareRefs = append(shareRefs, secret.Secret(share))
+			}
+			ref, err := secret.NewShamirSecret(threshold, shareRefs)
+			if err != nil {
+				return err
+			}
+			var value string
+			if fromRef != "" {
+				value, err = secret.Secret(fromRef).Load()
+			} else {
+				value, err = readSecretValue("value to split: ")
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read secret value: %v", err)
+			}
+			if value == "" {
+				return fmt.Errorf("secret value is empty")
+			}
+			if err := ref.Store(value); err != nil {
+				return err
+			}
+			// check the shares reconstruct the value before it is relied on
+			reconstructed, err := ref.Load()
+			if err != nil {
+				return fmt.Errorf("stored shares could not be loaded back: %v", err)
+			}
+			if reconstructed != value {
+				return fmt.Errorf("stored shares do not reconstruct the value")
+			}
+			fmt.Println(ref)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&fromRef, "from", "", "Secret reference of the value to split")
+	cmd.Flags().IntVarP(&threshold, "threshold", "k", 2, "Number of shares required to reconstruct the secret")
+	// not a slice flag, as secret references contain commas
+	cmd.Flags().StringArrayVar(&shares, "share", []string{}, fmt.Sprintf("Secret reference to store a share in, repeated for each share (one of %v)", secret.WritableTypes))
+	return cmd
+}
+
+func SecretSealCmd() *cobra.Command {
+	var fromRef string
+	var identityRef string
+	var recipientKey string
+	var out string
+	var cmd = &cobra.Command{
+		Use:   "seal",
+		Short: "Encrypt a secret to an age file, unlocked by an identity held in another secret",
+		Long: "Encrypt a secret (read from stdin unless --from is set) to --out and print the agefile: reference that decrypts it.\n\n" +
+			"The --identity secret holds an age identity (AGE-SECRET-KEY-1...) or a passphrase, e.g. a systemd credential " +
+			"(creds:panel.age-identity), or a passphrase entered at boot with systemd-ask-password into a file under /run. " +
+			"Pass --recipient to seal for an X25519 identity that is not available on this host.",
+		Example:      "  panel secret seal --from file:/root/ear --out /etc/panel/ear.age --identity creds:panel.age-identity",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if out == "" {
+				return fmt.Errorf("--out is required")
+			}
+			ref, err := secret.NewAgeFileSecret(out, secret.Secret(identityRef))
+			if err != nil {
+				return err
+			}
+			var value string
+			if fromRef != "" {
+				value, err = secret.Secret(fromRef).Load()
+			} else {
+				value, err = readSecretValue("value to seal: ")
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read secret value: %v", err)
+			}
+			if recipientKey != "" {
+				recipient, err := age.ParseX25519Recipient(recipientKey)
+				if err != nil {
+					return fmt.Errorf("invalid --recipient: %v", err)
+				}
+				err = secret.SealAgeFile(out, recipient, value)
+				if err != nil {
+					return err
+				}
+			} else {
+				if err := ref.Store(value); err != nil {
+					return err
+				}
+				// check the identity opens the file before it is relied on
+				unsealed, err := ref.Load()
+				if err != nil {
+					return fmt.Errorf("sealed file could not be opened: %v", err)
+				}
+				if unsealed != value {
+					return fmt.Errorf("sealed file does not contain the value")
+				}
+			}
+			fmt.Println(ref)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&fromRef, "from", "", "Secret reference of the value to seal")
+	cmd.Flags().StringVar(&identityRef, "identity", "", "Secret reference of the age identity or passphrase that unlocks the file")
+	cmd.Flags().StringVar(&recipientKey, "recipient", "", "Seal to this age recipient (age1...) instead of loading --identity")
+	cmd.Flags().StringVar(&out, "out", "", "Path of the age file to write (mode 0600)")
+	return cmd
+}
+
+func SecretCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "secret",
+		Short: "Manage secret references",
+	}
+
+	cmd.AddCommand(SecretSplitCmd())
+	cmd.AddCommand(SecretSealCmd())
+
+	return cmd
+}
+
+func TlsFingerprintCmd() *cobra.Command {
+	var _panelDir string
+	var certFile string
+	var cmd = &cobra.Command{
+		Use:          "fingerprint",
+		Short:        "Print the SHA-256 fingerprint of the panel TLS certificate, for use with --fingerprint",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if certFile == "" {
+				certFile = paths.PanelHome(_panelDir).TlsCertFile()
+			}
+			certBz, err := os.ReadFile(certFile)
+			if err != nil {
+				return fmt.Errorf("failed to read certificate: %v", err)
+			}
+			block, _ := pem.Decode(certBz)
+			if block == nil || block.Type != "CERTIFICATE" {
+				return fmt.Errorf("no certificate found in %s", certFile)
+			}
+			fmt.Println(client.CertificateFingerprint(block.Bytes))
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&_panelDir, "panel-dir", string(panel.New().PanelDir), "Panel directory override")
+	cmd.Flags().StringVar(&certFile, "tls-cert", "", "Certificate to fingerprint, if not the generated certificate")
+	return cmd
+}
+
+func TlsCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "tls",
+		Short: "Inspect the panel TLS configuration (must be run on the panel host)",
+	}
+
+	cmd.AddCommand(TlsFingerprintCmd())
+
+	return cmd
+}
+
+func ResetCmd() *cobra.Command {
+	var force bool
+	var panelHome string
+	var cmd = &cobra.Command{
+		Use:   "reset",
+		Short: "Reset the panel server",
+		Long: "This is required if you want to change the backup keys for this node.\n\n" +
+			"The reset is approved by a second admin through the panel, but is carried out locally, " +
+			"so the approval is advisory: it records consent and does not stop root on the host from resetting.",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fmt.Println("Resetting panel server...")
+			if !force {
+				fmt.Println("This will delete the panel server backup keys and API keys, do you want to continue? (y/n)")
+				var confirm string
+				fmt.Scanln(&confirm)
+				if strings.ToLower(strings.TrimSpace(confirm)) != "y" {
+					return fmt.Errorf("cancelled")
+				}
+			}
+			// requires a second admin to approve, then re-run with --approval <id>
+			err := panelClient.ApproveReset()
+			if err != nil {
+				return approvalError(err, "reset")
+			}
+			err = resetPanelHome(paths.PanelHome(panelHome))
+			if err != nil {
+				return err
+			}
+			fmt.Println("Panel server reset, keeping the audit log.")
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&force, "force", false, "Force reset")
+	cmd.Flags().StringVar(&panelHome, "panel-home", "/etc/panel", "Panel home directory")
+	return cmd
+}
+
+// Remove everything in the panel directory except the audit log, so the history of the panel
+// survives a reset.
+func resetPanelHome(panelHome paths.PanelHome) error {
+	entries, err := os.ReadDir(panelHome.String())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(panelHome.String(), entry.Name())
+		if path == panelHome.AuditLogFile() {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func DeleteTreasuryCmd() *cobra.Command {
+	var remote string
+	var force bool
+	var includeSupervisor bool
+	var cmd = &cobra.Command{
+		Use:          "delete-treasury",
+		Short:        "Delete the treasury node",
+		Long:         "This is required to recreate the treasury node.",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !force {
+				fmt.Println("This will permanently delete the treasury node locally, do you want to continue? (y/n)")
+				var confirm string
+				fmt.Scanln(&confirm)
+				if strings.ToLower(strings.TrimSpace(confirm)) != "y" {
+					return fmt.Errorf("cancelled")
+				}
+			}
+			// the panel stops the treasury services itself, once any approval is given
+			fmt.Println("Deleting treasury...")
+			err := panelClient.DeleteTreasury(includeSupervisor)
+			if err != nil {
+				return approvalError(err, "delete-treasury --supervisor")
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&remote, "url", "https://localhost:7666", "URL of the panel server")
+	cmd.Flags().BoolVar(&force, "force", false, "Skip any confirmation")
+	cmd.Flags().BoolVar(&includeSupervisor, "supervisor", false, "Include deleting supervisor config (reset to using initial image, no EAR)")
+	return cmd
+}
+
+func SyncTreasuryPeersCmd() *cobra.Command {
+	var remote string
+	var cmd = &cobra.Command{
+		Use:          "sync-peers",
+		Short:        "Sync the treasury peers",
+		Long:         "In case DNS names change, you can re-sync the configured peers.",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := panelClient.SyncTreasuryPeers()
+			if err != nil {
+				return err
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&remote, "url", "https://localhost:7666", "URL of the panel server")
+	return cmd
+}
+
+func DoTreasuryConfigSync(panelInfo *panel.Panel, treasuryHome paths.TreasuryHome) error {
+	treasuryConfig := map[string]interface{}{}
+
+	treasuryConfigFile, err := os.Open(treasuryHome.TreasuryConfig())
+	if err != nil {
+		return fmt.Errorf("failed to open treasury config: %v", err)
+	}
+	defer treasuryConfigFile.Close()
+
+	treasuryConfigBz, err := io.ReadAll(treasuryConfigFile)
+	if err != nil {
+		return fmt.Errorf("failed to read treasury config: %v", err)
+	}
+	treasuryConfigFileStat, err := treasuryConfigFile.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat treasury config: %v", err)
+	}
+	_ = treasuryConfigFile.Close()
+
+	err = toml.Unmarshal(treasuryConfigBz, &treasuryConfig)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal treasury config: %v", err)
+	}
+
+	// Modify only the backup.bak entry
+	backupConfig, ok := treasuryConfig["backup"].(map[string]interface{})
+	if !ok {
+		// add backup section if not present
+		treasuryConfig["backup"] = map[string]interface{}{}
+	}
+	backupConfig = treasuryConfig["backup"].(map[string]interface{})
+
+	backupConfig["bak"] = panelInfo.Baks
+	treasuryConfigBz, err = toml.Marshal(treasuryConfig)
+	if err != nil {
+		return fmt.Errorf("failed to marshal treasury config: %v", err)
+	}
+	err = os.WriteFile(treasuryHome.TreasuryConfig(), treasuryConfigBz, treasuryConfigFileStat.Mode())
+	if err != nil {
+		return fmt.Errorf("failed to write treasury config: %v", err)
+	}
+	return nil
+}
+
+func DoSupervisorConfigSync(panelInfo *panel.Panel, supervisorHome paths.SupervisorHome) error {
+	supervisorConfig := map[string]interface{}{}
+
+	// create file if it doesn't exist
+	if _, err := os.Stat(supervisorHome.ConfigFile()); os.IsNotExist(err) {
+		f, err := os.Create(supervisorHome.ConfigFile())
+		if err != nil {
+			return fmt.Errorf("failed to create supervisor config: %v", err)
+		}
+		_ = f.Close()
+	}
+
+	supervisorConfigFile, err := os.Open(supervisorHome.ConfigFile())
+	if err != nil {
+		return fmt.Errorf("failed to open supervisor config: %v", err)
+	}
+	defer supervisorConfigFile.Close()
+
+	supervisorConfigBz, err := io.ReadAll(supervisorConfigFile)
+	if err != nil {
+		return fmt.Errorf("failed to read supervisor config: %v", err)
+	}
+	supervisorConfigFileStat, err := supervisorConfigFile.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat treasury config: %v", err)
+	}
+	err = toml.Unmarshal(supervisorConfigBz, &supervisorConfig)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal supervisor config: %v", err)
+	}
+
+	supervisorConfig["ear_secret"] = panelInfo.EarSecret.Secret()
+	supervisorConfigBz, err = toml.Marshal(supervisorConfig)
+	if err != nil {
+		return fmt.Errorf("failed to marshal supervisor config: %v", err)
+	}
+	err = os.WriteFile(supervisorHome.ConfigFile(), supervisorConfigBz, supervisorConfigFileStat.Mode())
+	if err != nil {
+		return fmt.Errorf("failed to write supervisor config: %v", err)
+	}
+	return nil
+}
+
+func SyncConfigCmd() *cobra.Command {
+	var _panelDir string
+	var _treasuryHome string
+	var _supervisorHome string
+	var cmd = &cobra.Command{
+		Use:          "sync-config",
+		Aliases:      []string{"sync-backup-keys", "sync-config"},
+		Short:        "Write the configured backup keys in the panel to the current Treasury config",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			panelDir := paths.PanelHome(_panelDir)
+			treasuryHome := paths.TreasuryHome(_treasuryHome)
+			supervisorHome := paths.SupervisorHome(_supervisorHome)
+			panelInfo, err := panel.Load(panelDir)
+			if err != nil {
+				return fmt.Errorf("failed to load panel data: %v", err)
+			}
+			if len(panelInfo.Baks) == 0 {
+				return fmt.Errorf("no backup keys configured on panel")
+			}
+
+			err = DoTreasuryConfigSync(panelInfo, treasuryHome)
+			if err != nil {
+				return fmt.Errorf("failed to sync treasury config: %v", err)
+			}
+
+			err = DoSupervisorConfigSync(panelInfo, supervisorHome)
+			if err != nil {
+				return fmt.Errorf("failed to sync supervisor config: %v", err)
+			}
+
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&_panelDir, "panel-dir", string(panel.New().PanelDir), "Panel directory override")
+	cmd.Flags().StringVar(&_treasuryHome, "treasury-home", string(panel.New().TreasuryHome), "Treasury home directory override")
+	cmd.Flags().StringVar(&_supervisorHome, "supervisor-home", string(panel.New().SupervisorHome), "Supervisor home directory override")
+	return cmd
+}
+
+func GenerateCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:          "bak",
+		Short:        "Generate a backup key",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fmt.Println("# You must save this somewhere safe")
+			sk := bak.GenerateEncryptionKey()
+			recipient := sk.Recipient()
+
+			fmt.Println(strings.Join(sk.Words(), " "))
+			fmt.Println(recipient.String())
+
+			return nil
+		},
+	}
+	return cmd
+}
+
+// Used by systemd units so the API key is only resolved at runtime, rather than stored in the env file.
+func ExecCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:          "exec -- <command> [args...]",
+		Short:        "Run a command with $" + panel.ENV_API_KEY + " resolved from $" + panel.ENV_API_KEY_REF + " (or the " + panel.CredentialApiKey + " systemd credential)",
+		Args:         cobra.MinimumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			env := os.Environ()
+			ref := os.Getenv(panel.ENV_API_KEY_REF)
+			if ref == "" && secret.HasCredential(panel.CredentialApiKey) {
+				ref = string(panel.ApiKeyCredentialRef())
+			}
+			if ref != "" {
+				apiKey, err := secret.Secret(ref).Load()
+				if err != nil {
+					return fmt.Errorf("failed to load API key: %v", err)
+				}
+				env = append(env, panel.ENV_API_KEY+"="+apiKey)
+			}
+			binary, err := exec.LookPath(args[0])
+			if err != nil {
+				return err
+			}
+			return syscall.Exec(binary, args, env)
+		},
+	}
+	return cmd
+}
+
+func HealthyCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:          "health",
+		Aliases:      []string{"healthy"},
+		Short:        "Check if the treasury node is healthy",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			health, err := panelClient.TreasuryHealth()
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(health))
+			return nil
+		},
+	}
+	return cmd
+}
+
+var panelClient *client.Client
+
+const ENV_PANEL_TOKEN = "PANEL_TOKEN"
+
+// Resolve the admin token from --token, $PANEL_TOKEN, or the local initial token file.
+func loadPanelToken(tokenRef string) (string, error) {
+	if tokenRef == "" {
+		tokenRef = os.Getenv(ENV_PANEL_TOKEN)
+	}
+	if tokenRef != "" {
+		secretMaybe := secret.Secret(tokenRef)
+		if _, ok := secretMaybe.Type(); !ok {
+			// treat as literal
+			return tokenRef, nil
+		}
+		return secretMaybe.Load()
+	}
+	// not an error if not present, it may be created by activation
+	token, _ := auth.LoadLocal(panel.New().PanelDir)
+	return token, nil
+}
+
+// Default to trusting the local panel certificate (and presenting the local client certificate)
+// when running on the panel host.
+func defaultTlsOptions(options *client.ClientOptions) {
+	panelDir := panel.New().PanelDir
+	if options.CaFile == "" && options.Fingerprint == "" {
+		if _, err := os.Stat(panelDir.TlsCertFile()); err == nil {
+			options.CaFile = panelDir.TlsCertFile()
+		}
+	}
+	if options.CertFile == "" {
+		if _, err := os.Stat(panelDir.ClientCertFile()); err == nil {
+			options.CertFile = panelDir.ClientCertFile()
+		}
+	}
+}
+
+func main() {
 	var verbose int
 	var quiet bool
 	var remote string
+	var tokenRef string
+	var tlsOptions client.ClientOptions
+	var approvalId string
 	var rootCmd = &cobra.Command{
 		Use:   "panel",
 		Short: "Panel server application",
@@ -732,13 +2057,30 @@ func main() {
 			if err != nil {
 				return fmt.Errorf("failed to parse --url: %v", err)
 			}
-			panelClient = client.NewClient(remoteUrl)
+			token, err := loadPanelToken(tokenRef)
+			if err != nil {
+				return fmt.Errorf("failed to load --token: %v", err)
+			}
+			options := tlsOptions
+			options.Token = token
+			defaultTlsOptions(&options)
+			panelClient, err = client.NewClient(remoteUrl, options)
+			if err != nil {
+				return err
+			}
+			panelClient.SetApproval(approvalId)
 			return nil
 		},
 	}
 	rootCmd.PersistentFlags().CountVarP(&verbose, "verbose", "v", "Verbosity level")
 	rootCmd.PersistentFlags().BoolVar(&quiet, "quiet", false, "Quiet mode")
-	rootCmd.Flags().StringVar(&remote, "url", "http://localhost:7666", "URL of the panel server")
+	rootCmd.Flags().StringVar(&remote, "url", "https://localhost:7666", "URL of the panel server")
+	rootCmd.PersistentFlags().StringVar(&tokenRef, "token", "", "Admin token (or secret reference) for the panel API, defaults to $"+ENV_PANEL_TOKEN)
+	rootCmd.PersistentFlags().StringVar(&approvalId, "approval", "", "Id of an approved request, for operations requiring two-person approval")
+	rootCmd.PersistentFlags().StringVar(&tlsOptions.CaFile, "ca", "", "CA certificate to verify the panel with, defaults to the local panel certificate")
+	rootCmd.PersistentFlags().StringVar(&tlsOptions.Fingerprint, "fingerprint", "", "Pin the SHA-256 fingerprint of the panel certificate")
+	rootCmd.PersistentFlags().StringVar(&tlsOptions.CertFile, "cert", "", "Client certificate, if the panel requires mutual TLS")
+	rootCmd.PersistentFlags().StringVar(&tlsOptions.KeyFile, "key", "", "Key for --cert, if not included in the certificate file")
 
 	startCmd := StartCmd()
 
@@ -751,6 +2093,16 @@ func main() {
 	rootCmd.AddCommand(SyncTreasuryPeersCmd())
 	rootCmd.AddCommand(SyncConfigCmd())
 	rootCmd.AddCommand(HealthyCmd())
+	rootCmd.AddCommand(ExecCmd())
+	rootCmd.AddCommand(TokenCmd())
+	rootCmd.AddCommand(TlsCmd())
+	rootCmd.AddCommand(AuditCmd())
+	rootCmd.AddCommand(ApprovalsCmd())
+	rootCmd.AddCommand(StateCmd())
+	rootCmd.AddCommand(EarCmd())
+	rootCmd.AddCommand(KeyringCmd())
+	rootCmd.AddCommand(SecretCmd())
+	rootCmd.AddCommand(BackupCmd())
 
 	// Execute
 	if err := rootCmd.Execute(); err != nil {
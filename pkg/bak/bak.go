@@ -28,6 +28,10 @@ func (sk *SecretKey) Entropy() []byte {
 	return sk.entropy
 }
 
+func (sk *SecretKey) Identity() *age.X25519Identity {
+	return sk.identity
+}
+
 func (sk *SecretKey) Recipient() Recipient {
 	recipient := sk.identity.Recipient()
 	return Recipient{
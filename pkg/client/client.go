@@ -2,6 +2,7 @@ package client
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,15 +10,63 @@ import (
 	"net/http"
 	"net/url"
 
+	"filippo.io/age"
+	"github.com/cordialsys/panel/pkg/s3client"
+	"github.com/cordialsys/panel/pkg/secret"
+	"github.com/cordialsys/panel/pkg/snapshot"
+	"github.com/cordialsys/panel/server/approvals"
+	"github.com/cordialsys/panel/server/catalog"
 	"github.com/cordialsys/panel/server/panel"
+	"github.com/cordialsys/panel/server/schedule"
+	"github.com/cordialsys/panel/server/sessions"
 )
 
 type Client struct {
-	remote *url.URL
+	remote     *url.URL
+	token      string
+	approval   string
+	httpClient *http.Client
 }
 
-func NewClient(remote *url.URL) *Client {
-	return &Client{remote}
+type ClientOptions struct {
+	// Admin token used to authenticate to the panel API
+	Token string
+
+	// Optional:
+	// PEM file with the CA (or self-signed certificate) to trust for the panel
+	CaFile string
+	// Pin the SHA-256 fingerprint of the panel certificate instead of verifying the chain
+	Fingerprint string
+	// PEM client certificate, if the panel requires mutual TLS.  May include the key.
+	CertFile string
+	KeyFile  string
+}
+
+func NewClient(remote *url.URL, options ClientOptions) (*Client, error) {
+	tlsConfig, err := newTlsConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &Client{
+		remote:     remote,
+		token:      options.Token,
+		httpClient: &http.Client{Transport: transport},
+	}, nil
+}
+
+func (c *Client) SetToken(token string) {
+	c.token = token
+}
+
+func (c *Client) HasToken() bool {
+	return c.token != ""
+}
+
+// Execute requests using a previously approved two-person approval request.
+func (c *Client) SetApproval(approvalId string) {
+	c.approval = approvalId
 }
 
 type Error struct {
@@ -30,6 +79,16 @@ func (e *Error) Error() string {
 	return fmt.Sprintf("%s: %s", e.Status, e.Message)
 }
 
+// Returned when the request requires approval by a second admin.  A pending approval request has been created.
+type ApprovalRequiredError struct {
+	ApprovalId string
+	Err        *Error
+}
+
+func (e *ApprovalRequiredError) Error() string {
+	return e.Err.Message
+}
+
 type Options struct {
 	query         url.Values
 	skipHttpError bool
@@ -59,6 +118,13 @@ func (c *Client) Do(method string, path string, inputMaybe any, outputMaybe any,
 		return fmt.Errorf("failed to create request: %w", err)
 	}
 
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if c.approval != "" {
+		req.Header.Set(approvals.HeaderApproval, c.approval)
+	}
+
 	req.Body = http.NoBody
 	if inputMaybe != nil {
 		body, err := json.Marshal(inputMaybe)
@@ -73,8 +139,7 @@ func (c *Client) Do(method string, path string, inputMaybe any, outputMaybe any,
 	}
 
 	// Make the HTTP request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("request failed: %w", err)
 	}
@@ -94,6 +159,12 @@ func (c *Client) Do(method string, path string, inputMaybe any, outputMaybe any,
 			}
 			apiErr.Code = resp.StatusCode
 			apiErr.Status = resp.Status
+			if resp.StatusCode == http.StatusPreconditionRequired && resp.Header.Get(approvals.HeaderApproval) != "" {
+				return &ApprovalRequiredError{
+					ApprovalId: resp.Header.Get(approvals.HeaderApproval),
+					Err:        &apiErr,
+				}
+			}
 			return &apiErr
 		}
 	}
@@ -109,10 +180,13 @@ func (c *Client) Do(method string, path string, inputMaybe any, outputMaybe any,
 }
 
 type RequestActivateApiKey struct {
-	ApiKey      string  `json:"api_key"`
-	Connector   *bool   `json:"connector,omitempty"`
-	Network     *string `json:"network,omitempty"`
-	OtelEnabled *bool   `json:"otel_enabled,omitempty"`
+	ApiKey string `json:"api_key,omitempty"`
+	// Alternatively, a secret reference for the panel to load the API key from (e.g. vault, gcp, aws).
+	// Only the reference is stored.
+	ApiKeyRef   secret.Secret `json:"api_key_ref,omitempty"`
+	Connector   *bool         `json:"connector,omitempty"`
+	Network     *string       `json:"network,omitempty"`
+	OtelEnabled *bool         `json:"otel_enabled,omitempty"`
 }
 
 func (c *Client) ActivateApiKey(apiKey string, connector *bool) error {
@@ -122,6 +196,14 @@ func (c *Client) ActivateApiKey(apiKey string, connector *bool) error {
 	}, nil)
 }
 
+// Activate using a secret reference that the panel resolves itself; only the reference is stored.
+func (c *Client) ActivateApiKeyRef(apiKeyRef secret.Secret, connector *bool) error {
+	return c.Do("POST", "/v1/activate/api-key", &RequestActivateApiKey{
+		ApiKeyRef: apiKeyRef,
+		Connector: connector,
+	}, nil)
+}
+
 type ActivateBinariesOptions struct {
 	Version string
 }
@@ -156,6 +238,34 @@ func (c *Client) ActivateOtel(enabled bool) error {
 	return c.Do("POST", "/v1/activate/otel", &RequestActivateOtel{Enabled: enabled}, nil)
 }
 
+// Check that the panel is reachable and the admin token is valid.
+func (c *Client) Health() error {
+	u := *c.remote
+	u.Path = "/health"
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(resp.Body)
+		apiErr := Error{Code: resp.StatusCode, Status: resp.Status}
+		var decoded Error
+		if err := json.Unmarshal(body, &decoded); err == nil {
+			apiErr.Message = decoded.Message
+		}
+		return &apiErr
+	}
+	return nil
+}
+
 func (c *Client) TreasuryHealth() (json.RawMessage, error) {
 	var resp json.RawMessage
 	if err := c.Do("GET", "/v1/treasury/healthy", nil, &resp, Options{
@@ -253,3 +363,212 @@ type RequestSyncTreasuryPeers struct {
 func (c *Client) SyncTreasuryPeers() error {
 	return c.Do("POST", "/v1/treasury/peers/sync", &RequestSyncTreasuryPeers{}, nil)
 }
+
+func (c *Client) ListApprovals() ([]approvals.Approval, error) {
+	var resp []approvals.Approval
+	if err := c.Do("GET", "/v1/approvals", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Client) Approve(approvalId string) (*approvals.Approval, error) {
+	var resp approvals.Approval
+	if err := c.Do("POST", "/v1/approvals/"+approvalId+"/approve", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) CancelApproval(approvalId string) (*approvals.Approval, error) {
+	var resp approvals.Approval
+	if err := c.Do("DELETE", "/v1/approvals/"+approvalId, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+type RequestRotateEncryptionAtRest struct {
+	// Where to store the new phrase, defaults to the current EAR secret
+	EarSecret secret.Ref `json:"ear_secret,omitzero"`
+}
+
+// Generate a new EAR phrase, store it in the secret backend and re-encrypt signer.db with it.
+func (c *Client) RotateEncryptionAtRest(earSecret secret.Ref) error {
+	return c.Do("POST", "/v1/panel/ear/rotate", &RequestRotateEncryptionAtRest{
+		EarSecret: earSecret,
+	}, nil)
+}
+
+// Gate for `panel reset`, which requires approval from a second admin.
+func (c *Client) ApproveReset() error {
+	return c.Do("POST", "/v1/panel/reset", nil, nil)
+}
+
+func (c *Client) ListSchedules() ([]schedule.Schedule, error) {
+	var resp []schedule.Schedule
+	if err := c.Do("GET", "/v1/backup/schedule", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Create or replace the snapshot schedule for the backup key.
+func (c *Client) PutSchedule(req schedule.Schedule) (*schedule.Schedule, error) {
+	var resp schedule.Schedule
+	if err := c.Do("PUT", "/v1/backup/schedule/"+url.PathEscape(req.Bak), &req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) DeleteSchedule(bak string) error {
+	return c.Do("DELETE", "/v1/backup/schedule/"+url.PathEscape(bak), nil, nil)
+}
+
+// Test connectivity and permissions of the current backup destination.
+func (c *Client) TestBackupDestination() (*s3client.TestResult, error) {
+	var resp s3client.TestResult
+	if err := c.Do("POST", "/v1/backup/destination/test", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Keep snapshots and key backups in an S3-compatible bucket.  With force, it is used even if it fails its checks.
+func (c *Client) SetBackupDestination(destination panel.BackupDestination, force bool) (*s3client.TestResult, error) {
+	query := url.Values{}
+	if force {
+		query.Set("force", "")
+	}
+	var resp s3client.TestResult
+	if err := c.Do("PUT", "/v1/backup/destination", &destination, &resp, Options{query: query}); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Go back to the Cordial Systems backup service.
+func (c *Client) DeleteBackupDestination() error {
+	return c.Do("DELETE", "/v1/backup/destination", nil, nil)
+}
+
+// Add or replace a backup replica that uploads are copied to.  With force, it is used even if it fails its checks.
+func (c *Client) PutBackupReplica(replica panel.BackupReplica, force bool) (*s3client.TestResult, error) {
+	query := url.Values{}
+	if force {
+		query.Set("force", "")
+	}
+	var resp s3client.TestResult
+	if err := c.Do("PUT", "/v1/backup/replicas/"+url.PathEscape(replica.Name), &replica, &resp, Options{query: query}); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) DeleteBackupReplica(name string) error {
+	return c.Do("DELETE", "/v1/backup/replicas/"+url.PathEscape(name), nil, nil)
+}
+
+func (c *Client) GetReplication() (*s3client.ReplicationSummary, error) {
+	var resp s3client.ReplicationSummary
+	if err := c.Do("GET", "/v1/backup/replication", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Copy any backups missing from a destination from one that has them.
+func (c *Client) ReconcileBackups() (*s3client.ReconcileResult, error) {
+	var resp s3client.ReconcileResult
+	if err := c.Do("POST", "/v1/backup/reconcile", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+type ListBackupSnapshotsOptions struct {
+	// Defaults to the panel's node, or `all`
+	Node string
+	// Backup key or short id of one
+	Bak string
+	// Do not read the info of snapshots the panel has not seen before
+	SkipInfo bool
+	// Only the snapshot with the greatest height, among those with a verified sidecar
+	Latest bool
+}
+
+func (c *Client) ListBackupSnapshots(opts ListBackupSnapshotsOptions) ([]snapshot.Entry, error) {
+	query := url.Values{}
+	if opts.Node != "" {
+		query.Set("node", opts.Node)
+	}
+	if opts.Bak != "" {
+		query.Set("bak", opts.Bak)
+	}
+	if opts.SkipInfo {
+		query.Set("info", "false")
+	}
+	if opts.Latest {
+		query.Set("latest", "true")
+	}
+	var resp []snapshot.Entry
+	if err := c.Do("GET", "/v1/backup/snapshots", nil, &resp, Options{query: query}); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Encrypt a secret phrase to a new session recipient for the operation, returning the session id
+// and the encrypted phrase, base64 encoded.
+func (c *Client) EncryptSecretPhrase(operation sessions.Operation, phrase string) (string, string, error) {
+	var session sessions.Session
+	if err := c.Do("POST", "/v1/sessions/recipient", map[string]any{"operation": operation}, &session); err != nil {
+		return "", "", err
+	}
+	recipient, err := age.ParseX25519Recipient(session.Recipient)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid session recipient: %v", err)
+	}
+	var encrypted bytes.Buffer
+	writer, err := age.Encrypt(&encrypted, recipient)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := writer.Write([]byte(phrase)); err != nil {
+		return "", "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", "", err
+	}
+	return session.Id, base64.StdEncoding.EncodeToString(encrypted.Bytes()), nil
+}
+
+// Endorse the panel's sidecar signing key with the bak of the secret phrase, returning the hex
+// public keys endorsed with it.
+func (c *Client) EndorseSigningKey(phrase string) ([]string, error) {
+	sessionId, encrypted, err := c.EncryptSecretPhrase(sessions.OperationEndorseSigningKey, phrase)
+	if err != nil {
+		return nil, err
+	}
+	req := map[string]string{"session_id": sessionId, "encrypted_secret_phrase": encrypted}
+	var resp struct {
+		EndorsedKeys []string `json:"endorsed_keys"`
+	}
+	if err := c.Do("POST", "/v1/backup/snapshots/endorse", req, &resp); err != nil {
+		return nil, err
+	}
+	return resp.EndorsedKeys, nil
+}
+
+func (c *Client) BackfillSidecars(force bool) (*catalog.BackfillResult, error) {
+	query := url.Values{}
+	if force {
+		query.Set("force", "")
+	}
+	var resp catalog.BackfillResult
+	if err := c.Do("POST", "/v1/backup/snapshots/sidecars", nil, &resp, Options{query: query}); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
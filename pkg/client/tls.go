@@ -0,0 +1,70 @@
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SHA-256 fingerprint of a DER encoded certificate, as printed by `panel start`.
+func CertificateFingerprint(der []byte) string {
+	digest := sha256.Sum256(der)
+	return hex.EncodeToString(digest[:])
+}
+
+// Accept fingerprints in the common "AA:BB:.." format as well.
+func normalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.TrimPrefix(strings.TrimSpace(fingerprint), "sha256:")
+	fingerprint = strings.ReplaceAll(fingerprint, ":", "")
+	return strings.ToLower(fingerprint)
+}
+
+func newTlsConfig(options ClientOptions) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if options.CaFile != "" {
+		caBz, err := os.ReadFile(options.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBz) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", options.CaFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if options.Fingerprint != "" {
+		expected := normalizeFingerprint(options.Fingerprint)
+		// The pinned fingerprint replaces the usual chain verification, as the panel
+		// certificate is normally self-signed.
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return fmt.Errorf("panel did not present a certificate")
+			}
+			actual := CertificateFingerprint(state.PeerCertificates[0].Raw)
+			if actual != expected {
+				return fmt.Errorf("panel certificate fingerprint %s does not match pinned fingerprint %s", actual, expected)
+			}
+			return nil
+		}
+	}
+	if options.CertFile != "" {
+		keyFile := options.KeyFile
+		if keyFile == "" {
+			// permit the key to be bundled in the same PEM file
+			keyFile = options.CertFile
+		}
+		cert, err := tls.LoadX509KeyPair(options.CertFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,188 @@
+package diagnostics
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultDepth = 1
+	MaxDepth     = 8
+	// Stop listing after this many entries, to bound the response size.
+	MaxEntries = 5000
+)
+
+var ErrOutsideRoot = errors.New("path is outside of the root")
+var ErrUnknownRoot = errors.New("unknown root")
+
+// A directory that may be browsed.  Nothing outside of the roots is reachable.
+type Root struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// Metadata only: file contents are never exposed.
+type FileEntry struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	Mode    string    `json:"mode"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Owner   string    `json:"owner,omitempty"`
+	Group   string    `json:"group,omitempty"`
+	Dir     bool      `json:"dir"`
+	Symlink bool      `json:"symlink,omitempty"`
+
+	Children []*FileEntry `json:"children,omitempty"`
+	// Set if the children were not listed due to the depth or entry limits
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+type Browser struct {
+	roots []Root
+}
+
+func NewBrowser(roots []Root) *Browser {
+	return &Browser{roots: roots}
+}
+
+func (b *Browser) Roots() []Root {
+	return b.roots
+}
+
+// Resolve a path relative to the named root, following symlinks, and
+// ensuring the result is still within the (resolved) root.
+func (b *Browser) Resolve(rootName string, relPath string) (rootPath string, resolved string, err error) {
+	var root *Root
+	for i := range b.roots {
+		if b.roots[i].Name == rootName {
+			root = &b.roots[i]
+		}
+	}
+	if root == nil || root.Path == "" {
+		return "", "", ErrUnknownRoot
+	}
+	rootPath, err = filepath.EvalSymlinks(root.Path)
+	if err != nil {
+		return "", "", err
+	}
+	rootPath, err = filepath.Abs(rootPath)
+	if err != nil {
+		return "", "", err
+	}
+
+	if filepath.IsAbs(relPath) {
+		return "", "", ErrOutsideRoot
+	}
+	cleaned := filepath.Clean(relPath)
+	if cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", "", ErrOutsideRoot
+	}
+	resolved, err = filepath.EvalSymlinks(filepath.Join(rootPath, cleaned))
+	if err != nil {
+		return "", "", err
+	}
+	if !within(rootPath, resolved) {
+		return "", "", ErrOutsideRoot
+	}
+	return rootPath, resolved, nil
+}
+
+func within(root string, path string) bool {
+	return path == root || strings.HasPrefix(path, root+string(filepath.Separator))
+}
+
+// List the metadata of the path within the root, recursing into directories up to `depth` levels.
+// Symlinks are reported, but never followed while recursing.
+func (b *Browser) List(rootName string, relPath string, depth int) (*FileEntry, error) {
+	if depth < 0 || depth > MaxDepth {
+		return nil, fmt.Errorf("depth must be between 0 and %d", MaxDepth)
+	}
+	rootPath, resolved, err := b.Resolve(rootName, relPath)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Lstat(resolved)
+	if err != nil {
+		return nil, err
+	}
+	remaining := MaxEntries
+	return walk(rootPath, resolved, stat, depth, &remaining), nil
+}
+
+func walk(rootPath string, path string, stat os.FileInfo, depth int, remaining *int) *FileEntry {
+	*remaining--
+	entry := newEntry(rootPath, path, stat)
+	if !entry.Dir {
+		return entry
+	}
+	if depth == 0 || *remaining <= 0 {
+		entry.Truncated = true
+		return entry
+	}
+	dirEntries, err := os.ReadDir(path)
+	if err != nil {
+		entry.Truncated = true
+		return entry
+	}
+	sort.Slice(dirEntries, func(i, j int) bool { return dirEntries[i].Name() < dirEntries[j].Name() })
+	entry.Children = []*FileEntry{}
+	for _, dirEntry := range dirEntries {
+		if *remaining <= 0 {
+			entry.Truncated = true
+			break
+		}
+		childPath := filepath.Join(path, dirEntry.Name())
+		childStat, err := os.Lstat(childPath)
+		if err != nil {
+			continue
+		}
+		entry.Children = append(entry.Children, walk(rootPath, childPath, childStat, depth-1, remaining))
+	}
+	return entry
+}
+
+func newEntry(rootPath string, path string, stat os.FileInfo) *FileEntry {
+	relPath, err := filepath.Rel(rootPath, path)
+	if err != nil {
+		relPath = stat.Name()
+	}
+	entry := &FileEntry{
+		Name:    stat.Name(),
+		Path:    relPath,
+		Mode:    stat.Mode().String(),
+		Size:    stat.Size(),
+		ModTime: stat.ModTime(),
+		Dir:     stat.IsDir(),
+		Symlink: stat.Mode()&os.ModeSymlink != 0,
+	}
+	if sys, ok := stat.Sys().(*syscall.Stat_t); ok {
+		entry.Owner = lookupUser(sys.Uid)
+		entry.Group = lookupGroup(sys.Gid)
+	}
+	return entry
+}
+
+func lookupUser(uid uint32) string {
+	id := strconv.FormatUint(uint64(uid), 10)
+	if u, err := user.LookupId(id); err == nil {
+		return u.Username
+	}
+	return id
+}
+
+func lookupGroup(gid uint32) string {
+	id := strconv.FormatUint(uint64(gid), 10)
+	if g, err := user.LookupGroupId(id); err == nil {
+		return g.Name
+	}
+	return id
+}
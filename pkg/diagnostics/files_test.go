@@ -0,0 +1,60 @@
+package diagnostics_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cordialsys/panel/pkg/diagnostics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrowser(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "signer", "data"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "signer", "data", "signer.db"), []byte("secret"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "treasury.toml"), []byte("x"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "identity.txt"), []byte("secret"), 0600))
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "escape")))
+	require.NoError(t, os.Symlink(filepath.Join(root, "signer"), filepath.Join(root, "link")))
+
+	browser := diagnostics.NewBrowser([]diagnostics.Root{{Name: "treasury", Path: root}})
+
+	entry, err := browser.List("treasury", ".", 1)
+	require.NoError(t, err)
+	require.True(t, entry.Dir)
+	names := []string{}
+	for _, child := range entry.Children {
+		names = append(names, child.Name)
+	}
+	require.Equal(t, []string{"escape", "link", "signer", "treasury.toml"}, names)
+	// symlinks are reported but not followed
+	require.True(t, entry.Children[0].Symlink)
+	require.Empty(t, entry.Children[0].Children)
+	// depth limit
+	require.True(t, entry.Children[2].Truncated)
+	require.Equal(t, int64(1), entry.Children[3].Size)
+
+	entry, err = browser.List("treasury", "signer", 2)
+	require.NoError(t, err)
+	require.Equal(t, "signer.db", entry.Children[0].Children[0].Name)
+	require.Equal(t, filepath.Join("signer", "data", "signer.db"), entry.Children[0].Children[0].Path)
+	require.Equal(t, "-rw-------", entry.Children[0].Children[0].Mode)
+
+	// symlinks within the root may be resolved
+	_, err = browser.List("treasury", "link", 1)
+	require.NoError(t, err)
+
+	for _, path := range []string{"..", "../", "signer/../..", "/etc", "escape", "escape/identity.txt"} {
+		_, err = browser.List("treasury", path, 1)
+		require.ErrorIs(t, err, diagnostics.ErrOutsideRoot, path)
+	}
+
+	_, err = browser.List("etc", ".", 1)
+	require.ErrorIs(t, err, diagnostics.ErrUnknownRoot)
+	_, err = browser.List("treasury", ".", diagnostics.MaxDepth+1)
+	require.Error(t, err)
+	_, err = browser.List("treasury", "missing", 1)
+	require.True(t, os.IsNotExist(err))
+}
@@ -32,6 +32,80 @@ func (p PanelHome) BlueprintFile() string {
 	return filepath.Join(string(p), "blueprint.csl")
 }
 
+// Hashed admin tokens permitted to call the panel API
+func (p PanelHome) AdminTokensFile() string {
+	return filepath.Join(string(p), "tokens.json")
+}
+
+// Plaintext initial admin token, readable only by root, for use by the local CLI
+func (p PanelHome) AdminTokenFile() string {
+	return filepath.Join(string(p), "token")
+}
+
+// Self-signed TLS certificate generated for the panel listener, if none is supplied
+func (p PanelHome) TlsCertFile() string {
+	return filepath.Join(string(p), "tls.crt")
+}
+
+func (p PanelHome) TlsKeyFile() string {
+	return filepath.Join(string(p), "tls.key")
+}
+
+// Optional client certificate (with key) used by the local CLI and units when mutual TLS is required
+func (p PanelHome) ClientCertFile() string {
+	return filepath.Join(string(p), "client.pem")
+}
+
+// Append-only, hash-chained audit log of state-changing operations
+func (p PanelHome) AuditLogFile() string {
+	return filepath.Join(string(p), "audit.jsonl")
+}
+
+// Pending and completed two-person approval requests
+func (p PanelHome) ApprovalsFile() string {
+	return filepath.Join(string(p), "approvals.json")
+}
+
+// Activation API key, readable only by root and the treasury user
+func (p PanelHome) ApiKeyFile() string {
+	return filepath.Join(string(p), "api-key")
+}
+
+// Scheduled snapshot configuration and the status of their last runs
+func (p PanelHome) SchedulesFile() string {
+	return filepath.Join(string(p), "schedules.json")
+}
+
+// Where each backup object has been replicated to
+func (p PanelHome) ReplicationFile() string {
+	return filepath.Join(string(p), "replication.json")
+}
+
+// Info read from each snapshot in the backup bucket, so it is only downloaded once
+func (p PanelHome) SnapshotCatalogFile() string {
+	return filepath.Join(string(p), "snapshots.json")
+}
+
+// Ed25519 key the snapshot sidecars uploaded by the panel are signed with
+func (p PanelHome) SnapshotSigningKeyFile() string {
+	return filepath.Join(string(p), "snapshot-signing.key")
+}
+
+// Sealed-state configuration, never encrypted itself
+func (p PanelHome) StateConfigFile() string {
+	return filepath.Join(string(p), "state.json")
+}
+
+// Local keyring of named secrets, age encrypted
+func (p PanelHome) KeyringFile() string {
+	return filepath.Join(string(p), "keyring.age")
+}
+
+// Keyring configuration, naming the secret that unlocks the keyring
+func (p PanelHome) KeyringConfigFile() string {
+	return filepath.Join(string(p), "keyring.json")
+}
+
 func PanelDir(home string) string {
 	return filepath.Join(home, "panel")
 }
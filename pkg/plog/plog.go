@@ -27,9 +27,9 @@ func (w *ioWrapper) Write(p []byte) (n int, err error) {
 func Init(level slog.Level) {
 	wrapped := &ioWrapper{writer: os.Stderr}
 	if os.Getenv("TREASURY_LOG_FORMAT") == "json" {
-		logg = slog.New(slog.NewJSONHandler(wrapped, &slog.HandlerOptions{Level: level}))
+		logg = slog.New(NewRedactHandler(slog.NewJSONHandler(wrapped, &slog.HandlerOptions{Level: level})))
 	} else {
-		logg = slog.New(slog.NewTextHandler(wrapped, &slog.HandlerOptions{Level: level}))
+		logg = slog.New(NewRedactHandler(slog.NewTextHandler(wrapped, &slog.HandlerOptions{Level: level})))
 	}
 	slog.SetDefault(logg)
 }
@@ -0,0 +1,153 @@
+package plog
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Replaces known secret values in logs, exec transcripts and API errors.
+const Redacted = "[REDACTED]"
+
+// Shorter values are not tracked, as redacting them would mangle unrelated output.
+const MinSecretLength = 8
+
+var secretsLock sync.RWMutex
+
+// The number of registrations of each value
+var secrets = map[string]int{}
+var replacer = strings.NewReplacer()
+
+// Register secret values (API keys, EAR and bak phrases, invite codes, ...) to be redacted.
+// Values only needed for one operation (e.g. a submitted bak phrase) are unregistered with the
+// returned function, once done with.  A value stays registered while any registration remains.
+func AddSecret(values ...string) (remove func()) {
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+	added := []string{}
+	changed := false
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if len(value) < MinSecretLength {
+			continue
+		}
+		if secrets[value] == 0 {
+			changed = true
+		}
+		secrets[value]++
+		added = append(added, value)
+	}
+	if changed {
+		rebuildReplacer()
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			removeSecrets(added)
+		})
+	}
+}
+
+func removeSecrets(values []string) {
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+	changed := false
+	for _, value := range values {
+		secrets[value]--
+		if secrets[value] <= 0 {
+			delete(secrets, value)
+			changed = true
+		}
+	}
+	if changed {
+		rebuildReplacer()
+	}
+}
+
+func rebuildReplacer() {
+	// longest first, so a secret containing another is redacted whole
+	sorted := make([]string, 0, len(secrets))
+	for value := range secrets {
+		sorted = append(sorted, value)
+	}
+	slices.SortFunc(sorted, func(a, b string) int { return len(b) - len(a) })
+	oldnew := make([]string, 0, 2*len(sorted))
+	for _, value := range sorted {
+		oldnew = append(oldnew, value, Redacted)
+	}
+	replacer = strings.NewReplacer(oldnew...)
+}
+
+// Replace any registered secret values in the string.
+func Redact(s string) string {
+	secretsLock.RLock()
+	defer secretsLock.RUnlock()
+	return replacer.Replace(s)
+}
+
+// Wraps a handler to redact registered secret values from every record.
+type redactHandler struct {
+	handler slog.Handler
+}
+
+var _ slog.Handler = &redactHandler{}
+
+func NewRedactHandler(handler slog.Handler) slog.Handler {
+	return &redactHandler{handler: handler}
+}
+
+func (h *redactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *redactHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, Redact(record.Message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(redactAttr(attr))
+		return true
+	})
+	return h.handler.Handle(ctx, redacted)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		redacted[i] = redactAttr(attr)
+	}
+	return &redactHandler{handler: h.handler.WithAttrs(redacted)}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{handler: h.handler.WithGroup(name)}
+}
+
+func redactAttr(attr slog.Attr) slog.Attr {
+	return slog.Attr{Key: attr.Key, Value: redactValue(attr.Value)}
+}
+
+func redactValue(value slog.Value) slog.Value {
+	value = value.Resolve()
+	switch value.Kind() {
+	case slog.KindString:
+		return slog.StringValue(Redact(value.String()))
+	case slog.KindGroup:
+		group := value.Group()
+		redacted := make([]slog.Attr, len(group))
+		for i, attr := range group {
+			redacted[i] = redactAttr(attr)
+		}
+		return slog.GroupValue(redacted...)
+	case slog.KindAny:
+		// e.g. errors, []string args, structs: only replaced if they contain a secret
+		formatted := fmt.Sprintf("%+v", value.Any())
+		if redacted := Redact(formatted); redacted != formatted {
+			return slog.StringValue(redacted)
+		}
+		return value
+	default:
+		return value
+	}
+}
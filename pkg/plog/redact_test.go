@@ -0,0 +1,69 @@
+package plog_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"testing"
+
+	"github.com/cordialsys/panel/pkg/plog"
+	"github.com/cordialsys/panel/pkg/secret"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedact(t *testing.T) {
+	apiKey := "dGVzdC1rZXk6c2VjcmV0LWFwaS1rZXk="
+	earPhrase := "abandon ability able about above absent absorb abstract absurd abuse access accident"
+	bakPhrase := "zoo zone youth young yellow year wrong write wrist world worth wreck"
+	invite := "7Hq2xvPZ9kfM3aWnYbC4dE"
+	t.Setenv("TEST_API_KEY", apiKey)
+
+	// secrets are registered when loaded
+	loaded, err := secret.Secret("env:TEST_API_KEY").Load()
+	require.NoError(t, err)
+	require.Equal(t, apiKey, loaded)
+	plog.AddSecret(earPhrase, bakPhrase, invite)
+	// too short to redact
+	plog.AddSecret("abc")
+	secrets := []string{apiKey, earPhrase, bakPhrase, invite}
+
+	var buf bytes.Buffer
+	for _, handler := range []slog.Handler{
+		slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}),
+		slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}),
+	} {
+		logger := slog.New(plog.NewRedactHandler(handler)).With("api_key", apiKey)
+		logger.Info("activating with " + apiKey)
+		logger.Debug("admin request", "body", fmt.Sprintf(`{"api_key":"%s"}`, apiKey))
+		logger.Info("generating blueprint", "args", []string{"--user", "a@b.c;cli=" + invite})
+		logger.Error("failed", "error", errors.New("bad phrase "+earPhrase))
+		logger.WithGroup("restore").Info("restoring", slog.Group("env", "phrase", bakPhrase))
+
+		cmd := exec.Command("cord", "backup", "restore", "--phrase", bakPhrase)
+		logger.Info("exec", "binary", "cord", "cmd", cmd.String(), "output", "using "+earPhrase)
+	}
+	output := buf.String()
+	require.Contains(t, output, plog.Redacted)
+	require.Equal(t, "abc", plog.Redact("abc"))
+	for _, value := range secrets {
+		require.NotContains(t, output, value)
+	}
+
+	// a secret containing another is redacted whole
+	plog.AddSecret("zone youth young")
+	require.Equal(t, "phrase: "+plog.Redacted, plog.Redact("phrase: "+bakPhrase))
+
+	// a value registered for one operation is redacted until removed, unless also registered elsewhere
+	submitted := "pupil ranch snake tissue urge vivid"
+	remove := plog.AddSecret(submitted)
+	removeAgain := plog.AddSecret(submitted)
+	require.Equal(t, plog.Redacted, plog.Redact(submitted))
+	remove()
+	remove()
+	require.Equal(t, plog.Redacted, plog.Redact(submitted))
+	removeAgain()
+	require.Equal(t, submitted, plog.Redact(submitted))
+	require.Equal(t, "phrase: "+plog.Redacted, plog.Redact("phrase: "+bakPhrase))
+}
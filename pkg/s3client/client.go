@@ -1,6 +1,7 @@
 package s3client
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"errors"
@@ -9,10 +10,10 @@ import (
 	"net/http"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/cordialsys/panel/pkg/secret"
@@ -22,7 +23,8 @@ import (
 type treasuryS3Transport struct {
 	treasury string
 	node     string
-	apiKey   string
+	// resolved on each request, so that the reference may be rotated
+	apiKey secret.Secret
 }
 
 func (t *treasuryS3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -33,9 +35,13 @@ func (t *treasuryS3Transport) RoundTrip(req *http.Request) (*http.Response, erro
 		req.Header.Set("node", t.node)
 	}
 	if t.apiKey != "" {
+		apiKey, err := t.apiKey.Load()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load treasury api key: %w", err)
+		}
 		asB64 := ""
-		if strings.Contains(t.apiKey, ":") {
-			asB64 = base64.StdEncoding.EncodeToString([]byte(t.apiKey))
+		if strings.Contains(apiKey, ":") {
+			asB64 = base64.StdEncoding.EncodeToString([]byte(apiKey))
 		}
 		req.Header.Set("authorization", fmt.Sprintf("Basic %s", asB64))
 	}
@@ -75,6 +81,32 @@ func (opts BackupS3ClientOptions) BucketName() string {
 	return bucket
 }
 
+// How long credentials loaded from a secret reference are used before loading them again
+const s3TokenTtl = 5 * time.Minute
+
+// Load `<access-key-id>:<secret-access-key>[:<session-token>]` from a secret reference.
+func loadS3Token(ref secret.Secret) (aws.Credentials, error) {
+	s3Token, err := ref.Load()
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to load s3 token: %w", err)
+	}
+	parts := strings.SplitN(strings.TrimSpace(s3Token), ":", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return aws.Credentials{}, fmt.Errorf("s3 token must be <access-key-id>:<secret-access-key>[:<session-token>]")
+	}
+	creds := aws.Credentials{
+		AccessKeyID:     parts[0],
+		SecretAccessKey: parts[1],
+		Source:          "s3-token",
+		CanExpire:       true,
+		Expires:         time.Now().Add(s3TokenTtl),
+	}
+	if len(parts) > 2 {
+		creds.SessionToken = parts[2]
+	}
+	return creds, nil
+}
+
 func NewBackupS3Client(opts BackupS3ClientOptions) (*BackupS3Client, error) {
 	var err error
 	region := "unknown"
@@ -90,55 +122,26 @@ func NewBackupS3Client(opts BackupS3ClientOptions) (*BackupS3Client, error) {
 
 	var creds aws.CredentialsProvider = aws.AnonymousCredentials{}
 
-	// Check for environment credentials first
-	envCreds := cfg.Credentials
-	if _, err := envCreds.Retrieve(context.TODO()); err == nil {
-		creds = envCreds
-	}
-
 	if opts.S3Token != "" {
-		s3Token, err := opts.S3Token.Load()
-		if err != nil {
-			logrus.WithError(err).Error("error loading s3 token")
-			return nil, err
-		}
-		if s3Token == "" {
-			logrus.Warn("s3 token is empty")
-		} else {
-			parts := strings.Split(s3Token, ":")
-			if len(parts) == 0 {
-				logrus.Warn("unable to split s3 token by ':'")
-			}
-			id := parts[0]
-			secret := ""
-			token := ""
-			if len(parts) > 1 {
-				secret = parts[1]
-			}
-			if len(parts) > 2 {
-				token = parts[2]
-			}
-			creds = credentials.NewStaticCredentialsProvider(id, secret, token)
+		// resolved when the credentials expire, so that the reference may be rotated
+		creds = aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return loadS3Token(opts.S3Token)
+		})
+	} else {
+		// Check for environment credentials
+		envCreds := cfg.Credentials
+		if _, err := envCreds.Retrieve(context.TODO()); err == nil {
+			creds = envCreds
 		}
 	}
 
-	var apiKey string
+	var apiKey secret.Secret
 	if opts.ApiKey != "" {
 		// Check if we're using non-anonymous credentials
-		_, err := creds.Retrieve(context.TODO())
-		isAnonymous := err != nil
-
-		if !isAnonymous {
+		if _, isAnonymous := creds.(aws.AnonymousCredentials); !isAnonymous {
 			logrus.Warn("ignoring TREASURY_API_KEY since s3-token is set or inferred from environment")
 		} else {
-			apiKey, err = opts.ApiKey.Load()
-			if err != nil {
-				logrus.WithError(err).Error("error loading treasury api key")
-				return nil, err
-			}
-			if apiKey == "" {
-				logrus.Warn("treasury api key is empty")
-			}
+			apiKey = opts.ApiKey
 		}
 	}
 
@@ -217,22 +220,178 @@ func trimPathPrefix(path string) string {
 	return path
 }
 
-func (c *BackupS3Client) PutKey(ctx context.Context, keyPath string, body io.ReadSeeker) (*s3.PutObjectOutput, error) {
-	keyPath = trimPathPrefix(keyPath)
+func (c *BackupS3Client) KeyFileKey(keyPath string) string {
+	return filepath.Join("nodes", c.opts.Node, "keys", trimPathPrefix(keyPath))
+}
+
+func (c *BackupS3Client) SnapshotKey(snapshotPath string) string {
+	return filepath.Join("nodes", c.opts.Node, "snapshots", trimPathPrefix(snapshotPath))
+}
+
+// The prefix of the snapshots of a backup key, by its short id.
+func (c *BackupS3Client) SnapshotPrefix(bakShortId string) string {
+	return filepath.Join("nodes", c.opts.Node, "snapshots", bakShortId) + "/"
+}
+
+// The prefix the treasury uploads its key backups under.
+func (c *BackupS3Client) KeyPrefix() string {
+	return filepath.Join("nodes", c.opts.Node, "keys") + "/"
+}
+
+func (c *BackupS3Client) NodePrefix() string {
+	return filepath.Join("nodes", c.opts.Node) + "/"
+}
+
+func (c *BackupS3Client) PutSnapshot(ctx context.Context, snapshotPath string, body io.ReadSeeker) (*s3.PutObjectOutput, error) {
 	return c.svc.PutObject(ctx, &s3.PutObjectInput{
 		Bucket: c.bucketName,
-		Key:    aws.String(filepath.Join("nodes", c.opts.Node, "keys", keyPath)),
+		Key:    aws.String(c.SnapshotKey(snapshotPath)),
 		Body:   body,
 	})
 }
 
-func (c *BackupS3Client) PutSnapshot(ctx context.Context, snapshotPath string, body io.ReadSeeker) (*s3.PutObjectOutput, error) {
-	snapshotPath = trimPathPrefix(snapshotPath)
-	return c.svc.PutObject(ctx, &s3.PutObjectInput{
+var _ Destination = &BackupS3Client{}
+
+func (c *BackupS3Client) String() string {
+	if c.opts.Endpoint != "" {
+		return strings.TrimSuffix(c.opts.Endpoint, "/") + "/" + *c.bucketName
+	}
+	return "s3://" + *c.bucketName
+}
+
+func (c *BackupS3Client) Put(ctx context.Context, key string, body io.ReadSeeker) error {
+	_, err := c.svc.PutObject(ctx, &s3.PutObjectInput{
 		Bucket: c.bucketName,
-		Key:    aws.String(filepath.Join("nodes", c.opts.Node, "snapshots", snapshotPath)),
+		Key:    aws.String(key),
 		Body:   body,
 	})
+	return err
+}
+
+func (c *BackupS3Client) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	object, err := c.GetObject(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return object.Body, nil
+}
+
+func (c *BackupS3Client) Delete(ctx context.Context, key string) error {
+	_, err := c.svc.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: c.bucketName,
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (c *BackupS3Client) List(ctx context.Context, prefix string) ([]Object, error) {
+	objects := []Object{}
+	iter, errs := c.IterateObjects(ctx, prefix)
+	for obj := range iter {
+		objects = append(objects, obj)
+	}
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+type Check struct {
+	Name  string `json:"name"`
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type TestResult struct {
+	Endpoint string  `json:"endpoint,omitempty"`
+	Bucket   string  `json:"bucket,omitempty"`
+	Ok       bool    `json:"ok"`
+	Checks   []Check `json:"checks"`
+}
+
+// The failed checks, e.g. `write: access denied`.
+func (r *TestResult) Error() string {
+	failed := []string{}
+	for _, check := range r.Checks {
+		if !check.Ok {
+			failed = append(failed, check.Name+": "+check.Error)
+		}
+	}
+	return strings.Join(failed, "; ")
+}
+
+func (r *TestResult) check(name string, err error) bool {
+	check := Check{Name: name, Ok: err == nil}
+	if err != nil {
+		check.Error = err.Error()
+		r.Ok = false
+	}
+	r.Checks = append(r.Checks, check)
+	return err == nil
+}
+
+var probeBody = []byte("panel backup destination test\n")
+
+func probeKey(prefix string) string {
+	return fmt.Sprintf("%s.panel-test-%d", prefix, time.Now().UnixNano())
+}
+
+func checkProbe(read []byte) error {
+	if !bytes.Equal(read, probeBody) {
+		return fmt.Errorf("read back %d bytes that do not match what was written", len(read))
+	}
+	return nil
+}
+
+// Check connectivity and permissions by listing the node prefix, then writing, reading back and
+// deleting a probe object under it.  The probe is removed even if reading it back fails.
+func (c *BackupS3Client) Test(ctx context.Context) *TestResult {
+	result := &TestResult{
+		Endpoint: c.opts.Endpoint,
+		Bucket:   *c.bucketName,
+		Ok:       true,
+	}
+	check := result.check
+	// report failures at once, rather than retrying them
+	noRetry := func(o *s3.Options) {
+		o.RetryMaxAttempts = 1
+	}
+	prefix := c.NodePrefix()
+	_, err := c.svc.ListObjects(ctx, &s3.ListObjectsInput{
+		Bucket: c.bucketName,
+		Prefix: aws.String(prefix),
+	}, noRetry)
+	check("list", err)
+
+	probe := probeKey(prefix)
+	body := probeBody
+	_, err = c.svc.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: c.bucketName,
+		Key:    aws.String(probe),
+		Body:   bytes.NewReader(body),
+	}, noRetry)
+	if !check("write", err) {
+		return result
+	}
+	object, err := c.svc.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: c.bucketName,
+		Key:    aws.String(probe),
+	}, noRetry)
+	if err == nil {
+		var read []byte
+		read, err = io.ReadAll(object.Body)
+		object.Body.Close()
+		if err == nil {
+			err = checkProbe(read)
+		}
+	}
+	check("read", err)
+	_, err = c.svc.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: c.bucketName,
+		Key:    aws.String(probe),
+	}, noRetry)
+	check("delete", err)
+	return result
 }
 
 func (s3Client *BackupS3Client) CreateBucketIfErrIsMissing(ctx context.Context, err error) bool {
@@ -262,14 +421,14 @@ func (s3Client *BackupS3Client) CreateBucketIfErrIsMissing(ctx context.Context,
 	return false
 }
 
-// Return an iterator for the files under the given prefix.
-// Note that files will be returned in lexicographic order, and without the prefix.
-func (s3Client *BackupS3Client) IterateFiles(ctx context.Context, prefix string) (<-chan string, error) {
-	files := make(chan string)
-	// err := make(chan error)
+// Return an iterator for the objects under the given prefix, listing a page at a time.
+// If listing fails, the error is sent once the objects channel is closed.
+func (s3Client *BackupS3Client) IterateObjects(ctx context.Context, prefix string) (<-chan Object, <-chan error) {
+	objects := make(chan Object)
+	errs := make(chan error, 1)
 	go func() {
-		defer close(files)
-		// defer close(err)
+		defer close(errs)
+		defer close(objects)
 		var nextMarker string
 		for {
 			output, err := s3Client.ListObjects(ctx, ListObjectsOptions{
@@ -277,21 +436,48 @@ func (s3Client *BackupS3Client) IterateFiles(ctx context.Context, prefix string)
 				Marker: nextMarker,
 			})
 			if err != nil {
-				logrus.WithError(err).Error("error listing objects")
+				errs <- err
 				return
 			}
 			for _, obj := range output.Contents {
-				path := strings.TrimPrefix(*obj.Key, prefix)
-				path = strings.TrimPrefix(path, "/")
-				files <- path
+				select {
+				case objects <- Object{
+					Key:      aws.ToString(obj.Key),
+					Size:     aws.ToInt64(obj.Size),
+					Modified: aws.ToTime(obj.LastModified),
+				}:
+				case <-ctx.Done():
+					errs <- ctx.Err()
+					return
+				}
 			}
-			if len(output.Contents) == 0 {
+			if len(output.Contents) == 0 || !aws.ToBool(output.IsTruncated) {
 				break
 			}
-			if output.NextMarker == nil || *output.NextMarker == "" {
-				break
+			// the next marker is only returned when listing with a delimiter
+			nextMarker = aws.ToString(output.NextMarker)
+			if nextMarker == "" {
+				nextMarker = aws.ToString(output.Contents[len(output.Contents)-1].Key)
 			}
-			nextMarker = *output.NextMarker
+		}
+	}()
+	return objects, errs
+}
+
+// Return an iterator for the files under the given prefix.
+// Note that files will be returned in lexicographic order, and without the prefix.
+func (s3Client *BackupS3Client) IterateFiles(ctx context.Context, prefix string) (<-chan string, error) {
+	files := make(chan string)
+	objects, errs := s3Client.IterateObjects(ctx, prefix)
+	go func() {
+		defer close(files)
+		for obj := range objects {
+			path := strings.TrimPrefix(obj.Key, prefix)
+			path = strings.TrimPrefix(path, "/")
+			files <- path
+		}
+		if err := <-errs; err != nil {
+			logrus.WithError(err).Error("error listing objects")
 		}
 	}()
 
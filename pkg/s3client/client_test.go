@@ -0,0 +1,96 @@
+package s3client_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/cordialsys/panel/pkg/s3client"
+	"github.com/cordialsys/panel/pkg/s3client/s3test"
+	"github.com/cordialsys/panel/pkg/secret"
+	"github.com/stretchr/testify/require"
+)
+
+func newClient(t *testing.T, server *s3test.Server, token secret.Secret) *s3client.BackupS3Client {
+	client, err := s3client.NewBackupS3Client(s3client.BackupS3ClientOptions{
+		Endpoint: server.URL,
+		Node:     "3",
+		Bucket:   "backups",
+		Region:   "us-east-1",
+		S3Token:  token,
+	})
+	require.NoError(t, err)
+	return client
+}
+
+func TestDestination(t *testing.T) {
+	ctx := context.Background()
+	server := s3test.NewServer("backups")
+	defer server.Close()
+	server.AccessKeyId = "AKIDPANEL"
+	t.Setenv("PANEL_S3_TOKEN", "AKIDPANEL:secret")
+
+	client := newClient(t, server, "env:PANEL_S3_TOKEN")
+	result := client.Test(ctx)
+	require.True(t, result.Ok, result.Error())
+	require.Equal(t, []string{"list", "write", "read", "delete"}, checkNames(result))
+	// the probe is removed
+	require.Empty(t, server.Objects("backups"))
+
+	// snapshots are kept under the node prefix
+	server.MaxKeys = 2
+	for i := range 5 {
+		_, err := client.PutSnapshot(ctx, fmt.Sprintf("snapshots/age1abc/snap-%d.tar", i), bytes.NewReader([]byte("tar")))
+		require.NoError(t, err)
+	}
+	server.PutObject("backups", "nodes/3/snapshots/age1other/snap-9.tar", []byte("tar"))
+	require.Contains(t, server.Objects("backups"), "nodes/3/snapshots/age1abc/snap-0.tar")
+	ids, err := s3client.ListSnapshots(ctx, client, client.SnapshotPrefix("age1abc"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"snap-0", "snap-1", "snap-2", "snap-3", "snap-4"}, ids)
+	require.NoError(t, client.Delete(ctx, "nodes/3/snapshots/age1abc/snap-2.tar"))
+	ids, err = s3client.ListSnapshots(ctx, client, client.SnapshotPrefix("age1abc"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"snap-0", "snap-1", "snap-3", "snap-4"}, ids)
+
+	// missing permissions are reported per check
+	server.DenyMethods = []string{http.MethodDelete}
+	result = client.Test(ctx)
+	require.False(t, result.Ok)
+	require.Equal(t, []bool{true, true, true, false}, checkResults(result))
+	require.Contains(t, result.Error(), "delete: ")
+	require.Contains(t, result.Error(), "AccessDenied")
+	server.DenyMethods = nil
+
+	// credentials are loaded from the reference when the client is used
+	result = newClient(t, server, secret.Secret("file:"+t.TempDir()+"/missing")).Test(ctx)
+	require.False(t, result.Ok)
+	require.Contains(t, result.Error(), "failed to load s3 token")
+
+	t.Setenv("OTHER_S3_TOKEN", "AKIDOTHER:secret")
+	result = newClient(t, server, "env:OTHER_S3_TOKEN").Test(ctx)
+	require.False(t, result.Ok)
+	require.Contains(t, result.Error(), "InvalidAccessKeyId")
+
+	t.Setenv("BAD_S3_TOKEN", "AKIDPANEL")
+	result = newClient(t, server, "env:BAD_S3_TOKEN").Test(ctx)
+	require.Contains(t, result.Error(), "s3 token must be <access-key-id>:<secret-access-key>")
+}
+
+func checkNames(result *s3client.TestResult) []string {
+	names := []string{}
+	for _, check := range result.Checks {
+		names = append(names, check.Name)
+	}
+	return names
+}
+
+func checkResults(result *s3client.TestResult) []bool {
+	results := []bool{}
+	for _, check := range result.Checks {
+		results = append(results, check.Ok)
+	}
+	return results
+}
@@ -0,0 +1,56 @@
+package s3client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Returned by `Replicator.Get` when no destination has the object.
+var ErrNotFound = errors.New("object not found")
+
+// Whether reading an object failed because it does not exist.
+func IsNotFound(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	return errors.Is(err, ErrNotFound) || errors.Is(err, fs.ErrNotExist) || errors.As(err, &noSuchKey)
+}
+
+// Destination is somewhere backups are kept, with objects addressed by the same keys as in the
+// backup bucket, e.g. `nodes/<node>/snapshots/<bak>/<id>.tar`.
+type Destination interface {
+	String() string
+	Put(ctx context.Context, key string, body io.ReadSeeker) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Deleting a missing object is not an error
+	Delete(ctx context.Context, key string) error
+	// All objects under the prefix, in key order
+	List(ctx context.Context, prefix string) ([]Object, error)
+	Test(ctx context.Context) *TestResult
+}
+
+type Object struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// List the ids of the `<id>.tar` snapshots directly under a prefix, see `SnapshotPrefix`.
+func ListSnapshots(ctx context.Context, destination Destination, prefix string) ([]string, error) {
+	objects, err := destination.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, obj := range objects {
+		name := strings.TrimPrefix(obj.Key, prefix)
+		if id, ok := strings.CutSuffix(name, ".tar"); ok && !strings.Contains(id, "/") {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
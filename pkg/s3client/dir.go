@@ -0,0 +1,148 @@
+package s3client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// DirDestination keeps objects as files under a directory, such as an NFS mount.  Files are
+// written to a hidden temporary name first, so a partial upload is never listed.
+type DirDestination string
+
+var _ Destination = DirDestination("")
+
+func (d DirDestination) String() string {
+	return string(d)
+}
+
+func (d DirDestination) path(key string) (string, error) {
+	if !filepath.IsLocal(key) {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(string(d), filepath.FromSlash(key)), nil
+}
+
+func (d DirDestination) Put(ctx context.Context, key string, body io.ReadSeeker) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if _, err := io.Copy(tmp, body); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (d DirDestination) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (d DirDestination) Delete(ctx context.Context, key string) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (d DirDestination) List(ctx context.Context, prefix string) ([]Object, error) {
+	// only walk the deepest directory the prefix names
+	dir := strings.TrimSuffix(prefix, "/")
+	if !strings.HasSuffix(prefix, "/") {
+		dir = path.Dir(prefix)
+	}
+	root, err := d.path(dir)
+	if err != nil {
+		return nil, err
+	}
+	objects := []Object{}
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == root {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if strings.HasPrefix(entry.Name(), ".") && path != root {
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(string(d), path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, Object{Key: key, Size: info.Size(), Modified: info.ModTime().UTC()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(objects, func(a, b Object) int { return strings.Compare(a.Key, b.Key) })
+	return objects, nil
+}
+
+// Check the directory exists, and that a probe file can be written, read back and removed.
+func (d DirDestination) Test(ctx context.Context) *TestResult {
+	result := &TestResult{Endpoint: string(d), Ok: true}
+	if _, err := os.ReadDir(string(d)); !result.check("list", err) {
+		return result
+	}
+	probe := probeKey("")
+	if !result.check("write", d.Put(ctx, probe, strings.NewReader(string(probeBody)))) {
+		return result
+	}
+	var read []byte
+	body, err := d.Get(ctx, probe)
+	if err == nil {
+		read, err = io.ReadAll(body)
+		body.Close()
+		if err == nil {
+			err = checkProbe(read)
+		}
+	}
+	result.check("read", err)
+	result.check("delete", d.Delete(ctx, probe))
+	return result
+}
@@ -0,0 +1,383 @@
+package s3client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Name of the primary destination in the replication state
+const PrimaryName = "primary"
+
+type Replica struct {
+	Name string `json:"name"`
+	Destination
+	// Whether snapshots pruned from the primary are also deleted here
+	Prune bool `json:"prune,omitempty"`
+}
+
+// Replicator writes backups to the primary destination and fans them out to the replicas,
+// recording where each object has been replicated to.
+type Replicator struct {
+	Primary  *BackupS3Client
+	Replicas []Replica
+	// Optional
+	State *ReplicationState
+}
+
+// The primary followed by the replicas.
+func (r *Replicator) Destinations() []Replica {
+	return append([]Replica{{Name: PrimaryName, Destination: r.Primary}}, r.Replicas...)
+}
+
+func (r *Replicator) PutSnapshot(ctx context.Context, snapshotPath string, body io.ReadSeeker) error {
+	return r.Put(ctx, r.Primary.SnapshotKey(snapshotPath), body)
+}
+
+// Write an object to every destination.  Only a failure of the primary is returned; replicas
+// that fail are recorded so that `Reconcile` can copy the object later.
+func (r *Replicator) Put(ctx context.Context, key string, body io.ReadSeeker) error {
+	updates := []ReplicaUpdate{}
+	defer func() {
+		r.record(updates...)
+	}()
+	for i, destination := range r.Destinations() {
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		err := destination.Put(ctx, key, body)
+		updates = append(updates, ReplicaUpdate{Key: key, Destination: destination.Name, Err: err})
+		if err != nil {
+			if i == 0 {
+				return err
+			}
+			logrus.WithError(err).WithField("replica", destination.Name).WithField("key", key).Warn("failed to replicate object")
+		}
+	}
+	return nil
+}
+
+// Read an object from the primary, falling back to the replicas in order.  The error is
+// `ErrNotFound` only if no destination has the object; one that could not be read may.
+func (r *Replicator) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	errs := []error{}
+	destinations := r.Destinations()
+	notFound := 0
+	for _, destination := range destinations {
+		body, err := destination.Get(ctx, key)
+		if err == nil {
+			return body, nil
+		}
+		if IsNotFound(err) {
+			notFound++
+			errs = append(errs, fmt.Errorf("%s: %v", destination.Name, err))
+		} else {
+			errs = append(errs, fmt.Errorf("%s: %w", destination.Name, err))
+		}
+	}
+	if notFound == len(destinations) {
+		return nil, fmt.Errorf("%w: %v", ErrNotFound, errors.Join(errs...))
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (r *Replicator) record(updates ...ReplicaUpdate) {
+	if r.State == nil || len(updates) == 0 {
+		return
+	}
+	if err := r.State.Record(updates...); err != nil {
+		logrus.WithError(err).Warn("failed to record replication state")
+	}
+}
+
+type ReconcileCopy struct {
+	Key  string `json:"key"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type ReconcileFailure struct {
+	// Not set if the destination could not be listed
+	Key         string `json:"key,omitempty"`
+	Destination string `json:"destination"`
+	Error       string `json:"error"`
+}
+
+type ReconcileResult struct {
+	// Distinct objects found across the destinations
+	Objects int                `json:"objects"`
+	Copied  []ReconcileCopy    `json:"copied"`
+	Failed  []ReconcileFailure `json:"failed"`
+}
+
+// Copy every object under the prefix that is missing from a destination, from the first
+// destination that has it, and record the state of each object.  Nothing is deleted.
+func (r *Replicator) Reconcile(ctx context.Context, prefix string) (*ReconcileResult, error) {
+	result := &ReconcileResult{Copied: []ReconcileCopy{}, Failed: []ReconcileFailure{}}
+	destinations := r.Destinations()
+	// the keys present in each destination, or nil if it could not be listed
+	present := make([]map[string]bool, len(destinations))
+	keys := []string{}
+	for i, destination := range destinations {
+		objects, err := destination.List(ctx, prefix)
+		if err != nil {
+			result.Failed = append(result.Failed, ReconcileFailure{Destination: destination.Name, Error: err.Error()})
+			continue
+		}
+		present[i] = map[string]bool{}
+		for _, obj := range objects {
+			present[i][obj.Key] = true
+			keys = append(keys, obj.Key)
+		}
+	}
+	slices.Sort(keys)
+	keys = slices.Compact(keys)
+	result.Objects = len(keys)
+
+	updates := []ReplicaUpdate{}
+	for _, key := range keys {
+		source := slices.IndexFunc(present, func(keys map[string]bool) bool { return keys[key] })
+		for i, destination := range destinations {
+			if present[i] == nil {
+				continue
+			}
+			if present[i][key] {
+				updates = append(updates, ReplicaUpdate{Key: key, Destination: destination.Name, Present: true})
+				continue
+			}
+			err := copyObject(ctx, destinations[source], destination, key)
+			updates = append(updates, ReplicaUpdate{Key: key, Destination: destination.Name, Err: err})
+			if err != nil {
+				result.Failed = append(result.Failed, ReconcileFailure{Key: key, Destination: destination.Name, Error: err.Error()})
+				continue
+			}
+			result.Copied = append(result.Copied, ReconcileCopy{Key: key, From: destinations[source].Name, To: destination.Name})
+		}
+	}
+
+	if r.State != nil {
+		names := []string{}
+		for _, destination := range destinations {
+			names = append(names, destination.Name)
+		}
+		err := r.State.update(func(objects map[string]map[string]ReplicaState) {
+			for key, replicas := range objects {
+				if !strings.HasPrefix(key, prefix) {
+					continue
+				}
+				if _, found := slices.BinarySearch(keys, key); !found {
+					// removed everywhere that could be listed
+					delete(objects, key)
+					continue
+				}
+				for name := range replicas {
+					if !slices.Contains(names, name) {
+						delete(replicas, name)
+					}
+				}
+			}
+			applyUpdates(objects, updates)
+		})
+		if err != nil {
+			return result, fmt.Errorf("failed to record replication state: %v", err)
+		}
+	}
+	return result, nil
+}
+
+// Copy through a temporary file, as uploads must be seekable.
+func copyObject(ctx context.Context, from Replica, to Replica, key string) error {
+	body, err := from.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to read from %s: %v", from.Name, err)
+	}
+	defer body.Close()
+	tmp, err := os.CreateTemp("", "replicate-"+filepath.Base(key)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if _, err := io.Copy(tmp, body); err != nil {
+		return fmt.Errorf("failed to read from %s: %v", from.Name, err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return to.Put(ctx, key, tmp)
+}
+
+type ReplicaStatus string
+
+const (
+	ReplicaStatusReplicated ReplicaStatus = "replicated"
+	ReplicaStatusFailed     ReplicaStatus = "failed"
+)
+
+type ReplicaState struct {
+	Status ReplicaStatus `json:"status"`
+	// When the object was written or last failed to be
+	Time  time.Time `json:"time"`
+	Error string    `json:"error,omitempty"`
+}
+
+type ReplicaUpdate struct {
+	Key         string
+	Destination string
+	// The result of writing the object
+	Err error
+	// The object was found to already exist
+	Present bool
+}
+
+type replicationFile struct {
+	// By object key, then destination name
+	Objects map[string]map[string]ReplicaState `json:"objects"`
+}
+
+// ReplicationState persists the state of each object at each destination in a JSON file.
+type ReplicationState struct {
+	lock sync.Mutex
+	path string
+}
+
+func NewReplicationState(path string) *ReplicationState {
+	return &ReplicationState{path: path}
+}
+
+func (s *ReplicationState) load() (map[string]map[string]ReplicaState, error) {
+	stateBz, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]map[string]ReplicaState{}, nil
+		}
+		return nil, err
+	}
+	var file replicationFile
+	if err := json.Unmarshal(stateBz, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", s.path, err)
+	}
+	if file.Objects == nil {
+		file.Objects = map[string]map[string]ReplicaState{}
+	}
+	return file.Objects, nil
+}
+
+func (s *ReplicationState) save(objects map[string]map[string]ReplicaState) error {
+	stateBz, err := json.MarshalIndent(replicationFile{Objects: objects}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, stateBz, 0600)
+}
+
+func (s *ReplicationState) update(cb func(objects map[string]map[string]ReplicaState)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	objects, err := s.load()
+	if err != nil {
+		return err
+	}
+	cb(objects)
+	return s.save(objects)
+}
+
+// The state of each object, by key and then destination name.
+func (s *ReplicationState) Objects() (map[string]map[string]ReplicaState, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.load()
+}
+
+func (s *ReplicationState) Record(updates ...ReplicaUpdate) error {
+	return s.update(func(objects map[string]map[string]ReplicaState) {
+		applyUpdates(objects, updates)
+	})
+}
+
+// Drop an object from the state of a destination, after it has been deleted there.
+func (s *ReplicationState) Forget(key string, destination string) error {
+	return s.update(func(objects map[string]map[string]ReplicaState) {
+		delete(objects[key], destination)
+		if len(objects[key]) == 0 {
+			delete(objects, key)
+		}
+	})
+}
+
+func applyUpdates(objects map[string]map[string]ReplicaState, updates []ReplicaUpdate) {
+	now := time.Now().UTC()
+	for _, update := range updates {
+		if objects[update.Key] == nil {
+			objects[update.Key] = map[string]ReplicaState{}
+		}
+		existing, ok := objects[update.Key][update.Destination]
+		switch {
+		case update.Present && ok && existing.Status == ReplicaStatusReplicated:
+			// keep when it was written
+		case update.Err != nil:
+			objects[update.Key][update.Destination] = ReplicaState{Status: ReplicaStatusFailed, Time: now, Error: update.Err.Error()}
+		default:
+			objects[update.Key][update.Destination] = ReplicaState{Status: ReplicaStatusReplicated, Time: now}
+		}
+	}
+}
+
+type DestinationSummary struct {
+	Name       string `json:"name"`
+	Replicated int    `json:"replicated"`
+	Failed     int    `json:"failed"`
+	// Objects with no record at this destination, until they are written or reconciled
+	Missing int `json:"missing"`
+}
+
+type ReplicationSummary struct {
+	Objects      int                  `json:"objects"`
+	Destinations []DestinationSummary `json:"destinations"`
+	// The objects not replicated to every destination, by key and then destination name
+	Pending map[string]map[string]ReplicaState `json:"pending"`
+}
+
+// Count the objects replicated to each of the named destinations.
+func (s *ReplicationState) Summary(names []string) (*ReplicationSummary, error) {
+	objects, err := s.Objects()
+	if err != nil {
+		return nil, err
+	}
+	summary := &ReplicationSummary{
+		Objects:      len(objects),
+		Destinations: []DestinationSummary{},
+		Pending:      map[string]map[string]ReplicaState{},
+	}
+	for _, name := range names {
+		destination := DestinationSummary{Name: name}
+		for key, replicas := range objects {
+			replica, ok := replicas[name]
+			switch {
+			case ok && replica.Status == ReplicaStatusReplicated:
+				destination.Replicated++
+				continue
+			case ok:
+				destination.Failed++
+			default:
+				destination.Missing++
+			}
+			summary.Pending[key] = replicas
+		}
+		summary.Destinations = append(summary.Destinations, destination)
+	}
+	return summary, nil
+}
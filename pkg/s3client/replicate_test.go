@@ -0,0 +1,179 @@
+package s3client_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cordialsys/panel/pkg/s3client"
+	"github.com/cordialsys/panel/pkg/s3client/s3test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirDestination(t *testing.T) {
+	ctx := context.Background()
+	dir := s3client.DirDestination(t.TempDir())
+
+	result := dir.Test(ctx)
+	require.True(t, result.Ok, result.Error())
+	entries, err := os.ReadDir(string(dir))
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	for _, key := range []string{"nodes/3/snapshots/age1abc/snap-1.tar", "nodes/3/snapshots/age1abc/snap-2.tar", "nodes/3/keys/k1.json", "nodes/30/keys/k2.json"} {
+		require.NoError(t, dir.Put(ctx, key, bytes.NewReader([]byte(key))))
+	}
+	objects, err := dir.List(ctx, "nodes/3/")
+	require.NoError(t, err)
+	require.Equal(t, []string{"nodes/3/keys/k1.json", "nodes/3/snapshots/age1abc/snap-1.tar", "nodes/3/snapshots/age1abc/snap-2.tar"}, keys(objects))
+	objects, err = dir.List(ctx, "nodes/3")
+	require.NoError(t, err)
+	require.Len(t, objects, 4)
+	objects, err = dir.List(ctx, "nodes/4/")
+	require.NoError(t, err)
+	require.Empty(t, objects)
+
+	ids, err := s3client.ListSnapshots(ctx, dir, "nodes/3/snapshots/age1abc/")
+	require.NoError(t, err)
+	require.Equal(t, []string{"snap-1", "snap-2"}, ids)
+
+	body, err := dir.Get(ctx, "nodes/3/keys/k1.json")
+	require.NoError(t, err)
+	data, err := io.ReadAll(body)
+	require.NoError(t, err)
+	body.Close()
+	require.Equal(t, "nodes/3/keys/k1.json", string(data))
+
+	require.NoError(t, dir.Delete(ctx, "nodes/3/keys/k1.json"))
+	require.NoError(t, dir.Delete(ctx, "nodes/3/keys/k1.json"))
+	require.ErrorContains(t, dir.Put(ctx, "../escape", bytes.NewReader(nil)), "invalid object key")
+
+	result = s3client.DirDestination(filepath.Join(string(dir), "missing")).Test(ctx)
+	require.False(t, result.Ok)
+	require.Contains(t, result.Error(), "list: ")
+}
+
+func TestReplicator(t *testing.T) {
+	ctx := context.Background()
+	server := s3test.NewServer("backups", "offsite")
+	defer server.Close()
+	t.Setenv("PANEL_S3_TOKEN", "AKIDPANEL:secret")
+
+	primary := newClient(t, server, "env:PANEL_S3_TOKEN")
+	offsite, err := s3client.NewBackupS3Client(s3client.BackupS3ClientOptions{
+		Endpoint: server.URL,
+		Node:     "3",
+		Bucket:   "offsite",
+		Region:   "us-east-1",
+		S3Token:  "env:PANEL_S3_TOKEN",
+	})
+	require.NoError(t, err)
+	dir := s3client.DirDestination(t.TempDir())
+	state := s3client.NewReplicationState(filepath.Join(t.TempDir(), "replication.json"))
+	replicator := &s3client.Replicator{
+		Primary:  primary,
+		Replicas: []s3client.Replica{{Name: "nfs", Destination: dir}, {Name: "offsite", Destination: offsite}},
+		State:    state,
+	}
+
+	// uploads are fanned out to every destination
+	require.NoError(t, replicator.PutSnapshot(ctx, "age1abc/snap-1.tar", bytes.NewReader([]byte("snap-1"))))
+	require.NoError(t, replicator.Put(ctx, primary.KeyFileKey("k1.json"), bytes.NewReader([]byte("k1"))))
+	snapshotKey := "nodes/3/snapshots/age1abc/snap-1.tar"
+	require.Equal(t, []byte("snap-1"), server.Objects("backups")[snapshotKey])
+	require.Equal(t, []byte("snap-1"), server.Objects("offsite")[snapshotKey])
+	require.FileExists(t, filepath.Join(string(dir), snapshotKey))
+	objects, err := state.Objects()
+	require.NoError(t, err)
+	require.Len(t, objects, 2)
+	require.Equal(t, s3client.ReplicaStatusReplicated, objects[snapshotKey]["offsite"].Status)
+
+	// a failing replica does not fail the upload, but is recorded
+	server.DenyMethods = []string{http.MethodPut}
+	require.Error(t, replicator.PutSnapshot(ctx, "age1abc/snap-2.tar", bytes.NewReader([]byte("snap-2"))))
+	server.DenyMethods = nil
+	// a directory that cannot be created, as the root of the replica is a file
+	notDir := filepath.Join(t.TempDir(), "not-a-dir")
+	require.NoError(t, os.WriteFile(notDir, nil, 0600))
+	replicator.Replicas[0].Destination = s3client.DirDestination(notDir)
+	require.NoError(t, replicator.PutSnapshot(ctx, "age1abc/snap-3.tar", bytes.NewReader([]byte("snap-3"))))
+	replicator.Replicas[0].Destination = dir
+	objects, err = state.Objects()
+	require.NoError(t, err)
+	snap3 := objects["nodes/3/snapshots/age1abc/snap-3.tar"]
+	require.Equal(t, s3client.ReplicaStatusFailed, snap3["nfs"].Status)
+	require.NotEmpty(t, snap3["nfs"].Error)
+	require.Equal(t, s3client.ReplicaStatusReplicated, snap3["offsite"].Status)
+	require.Equal(t, s3client.ReplicaStatusReplicated, snap3[s3client.PrimaryName].Status)
+	summary, err := state.Summary([]string{"primary", "nfs", "offsite"})
+	require.NoError(t, err)
+	require.Equal(t, []s3client.DestinationSummary{
+		// snap-2 failed to upload at all
+		{Name: "primary", Replicated: 3, Failed: 1},
+		{Name: "nfs", Replicated: 2, Failed: 1, Missing: 1},
+		{Name: "offsite", Replicated: 3, Missing: 1},
+	}, summary.Destinations)
+	require.Len(t, summary.Pending, 2)
+
+	// reads fall back to the replicas
+	server.PutObject("offsite", "nodes/3/keys/only-offsite.json", []byte("offsite"))
+	body, err := replicator.Get(ctx, "nodes/3/keys/only-offsite.json")
+	require.NoError(t, err)
+	data, err := io.ReadAll(body)
+	require.NoError(t, err)
+	body.Close()
+	require.Equal(t, "offsite", string(data))
+	_, err = replicator.Get(ctx, "nodes/3/keys/missing.json")
+	require.True(t, s3client.IsNotFound(err), err)
+
+	// reconcile copies whatever is missing, in any direction
+	server.PutObject("backups", "nodes/3/keys/k2.json", []byte("k2"))
+	server.PutObject("backups", "nodes/4/keys/other-node.json", []byte("other"))
+	result, err := replicator.Reconcile(ctx, primary.NodePrefix())
+	require.NoError(t, err)
+	require.Empty(t, result.Failed)
+	require.Equal(t, 5, result.Objects)
+	require.ElementsMatch(t, []s3client.ReconcileCopy{
+		{Key: "nodes/3/keys/k2.json", From: "primary", To: "nfs"},
+		{Key: "nodes/3/keys/k2.json", From: "primary", To: "offsite"},
+		{Key: "nodes/3/keys/only-offsite.json", From: "offsite", To: "primary"},
+		{Key: "nodes/3/keys/only-offsite.json", From: "offsite", To: "nfs"},
+		{Key: "nodes/3/snapshots/age1abc/snap-3.tar", From: "primary", To: "nfs"},
+	}, result.Copied)
+	require.Equal(t, []byte("offsite"), server.Objects("backups")["nodes/3/keys/only-offsite.json"])
+	require.NotContains(t, server.Objects("offsite"), "nodes/4/keys/other-node.json")
+	data, err = os.ReadFile(filepath.Join(string(dir), "nodes/3/snapshots/age1abc/snap-3.tar"))
+	require.NoError(t, err)
+	require.Equal(t, "snap-3", string(data))
+
+	objects, err = state.Objects()
+	require.NoError(t, err)
+	require.Len(t, objects, 5)
+	for key, replicas := range objects {
+		require.Len(t, replicas, 3, key)
+		for name, replica := range replicas {
+			require.Equal(t, s3client.ReplicaStatusReplicated, replica.Status, key+" at "+name)
+		}
+	}
+
+	// everything is in place, and a destination that cannot be listed is reported
+	server.DenyMethods = []string{http.MethodGet}
+	result, err = replicator.Reconcile(ctx, primary.NodePrefix())
+	require.NoError(t, err)
+	require.Empty(t, result.Copied)
+	require.Len(t, result.Failed, 2)
+	require.Equal(t, "primary", result.Failed[0].Destination)
+	require.Empty(t, result.Failed[0].Key)
+}
+
+func keys(objects []s3client.Object) []string {
+	keys := []string{}
+	for _, obj := range objects {
+		keys = append(keys, obj.Key)
+	}
+	return keys
+}
@@ -0,0 +1,193 @@
+// Package s3test is a minimal in-memory S3 stand-in for tests, serving path-style requests
+// for the object operations the backup client uses.
+package s3test
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type object struct {
+	data     []byte
+	modified time.Time
+}
+
+type Server struct {
+	*httptest.Server
+	lock    sync.Mutex
+	buckets map[string]map[string]object
+
+	// If set, requests must be signed with this access key id
+	AccessKeyId string
+	// Methods that are refused with AccessDenied, e.g. to test a bucket without delete permission
+	DenyMethods []string
+	// Page size of object listings
+	MaxKeys int
+}
+
+func NewServer(buckets ...string) *Server {
+	s := &Server{buckets: map[string]map[string]object{}, MaxKeys: 1000}
+	for _, bucket := range buckets {
+		s.buckets[bucket] = map[string]object{}
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// The objects in a bucket, by key.
+func (s *Server) Objects(bucket string) map[string][]byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	objects := map[string][]byte{}
+	for key, obj := range s.buckets[bucket] {
+		objects[key] = obj.data
+	}
+	return objects
+}
+
+func (s *Server) PutObject(bucket string, key string, data []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = map[string]object{}
+	}
+	s.buckets[bucket][key] = object{data, time.Now().UTC()}
+}
+
+type errorResponse struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(errorResponse{Code: code, Message: message})
+}
+
+type listContents struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag"`
+	Size         int64     `xml:"Size"`
+}
+
+type listBucketResult struct {
+	XMLName     xml.Name       `xml:"ListBucketResult"`
+	Name        string         `xml:"Name"`
+	Prefix      string         `xml:"Prefix"`
+	Marker      string         `xml:"Marker"`
+	MaxKeys     int            `xml:"MaxKeys"`
+	IsTruncated bool           `xml:"IsTruncated"`
+	Contents    []listContents `xml:"Contents"`
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if s.AccessKeyId != "" && !strings.Contains(r.Header.Get("Authorization"), "Credential="+s.AccessKeyId+"/") {
+		writeError(w, http.StatusForbidden, "InvalidAccessKeyId", "the access key id does not exist")
+		return
+	}
+	if slices.Contains(s.DenyMethods, r.Method) {
+		writeError(w, http.StatusForbidden, "AccessDenied", "access denied")
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	objects, ok := s.buckets[bucket]
+	if key == "" && r.Method == http.MethodPut {
+		if !ok {
+			s.buckets[bucket] = map[string]object{}
+		}
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", fmt.Sprintf("bucket %s does not exist", bucket))
+		return
+	}
+	if key == "" {
+		s.list(w, r, bucket, objects)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		objects[key] = object{data, time.Now().UTC()}
+		w.Header().Set("ETag", etag(data))
+	case http.MethodGet, http.MethodHead:
+		obj, ok := objects[key]
+		if !ok {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			writeError(w, http.StatusNotFound, "NoSuchKey", fmt.Sprintf("key %s does not exist", key))
+			return
+		}
+		w.Header().Set("ETag", etag(obj.data))
+		w.Header().Set("Last-Modified", obj.modified.Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+		if r.Method == http.MethodGet {
+			w.Write(obj.data)
+		}
+	case http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+	}
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request, bucket string, objects map[string]object) {
+	query := r.URL.Query()
+	result := listBucketResult{
+		Name:    bucket,
+		Prefix:  query.Get("prefix"),
+		Marker:  query.Get("marker"),
+		MaxKeys: s.MaxKeys,
+	}
+	keys := []string{}
+	for key := range objects {
+		if strings.HasPrefix(key, result.Prefix) && key > result.Marker {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	if len(keys) > s.MaxKeys {
+		keys = keys[:s.MaxKeys]
+		result.IsTruncated = true
+	}
+	for _, key := range keys {
+		obj := objects[key]
+		result.Contents = append(result.Contents, listContents{
+			Key:          key,
+			LastModified: obj.modified,
+			ETag:         etag(obj.data),
+			Size:         int64(len(obj.data)),
+		})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
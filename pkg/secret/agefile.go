@@ -0,0 +1,112 @@
+package secret
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// Prefix of age X25519 identities, which are used directly instead of as a passphrase.
+const ageIdentityPrefix = "AGE-SECRET-KEY-1"
+
+// Work factor for passphrase-protected age files, which are read rarely (e.g. on start).
+const ageFileWorkFactor = 18
+
+// The recipient and identity for an age key: an X25519 identity, or otherwise a passphrase.
+func parseAgeKey(key string, workFactor int) (age.Recipient, age.Identity, error) {
+	if strings.HasPrefix(key, ageIdentityPrefix) {
+		identity, err := age.ParseX25519Identity(key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid age identity: %v", err)
+		}
+		return identity.Recipient(), identity, nil
+	}
+	recipient, err := age.NewScryptRecipient(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	recipient.SetWorkFactor(workFactor)
+	identity, err := age.NewScryptIdentity(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return recipient, identity, nil
+}
+
+// Create an age file secret reference, for a file encrypted to the identity held in another secret.
+func NewAgeFileSecret(path string, identity Secret) (Secret, error) {
+	identityRef, err := identity.Ref()
+	if err != nil {
+		return "", fmt.Errorf("invalid %s identity reference: %v", AgeFile, err)
+	}
+	ref := Ref{Type: AgeFile, Path: path, Identity: &identityRef}
+	if err := ref.Validate(); err != nil {
+		return "", err
+	}
+	return ref.Secret(), nil
+}
+
+func loadAgeFileKey(identity Ref) (age.Recipient, age.Identity, error) {
+	key, err := identity.Load()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load %s identity: %v", AgeFile, err)
+	}
+	if key == "" {
+		return nil, nil, fmt.Errorf("%s identity resolved to an empty value", AgeFile)
+	}
+	return parseAgeKey(key, ageFileWorkFactor)
+}
+
+func readAgeFile(ref Ref) (string, error) {
+	path := replaceTilda(ref.Path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	_, identity, err := loadAgeFileKey(*ref.Identity)
+	if err != nil {
+		return "", err
+	}
+	reader, err := age.Decrypt(bytes.NewReader(data), identity)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt %s: %v", path, err)
+	}
+	value, err := io.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(value)), nil
+}
+
+func storeAgeFile(ref Ref, value string) error {
+	recipient, _, err := loadAgeFileKey(*ref.Identity)
+	if err != nil {
+		return err
+	}
+	return SealAgeFile(ref.Path, recipient, value)
+}
+
+// Encrypt the value to the recipient and write it to the path (mode 0600).  Only the recipient
+// is needed, so a file can be sealed for an identity that is not available here.
+func SealAgeFile(path string, recipient age.Recipient, value string) error {
+	if value == "" {
+		return errors.New("cannot store an empty secret")
+	}
+	var buf bytes.Buffer
+	writer, err := age.Encrypt(&buf, recipient)
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write([]byte(value)); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return writeFileAtomic(replaceTilda(path), buf.Bytes())
+}
@@ -0,0 +1,69 @@
+package secret_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/cordialsys/panel/pkg/secret"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAgeFileIdentity(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	credentials := t.TempDir()
+	t.Setenv(secret.ENV_CREDENTIALS_DIRECTORY, credentials)
+	require.NoError(t, os.WriteFile(filepath.Join(credentials, "panel.age-identity"), []byte(identity.String()+"\n"), 0400))
+
+	path := filepath.Join(t.TempDir(), "ear.age")
+	ref, err := secret.NewAgeFileSecret(path, "creds:panel.age-identity")
+	require.NoError(t, err)
+	require.Equal(t, secret.Secret("agefile:"+path+",creds:panel.age-identity"), ref)
+
+	require.NoError(t, ref.Store("phrase one"))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "phrase one")
+	stat, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+
+	value, err := ref.Load()
+	require.NoError(t, err)
+	require.Equal(t, "phrase one", value)
+
+	// sealed with only the recipient
+	require.NoError(t, secret.SealAgeFile(path, identity.Recipient(), "phrase two"))
+	value, err = ref.Load()
+	require.NoError(t, err)
+	require.Equal(t, "phrase two", value)
+
+	// a different identity cannot open it
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(credentials, "panel.other-identity"), []byte(other.String()), 0400))
+	_, err = secret.Secret("agefile:" + path + ",creds:panel.other-identity").Load()
+	require.ErrorContains(t, err, "failed to decrypt")
+}
+
+func TestAgeFilePassphrase(t *testing.T) {
+	t.Setenv("PANEL_TEST_PASSPHRASE", "correct horse battery staple")
+	path := filepath.Join(t.TempDir(), "ear.age")
+	ref := secret.Secret("agefile:" + path + ",env:PANEL_TEST_PASSPHRASE")
+
+	require.NoError(t, ref.Store("phrase one"))
+	value, err := ref.Load()
+	require.NoError(t, err)
+	require.Equal(t, "phrase one", value)
+}
+
+func TestAgeFileInvalid(t *testing.T) {
+	_, err := secret.NewAgeFileSecret("/tmp/ear.age", "")
+	require.Error(t, err)
+	_, err = secret.NewAgeFileSecret("/tmp/ear.age", "agefile:/tmp/other.age,env:KEY")
+	require.Error(t, err)
+	_, err = secret.Secret("agefile:/tmp/ear.age").Load()
+	require.ErrorContains(t, err, "2 comma separated arguments")
+}
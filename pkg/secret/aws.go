@@ -0,0 +1,145 @@
+package secret
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	awssecretmanager "github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+)
+
+func loadAwsConfig(ctx context.Context, region string) (aws.Config, error) {
+	awsArgs := []func(*config.LoadOptions) error{}
+	if region != "" {
+		awsArgs = append(awsArgs, config.WithRegion(region))
+	}
+	return config.LoadDefaultConfig(ctx, awsArgs...)
+}
+
+func newAwsClient(ctx context.Context, region string) (*awssecretmanager.Client, error) {
+	cfg, err := loadAwsConfig(ctx, region)
+	if err != nil {
+		return nil, err
+	}
+	return awssecretmanager.NewFromConfig(cfg), nil
+}
+
+// Overridable for testing against a local stand-in.
+var NewAwsClient = newAwsClient
+
+// A secret holds either a string or binary value.
+func awsSecretValue(result *awssecretmanager.GetSecretValueOutput) (string, error) {
+	if result.SecretString != nil {
+		return *result.SecretString, nil
+	}
+	if result.SecretBinary != nil {
+		return string(result.SecretBinary), nil
+	}
+	return "", fmt.Errorf("%s secret %s has no value", AwsSecretManager, aws.ToString(result.Name))
+}
+
+func loadAwsSecret(ref Ref) (string, error) {
+	secretName, keyName, version := ref.Name, ref.Key, ref.Version
+	if version == "" {
+		version = "AWSCURRENT"
+	}
+	svc, err := NewAwsClient(context.Background(), ref.Region)
+	if err != nil {
+		return "", err
+	}
+	input := &awssecretmanager.GetSecretValueInput{
+		SecretId:     aws.String(secretName),
+		VersionStage: aws.String(version),
+	}
+	result, err := svc.GetSecretValue(context.Background(), input)
+	if err != nil {
+		// https://docs.aws.amazon.com/secretsmanager/latest/apireference/API_GetSecretValue.html
+		return "", err
+	}
+	secretBz, err := awsSecretValue(result)
+	if err != nil {
+		return "", err
+	}
+	if keyName != "" {
+		// Another layer of nesting to unwrap, this time JSON
+		secretData := map[string]interface{}{}
+		err = json.Unmarshal([]byte(secretBz), &secretData)
+		if err != nil {
+			// do not omit internal error to guard from leaking anything sensitive
+			return "", fmt.Errorf("could not retrieve %s key because %s has invalid JSON", keyName, secretName)
+		}
+		secretValue, ok := secretData[keyName]
+		if !ok {
+			return "", fmt.Errorf("could not find %s key in %s JSON", keyName, secretName)
+		}
+		return fmt.Sprint(secretValue), nil
+	}
+	// return secretBz literally as the secret, no JSON nesting
+	return secretBz, nil
+}
+
+// Put a new (AWSCURRENT) version of the secret, creating the secret if it does not exist yet.
+// If a key is set, only that key of the secret's JSON is replaced.
+func storeAwsSecret(ref Ref, value string) error {
+	secretName, keyName, region := ref.Name, ref.Key, ref.Region
+	if ref.Version != "" && ref.Version != "AWSCURRENT" {
+		return fmt.Errorf("cannot store to a pinned %s secret version", AwsSecretManager)
+	}
+	ctx := context.Background()
+	svc, err := NewAwsClient(ctx, region)
+	if err != nil {
+		return err
+	}
+
+	exists := true
+	current, err := svc.GetSecretValue(ctx, &awssecretmanager.GetSecretValueInput{
+		SecretId: aws.String(secretName),
+	})
+	var notFound *types.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		exists = false
+	} else if err != nil {
+		return err
+	}
+
+	secretString := value
+	if keyName != "" {
+		secretData := map[string]interface{}{}
+		if exists {
+			currentBz, _ := awsSecretValue(current)
+			if err := json.Unmarshal([]byte(currentBz), &secretData); err != nil && currentBz != "" {
+				// do not omit internal error to guard from leaking anything sensitive
+				return fmt.Errorf("could not update %s key because %s has invalid JSON", keyName, secretName)
+			}
+		}
+		secretData[keyName] = value
+		secretBz, err := json.Marshal(secretData)
+		if err != nil {
+			return err
+		}
+		secretString = string(secretBz)
+	}
+
+	if !exists {
+		_, err = svc.CreateSecret(ctx, &awssecretmanager.CreateSecretInput{
+			Name:         aws.String(secretName),
+			SecretString: aws.String(secretString),
+		})
+		return err
+	}
+	input := &awssecretmanager.PutSecretValueInput{
+		SecretId: aws.String(secretName),
+	}
+	if current.SecretString == nil && current.SecretBinary != nil {
+		// keep a binary secret binary
+		input.SecretBinary = []byte(secretString)
+	} else {
+		input.SecretString = aws.String(secretString)
+	}
+	_, err = svc.PutSecretValue(ctx, input)
+	return err
+}
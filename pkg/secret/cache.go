@@ -0,0 +1,141 @@
+package secret
+
+import (
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cordialsys/panel/pkg/plog"
+)
+
+// Types resolved over the network, which are cached by a `Resolver`.  Local types are always
+// read directly, so changes to them take effect immediately.
+var CachedTypes = []SecretType{Vault, GcpSecretManager, AwsSecretManager, Kms}
+
+// If set, `Secret.Load` resolves cached types through it.  Set by `panel start`.
+var DefaultResolver *Resolver
+
+// How long past its TTL a cached value may be used while reloading fails.
+const DefaultMaxStale = time.Hour
+
+type cacheEntry struct {
+	value     *lockedBuffer
+	loadTime  time.Time
+	expiresAt time.Time
+	// Unregisters the value from redaction
+	unregister func()
+}
+
+// Zero the value, which is then no longer redacted unless registered elsewhere.
+func (e *cacheEntry) destroy() {
+	e.value.Destroy()
+	e.unregister()
+}
+
+// Caches resolved secrets for a TTL, so that repeated loads (e.g. the EAR phrase for every
+// `cord` invocation) do not each need a round trip to the secret manager.
+type Resolver struct {
+	// How long a value is used before it is loaded again
+	TTL time.Duration
+	// Use the last value if reloading fails, e.g. while the secret manager is unreachable
+	StaleOnError bool
+	// Stop using the last value this long after it expired, so a revoked secret is not used forever
+	MaxStale time.Duration
+	// Called when a reload returns a different value than the cached one
+	OnChange func(ref Secret)
+
+	lock    sync.Mutex
+	entries map[Secret]*cacheEntry
+}
+
+func NewResolver(ttl time.Duration) *Resolver {
+	return &Resolver{
+		TTL:      ttl,
+		MaxStale: DefaultMaxStale,
+		entries:  map[Secret]*cacheEntry{},
+	}
+}
+
+func (r *Resolver) caches(ref Secret) bool {
+	secretType, _ := ref.Type()
+	return slices.Contains(CachedTypes, secretType)
+}
+
+func (r *Resolver) Load(ref Secret) (string, error) {
+	r.lock.Lock()
+	entry, ok := r.entries[ref]
+	if ok && time.Now().Before(entry.expiresAt) {
+		value := entry.value.String()
+		r.lock.Unlock()
+		return value, nil
+	}
+	r.lock.Unlock()
+
+	// not holding the lock, so an unreachable backend does not block other secrets
+	return r.reload(ref)
+}
+
+func (r *Resolver) reload(ref Secret) (string, error) {
+	value, err := GetSecret(string(ref))
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	previous, ok := r.entries[ref]
+	if err != nil {
+		if ok && r.StaleOnError {
+			if time.Since(previous.expiresAt) < r.MaxStale {
+				slog.Warn("failed to reload secret, using the cached value",
+					"type", ref.typeOf(), "age", time.Since(previous.loadTime).Round(time.Second), "error", err)
+				return previous.value.String(), nil
+			}
+			// too stale to be used again
+			previous.destroy()
+			delete(r.entries, ref)
+		}
+		return "", err
+	}
+	unregister := plog.AddSecret(value)
+
+	buffer, err := newLockedBuffer(value)
+	if err != nil {
+		// not cached, so stays registered
+		// caching is best effort
+		slog.Warn("failed to cache secret", "type", ref.typeOf(), "error", err)
+		return value, nil
+	}
+	changed := ok && !previous.value.Equal(value)
+	if ok {
+		previous.destroy()
+	}
+	now := time.Now()
+	r.entries[ref] = &cacheEntry{value: buffer, loadTime: now, expiresAt: now.Add(r.TTL), unregister: unregister}
+	if changed && r.OnChange != nil {
+		r.OnChange(ref)
+	}
+	return value, nil
+}
+
+// Drop the cached value, e.g. after the panel has stored a new one.
+func (r *Resolver) Forget(ref Secret) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if entry, ok := r.entries[ref]; ok {
+		entry.destroy()
+		delete(r.entries, ref)
+	}
+}
+
+// Zero and drop all cached values, e.g. when the panel shuts down.
+func (r *Resolver) Purge() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for ref, entry := range r.entries {
+		entry.destroy()
+		delete(r.entries, ref)
+	}
+}
+
+func (s Secret) typeOf() string {
+	secretType, _ := s.Type()
+	return string(secretType)
+}
@@ -0,0 +1,152 @@
+package secret_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cordialsys/panel/pkg/plog"
+	"github.com/cordialsys/panel/pkg/secret"
+	vault "github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/require"
+)
+
+// A vault stand-in counting reads, whose value and availability can be changed.
+type countingVault struct {
+	lock  sync.Mutex
+	value string
+	down  bool
+	reads int
+}
+
+var _ secret.VaultStorer = &countingVault{}
+
+func (v *countingVault) LoadSecretData(path string) (*vault.Secret, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.reads++
+	if v.down {
+		return nil, errors.New("connection refused")
+	}
+	return &vault.Secret{Data: map[string]interface{}{"data": map[string]interface{}{"ear": v.value}}}, nil
+}
+
+func (v *countingVault) StoreSecretData(path string, data map[string]interface{}) (*vault.Secret, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.value = data["data"].(map[string]interface{})["ear"].(string)
+	return &vault.Secret{}, nil
+}
+
+func setupResolver(t *testing.T, ttl time.Duration) (*countingVault, *secret.Resolver) {
+	fake := &countingVault{value: "phrase one"}
+	secret.NewVaultClient = func(cfg *vault.Config) (secret.VaultLoader, error) {
+		return fake, nil
+	}
+	resolver := secret.NewResolver(ttl)
+	secret.DefaultResolver = resolver
+	t.Cleanup(func() {
+		resolver.Purge()
+		secret.DefaultResolver = nil
+	})
+	return fake, resolver
+}
+
+func TestResolverCaches(t *testing.T) {
+	fake, _ := setupResolver(t, time.Hour)
+	ref := secret.Secret("vault:https://vault.example.com,secret/data/panel/ear")
+
+	for range 3 {
+		value, err := ref.Load()
+		require.NoError(t, err)
+		require.Equal(t, "phrase one", value)
+	}
+	require.Equal(t, 1, fake.reads)
+
+	// storing through the panel replaces the cached value, without a change event
+	require.NoError(t, ref.Store("phrase two"))
+	value, err := ref.Load()
+	require.NoError(t, err)
+	require.Equal(t, "phrase two", value)
+
+	// local secrets are not cached
+	t.Setenv("PANEL_TEST_SECRET", "one")
+	value, err = secret.Secret("env:PANEL_TEST_SECRET").Load()
+	require.NoError(t, err)
+	require.Equal(t, "one", value)
+	t.Setenv("PANEL_TEST_SECRET", "two")
+	value, err = secret.Secret("env:PANEL_TEST_SECRET").Load()
+	require.NoError(t, err)
+	require.Equal(t, "two", value)
+}
+
+func TestResolverDetectsChanges(t *testing.T) {
+	fake, resolver := setupResolver(t, time.Millisecond)
+	changed := []secret.Secret{}
+	resolver.OnChange = func(ref secret.Secret) {
+		changed = append(changed, ref)
+	}
+	ref := secret.Secret("vault:https://vault.example.com,secret/data/panel/ear")
+
+	_, err := ref.Load()
+	require.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+	_, err = ref.Load()
+	require.NoError(t, err)
+	require.Empty(t, changed)
+
+	fake.lock.Lock()
+	fake.value = "rotated elsewhere"
+	fake.lock.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	value, err := ref.Load()
+	require.NoError(t, err)
+	require.Equal(t, "rotated elsewhere", value)
+	require.Equal(t, []secret.Secret{ref}, changed)
+	require.Equal(t, plog.Redacted, plog.Redact(value))
+
+	// the replaced value is no longer redacted, once its buffer is destroyed
+	fake.lock.Lock()
+	fake.value = "rotated once more"
+	fake.lock.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	_, err = ref.Load()
+	require.NoError(t, err)
+	require.Equal(t, "rotated elsewhere", plog.Redact("rotated elsewhere"))
+	resolver.Purge()
+	require.Equal(t, "rotated once more", plog.Redact("rotated once more"))
+}
+
+func TestResolverStaleOnError(t *testing.T) {
+	fake, resolver := setupResolver(t, time.Millisecond)
+	ref := secret.Secret("vault:https://vault.example.com,secret/data/panel/ear")
+	_, err := ref.Load()
+	require.NoError(t, err)
+
+	fake.lock.Lock()
+	fake.down = true
+	fake.lock.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	_, err = ref.Load()
+	require.ErrorContains(t, err, "connection refused")
+
+	resolver.StaleOnError = true
+	value, err := ref.Load()
+	require.NoError(t, err)
+	require.Equal(t, "phrase one", value)
+
+	// but not for longer than the max stale
+	resolver.MaxStale = 10 * time.Millisecond
+	time.Sleep(20 * time.Millisecond)
+	_, err = ref.Load()
+	require.ErrorContains(t, err, "connection refused")
+	resolver.MaxStale = secret.DefaultMaxStale
+	_, err = ref.Load()
+	require.Error(t, err)
+
+	// nothing to fall back to
+	resolver.Purge()
+	_, err = ref.Load()
+	require.Error(t, err)
+}
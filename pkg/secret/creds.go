@@ -0,0 +1,48 @@
+package secret
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// systemd credentials (LoadCredential=, LoadCredentialEncrypted=, ImportCredential=) are
+// decrypted by systemd into a directory private to the service, named by this variable.
+const ENV_CREDENTIALS_DIRECTORY = "CREDENTIALS_DIRECTORY"
+
+func credentialPath(name string) (string, error) {
+	dir := os.Getenv(ENV_CREDENTIALS_DIRECTORY)
+	if dir == "" {
+		return "", fmt.Errorf("no systemd credentials are available, $%s is not set (see LoadCredential= and ImportCredential=)", ENV_CREDENTIALS_DIRECTORY)
+	}
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", fmt.Errorf("invalid credential name %q", name)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// Whether the service was started with the named credential.
+func HasCredential(name string) bool {
+	path, err := credentialPath(name)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+func readCredential(name string) (string, error) {
+	path, err := credentialPath(name)
+	if err != nil {
+		return "", err
+	}
+	value, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("systemd credential %q was not passed to this service", name)
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(value)), nil
+}
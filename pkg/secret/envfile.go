@@ -0,0 +1,84 @@
+package secret
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Read a file of KEY=VALUE lines, as used by systemd's EnvironmentFile.
+func readEnvFile(path string) (map[string]string, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		values[strings.TrimSpace(key)] = strings.Trim(strings.TrimSpace(value), `"'`)
+	}
+	return values, nil
+}
+
+// Set a single variable in an environment file, keeping the other lines as they are.
+func storeEnvFile(path string, name string, value string) error {
+	if strings.ContainsAny(value, "\n\r") {
+		return fmt.Errorf("%s secret value may not contain newlines", EnvFile)
+	}
+	lines := []string{}
+	contents, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(contents) > 0 {
+		lines = strings.Split(strings.TrimRight(string(contents), "\n"), "\n")
+	}
+	entry := fmt.Sprintf("%s=%s", name, value)
+	replaced := false
+	for i, line := range lines {
+		key, _, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if ok && strings.TrimSpace(key) == name {
+			lines[i] = entry
+			replaced = true
+		}
+	}
+	if !replaced {
+		lines = append(lines, entry)
+	}
+	return writeFileAtomic(path, []byte(strings.Join(lines, "\n")+"\n"))
+}
+
+// Write a private file via a rename, so readers never see a partially written secret.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// CreateTemp uses 0600 already, but keep an existing file's mode and (if permitted) owner
+	if stat, err := os.Stat(path); err == nil {
+		if err := os.Chmod(tmp.Name(), stat.Mode().Perm()); err != nil {
+			return err
+		}
+		if sys, ok := stat.Sys().(*syscall.Stat_t); ok {
+			_ = os.Chown(tmp.Name(), int(sys.Uid), int(sys.Gid))
+		}
+	}
+	return os.Rename(tmp.Name(), path)
+}
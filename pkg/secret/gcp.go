@@ -0,0 +1,113 @@
+package secret
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Regional secrets are only served by the endpoint of their location.
+func newGcpClient(ctx context.Context, location string) (*secretmanager.Client, error) {
+	if location != "" {
+		return secretmanager.NewClient(ctx, option.WithEndpoint(fmt.Sprintf("secretmanager.%s.rep.googleapis.com:443", location)))
+	}
+	return secretmanager.NewClient(ctx)
+}
+
+// Overridable for testing against a local stand-in.
+var NewGcpClient = newGcpClient
+
+// GCP payloads carry a CRC32C checksum to detect corruption in transit.
+func crc32c(data []byte) int64 {
+	return int64(crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+}
+
+// The resource name of the project, or of the location for a regional secret.
+func (r Ref) gcpParent() string {
+	if r.Location != "" {
+		return fmt.Sprintf("projects/%s/locations/%s", r.Project, r.Location)
+	}
+	return "projects/" + r.Project
+}
+
+func (r Ref) gcpSecretName() string {
+	return r.gcpParent() + "/secrets/" + r.Name
+}
+
+// Access the version directly by its resource name, which only needs
+// `secretmanager.versions.access` on the secret.
+func loadGcpSecret(ref Ref) (string, error) {
+	version := ref.Version
+	if version == "" {
+		version = "latest"
+	}
+	ctx := context.Background()
+	client, err := NewGcpClient(ctx, ref.Location)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	resp, err := client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{
+		Name: ref.gcpSecretName() + "/versions/" + version,
+	})
+	if err != nil {
+		return "", err
+	}
+	payload := resp.GetPayload()
+	if payload.DataCrc32C != nil && *payload.DataCrc32C != crc32c(payload.Data) {
+		return "", fmt.Errorf("%s secret %s failed its checksum", GcpSecretManager, ref.Name)
+	}
+	return string(payload.Data), nil
+}
+
+// Add a new version of the secret, creating the secret if it does not exist yet.
+func storeGcpSecret(ref Ref, value string) error {
+	if ref.Version != "" {
+		return fmt.Errorf("cannot store to a pinned %s secret version", GcpSecretManager)
+	}
+	ctx := context.Background()
+	client, err := NewGcpClient(ctx, ref.Location)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	addVersion := func() error {
+		data := []byte(value)
+		checksum := crc32c(data)
+		_, err := client.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
+			Parent:  ref.gcpSecretName(),
+			Payload: &secretmanagerpb.SecretPayload{Data: data, DataCrc32C: &checksum},
+		})
+		return err
+	}
+	err = addVersion()
+	if status.Code(err) != codes.NotFound {
+		return err
+	}
+	newSecret := &secretmanagerpb.Secret{}
+	if ref.Location == "" {
+		// regional secrets are stored in their location, and take no replication policy
+		newSecret.Replication = &secretmanagerpb.Replication{
+			Replication: &secretmanagerpb.Replication_Automatic_{
+				Automatic: &secretmanagerpb.Replication_Automatic{},
+			},
+		}
+	}
+	_, err = client.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{
+		Parent:   ref.gcpParent(),
+		SecretId: ref.Name,
+		Secret:   newSecret,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create %s secret %s: %v", GcpSecretManager, ref.Name, err)
+	}
+	return addVersion()
+}
@@ -0,0 +1,265 @@
+package secret
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+	"github.com/cordialsys/panel/pkg/paths"
+	"github.com/cordialsys/panel/pkg/plog"
+)
+
+// The panel directory holding the keyring used to resolve `keyring:<id>` secrets.
+// Set by `panel start --panel-dir`.
+var KeyringHome = paths.PanelHome("/etc/panel")
+
+// The keyring key is loaded on every access, so a modest work factor is used for passphrases.
+const keyringWorkFactor = 15
+
+var keyringIdRegex = regexp.MustCompile(`^[A-Za-z0-9_.\-]+$`)
+
+// Serializes read-modify-write of the keyring file within the process.
+var keyringLock sync.Mutex
+
+// Configuration of the keyring.  This file itself is never encrypted, as it is needed to
+// find the key.
+type KeyringConfig struct {
+	// Secret holding the key: an age identity (AGE-SECRET-KEY-1...), or otherwise a passphrase.
+	Key Secret `json:"key"`
+}
+
+type KeyringEntry struct {
+	Id         string    `json:"id"`
+	Value      string    `json:"value,omitempty"`
+	CreateTime time.Time `json:"create_time"`
+	UpdateTime time.Time `json:"update_time"`
+}
+
+func validateKeyringId(id string) error {
+	if !keyringIdRegex.MatchString(id) {
+		return fmt.Errorf("invalid keyring id %q, may only contain letters, digits, '_', '.' and '-'", id)
+	}
+	return nil
+}
+
+func LoadKeyringConfig(home paths.PanelHome) (*KeyringConfig, error) {
+	configBz, err := os.ReadFile(home.KeyringConfigFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no keyring in %s, create one with `panel keyring add --key <secret>`", home)
+		}
+		return nil, err
+	}
+	var config KeyringConfig
+	if err := json.Unmarshal(configBz, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", home.KeyringConfigFile(), err)
+	}
+	return &config, nil
+}
+
+// Create the keyring, unlocked by the given secret.  It is not an error if the keyring already
+// exists with the same key.
+func InitKeyring(home paths.PanelHome, key Secret) error {
+	if _, ok := key.Type(); !ok {
+		return fmt.Errorf("invalid keyring key, must be one of %v", Types)
+	}
+	if key.IsType(Keyring) {
+		return errors.New("the keyring key cannot itself be stored in the keyring")
+	}
+	// the config is kept in the clear next to the keyring
+	if key.IsPlaintextAtRest() {
+		return fmt.Errorf("%s type secret is not allowed for the keyring key", key.typeOf())
+	}
+	keyringLock.Lock()
+	defer keyringLock.Unlock()
+
+	if existing, err := LoadKeyringConfig(home); err == nil {
+		if existing.Key != key {
+			return fmt.Errorf("keyring in %s already exists with a different key", home)
+		}
+		return nil
+	}
+	config := &KeyringConfig{Key: key}
+	// check the key before writing anything
+	if _, err := config.loadKey(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(home.String(), 0755); err != nil {
+		return err
+	}
+	if err := config.write(home, []KeyringEntry{}); err != nil {
+		return err
+	}
+	configBz, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(home.KeyringConfigFile(), configBz)
+}
+
+func (config *KeyringConfig) loadKey() (string, error) {
+	if config.Key == "" {
+		return "", errors.New("keyring has no key configured")
+	}
+	key, err := config.Key.Load()
+	if err != nil {
+		return "", fmt.Errorf("failed to load keyring key: %v", err)
+	}
+	if key == "" {
+		return "", errors.New("keyring key resolved to an empty value")
+	}
+	return key, nil
+}
+
+func (config *KeyringConfig) recipient() (age.Recipient, age.Identity, error) {
+	key, err := config.loadKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	return parseAgeKey(key, keyringWorkFactor)
+}
+
+func (config *KeyringConfig) read(home paths.PanelHome) ([]KeyringEntry, error) {
+	data, err := os.ReadFile(home.KeyringFile())
+	if err != nil {
+		return nil, err
+	}
+	_, identity, err := config.recipient()
+	if err != nil {
+		return nil, err
+	}
+	reader, err := age.Decrypt(bytes.NewReader(data), identity)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt keyring: %v", err)
+	}
+	plaintext, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	entries := []KeyringEntry{}
+	if err := json.Unmarshal(plaintext, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse keyring: %v", err)
+	}
+	return entries, nil
+}
+
+func (config *KeyringConfig) write(home paths.PanelHome, entries []KeyringEntry) error {
+	recipient, _, err := config.recipient()
+	if err != nil {
+		return err
+	}
+	plaintext, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	writer, err := age.Encrypt(&buf, recipient)
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(plaintext); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return writeFileAtomic(home.KeyringFile(), buf.Bytes())
+}
+
+// List the keyring entries, without their values.
+func ListKeyring(home paths.PanelHome) ([]KeyringEntry, error) {
+	config, err := LoadKeyringConfig(home)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := config.read(home)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		entries[i].Value = ""
+	}
+	return entries, nil
+}
+
+// Add an entry to the keyring, replacing any existing entry with the same id.
+func AddKeyringEntry(home paths.PanelHome, id string, value string) error {
+	if err := validateKeyringId(id); err != nil {
+		return err
+	}
+	if value == "" {
+		return errors.New("cannot store an empty secret")
+	}
+	config, err := LoadKeyringConfig(home)
+	if err != nil {
+		return err
+	}
+	keyringLock.Lock()
+	defer keyringLock.Unlock()
+
+	entries, err := config.read(home)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	index := slices.IndexFunc(entries, func(entry KeyringEntry) bool { return entry.Id == id })
+	if index == -1 {
+		entries = append(entries, KeyringEntry{Id: id, Value: value, CreateTime: now, UpdateTime: now})
+	} else {
+		entries[index].Value = value
+		entries[index].UpdateTime = now
+	}
+	if err := config.write(home, entries); err != nil {
+		return err
+	}
+	plog.AddSecret(value)
+	return nil
+}
+
+// Remove an entry from the keyring.
+func RemoveKeyringEntry(home paths.PanelHome, id string) error {
+	config, err := LoadKeyringConfig(home)
+	if err != nil {
+		return err
+	}
+	keyringLock.Lock()
+	defer keyringLock.Unlock()
+
+	entries, err := config.read(home)
+	if err != nil {
+		return err
+	}
+	index := slices.IndexFunc(entries, func(entry KeyringEntry) bool { return entry.Id == id })
+	if index == -1 {
+		return fmt.Errorf("keyring has no entry %q", id)
+	}
+	return config.write(home, slices.Delete(entries, index, index+1))
+}
+
+func getKeyringEntry(home paths.PanelHome, id string) (string, error) {
+	if err := validateKeyringId(id); err != nil {
+		return "", err
+	}
+	config, err := LoadKeyringConfig(home)
+	if err != nil {
+		return "", err
+	}
+	entries, err := config.read(home)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if entry.Id == id {
+			return entry.Value, nil
+		}
+	}
+	return "", fmt.Errorf("keyring has no entry %q", id)
+}
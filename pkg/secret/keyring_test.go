@@ -0,0 +1,105 @@
+package secret_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/cordialsys/panel/pkg/paths"
+	"github.com/cordialsys/panel/pkg/secret"
+	"github.com/stretchr/testify/require"
+)
+
+func setupKeyring(t *testing.T, key string) paths.PanelHome {
+	home := paths.PanelHome(t.TempDir())
+	credentials := t.TempDir()
+	t.Setenv(secret.ENV_CREDENTIALS_DIRECTORY, credentials)
+	require.NoError(t, os.WriteFile(filepath.Join(credentials, "keyring-key"), []byte(key), 0400))
+	require.NoError(t, secret.InitKeyring(home, secret.Secret("creds:keyring-key")))
+
+	previous := secret.KeyringHome
+	secret.KeyringHome = home
+	t.Cleanup(func() { secret.KeyringHome = previous })
+	return home
+}
+
+func TestKeyringPassphrase(t *testing.T) {
+	home := setupKeyring(t, "correct horse battery staple")
+
+	require.NoError(t, secret.AddKeyringEntry(home, "ear", "phrase one"))
+	require.NoError(t, secret.AddKeyringEntry(home, "api-key", "key-id:key-secret"))
+
+	value, err := secret.Secret("keyring:ear").Load()
+	require.NoError(t, err)
+	require.Equal(t, "phrase one", value)
+	value, err = secret.Secret("keyring:api-key").Load()
+	require.NoError(t, err)
+	require.Equal(t, "key-id:key-secret", value)
+
+	// values are not stored in the clear
+	data, err := os.ReadFile(home.KeyringFile())
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "phrase one")
+	stat, err := os.Stat(home.KeyringFile())
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+
+	entries, err := secret.ListKeyring(home)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	for _, entry := range entries {
+		require.Empty(t, entry.Value)
+	}
+
+	// rotate via the generic secret interface
+	previous, err := secret.Secret("keyring:ear").Rotate("phrase two")
+	require.NoError(t, err)
+	require.Equal(t, "phrase one", previous)
+	value, err = secret.Secret("keyring:ear").Load()
+	require.NoError(t, err)
+	require.Equal(t, "phrase two", value)
+
+	require.NoError(t, secret.RemoveKeyringEntry(home, "ear"))
+	_, err = secret.Secret("keyring:ear").Load()
+	require.ErrorContains(t, err, "no entry")
+	require.Error(t, secret.RemoveKeyringEntry(home, "ear"))
+}
+
+func TestKeyringAgeIdentity(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	home := setupKeyring(t, identity.String())
+
+	require.NoError(t, secret.AddKeyringEntry(home, "ear", "phrase one"))
+	value, err := secret.Secret("keyring:ear").Load()
+	require.NoError(t, err)
+	require.Equal(t, "phrase one", value)
+}
+
+func TestKeyringErrors(t *testing.T) {
+	home := setupKeyring(t, "correct horse battery staple")
+
+	require.ErrorContains(t, secret.AddKeyringEntry(home, "bad,id", "value"), "invalid keyring id")
+	require.Error(t, secret.AddKeyringEntry(home, "empty", ""))
+
+	// the keyring cannot be unlocked by itself, or re-keyed in place
+	require.Error(t, secret.InitKeyring(home, secret.Secret("keyring:other")))
+	// nor by a key kept in the clear beside it
+	require.ErrorContains(t, secret.InitKeyring(paths.PanelHome(t.TempDir()), secret.NewRawSecret("passphrase")), "not allowed")
+	require.ErrorContains(t, secret.InitKeyring(paths.PanelHome(t.TempDir()), secret.Secret("file:/etc/keyring.key")), "not allowed")
+	require.ErrorContains(t, secret.InitKeyring(paths.PanelHome(t.TempDir()), secret.Secret("envfile:/etc/panel.env,KEYRING_KEY")), "not allowed")
+	require.ErrorContains(t, secret.InitKeyring(paths.PanelHome(t.TempDir()), secret.Secret("env:KEYRING_KEY")), "not allowed")
+	require.ErrorContains(t, secret.InitKeyring(home, secret.Secret("creds:other-key")), "different key")
+
+	// the wrong key cannot open it
+	wrongKey := filepath.Join(t.TempDir(), "wrong.key")
+	require.NoError(t, os.WriteFile(wrongKey, []byte("wrong passphrase"), 0600))
+	require.NoError(t, os.WriteFile(home.KeyringConfigFile(), []byte(`{"key":"file:`+wrongKey+`"}`), 0600))
+	_, err := secret.Secret("keyring:ear").Load()
+	require.ErrorContains(t, err, "failed to decrypt keyring")
+
+	// no keyring
+	_, err = secret.ListKeyring(paths.PanelHome(t.TempDir()))
+	require.ErrorContains(t, err, "no keyring")
+}
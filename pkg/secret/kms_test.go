@@ -0,0 +1,122 @@
+package secret_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gcpkms "cloud.google.com/go/kms/apiv1"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	awskms "github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/cordialsys/panel/pkg/secret"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+)
+
+// The stand-ins "encrypt" by prefixing the key, so a ciphertext only opens with its key.
+func fakeSeal(key string, plaintext string) string {
+	return base64.StdEncoding.EncodeToString([]byte(key + "|" + plaintext))
+}
+
+func fakeOpen(key string, ciphertext []byte) ([]byte, bool) {
+	plaintext, ok := strings.CutPrefix(string(ciphertext), key+"|")
+	return []byte(plaintext), ok
+}
+
+func TestKmsAws(t *testing.T) {
+	key := "arn:aws:kms:eu-west-1:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "TrentService.Decrypt", r.Header.Get("X-Amz-Target"))
+		var body struct {
+			CiphertextBlob []byte
+			KeyId          string
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		plaintext, ok := fakeOpen(body.KeyId, body.CiphertextBlob)
+		if !ok {
+			w.Header().Set("X-Amzn-Errortype", "IncorrectKeyException")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "IncorrectKeyException", "message": "incorrect key"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"KeyId": body.KeyId, "Plaintext": plaintext})
+	}))
+	defer server.Close()
+	regions := []string{}
+	secret.NewAwsKmsClient = func(ctx context.Context, region string) (*awskms.Client, error) {
+		regions = append(regions, region)
+		return awskms.New(awskms.Options{
+			Region:       region,
+			BaseEndpoint: aws.String(server.URL),
+			Credentials:  credentials.NewStaticCredentialsProvider("key", "secret", ""),
+		}), nil
+	}
+
+	path := filepath.Join(t.TempDir(), "ear.kms")
+	require.NoError(t, os.WriteFile(path, []byte(fakeSeal(key, "phrase one")+"\n"), 0600))
+	value, err := secret.Secret(fmt.Sprintf("kms:%s,file:%s", key, path)).Load()
+	require.NoError(t, err)
+	require.Equal(t, "phrase one", value)
+	require.Equal(t, []string{"eu-west-1"}, regions)
+
+	value, err = secret.Secret(fmt.Sprintf("kms:%s,raw:%s", key, fakeSeal(key, "phrase two"))).Load()
+	require.NoError(t, err)
+	require.Equal(t, "phrase two", value)
+
+	other := "arn:aws:kms:eu-west-1:123456789012:alias/other"
+	_, err = secret.Secret(fmt.Sprintf("kms:%s,file:%s", other, path)).Load()
+	require.ErrorContains(t, err, "incorrect key")
+	_, err = secret.Secret(fmt.Sprintf("kms:%s,raw:not base64", key)).Load()
+	require.ErrorContains(t, err, "not valid base64")
+
+	require.ErrorContains(t, secret.Secret(fmt.Sprintf("kms:%s,file:%s", key, path)).Store("x"), "cannot be stored")
+}
+
+func TestKmsGcp(t *testing.T) {
+	key := "projects/my-project/locations/global/keyRings/panel/cryptoKeys/ear"
+	table := crc32.MakeTable(crc32.Castagnoli)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/v1/"), ":decrypt")
+		require.True(t, ok, r.URL.Path)
+		var body struct {
+			Ciphertext       []byte `json:"ciphertext"`
+			CiphertextCrc32c string `json:"ciphertextCrc32c"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		require.Equal(t, fmt.Sprint(crc32.Checksum(body.Ciphertext, table)), body.CiphertextCrc32c)
+		plaintext, ok := fakeOpen(name, body.Ciphertext)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]interface{}{"code": 400, "message": "decryption failed", "status": "INVALID_ARGUMENT"}})
+			return
+		}
+		checksum := crc32.Checksum(plaintext, table)
+		if strings.Contains(string(plaintext), "corrupt") {
+			checksum++
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"plaintext": plaintext, "plaintextCrc32c": fmt.Sprint(checksum)})
+	}))
+	defer server.Close()
+	secret.NewGcpKmsClient = func(ctx context.Context) (*gcpkms.KeyManagementClient, error) {
+		return gcpkms.NewKeyManagementRESTClient(ctx, option.WithEndpoint(server.URL), option.WithoutAuthentication())
+	}
+
+	value, err := secret.Secret(fmt.Sprintf("kms:%s,raw:%s", key, fakeSeal(key, "phrase one"))).Load()
+	require.NoError(t, err)
+	require.Equal(t, "phrase one", value)
+
+	_, err = secret.Secret(fmt.Sprintf("kms:%s,raw:%s", key, fakeSeal(key, "corrupt"))).Load()
+	require.ErrorContains(t, err, "failed its checksum")
+	_, err = secret.Secret(fmt.Sprintf("kms:%s/other,raw:%s", strings.TrimSuffix(key, "/ear"), fakeSeal(key, "phrase one"))).Load()
+	require.ErrorContains(t, err, "decryption failed")
+}
@@ -0,0 +1,57 @@
+package secret
+
+import (
+	"log/slog"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// A buffer outside of the Go heap, so the garbage collector never copies it, locked into memory
+// so it is never swapped to disk, and zeroed when destroyed.
+type lockedBuffer struct {
+	data   []byte
+	size   int
+	locked bool
+}
+
+var warnMlockOnce sync.Once
+
+func newLockedBuffer(value string) (*lockedBuffer, error) {
+	// mmap requires a non-zero length
+	data, err := unix.Mmap(-1, 0, max(len(value), 1), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return nil, err
+	}
+	buffer := &lockedBuffer{data: data, size: len(value)}
+	if err := unix.Mlock(data); err != nil {
+		// e.g. RLIMIT_MEMLOCK is too low, the value is still kept off the heap and zeroed
+		warnMlockOnce.Do(func() {
+			slog.Warn("could not lock cached secrets into memory", "error", err)
+		})
+	} else {
+		buffer.locked = true
+	}
+	copy(data, value)
+	return buffer, nil
+}
+
+func (b *lockedBuffer) String() string {
+	return string(b.data[:b.size])
+}
+
+func (b *lockedBuffer) Equal(value string) bool {
+	return b.String() == value
+}
+
+func (b *lockedBuffer) Destroy() {
+	if b.data == nil {
+		return
+	}
+	clear(b.data)
+	if b.locked {
+		_ = unix.Munlock(b.data)
+	}
+	_ = unix.Munmap(b.data)
+	b.data = nil
+}
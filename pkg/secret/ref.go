@@ -0,0 +1,526 @@
+package secret
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Within a component of a reference, these characters are escaped with a backslash, so e.g.
+// a vault path may contain a comma (`vault:<url>,kv/a\,b/key`).
+const refEscapable = `\,;:`
+
+// Prefix of AWS ARNs, which contain colons and so are never split into `<name>:<key>`.
+const awsArnPrefix = "arn:"
+
+// Number of colon separated fields of a secrets manager ARN, `arn:<partition>:secretsmanager:<region>:<account>:secret:<name>`.
+const awsArnFields = 7
+
+// The value shown instead of a raw secret.
+const hiddenValue = "<hidden>"
+
+// A parsed secret reference.  Only the fields used by its type are set.
+type Ref struct {
+	Type SecretType
+	// env, envfile and creds: the variable or credential; keyring: the id;
+	// gcp: the secret id; aws: the secret name or ARN; kms: the key ARN or resource name
+	Name string
+	// file, envfile and agefile
+	Path string
+	// vault: the server url, including any auth parameters
+	Url string
+	// vault: the key within the secret at Path; aws: the key within the secret's JSON, if any
+	Key string
+	// gcp
+	Project string
+	// gcp: the location of a regional secret
+	Location string
+	// aws
+	Region string
+	// gcp: a pinned version; aws: a pinned version stage
+	Version string
+	// shamir
+	Threshold int
+	Shares    []Ref
+	// agefile
+	Identity *Ref
+	// kms: the reference holding the base64 ciphertext
+	Ciphertext *Ref
+	// raw
+	Value string
+}
+
+// A reference that failed to parse or validate, naming the component at fault.
+type RefError struct {
+	Type      SecretType
+	Component string
+	Reason    string
+}
+
+func (e *RefError) Error() string {
+	if e.Component == "" {
+		return fmt.Sprintf("%s secret %s", e.Type, e.Reason)
+	}
+	return fmt.Sprintf("malformed %s secret: %s %s", e.Type, e.Component, e.Reason)
+}
+
+func argumentsError(secretType SecretType, count string) error {
+	return &RefError{Type: secretType, Reason: fmt.Sprintf("has %s comma separated arguments: %s", count, secretType.Usage())}
+}
+
+// The type named by a prefix; "gsm" is an alias of gcp.
+func parseType(prefix string) (SecretType, bool) {
+	secretType := SecretType(strings.ToLower(prefix))
+	if secretType == "gsm" {
+		return GcpSecretManager, true
+	}
+	return secretType, secretType == Raw || slices.Contains(Types, secretType)
+}
+
+// Split on the unescaped separator into at most n parts (all if n < 0), keeping escapes.
+func splitEscaped(s string, sep byte, n int) []string {
+	parts := []string{}
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(refEscapable, s[i+1]) >= 0 {
+			i++
+			continue
+		}
+		if s[i] == sep && (n < 0 || len(parts) < n-1) {
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func unescape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(refEscapable, s[i+1]) >= 0 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func escape(s string, special string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(special, s[i]) >= 0 {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Escape a component; colons only need escaping in aws names.
+func escapeComponent(s string) string {
+	return escape(s, `\,;`)
+}
+
+// Parse a secret reference, `<type>:<arguments>`.  `raw:` values are taken verbatim.
+func ParseRef(s string) (Ref, error) {
+	prefix, arg, ok := strings.Cut(s, ":")
+	if !ok {
+		return Ref{}, fmt.Errorf(
+			"missing prefix; secret should be in '<prefix>:<path>' format, where prefix is one of %v",
+			Types,
+		)
+	}
+	secretType, ok := parseType(prefix)
+	if !ok {
+		// the prefix is not echoed, in case a secret value was given instead of a reference
+		return Ref{}, fmt.Errorf("unknown secret type, must be one of %v", Types)
+	}
+	ref := Ref{Type: secretType}
+	args := splitEscaped(arg, ',', -1)
+	switch secretType {
+	case Raw:
+		ref.Value = arg
+		return ref, nil
+	case Env, Creds, Keyring:
+		if len(args) != 1 {
+			return Ref{}, &RefError{Type: secretType, Reason: fmt.Sprintf("has 1 argument: %s", secretType.Usage())}
+		}
+		ref.Name = unescape(args[0])
+	case File:
+		if len(args) != 1 {
+			return Ref{}, &RefError{Type: secretType, Reason: fmt.Sprintf("has 1 argument: %s", secretType.Usage())}
+		}
+		ref.Path = unescape(args[0])
+	case EnvFile:
+		if len(args) != 2 {
+			return Ref{}, argumentsError(secretType, "2")
+		}
+		ref.Path, ref.Name = unescape(args[0]), unescape(args[1])
+	case Vault:
+		if len(args) != 2 {
+			return Ref{}, argumentsError(secretType, "2")
+		}
+		ref.Url = unescape(args[0])
+		path := unescape(args[1])
+		idx := strings.LastIndex(path, "/")
+		if idx == -1 {
+			return Ref{}, &RefError{Type: secretType, Component: "path", Reason: fmt.Sprintf("%q must be <path>/<key>", path)}
+		}
+		ref.Path, ref.Key = path[:idx], path[idx+1:]
+	case GcpSecretManager:
+		if len(args) > 3 {
+			return Ref{}, argumentsError(secretType, "1-3")
+		}
+		if len(args) == 1 {
+			// a full resource name
+			ids, ok := parseGcpName(unescape(args[0]), "projects", "locations", "secrets", "versions")
+			if !ok || ids["projects"] == "" || ids["secrets"] == "" {
+				return Ref{}, &RefError{Type: secretType, Component: "name", Reason: fmt.Sprintf("%q must be projects/<project>[/locations/<location>]/secrets/<name>[/versions/<version>]", unescape(args[0]))}
+			}
+			ref.Project, ref.Location, ref.Name, ref.Version = ids["projects"], ids["locations"], ids["secrets"], ids["versions"]
+			break
+		}
+		project := unescape(args[0])
+		if strings.Contains(project, "/") {
+			ids, ok := parseGcpName(project, "projects", "locations")
+			if !ok || ids["projects"] == "" {
+				return Ref{}, &RefError{Type: secretType, Component: "project", Reason: fmt.Sprintf("%q must be <project>, projects/<project> or projects/<project>/locations/<location>", project)}
+			}
+			ref.Project, ref.Location = ids["projects"], ids["locations"]
+		} else {
+			ref.Project = project
+		}
+		ref.Name = unescape(args[1])
+		if len(args) > 2 {
+			ref.Version = strings.TrimPrefix(unescape(args[2]), "versions/")
+		}
+	case AwsSecretManager:
+		if len(args) > 3 {
+			return Ref{}, argumentsError(secretType, "1-3")
+		}
+		var err error
+		if ref.Name, ref.Key, err = parseAwsName(args[0]); err != nil {
+			return Ref{}, err
+		}
+		if len(args) > 1 {
+			ref.Region = unescape(args[1])
+		}
+		if len(args) > 2 {
+			ref.Version = unescape(args[2])
+		}
+	case AgeFile:
+		// the identity reference may itself contain commas
+		args = splitEscaped(arg, ',', 2)
+		if len(args) != 2 {
+			return Ref{}, argumentsError(secretType, "2")
+		}
+		ref.Path = unescape(args[0])
+		identity, err := ParseRef(args[1])
+		if err != nil {
+			return Ref{}, &RefError{Type: secretType, Component: "identity", Reason: fmt.Sprintf("is invalid: %v", err)}
+		}
+		ref.Identity = &identity
+	case Kms:
+		// the ciphertext reference may itself contain commas
+		args = splitEscaped(arg, ',', 2)
+		if len(args) != 2 {
+			return Ref{}, argumentsError(secretType, "2")
+		}
+		ref.Name = unescape(args[0])
+		ciphertext, err := ParseRef(args[1])
+		if err != nil {
+			return Ref{}, &RefError{Type: secretType, Component: "ciphertext", Reason: fmt.Sprintf("is invalid: %v", err)}
+		}
+		ref.Ciphertext = &ciphertext
+	case Shamir:
+		parts := splitEscaped(arg, ShamirShareSeparator[0], -1)
+		if len(parts) < 3 {
+			return Ref{}, &RefError{Type: secretType, Reason: fmt.Sprintf("requires a threshold and at least 2 shares: %s", secretType.Usage())}
+		}
+		threshold, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return Ref{}, &RefError{Type: secretType, Component: "threshold", Reason: fmt.Sprintf("%q is not a number", parts[0])}
+		}
+		ref.Threshold = threshold
+		for i, part := range parts[1:] {
+			share, err := ParseRef(strings.TrimSpace(part))
+			if err != nil {
+				return Ref{}, &RefError{Type: secretType, Component: fmt.Sprintf("share %d", i+1), Reason: fmt.Sprintf("is invalid: %v", err)}
+			}
+			ref.Shares = append(ref.Shares, share)
+		}
+	}
+	if err := ref.Validate(); err != nil {
+		return Ref{}, err
+	}
+	return ref, nil
+}
+
+// Parse a GCP resource name, `<collection>/<id>/...`, where the collections must be among
+// those given, in order.  Returns the id of each collection.
+func parseGcpName(name string, collections ...string) (map[string]string, bool) {
+	parts := strings.Split(name, "/")
+	if len(parts)%2 != 0 {
+		return nil, false
+	}
+	ids := map[string]string{}
+	next := 0
+	for i := 0; i < len(parts); i += 2 {
+		idx := slices.Index(collections[next:], parts[i])
+		if idx == -1 || parts[i+1] == "" {
+			return nil, false
+		}
+		next += idx + 1
+		ids[parts[i]] = parts[i+1]
+	}
+	return ids, true
+}
+
+// Split `<name>[:<key>]`, where the name may be an ARN.
+func parseAwsName(arg string) (name string, key string, err error) {
+	parts := splitEscaped(arg, ':', -1)
+	count := 1
+	if strings.HasPrefix(arg, awsArnPrefix) {
+		if len(parts) < awsArnFields {
+			return "", "", &RefError{Type: AwsSecretManager, Component: "name", Reason: fmt.Sprintf("%q is not a secrets manager ARN", arg)}
+		}
+		count = awsArnFields
+	}
+	for i, part := range parts {
+		parts[i] = unescape(part)
+	}
+	name = strings.Join(parts[:min(count, len(parts))], ":")
+	if len(parts) > count {
+		key = strings.Join(parts[count:], ":")
+	}
+	return name, key, nil
+}
+
+// Check the fields of the reference's type are set and consistent.
+func (r Ref) Validate() error {
+	missing := func(component string) error {
+		return &RefError{Type: r.Type, Component: component, Reason: "is empty"}
+	}
+	switch r.Type {
+	case Env, Creds:
+		if r.Name == "" {
+			return missing("name")
+		}
+	case Keyring:
+		if err := validateKeyringId(r.Name); err != nil {
+			return &RefError{Type: r.Type, Component: "id", Reason: fmt.Sprintf("%q may only contain letters, digits, '_', '.' and '-'", r.Name)}
+		}
+	case File:
+		if r.Path == "" {
+			return missing("path")
+		}
+	case EnvFile:
+		if r.Path == "" {
+			return missing("path")
+		}
+		if r.Name == "" {
+			return missing("name")
+		}
+	case Vault:
+		if r.Url == "" {
+			return missing("url")
+		}
+		if r.Path == "" || r.Key == "" {
+			return &RefError{Type: r.Type, Component: "path", Reason: "must be <path>/<key>"}
+		}
+	case GcpSecretManager:
+		if r.Project == "" {
+			return missing("project")
+		}
+		if r.Name == "" {
+			return missing("name")
+		}
+	case AwsSecretManager:
+		if r.Name == "" {
+			return missing("name")
+		}
+	case AgeFile:
+		if r.Path == "" {
+			return missing("path")
+		}
+		if r.Identity == nil || r.Identity.IsZero() {
+			return missing("identity")
+		}
+		if r.Identity.Type == AgeFile {
+			return &RefError{Type: r.Type, Component: "identity", Reason: fmt.Sprintf("cannot itself be an %s secret", AgeFile)}
+		}
+		if err := r.Identity.Validate(); err != nil {
+			return &RefError{Type: r.Type, Component: "identity", Reason: fmt.Sprintf("is invalid: %v", err)}
+		}
+	case Kms:
+		if _, ok := awsKmsRegion(r.Name); !ok && !isGcpKmsKey(r.Name) {
+			return &RefError{Type: r.Type, Component: "key", Reason: fmt.Sprintf("%q must be an AWS KMS key ARN or projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>", r.Name)}
+		}
+		if r.Ciphertext == nil || r.Ciphertext.IsZero() {
+			return missing("ciphertext")
+		}
+		if err := r.Ciphertext.Validate(); err != nil {
+			return &RefError{Type: r.Type, Component: "ciphertext", Reason: fmt.Sprintf("is invalid: %v", err)}
+		}
+	case Shamir:
+		if len(r.Shares) < 2 {
+			return &RefError{Type: r.Type, Reason: fmt.Sprintf("requires a threshold and at least 2 shares: %s", r.Type.Usage())}
+		}
+		for i, share := range r.Shares {
+			component := fmt.Sprintf("share %d", i+1)
+			if share.Type == Shamir {
+				return &RefError{Type: r.Type, Component: component, Reason: fmt.Sprintf("cannot itself be a %s secret", Shamir)}
+			}
+			if err := share.Validate(); err != nil {
+				return &RefError{Type: r.Type, Component: component, Reason: fmt.Sprintf("is invalid: %v", err)}
+			}
+		}
+		if r.Threshold < 2 || r.Threshold > len(r.Shares) {
+			return &RefError{Type: r.Type, Component: "threshold", Reason: fmt.Sprintf("must be between 2 and the number of shares (%d)", len(r.Shares))}
+		}
+	case Raw:
+	case "":
+		return errors.New("empty secret reference")
+	default:
+		return fmt.Errorf("unknown secret type, must be one of %v", Types)
+	}
+	return nil
+}
+
+// The reference in canonical form, including any raw values.
+func (r Ref) Secret() Secret {
+	var arg string
+	switch r.Type {
+	case Env, Creds, Keyring:
+		arg = escapeComponent(r.Name)
+	case File:
+		arg = escapeComponent(r.Path)
+	case EnvFile:
+		arg = escapeComponent(r.Path) + "," + escapeComponent(r.Name)
+	case Vault:
+		arg = escapeComponent(r.Url) + "," + escapeComponent(r.Path+"/"+r.Key)
+	case GcpSecretManager:
+		project := r.Project
+		if r.Location != "" {
+			project = "projects/" + r.Project + "/locations/" + r.Location
+		}
+		arg = escapeComponent(project) + "," + escapeComponent(r.Name)
+		if r.Version != "" {
+			arg += "," + escapeComponent(r.Version)
+		}
+	case AwsSecretManager:
+		if strings.HasPrefix(r.Name, awsArnPrefix) {
+			arg = escapeComponent(r.Name)
+		} else {
+			arg = escape(r.Name, `\,;:`)
+		}
+		if r.Key != "" {
+			arg += ":" + escapeComponent(r.Key)
+		}
+		if r.Version != "" {
+			arg += "," + escapeComponent(r.Region) + "," + escapeComponent(r.Version)
+		} else if r.Region != "" {
+			arg += "," + escapeComponent(r.Region)
+		}
+	case AgeFile:
+		arg = escapeComponent(r.Path) + ","
+		if r.Identity != nil {
+			arg += string(r.Identity.Secret())
+		}
+	case Kms:
+		arg = escapeComponent(r.Name) + ","
+		if r.Ciphertext != nil {
+			arg += string(r.Ciphertext.Secret())
+		}
+	case Shamir:
+		parts := []string{strconv.Itoa(r.Threshold)}
+		for _, share := range r.Shares {
+			parts = append(parts, string(share.Secret()))
+		}
+		arg = strings.Join(parts, ShamirShareSeparator)
+	case Raw:
+		arg = r.Value
+	case "":
+		return ""
+	}
+	return Secret(fmt.Sprintf("%s:%s", r.Type, arg))
+}
+
+// A copy with any raw values, including those of shares and identities, hidden.
+func (r Ref) Redacted() Ref {
+	switch r.Type {
+	case Raw:
+		r.Value = hiddenValue
+	case AgeFile:
+		if r.Identity != nil {
+			identity := r.Identity.Redacted()
+			r.Identity = &identity
+		}
+	case Kms:
+		if r.Ciphertext != nil {
+			ciphertext := r.Ciphertext.Redacted()
+			r.Ciphertext = &ciphertext
+		}
+	case Shamir:
+		shares := make([]Ref, len(r.Shares))
+		for i, share := range r.Shares {
+			shares[i] = share.Redacted()
+		}
+		r.Shares = shares
+	}
+	return r
+}
+
+// The canonical form with raw values hidden, so a reference can be logged.
+func (r Ref) String() string {
+	return string(r.Redacted().Secret())
+}
+
+func (r Ref) IsZero() bool {
+	return r.Type == ""
+}
+
+func (r Ref) IsType(t SecretType) bool {
+	return r.Type == t
+}
+
+func (r Ref) Equal(other Ref) bool {
+	return r.Secret() == other.Secret()
+}
+
+// Resolve the secret, see `Secret.Load`.
+func (r Ref) Load() (string, error) {
+	return r.Secret().Load()
+}
+
+func (r Ref) Store(value string) error {
+	return r.Secret().Store(value)
+}
+
+func (r Ref) Rotate(value string) (string, error) {
+	return r.Secret().Rotate(value)
+}
+
+// Used for JSON and TOML, where a reference is its canonical string.
+func (r Ref) MarshalText() ([]byte, error) {
+	return []byte(r.Secret()), nil
+}
+
+func (r *Ref) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*r = Ref{}
+		return nil
+	}
+	ref, err := ParseRef(string(text))
+	if err != nil {
+		return err
+	}
+	*r = ref
+	return nil
+}
+
+func (s Secret) Ref() (Ref, error) {
+	return ParseRef(string(s))
+}
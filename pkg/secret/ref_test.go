@@ -0,0 +1,165 @@
+package secret_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/cordialsys/panel/pkg/secret"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRef(t *testing.T) {
+	arn := "arn:aws:secretsmanager:us-east-1:123456789012:secret:panel-AbCdEf"
+	for _, tc := range []struct {
+		input     string
+		expected  secret.Ref
+		canonical string
+	}{
+		{"env:EAR", secret.Ref{Type: secret.Env, Name: "EAR"}, ""},
+		{"ENV:EAR", secret.Ref{Type: secret.Env, Name: "EAR"}, "env:EAR"},
+		{`file:/etc/panel/a\,b`, secret.Ref{Type: secret.File, Path: "/etc/panel/a,b"}, ""},
+		{"envfile:/etc/panel/env,EAR", secret.Ref{Type: secret.EnvFile, Path: "/etc/panel/env", Name: "EAR"}, ""},
+		{
+			`vault:https://vault:8200?auth=approle&role_id=panel,secret/a\,b/ear`,
+			secret.Ref{Type: secret.Vault, Url: "https://vault:8200?auth=approle&role_id=panel", Path: "secret/a,b", Key: "ear"}, "",
+		},
+		{"gsm:my-project,ear,versions/3", secret.Ref{Type: secret.GcpSecretManager, Project: "my-project", Name: "ear", Version: "3"}, "gcp:my-project,ear,3"},
+		{"aws:panel:ear,us-east-1", secret.Ref{Type: secret.AwsSecretManager, Name: "panel", Key: "ear", Region: "us-east-1"}, ""},
+		{"aws:panel,,AWSPREVIOUS", secret.Ref{Type: secret.AwsSecretManager, Name: "panel", Version: "AWSPREVIOUS"}, ""},
+		{`aws:a\:b:ear`, secret.Ref{Type: secret.AwsSecretManager, Name: "a:b", Key: "ear"}, ""},
+		{"aws:" + arn, secret.Ref{Type: secret.AwsSecretManager, Name: arn}, ""},
+		{"aws:" + arn + ":ear,us-east-1", secret.Ref{Type: secret.AwsSecretManager, Name: arn, Key: "ear", Region: "us-east-1"}, ""},
+		{
+			"gcp:projects/my-project/locations/europe-west1,ear",
+			secret.Ref{Type: secret.GcpSecretManager, Project: "my-project", Location: "europe-west1", Name: "ear"}, "",
+		},
+		{
+			"gcp:projects/my-project/locations/europe-west1/secrets/ear/versions/2",
+			secret.Ref{Type: secret.GcpSecretManager, Project: "my-project", Location: "europe-west1", Name: "ear", Version: "2"},
+			"gcp:projects/my-project/locations/europe-west1,ear,2",
+		},
+		{"gcp:projects/my-project/secrets/ear", secret.Ref{Type: secret.GcpSecretManager, Project: "my-project", Name: "ear"}, "gcp:my-project,ear"},
+		{"keyring:ear", secret.Ref{Type: secret.Keyring, Name: "ear"}, ""},
+		{
+			"kms:arn:aws:kms:us-east-1:123456789012:alias/panel,file:/etc/panel/ear.kms",
+			secret.Ref{Type: secret.Kms, Name: "arn:aws:kms:us-east-1:123456789012:alias/panel", Ciphertext: &secret.Ref{Type: secret.File, Path: "/etc/panel/ear.kms"}}, "",
+		},
+		{"creds:panel.ear", secret.Ref{Type: secret.Creds, Name: "panel.ear"}, ""},
+		{
+			"agefile:/etc/panel/ear.age,envfile:/etc/panel/env,AGE_KEY",
+			secret.Ref{Type: secret.AgeFile, Path: "/etc/panel/ear.age", Identity: &secret.Ref{Type: secret.EnvFile, Path: "/etc/panel/env", Name: "AGE_KEY"}}, "",
+		},
+		{
+			`shamir:2;file:/a\;b;vault:https://vault,secret/ear;keyring:share-3`,
+			secret.Ref{Type: secret.Shamir, Threshold: 2, Shares: []secret.Ref{
+				{Type: secret.File, Path: "/a;b"},
+				{Type: secret.Vault, Url: "https://vault", Path: "secret", Key: "ear"},
+				{Type: secret.Keyring, Name: "share-3"},
+			}}, "",
+		},
+		{`raw:a,b;c:\d`, secret.Ref{Type: secret.Raw, Value: `a,b;c:\d`}, ""},
+	} {
+		t.Run(tc.input, func(t *testing.T) {
+			ref, err := secret.ParseRef(tc.input)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, ref)
+			canonical := tc.canonical
+			if canonical == "" {
+				canonical = tc.input
+			}
+			require.Equal(t, secret.Secret(canonical), ref.Secret())
+
+			reparsed, err := ref.Secret().Ref()
+			require.NoError(t, err)
+			require.True(t, ref.Equal(reparsed))
+
+			secretType, ok := secret.Secret(tc.input).Type()
+			require.True(t, ok)
+			require.Equal(t, ref.Type, secretType)
+		})
+	}
+}
+
+func TestParseRefErrors(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		error string
+	}{
+		{"no-prefix", "missing prefix"},
+		{"hunter2:hunter2", "unknown secret type"},
+		{"env:", "malformed env secret: name is empty"},
+		{"file:/a,b", "file secret has 1 argument"},
+		{"vault:https://vault,ear", `malformed vault secret: path "ear" must be <path>/<key>`},
+		{"vault:https://vault,secret/", "malformed vault secret: path must be <path>/<key>"},
+		{"gcp:my-project", `malformed gcp secret: name "my-project" must be projects/<project>`},
+		{"gcp:projects/my-project/keyRings/ring,ear", "malformed gcp secret: project"},
+		{"kms:arn:aws:secretsmanager:us-east-1:123456789012:secret:ear,raw:AQID", "malformed kms secret: key"},
+		{"kms:projects/my-project/locations/global/keyRings/ring/cryptoKeys/ear", "kms secret has 2 comma separated arguments"},
+		{"aws:arn:aws:secretsmanager:us-east-1", "malformed aws secret: name"},
+		{"keyring:bad/id", "malformed keyring secret: id"},
+		{"agefile:/etc/panel/ear.age,nope", "malformed agefile secret: identity is invalid"},
+		{"agefile:/etc/panel/ear.age,agefile:/other.age,env:KEY", "malformed agefile secret: identity cannot itself"},
+		{"shamir:x;env:A;env:B", `malformed shamir secret: threshold "x" is not a number`},
+		{"shamir:2;env:A;vault:url,ear", "malformed shamir secret: share 2 is invalid"},
+	} {
+		t.Run(tc.input, func(t *testing.T) {
+			_, err := secret.ParseRef(tc.input)
+			require.ErrorContains(t, err, tc.error)
+			require.NotContains(t, err.Error(), "hunter2")
+		})
+	}
+
+	_, err := secret.ParseRef("shamir:3;env:A;env:B")
+	var refErr *secret.RefError
+	require.True(t, errors.As(err, &refErr))
+	require.Equal(t, secret.Shamir, refErr.Type)
+	require.Equal(t, "threshold", refErr.Component)
+}
+
+func TestRefRedacted(t *testing.T) {
+	ref, err := secret.ParseRef("raw:hunter2")
+	require.NoError(t, err)
+	require.Equal(t, "raw:<hidden>", ref.String())
+	require.Equal(t, secret.Secret("raw:hunter2"), ref.Secret())
+
+	ref, err = secret.ParseRef("shamir:2;raw:share-1;env:SHARE_2;agefile:/ear.age,raw:AGE-SECRET-KEY-1")
+	require.NoError(t, err)
+	require.Equal(t, "shamir:2;raw:<hidden>;env:SHARE_2;agefile:/ear.age,raw:<hidden>", ref.String())
+	// the original is unchanged
+	require.Equal(t, "share-1", ref.Shares[0].Value)
+}
+
+func TestRefEncoding(t *testing.T) {
+	type config struct {
+		EarSecret secret.Ref `json:"ear_secret,omitzero" toml:"ear_secret"`
+	}
+	ref, err := secret.ParseRef(`vault:https://vault,secret/a\,b/ear`)
+	require.NoError(t, err)
+
+	jsonBz, err := json.Marshal(config{EarSecret: ref})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"ear_secret":"vault:https://vault,secret/a\\,b/ear"}`, string(jsonBz))
+	var decoded config
+	require.NoError(t, json.Unmarshal(jsonBz, &decoded))
+	require.Equal(t, ref, decoded.EarSecret)
+
+	tomlBz, err := toml.Marshal(config{EarSecret: ref})
+	require.NoError(t, err)
+	decoded = config{}
+	require.NoError(t, toml.Unmarshal(tomlBz, &decoded))
+	require.Equal(t, ref, decoded.EarSecret)
+
+	// unset references are omitted, and decode as unset
+	jsonBz, err = json.Marshal(config{})
+	require.NoError(t, err)
+	require.Equal(t, `{}`, string(jsonBz))
+	decoded = config{EarSecret: ref}
+	require.NoError(t, json.Unmarshal([]byte(`{"ear_secret":""}`), &decoded))
+	require.True(t, decoded.EarSecret.IsZero())
+
+	// invalid references fail to decode, naming the component
+	err = json.Unmarshal([]byte(`{"ear_secret":"vault:https://vault,ear"}`), &decoded)
+	require.ErrorContains(t, err, "malformed vault secret: path")
+}
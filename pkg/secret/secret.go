@@ -1,58 +1,82 @@
 package secret
 
 import (
-	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
 	"slices"
 	"strings"
 
-	secretmanager "cloud.google.com/go/secretmanager/apiv1"
-	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	awssecretmanager "github.com/aws/aws-sdk-go-v2/service/secretsmanager"
-	vault "github.com/hashicorp/vault/api"
-	"google.golang.org/api/iterator"
+	"github.com/cordialsys/panel/pkg/plog"
 )
 
 type Secret string
 
+// Resolve the secret.  The value is registered to be redacted from logs and errors.
+// Remote secrets are cached if a `DefaultResolver` is set.
 func (s Secret) Load() (string, error) {
-	return GetSecret(string(s))
+	if DefaultResolver != nil && DefaultResolver.caches(s) {
+		return DefaultResolver.Load(s)
+	}
+	return s.loadUncached()
+}
+
+func (s Secret) loadUncached() (string, error) {
+	value, err := GetSecret(string(s))
+	if err != nil {
+		return "", err
+	}
+	plog.AddSecret(value)
+	return value, nil
 }
 
 func (s Secret) IsType(t SecretType) bool {
-	return strings.HasPrefix(string(s), string(t)+":")
+	secretType, _ := s.Type()
+	return secretType == t
 }
+
+// The type of the reference, parsed the same way as by `Load`.
 func (s Secret) Type() (SecretType, bool) {
-	splits := strings.Split(string(s), ":")
-	if len(splits) == 1 {
+	prefix, _, ok := strings.Cut(string(s), ":")
+	if !ok {
 		return "", false
 	}
-	return SecretType(splits[0]), SecretType(splits[0]).Name() != ""
+	return parseType(prefix)
 }
 
 type SecretType string
 
 const (
 	Env              SecretType = "env"
+	EnvFile          SecretType = "envfile"
 	Vault            SecretType = "vault"
 	File             SecretType = "file"
 	Keyring          SecretType = "keyring"
+	Shamir           SecretType = "shamir"
+	Creds            SecretType = "creds"
+	AgeFile          SecretType = "agefile"
+	Kms              SecretType = "kms"
 	GcpSecretManager SecretType = "gcp"
 	AwsSecretManager SecretType = "aws"
 	Raw              SecretType = "raw"
 )
 
+// Types whose value is kept in the clear on the host or in its environment, so they cannot be
+// used to protect other secrets kept on the same host.
+var PlaintextAtRestTypes = []SecretType{Raw, File, EnvFile, Env}
+
+func (s Secret) IsPlaintextAtRest() bool {
+	secretType, _ := s.Type()
+	return slices.Contains(PlaintextAtRestTypes, secretType)
+}
+
 func (t SecretType) Name() string {
 	switch t {
 	case Env:
 		return "Environment variable"
+	case EnvFile:
+		return "Environment file"
 	case Vault:
 		return "Hashicorp Vault"
 	case File:
@@ -62,7 +86,15 @@ func (t SecretType) Name() string {
 	case AwsSecretManager:
 		return "AWS Secret Manager"
 	case Keyring:
-		return "Treasury Keyring"
+		return "Panel Keyring"
+	case Shamir:
+		return "Shamir k-of-n shares"
+	case Creds:
+		return "systemd credential"
+	case AgeFile:
+		return "age encrypted file"
+	case Kms:
+		return "AWS or GCP KMS ciphertext"
 	case Raw:
 		return "Raw"
 	}
@@ -72,22 +104,32 @@ func (t SecretType) Usage() string {
 	switch t {
 	case Env:
 		return "<name>"
+	case EnvFile:
+		return "<path>,<name>"
 	case Vault:
-		return "<server-url>,<path>"
+		return "<server-url[?auth=...]>,<path>"
 	case File:
 		return "<path>"
 	case GcpSecretManager, "gsm":
-		return "<project>,<name>[,version]"
+		return "<project>,<name>[,version] or projects/<project>[/locations/<location>]/secrets/<name>[/versions/<version>]"
 	case AwsSecretManager:
 		return "<name[:key]>[,region][,version]"
 	case Keyring:
-		return "<id-or-path>"
+		return "<id>"
+	case Shamir:
+		return "<k>;<share-ref>;<share-ref>[;...]"
+	case Creds:
+		return "<name>"
+	case AgeFile:
+		return "<path>,<identity-ref>"
+	case Kms:
+		return "<key-arn-or-name>,<ciphertext-ref>"
 	}
 	return ""
 }
 
 var Types = []SecretType{
-	Env, Vault, File, GcpSecretManager, AwsSecretManager, Keyring,
+	Env, EnvFile, Vault, File, GcpSecretManager, AwsSecretManager, Keyring, Shamir, Creds, AgeFile, Kms,
 }
 
 func replaceTilda(path string) string {
@@ -100,24 +142,22 @@ func replaceTilda(path string) string {
 
 // GetSecret returns a secret, e.g. from env variable. Extend as needed.
 func GetSecret(uri string) (secret string, err error) {
-	value := uri
-
-	splits := strings.Split(value, ":")
-	if len(splits) < 2 {
-		return "", fmt.Errorf(
-			"could not load secret, missing prefix; secret should be in '<prefix>:<path>' format, where prefix is one of %v",
-			Types,
-		)
+	ref, err := ParseRef(uri)
+	if err != nil {
+		return "", fmt.Errorf("could not load secret, %w", err)
 	}
 
-	secretType := strings.ToLower(splits[0])
-	args := strings.Split(strings.Join(splits[1:], ":"), ",")
-	switch SecretType(secretType) {
+	switch ref.Type {
 	case Env:
-		path := args[0]
-		return strings.TrimSpace(os.Getenv(path)), nil
+		return strings.TrimSpace(os.Getenv(ref.Name)), nil
+	case EnvFile:
+		values, err := readEnvFile(replaceTilda(ref.Path))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(values[ref.Name]), nil
 	case File:
-		path := replaceTilda(args[0])
+		path := replaceTilda(ref.Path)
 		_, err := os.Stat(path)
 		if err != nil {
 			return "", err
@@ -133,145 +173,38 @@ func GetSecret(uri string) (secret string, err error) {
 		}
 		return strings.TrimSpace(string(result)), nil
 	case Vault:
-		if len(args) != 2 {
-			return "", errors.New("vault secret has 2 comma separated arguments (url,path)")
-		}
-		vaultUrl := args[0]
-		vaultFullPath := args[1]
-
-		cfg := &vault.Config{Address: vaultUrl}
-		// just check the error
-		_, err := vault.NewClient(cfg)
-		if err != nil {
-			return "", err
-		}
-		client, err := NewVaultClient(cfg)
+		client, err := newAuthenticatedVaultClient(ref.Url)
 		if err != nil {
 			return "", err
 		}
 
-		idx := strings.LastIndex(vaultFullPath, "/")
-		if idx == -1 || idx == len(vaultFullPath) { // idx shouldn't be the last char
-			return "", errors.New("malformed vault secret in config file")
-		}
-		vaultKey := vaultFullPath[idx+1:]
-		vaultPath := vaultFullPath[:idx]
-
-		secret, err := client.LoadSecretData(vaultPath)
+		secret, err := client.LoadSecretData(ref.Path)
 		if err != nil {
 			return "", err
 		}
 		data, _ := secret.Data["data"].(map[string]interface{})
-		result, _ := data[vaultKey].(string)
+		result, _ := data[ref.Key].(string)
 		return strings.TrimSpace(result), nil
-	case GcpSecretManager, "gsm":
-		// google secret manager
-		if !slices.Contains([]int{2, 3}, len(args)) {
-			return "", fmt.Errorf("%s secret has 2-3 comma separated arguments: %s", GcpSecretManager, GcpSecretManager.Usage())
-		}
-		project := args[0]
-		if len(strings.Split(project, "/")) == 1 {
-			// should have /projects/ prefix
-			project = filepath.Join("projects", project)
-		}
-		name := args[1]
-		version := "latest"
-		if len(args) > 2 {
-			version = args[2]
-			version = strings.TrimPrefix(version, "versions/")
-		}
-
-		client, err := secretmanager.NewClient(context.Background())
-		if err != nil {
-			return "", err
-		}
-
-		it := client.ListSecrets(context.Background(), &secretmanagerpb.ListSecretsRequest{
-			Parent: project,
-			Filter: name,
-		})
-		for {
-			resp, err := it.Next()
-			if err == iterator.Done {
-				break
-			}
-
-			if err != nil {
-				return "", err
-			}
-
-			_, secretName := filepath.Split(resp.Name)
-			if secretName == name {
-				// access the specific version
-				latest := filepath.Join(resp.Name, "versions/"+version)
-				latestSecret, err := client.AccessSecretVersion(context.Background(), &secretmanagerpb.AccessSecretVersionRequest{
-					Name: latest,
-				})
-				if err != nil {
-					return "", err
-				}
-				return string(latestSecret.Payload.Data), nil
-			}
-		}
-		return "", fmt.Errorf("could not find a gsm secret by name %s", name)
-
+	case GcpSecretManager:
+		return loadGcpSecret(ref)
 	case AwsSecretManager:
-		if !slices.Contains([]int{1, 2, 3}, len(args)) {
-			return "", fmt.Errorf("%s secret has 1-3 comma separated arguments: %s", AwsSecretManager, AwsSecretManager.Usage())
-		}
-		secretName := args[0]
-		keyName := ""
-		nameParts := strings.Split(secretName, ":")
-		if len(nameParts) > 1 {
-			secretName = nameParts[0]
-			keyName = strings.Join(nameParts[1:], ":")
-		}
-		region := ""
-		version := "AWSCURRENT"
-		if len(args) > 1 {
-			region = args[1]
-		}
-		if len(args) > 2 {
-			version = args[2]
-		}
-		awsAwgs := []func(*config.LoadOptions) error{}
-		if region != "" {
-			awsAwgs = append(awsAwgs, config.WithRegion(region))
-		}
-
-		config, err := config.LoadDefaultConfig(context.Background(), awsAwgs...)
-		if err != nil {
-			return "", err
-		}
-		svc := awssecretmanager.NewFromConfig(config)
-		input := &awssecretmanager.GetSecretValueInput{
-			SecretId:     aws.String(secretName),
-			VersionStage: aws.String(version),
-		}
-		result, err := svc.GetSecretValue(context.Background(), input)
+		return loadAwsSecret(ref)
+	case Kms:
+		return decryptKms(ref)
+	case Keyring:
+		result, err := getKeyringEntry(KeyringHome, ref.Name)
 		if err != nil {
-			// https://docs.aws.amazon.com/secretsmanager/latest/apireference/API_GetSecretValue.html
 			return "", err
 		}
-		secretBz := *result.SecretString
-		if keyName != "" {
-			// Another layer of nesting to unwrap, this time JSON
-			secretData := map[string]interface{}{}
-			err = json.Unmarshal([]byte(secretBz), &secretData)
-			if err != nil {
-				// do not omit internal error to guard from leaking anything sensitive
-				return "", fmt.Errorf("could not retrieve %s key because %s has invalid JSON", keyName, secretName)
-			}
-			secretValue, ok := secretData[keyName]
-			if !ok {
-				return "", fmt.Errorf("could not find %s key in %s JSON", keyName, secretName)
-			}
-			return fmt.Sprint(secretValue), nil
-		}
-		// return secretBz literally as the secret, no JSON nesting
-		return secretBz, nil
+		return strings.TrimSpace(result), nil
+	case Creds:
+		return readCredential(ref.Name)
+	case AgeFile:
+		return readAgeFile(ref)
+	case Shamir:
+		return loadShamir(ref)
 	case Raw:
-		return strings.Join(splits[1:], ":"), nil
+		return ref.Value, nil
 	}
 	return "", errors.New("invalid secret source for: ***")
 }
@@ -143,3 +143,24 @@ func TestGetSecretFileTrimmed(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, "MY SECRET", sec)
 }
+
+func TestGetSecretCreds(t *testing.T) {
+	_, err := GetSecret("creds:panel.api-key")
+	require.ErrorContains(t, err, "CREDENTIALS_DIRECTORY is not set")
+
+	dir := t.TempDir()
+	t.Setenv(secret.ENV_CREDENTIALS_DIRECTORY, dir)
+	require.NoError(t, os.WriteFile(dir+"/panel.api-key", []byte("key-id:key-secret\n"), 0400))
+
+	value, err := GetSecret("creds:panel.api-key")
+	require.NoError(t, err)
+	require.Equal(t, "key-id:key-secret", value)
+	require.True(t, secret.HasCredential("panel.api-key"))
+	require.False(t, secret.HasCredential("panel.other"))
+
+	_, err = GetSecret("creds:panel.other")
+	require.ErrorContains(t, err, "was not passed to this service")
+	_, err = GetSecret("creds:../panel.api-key")
+	require.ErrorContains(t, err, "invalid credential name")
+	require.Error(t, secret.Secret("creds:panel.api-key").Store("value"))
+}
@@ -0,0 +1,127 @@
+package secret
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cordialsys/panel/pkg/shamir"
+)
+
+// Shamir secrets are `shamir:<k>;<share>;<share>;...`, where each share is another secret
+// reference (which may itself contain commas), any k of which reconstruct the value.
+const ShamirShareSeparator = ";"
+
+// Prefix of the encoded share values, so a share is not mistaken for the secret itself.
+const shamirSharePrefix = "panel-share-v1:"
+
+// Length of the checksum appended to the value before splitting, to detect shares that do not
+// belong together (e.g. from different versions).
+const shamirChecksumLength = 4
+
+// Create a Shamir secret reference from its threshold and share references.
+func NewShamirSecret(threshold int, shares []Secret) (Secret, error) {
+	ref := Ref{Type: Shamir, Threshold: threshold}
+	for i, share := range shares {
+		shareRef, err := share.Ref()
+		if err != nil {
+			return "", fmt.Errorf("invalid %s share %d: %v", Shamir, i+1, err)
+		}
+		ref.Shares = append(ref.Shares, shareRef)
+	}
+	if err := ref.Validate(); err != nil {
+		return "", err
+	}
+	return ref.Secret(), nil
+}
+
+func checksum(value []byte) []byte {
+	hash := sha256.Sum256(value)
+	return hash[:shamirChecksumLength]
+}
+
+// Try each combination of threshold shares, returning the first with a valid checksum.
+func combineShares(shares [][]byte, threshold int) ([]byte, bool) {
+	var search func(start int, chosen [][]byte) ([]byte, bool)
+	search = func(start int, chosen [][]byte) ([]byte, bool) {
+		if len(chosen) == threshold {
+			payload, err := shamir.Combine(chosen)
+			if err != nil || len(payload) < shamirChecksumLength {
+				return nil, false
+			}
+			value := payload[:len(payload)-shamirChecksumLength]
+			if !bytes.Equal(checksum(value), payload[len(value):]) {
+				return nil, false
+			}
+			return value, true
+		}
+		for i := start; i < len(shares); i++ {
+			if value, ok := search(i+1, append(chosen, shares[i])); ok {
+				return value, true
+			}
+		}
+		return nil, false
+	}
+	return search(0, [][]byte{})
+}
+
+func shareName(index int, share Ref) string {
+	return fmt.Sprintf("share %d (%s)", index+1, share.Type)
+}
+
+// Load shares until the value can be reconstructed, so unreachable backends are tolerated.
+func loadShamir(ref Ref) (string, error) {
+	threshold, shares := ref.Threshold, ref.Shares
+	loaded := [][]byte{}
+	failures := []string{}
+	for i, share := range shares {
+		value, err := share.Load()
+		if err == nil && !strings.HasPrefix(value, shamirSharePrefix) {
+			err = errors.New("not a share value")
+		}
+		var decoded []byte
+		if err == nil {
+			decoded, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(value, shamirSharePrefix))
+		}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", shareName(i, share), err))
+			continue
+		}
+		loaded = append(loaded, decoded)
+		if len(loaded) >= threshold {
+			if value, ok := combineShares(loaded, threshold); ok {
+				return string(value), nil
+			}
+		}
+	}
+	if len(loaded) < threshold {
+		return "", fmt.Errorf("only %d of the %d required shares could be loaded: %s",
+			len(loaded), threshold, strings.Join(failures, "; "))
+	}
+	return "", fmt.Errorf("the %d loaded shares do not reconstruct a consistent value, they may be from different versions", len(loaded))
+}
+
+// Split the value and store a share in each of the share secrets.
+func storeShamir(ref Ref, value string) error {
+	threshold, shares := ref.Threshold, ref.Shares
+	payload := append([]byte(value), checksum([]byte(value))...)
+	parts, err := shamir.Split(payload, len(shares), threshold)
+	clear(payload)
+	if err != nil {
+		return err
+	}
+	failures := []string{}
+	for i, share := range shares {
+		encoded := shamirSharePrefix + base64.StdEncoding.EncodeToString(parts[i])
+		if err := share.Store(encoded); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", shareName(i, share), err))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("failed to store %d of %d shares: %s", len(failures), len(shares), strings.Join(failures, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package secret_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cordialsys/panel/pkg/secret"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShamirSecret(t *testing.T) {
+	dir := t.TempDir()
+	shares := []secret.Secret{
+		secret.Secret("file:" + filepath.Join(dir, "share-1")),
+		secret.Secret("file:" + filepath.Join(dir, "share-2")),
+		secret.Secret("envfile:" + filepath.Join(dir, "env") + ",PANEL_SHARE_3"),
+	}
+	ref, err := secret.NewShamirSecret(2, shares)
+	require.NoError(t, err)
+	require.True(t, ref.IsType(secret.Shamir))
+
+	phrase := "abandon ability able about above absent absorb abstract absurd abuse access accident"
+	require.NoError(t, ref.Store(phrase))
+	for _, share := range shares {
+		value, err := share.Load()
+		require.NoError(t, err)
+		require.NotContains(t, value, "abandon")
+	}
+
+	value, err := ref.Load()
+	require.NoError(t, err)
+	require.Equal(t, phrase, value)
+
+	// any 2 of 3
+	require.NoError(t, os.Remove(filepath.Join(dir, "share-1")))
+	value, err = ref.Load()
+	require.NoError(t, err)
+	require.Equal(t, phrase, value)
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "share-2")))
+	_, err = ref.Load()
+	require.ErrorContains(t, err, "only 1 of the 2 required shares could be loaded: share 1 (file)")
+	require.ErrorContains(t, err, "share 2 (file)")
+}
+
+func TestShamirSecretMixedVersions(t *testing.T) {
+	dir := t.TempDir()
+	shares := []secret.Secret{
+		secret.Secret("file:" + filepath.Join(dir, "share-1")),
+		secret.Secret("file:" + filepath.Join(dir, "share-2")),
+		secret.Secret("file:" + filepath.Join(dir, "share-3")),
+	}
+	ref, err := secret.NewShamirSecret(2, shares)
+	require.NoError(t, err)
+
+	require.NoError(t, ref.Store("phrase one"))
+	old, err := os.ReadFile(filepath.Join(dir, "share-1"))
+	require.NoError(t, err)
+
+	// a rotation that only partly completed: the 2 new shares are still found
+	previous, err := ref.Rotate("phrase two")
+	require.NoError(t, err)
+	require.Equal(t, "phrase one", previous)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "share-1"), old, 0600))
+	value, err := ref.Load()
+	require.NoError(t, err)
+	require.Equal(t, "phrase two", value)
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "share-3")))
+	_, err = ref.Load()
+	require.ErrorContains(t, err, "do not reconstruct a consistent value")
+}
+
+func TestShamirSecretInvalid(t *testing.T) {
+	_, err := secret.NewShamirSecret(3, []secret.Secret{"env:A", "env:B"})
+	require.ErrorContains(t, err, "threshold must be between 2")
+	_, err = secret.NewShamirSecret(2, []secret.Secret{"env:A"})
+	require.Error(t, err)
+	_, err = secret.NewShamirSecret(2, []secret.Secret{"env:A", "shamir:2;env:B;env:C"})
+	require.Error(t, err)
+	_, err = secret.NewShamirSecret(2, []secret.Secret{"env:A", "nope"})
+	require.Error(t, err)
+
+	t.Setenv("PANEL_TEST_NOT_A_SHARE", "some other value")
+	_, err = secret.Secret("shamir:2;env:PANEL_TEST_NOT_A_SHARE;env:PANEL_TEST_MISSING").Load()
+	require.ErrorContains(t, err, "not a share value")
+}
@@ -0,0 +1,97 @@
+package secret
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cordialsys/panel/pkg/plog"
+)
+
+// Types that support `Store` and `Rotate`.
+var WritableTypes = []SecretType{
+	EnvFile, File, Vault, GcpSecretManager, AwsSecretManager, Keyring, Shamir, AgeFile,
+}
+
+// Write the value to the secret's backend, as a new version where the backend is versioned.
+// The secret is created if it does not exist yet.
+func (s Secret) Store(value string) error {
+	if err := StoreSecret(string(s), value); err != nil {
+		return err
+	}
+	plog.AddSecret(value)
+	if DefaultResolver != nil {
+		DefaultResolver.Forget(s)
+	}
+	return nil
+}
+
+// Replace the current value with a new one, returning the previous value so the caller can
+// roll back (with `Store`) if the new value could not be put to use.
+func (s Secret) Rotate(value string) (previous string, err error) {
+	// not from the cache, as the previous value must be exact to roll back to
+	previous, err = s.loadUncached()
+	if err != nil {
+		return "", fmt.Errorf("failed to load current value: %v", err)
+	}
+	if previous == value {
+		return "", errors.New("new value is the same as the current value")
+	}
+	if err := s.Store(value); err != nil {
+		return "", err
+	}
+	return previous, nil
+}
+
+// StoreSecret writes a secret, e.g. to a file or secret manager.
+func StoreSecret(uri string, value string) error {
+	ref, err := ParseRef(uri)
+	if err != nil {
+		return fmt.Errorf("could not store secret, %w", err)
+	}
+	if value == "" {
+		return errors.New("cannot store an empty secret")
+	}
+
+	switch ref.Type {
+	case EnvFile:
+		return storeEnvFile(replaceTilda(ref.Path), ref.Name, value)
+	case File:
+		return writeFileAtomic(replaceTilda(ref.Path), []byte(value+"\n"))
+	case Vault:
+		loader, err := newAuthenticatedVaultClient(ref.Url)
+		if err != nil {
+			return err
+		}
+		client, ok := loader.(VaultStorer)
+		if !ok {
+			return errors.New("vault client does not support writing secrets")
+		}
+		// keep the other keys of the secret, writing a new KV version
+		existing, err := client.LoadSecretData(ref.Path)
+		if err != nil {
+			return err
+		}
+		data := map[string]interface{}{}
+		if existingData, ok := existing.Data["data"].(map[string]interface{}); ok {
+			for k, v := range existingData {
+				data[k] = v
+			}
+		}
+		data[ref.Key] = value
+		_, err = client.StoreSecretData(ref.Path, map[string]interface{}{"data": data})
+		return err
+	case GcpSecretManager:
+		return storeGcpSecret(ref, value)
+	case AwsSecretManager:
+		return storeAwsSecret(ref, value)
+	case Keyring:
+		return AddKeyringEntry(KeyringHome, ref.Name, value)
+	case AgeFile:
+		return storeAgeFile(ref, value)
+	case Shamir:
+		return storeShamir(ref, value)
+	case Env, Raw, Creds, Kms:
+		return fmt.Errorf("%s secrets cannot be stored, use one of %v", ref.Type, WritableTypes)
+	}
+	return errors.New("invalid secret source for: ***")
+}
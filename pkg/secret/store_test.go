@@ -0,0 +1,341 @@
+package secret_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	awssecretmanager "github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/cordialsys/panel/pkg/secret"
+	vault "github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestStoreFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ear")
+	ref := secret.Secret("file:" + path)
+
+	require.NoError(t, ref.Store("phrase one"))
+	stat, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+
+	previous, err := ref.Rotate("phrase two")
+	require.NoError(t, err)
+	require.Equal(t, "phrase one", previous)
+	value, err := ref.Load()
+	require.NoError(t, err)
+	require.Equal(t, "phrase two", value)
+
+	_, err = ref.Rotate("phrase two")
+	require.Error(t, err)
+
+	require.ErrorContains(t, secret.Secret("env:EAR").Store("x"), "cannot be stored")
+	require.ErrorContains(t, secret.NewRawSecret("x").Store("y"), "cannot be stored")
+}
+
+func TestStoreEnvFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "env")
+	require.NoError(t, os.WriteFile(path, []byte("# comment\nTREASURY_HOME=/var/treasury\nEAR=old phrase\n"), 0640))
+	ref := secret.Secret("envfile:" + path + ",EAR")
+
+	value, err := ref.Load()
+	require.NoError(t, err)
+	require.Equal(t, "old phrase", value)
+
+	previous, err := ref.Rotate("new phrase")
+	require.NoError(t, err)
+	require.Equal(t, "old phrase", previous)
+	require.NoError(t, secret.Secret("envfile:"+path+",OTHER").Store("other value"))
+
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "# comment\nTREASURY_HOME=/var/treasury\nEAR=new phrase\nOTHER=other value\n", string(contents))
+	stat, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0640), stat.Mode().Perm())
+
+	require.Error(t, ref.Store("multi\nline"))
+}
+
+func TestStoreVault(t *testing.T) {
+	var lock sync.Mutex
+	versions := []map[string]interface{}{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if strings.HasPrefix(r.URL.Path, "/v1/sys/internal/ui/mounts/") {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{"path": "secret/", "type": "kv", "options": map[string]interface{}{"version": "2"}},
+			})
+			return
+		}
+		require.Equal(t, "/v1/secret/data/panel", r.URL.Path)
+		switch r.Method {
+		case http.MethodGet:
+			if len(versions) == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{"data": versions[len(versions)-1]},
+			})
+		case http.MethodPut, http.MethodPost:
+			var body map[string]map[string]interface{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			versions = append(versions, body["data"])
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{"version": len(versions)},
+			})
+		}
+	}))
+	defer server.Close()
+	secret.NewVaultClient = func(cfg *vault.Config) (secret.VaultLoader, error) {
+		cli, err := vault.NewClient(cfg)
+		return &secret.DefaultVaultLoader{Client: cli}, err
+	}
+
+	ref := secret.Secret(fmt.Sprintf("vault:%s,secret/data/panel/ear", server.URL))
+	require.NoError(t, ref.Store("phrase one"))
+	require.NoError(t, secret.Secret(fmt.Sprintf("vault:%s,secret/data/panel/other", server.URL)).Store("other value"))
+
+	previous, err := ref.Rotate("phrase two")
+	require.NoError(t, err)
+	require.Equal(t, "phrase one", previous)
+	value, err := ref.Load()
+	require.NoError(t, err)
+	require.Equal(t, "phrase two", value)
+
+	// each write is a new version, keeping the other keys
+	require.Len(t, versions, 3)
+	require.Equal(t, map[string]interface{}{"ear": "phrase two", "other": "other value"}, versions[2])
+}
+
+func TestStoreAws(t *testing.T) {
+	var lock sync.Mutex
+	secrets := map[string][]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		var body map[string]string
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		name := body["SecretId"] + body["Name"]
+		notFound := func() {
+			w.Header().Set("X-Amzn-Errortype", "ResourceNotFoundException")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "ResourceNotFoundException", "message": "not found"})
+		}
+		switch strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "secretsmanager.") {
+		case "GetSecretValue":
+			if len(secrets[name]) == 0 {
+				notFound()
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"Name": name, "SecretString": secrets[name][len(secrets[name])-1]})
+		case "CreateSecret":
+			secrets[name] = []string{body["SecretString"]}
+			json.NewEncoder(w).Encode(map[string]string{"Name": name})
+		case "PutSecretValue":
+			if len(secrets[name]) == 0 {
+				notFound()
+				return
+			}
+			secrets[name] = append(secrets[name], body["SecretString"])
+			json.NewEncoder(w).Encode(map[string]string{"Name": name})
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+	defer server.Close()
+	secret.NewAwsClient = func(ctx context.Context, region string) (*awssecretmanager.Client, error) {
+		return awssecretmanager.New(awssecretmanager.Options{
+			Region:       "us-east-1",
+			BaseEndpoint: aws.String(server.URL),
+			Credentials:  credentials.NewStaticCredentialsProvider("key", "secret", ""),
+		}), nil
+	}
+
+	ref := secret.Secret("aws:panel:ear,us-east-1")
+	require.NoError(t, ref.Store("phrase one"))
+	require.NoError(t, secret.Secret("aws:panel:other").Store("other value"))
+	previous, err := ref.Rotate("phrase two")
+	require.NoError(t, err)
+	require.Equal(t, "phrase one", previous)
+	value, err := ref.Load()
+	require.NoError(t, err)
+	require.Equal(t, "phrase two", value)
+
+	require.Len(t, secrets["panel"], 3)
+	var data map[string]string
+	require.NoError(t, json.Unmarshal([]byte(secrets["panel"][2]), &data))
+	require.Equal(t, map[string]string{"ear": "phrase two", "other": "other value"}, data)
+
+	require.Error(t, secret.Secret("aws:panel:ear,us-east-1,AWSPREVIOUS").Store("x"))
+
+	// an ARN is not split at its colons
+	arn := "arn:aws:secretsmanager:us-east-1:123456789012:secret:panel-AbCdEf"
+	require.NoError(t, secret.Secret("aws:"+arn+":ear").Store("phrase three"))
+	require.Equal(t, []string{`{"ear":"phrase three"}`}, secrets[arn])
+	value, err = secret.Secret("aws:" + arn + ":ear").Load()
+	require.NoError(t, err)
+	require.Equal(t, "phrase three", value)
+}
+
+func TestAwsBinary(t *testing.T) {
+	var lock sync.Mutex
+	stored := [][]byte{[]byte(`{"ear":"phrase one"}`)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		var body struct {
+			SecretId     string
+			SecretString *string
+			SecretBinary []byte
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		switch strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "secretsmanager.") {
+		case "GetSecretValue":
+			json.NewEncoder(w).Encode(map[string]interface{}{"Name": body.SecretId, "SecretBinary": stored[len(stored)-1]})
+		case "PutSecretValue":
+			require.Nil(t, body.SecretString)
+			stored = append(stored, body.SecretBinary)
+			json.NewEncoder(w).Encode(map[string]string{"Name": body.SecretId})
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+	defer server.Close()
+	secret.NewAwsClient = func(ctx context.Context, region string) (*awssecretmanager.Client, error) {
+		return awssecretmanager.New(awssecretmanager.Options{
+			Region:       "us-east-1",
+			BaseEndpoint: aws.String(server.URL),
+			Credentials:  credentials.NewStaticCredentialsProvider("key", "secret", ""),
+		}), nil
+	}
+
+	ref := secret.Secret("aws:panel:ear")
+	value, err := ref.Load()
+	require.NoError(t, err)
+	require.Equal(t, "phrase one", value)
+
+	// stays binary when stored
+	require.NoError(t, ref.Store("phrase two"))
+	require.JSONEq(t, `{"ear":"phrase two"}`, string(stored[1]))
+	value, err = ref.Load()
+	require.NoError(t, err)
+	require.Equal(t, "phrase two", value)
+}
+
+type fakeGcp struct {
+	secretmanagerpb.UnimplementedSecretManagerServiceServer
+	lock    sync.Mutex
+	secrets map[string][][]byte
+}
+
+func (f *fakeGcp) CreateSecret(ctx context.Context, req *secretmanagerpb.CreateSecretRequest) (*secretmanagerpb.Secret, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	name := req.Parent + "/secrets/" + req.SecretId
+	f.secrets[name] = [][]byte{}
+	return &secretmanagerpb.Secret{Name: name}, nil
+}
+
+func (f *fakeGcp) AddSecretVersion(ctx context.Context, req *secretmanagerpb.AddSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	versions, ok := f.secrets[req.Parent]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "secret not found")
+	}
+	if req.Payload.GetDataCrc32C() != int64(crc32.Checksum(req.Payload.Data, crc32.MakeTable(crc32.Castagnoli))) {
+		return nil, status.Error(codes.InvalidArgument, "checksum mismatch")
+	}
+	f.secrets[req.Parent] = append(versions, req.Payload.Data)
+	return &secretmanagerpb.SecretVersion{Name: fmt.Sprintf("%s/versions/%d", req.Parent, len(versions)+1)}, nil
+}
+
+func (f *fakeGcp) AccessSecretVersion(ctx context.Context, req *secretmanagerpb.AccessSecretVersionRequest) (*secretmanagerpb.AccessSecretVersionResponse, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	name, version, _ := strings.Cut(req.Name, "/versions/")
+	versions := f.secrets[name]
+	idx := len(versions) - 1
+	if version != "latest" {
+		fmt.Sscan(version, &idx)
+		idx--
+	}
+	if idx < 0 || idx >= len(versions) {
+		return nil, status.Error(codes.NotFound, "version not found")
+	}
+	return &secretmanagerpb.AccessSecretVersionResponse{Payload: &secretmanagerpb.SecretPayload{Data: versions[idx]}}, nil
+}
+
+func TestStoreGcp(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	fake := &fakeGcp{secrets: map[string][][]byte{}}
+	secretmanagerpb.RegisterSecretManagerServiceServer(server, fake)
+	go server.Serve(listener)
+	defer server.Stop()
+	locations := []string{}
+	secret.NewGcpClient = func(ctx context.Context, location string) (*secretmanager.Client, error) {
+		locations = append(locations, location)
+		return secretmanager.NewClient(ctx,
+			option.WithEndpoint(listener.Addr().String()),
+			option.WithoutAuthentication(),
+			option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+		)
+	}
+
+	ref := secret.Secret("gcp:my-project,panel-ear")
+	require.NoError(t, ref.Store("phrase one"))
+	previous, err := ref.Rotate("phrase two")
+	require.NoError(t, err)
+	require.Equal(t, "phrase one", previous)
+
+	value, err := ref.Load()
+	require.NoError(t, err)
+	require.Equal(t, "phrase two", value)
+	value, err = secret.Secret("gcp:my-project,panel-ear,1").Load()
+	require.NoError(t, err)
+	require.Equal(t, "phrase one", value)
+
+	require.Error(t, secret.Secret("gcp:my-project,panel-ear,1").Store("x"))
+
+	// by full resource name
+	value, err = secret.Secret("gcp:projects/my-project/secrets/panel-ear/versions/1").Load()
+	require.NoError(t, err)
+	require.Equal(t, "phrase one", value)
+
+	// regional secrets use the endpoint of their location
+	locations = nil
+	regional := secret.Secret("gcp:projects/my-project/locations/europe-west1,panel-ear")
+	require.NoError(t, regional.Store("phrase three"))
+	require.Contains(t, fake.secrets, "projects/my-project/locations/europe-west1/secrets/panel-ear")
+	value, err = secret.Secret("gcp:projects/my-project/locations/europe-west1/secrets/panel-ear").Load()
+	require.NoError(t, err)
+	require.Equal(t, "phrase three", value)
+	require.Equal(t, []string{"europe-west1", "europe-west1"}, locations)
+}
@@ -1,6 +1,25 @@
 package secret
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/cordialsys/panel/pkg/plog"
 	vault "github.com/hashicorp/vault/api"
 )
 
@@ -14,20 +33,383 @@ func newVaultClient(cfg *vault.Config) (VaultLoader, error) {
 
 var NewVaultClient = newVaultClient
 
+type VaultAuthMethod string
+
+const (
+	// A token from `token_file`, or otherwise the ambient VAULT_TOKEN
+	VaultAuthToken      VaultAuthMethod = "token"
+	VaultAuthAppRole    VaultAuthMethod = "approle"
+	VaultAuthKubernetes VaultAuthMethod = "kubernetes"
+	VaultAuthAws        VaultAuthMethod = "aws"
+)
+
+var VaultAuthMethods = []VaultAuthMethod{VaultAuthToken, VaultAuthAppRole, VaultAuthKubernetes, VaultAuthAws}
+
+const DefaultKubernetesJwtFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// How to authenticate to vault.  Set in the panel config (`vault`), or per secret as query
+// parameters of the server url using the same names, e.g.
+// `vault:https://vault:8200?auth=approle&role_id=panel&secret_id=file:/etc/panel/secret-id,secret/panel/ear`.
+type VaultAuthConfig struct {
+	Method VaultAuthMethod `json:"auth,omitempty"`
+	// Mount of the auth method, if not the default for the method
+	Mount     string `json:"mount,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	// kubernetes and aws
+	Role string `json:"role,omitempty"`
+	// approle
+	RoleId   string `json:"role_id,omitempty"`
+	SecretId Secret `json:"secret_id,omitempty"`
+	// token
+	TokenFile string `json:"token_file,omitempty"`
+	// kubernetes, defaults to the service account token
+	JwtFile string `json:"jwt_file,omitempty"`
+	// aws, the global STS endpoint is used if unset
+	AwsRegion   string `json:"aws_region,omitempty"`
+	AwsServerId string `json:"aws_server_id,omitempty"`
+}
+
+// Used for vault secrets without query parameters, from the panel config.
+var DefaultVaultAuth *VaultAuthConfig
+
+// Split the authentication parameters from the server url of a vault secret.
+func parseVaultUrl(rawUrl string) (address string, auth *VaultAuthConfig, err error) {
+	address, query, ok := strings.Cut(rawUrl, "?")
+	if !ok {
+		return address, DefaultVaultAuth, nil
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid vault url parameters: %v", err)
+	}
+	// round trip through the JSON names, so the url and panel config stay in sync
+	params := map[string]string{}
+	for key := range values {
+		params[key] = values.Get(key)
+	}
+	paramsBz, _ := json.Marshal(params)
+	decoder := json.NewDecoder(strings.NewReader(string(paramsBz)))
+	decoder.DisallowUnknownFields()
+	auth = &VaultAuthConfig{}
+	if err := decoder.Decode(auth); err != nil {
+		return "", nil, fmt.Errorf("invalid vault url parameters: %v", err)
+	}
+	return address, auth, nil
+}
+
+func (auth *VaultAuthConfig) validate() error {
+	if auth.Method != "" && !slices.Contains(VaultAuthMethods, auth.Method) {
+		return fmt.Errorf("unsupported vault auth method %q, must be one of %v", auth.Method, VaultAuthMethods)
+	}
+	switch auth.Method {
+	case VaultAuthAppRole:
+		if auth.RoleId == "" || auth.SecretId == "" {
+			return errors.New("vault approle auth requires role_id and secret_id")
+		}
+		if auth.SecretId.IsType(Vault) {
+			return errors.New("vault approle secret_id cannot itself be a vault secret")
+		}
+	case VaultAuthKubernetes, VaultAuthAws:
+		if auth.Role == "" {
+			return fmt.Errorf("vault %s auth requires a role", auth.Method)
+		}
+	}
+	return nil
+}
+
+func (auth *VaultAuthConfig) mount() string {
+	if auth.Mount != "" {
+		return strings.Trim(auth.Mount, "/")
+	}
+	return string(auth.Method)
+}
+
+// The login path and request body for the auth method.
+func (auth *VaultAuthConfig) loginRequest() (string, map[string]interface{}, error) {
+	path := fmt.Sprintf("auth/%s/login", auth.mount())
+	switch auth.Method {
+	case VaultAuthAppRole:
+		secretId, err := auth.SecretId.Load()
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to load approle secret_id: %v", err)
+		}
+		return path, map[string]interface{}{"role_id": auth.RoleId, "secret_id": secretId}, nil
+	case VaultAuthKubernetes:
+		jwtFile := auth.JwtFile
+		if jwtFile == "" {
+			jwtFile = DefaultKubernetesJwtFile
+		}
+		jwt, err := os.ReadFile(replaceTilda(jwtFile))
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to read kubernetes service account token: %v", err)
+		}
+		return path, map[string]interface{}{"role": auth.Role, "jwt": strings.TrimSpace(string(jwt))}, nil
+	case VaultAuthAws:
+		data, err := auth.awsLoginData()
+		if err != nil {
+			return "", nil, err
+		}
+		return path, data, nil
+	}
+	return "", nil, fmt.Errorf("vault auth method %q does not log in", auth.Method)
+}
+
+// A signed sts:GetCallerIdentity request, which vault replays to verify the IAM identity.
+func (auth *VaultAuthConfig) awsLoginData() (map[string]interface{}, error) {
+	ctx := context.Background()
+	region := "us-east-1"
+	endpoint := "https://sts.amazonaws.com/"
+	if auth.AwsRegion != "" {
+		region = auth.AwsRegion
+		endpoint = fmt.Sprintf("https://sts.%s.amazonaws.com/", region)
+	}
+	body := "Action=GetCallerIdentity&Version=2011-06-15"
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	if auth.AwsServerId != "" {
+		req.Header.Set("X-Vault-AWS-IAM-Server-ID", auth.AwsServerId)
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, err
+	}
+	creds, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load aws credentials: %v", err)
+	}
+	payloadHash := sha256.Sum256([]byte(body))
+	err = v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(payloadHash[:]), "sts", region, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	headersBz, err := json.Marshal(req.Header)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"role":                    auth.Role,
+		"iam_http_request_method": http.MethodPost,
+		"iam_request_url":         base64.StdEncoding.EncodeToString([]byte(endpoint)),
+		"iam_request_body":        base64.StdEncoding.EncodeToString([]byte(body)),
+		"iam_request_headers":     base64.StdEncoding.EncodeToString(headersBz),
+	}, nil
+}
+
+// Tokens from logins, reused until they expire and renewed in the background where possible.
+type vaultToken struct {
+	token      string
+	expireTime time.Time
+}
+
+// Tokens are not used right up to their expiry.
+const vaultTokenMargin = 10 * time.Second
+
+var vaultTokensLock sync.Mutex
+var vaultTokens = map[string]*vaultToken{}
+
+func vaultTokenKey(address string, auth *VaultAuthConfig) string {
+	authBz, _ := json.Marshal(auth)
+	return address + "|" + string(authBz)
+}
+
+func getVaultToken(key string) (string, bool) {
+	vaultTokensLock.Lock()
+	defer vaultTokensLock.Unlock()
+	cached, ok := vaultTokens[key]
+	if !ok {
+		return "", false
+	}
+	if !cached.expireTime.IsZero() && time.Now().Add(vaultTokenMargin).After(cached.expireTime) {
+		delete(vaultTokens, key)
+		return "", false
+	}
+	return cached.token, true
+}
+
+func setVaultTokenExpiry(key string, token string, ttl time.Duration) {
+	vaultTokensLock.Lock()
+	defer vaultTokensLock.Unlock()
+	cached := &vaultToken{token: token}
+	if ttl > 0 {
+		cached.expireTime = time.Now().Add(ttl)
+	}
+	vaultTokens[key] = cached
+}
+
+func removeVaultToken(key string, token string) {
+	vaultTokensLock.Lock()
+	defer vaultTokensLock.Unlock()
+	if cached, ok := vaultTokens[key]; ok && cached.token == token {
+		delete(vaultTokens, key)
+	}
+}
+
+// Keep renewing the login token until it reaches its max TTL, after which the next load logs in again.
+func renewVaultToken(client *vault.Client, key string, login *vault.Secret) {
+	watcher, err := client.NewLifetimeWatcher(&vault.LifetimeWatcherInput{Secret: login})
+	if err != nil {
+		slog.Warn("cannot renew vault token", "error", err)
+		return
+	}
+	token := login.Auth.ClientToken
+	go watcher.Start()
+	go func() {
+		defer watcher.Stop()
+		for {
+			select {
+			case err := <-watcher.DoneCh():
+				if err != nil {
+					slog.Warn("vault token renewal stopped", "error", err)
+				}
+				removeVaultToken(key, token)
+				return
+			case renewal := <-watcher.RenewCh():
+				if renewal.Secret != nil && renewal.Secret.Auth != nil {
+					setVaultTokenExpiry(key, token, time.Duration(renewal.Secret.Auth.LeaseDuration)*time.Second)
+				}
+			}
+		}
+	}()
+}
+
+// Loaders that can authenticate with a method other than an ambient token.
+type VaultAuthenticator interface {
+	Login(auth *VaultAuthConfig) error
+}
+
+var _ VaultAuthenticator = &DefaultVaultLoader{}
+
+func (v *DefaultVaultLoader) Login(auth *VaultAuthConfig) error {
+	if err := auth.validate(); err != nil {
+		return err
+	}
+	if auth.Namespace != "" {
+		v.SetNamespace(auth.Namespace)
+	}
+	if auth.Method == "" || auth.Method == VaultAuthToken {
+		if auth.TokenFile != "" {
+			token, err := os.ReadFile(replaceTilda(auth.TokenFile))
+			if err != nil {
+				return fmt.Errorf("failed to read vault token file: %v", err)
+			}
+			v.SetToken(strings.TrimSpace(string(token)))
+		}
+		return nil
+	}
+
+	key := vaultTokenKey(v.Address(), auth)
+	if token, ok := getVaultToken(key); ok {
+		v.SetToken(token)
+		return nil
+	}
+	path, data, err := auth.loginRequest()
+	if err != nil {
+		return err
+	}
+	v.ClearToken()
+	login, err := v.Logical().Write(path, data)
+	if err != nil {
+		return fmt.Errorf("vault %s login failed: %v", auth.Method, err)
+	}
+	if login == nil || login.Auth == nil || login.Auth.ClientToken == "" {
+		return fmt.Errorf("vault %s login returned no token", auth.Method)
+	}
+	plog.AddSecret(login.Auth.ClientToken)
+	v.SetToken(login.Auth.ClientToken)
+	setVaultTokenExpiry(key, login.Auth.ClientToken, time.Duration(login.Auth.LeaseDuration)*time.Second)
+	if login.Auth.Renewable {
+		renewVaultToken(v.Client, key, login)
+	}
+	return nil
+}
+
+// Create a client for the server url of a vault secret, logging in if it has an auth method.
+func newAuthenticatedVaultClient(rawUrl string) (VaultLoader, error) {
+	address, auth, err := parseVaultUrl(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &vault.Config{Address: address}
+	// just check the error
+	_, err = vault.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	client, err := NewVaultClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if authenticator, ok := client.(VaultAuthenticator); ok && auth != nil {
+		if err := authenticator.Login(auth); err != nil {
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
 type DefaultVaultLoader struct {
 	*vault.Client
 }
 
 var _ VaultLoader = &DefaultVaultLoader{}
 
+// Resolve the path to read or write for the KV mount holding it, detecting the KV version as
+// the vault CLI does.  Paths on KV v2 mounts may be given with or without the `data/` segment.
+// If the mount cannot be inspected (e.g. no permission), the path is used as is.
+func (v *DefaultVaultLoader) kvPath(vaultPath string) (string, int) {
+	mount, err := v.Logical().Read("sys/internal/ui/mounts/" + vaultPath)
+	if err != nil || mount == nil {
+		return vaultPath, 0
+	}
+	mountPath, _ := mount.Data["path"].(string)
+	mountType, _ := mount.Data["type"].(string)
+	if mountPath == "" || (mountType != "kv" && mountType != "generic") {
+		return vaultPath, 0
+	}
+	options, _ := mount.Data["options"].(map[string]interface{})
+	if version, _ := options["version"].(string); version != "2" {
+		return vaultPath, 1
+	}
+	rest := strings.TrimPrefix(vaultPath, mountPath)
+	if strings.HasPrefix(rest, "data/") {
+		return vaultPath, 2
+	}
+	return mountPath + "data/" + rest, 2
+}
+
+// Secrets are returned in the KV v2 shape (`{"data": {...}}`), whatever the mount's version.
 func (v *DefaultVaultLoader) LoadSecretData(vaultPath string) (*vault.Secret, error) {
+	vaultPath, version := v.kvPath(vaultPath)
 	secret, err := v.Logical().Read(vaultPath)
 	if err != nil || secret == nil { // yes, secret can be nil
 		return &vault.Secret{}, err
 	}
+	if version == 1 {
+		secret.Data = map[string]interface{}{"data": secret.Data}
+	}
 	return secret, nil
 }
 
 type VaultLoader interface {
 	LoadSecretData(path string) (*vault.Secret, error)
 }
+
+// Loaders that can also write secrets, e.g. to rotate them.
+type VaultStorer interface {
+	VaultLoader
+	StoreSecretData(path string, data map[string]interface{}) (*vault.Secret, error)
+}
+
+var _ VaultStorer = &DefaultVaultLoader{}
+
+// The data is given in the KV v2 shape (`{"data": {...}}`), whatever the mount's version.
+func (v *DefaultVaultLoader) StoreSecretData(vaultPath string, data map[string]interface{}) (*vault.Secret, error) {
+	vaultPath, version := v.kvPath(vaultPath)
+	if version == 1 {
+		data, _ = data["data"].(map[string]interface{})
+	}
+	return v.Logical().Write(vaultPath, data)
+}
@@ -0,0 +1,223 @@
+package secret_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cordialsys/panel/pkg/secret"
+	vault "github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/require"
+)
+
+// A vault server with a KV v1 mount at kv1/, a KV v2 mount at secret/, and the login endpoints
+// of each auth method.
+type fakeVault struct {
+	t         *testing.T
+	lock      sync.Mutex
+	kv        map[string]map[string]interface{}
+	logins    map[string]int
+	tokens    map[string]bool
+	namespace string
+}
+
+func newFakeVault(t *testing.T) (*fakeVault, *httptest.Server) {
+	fake := &fakeVault{
+		t:      t,
+		kv:     map[string]map[string]interface{}{},
+		logins: map[string]int{},
+		tokens: map[string]bool{"static-token": true},
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	secret.NewVaultClient = func(cfg *vault.Config) (secret.VaultLoader, error) {
+		cli, err := vault.NewClient(cfg)
+		if err == nil {
+			cli.ClearToken()
+		}
+		return &secret.DefaultVaultLoader{Client: cli}, err
+	}
+	return fake, server
+}
+
+func (fake *fakeVault) login(w http.ResponseWriter, method string) {
+	fake.logins[method]++
+	token := fmt.Sprintf("%s-token-%d", method, fake.logins[method])
+	fake.tokens[token] = true
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"auth": map[string]interface{}{"client_token": token, "lease_duration": 3600, "renewable": false},
+	})
+}
+
+func (fake *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	t := fake.t
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	require.Equal(t, fake.namespace, r.Header.Get("X-Vault-Namespace"))
+
+	var body map[string]interface{}
+	if r.Method == http.MethodPut || r.Method == http.MethodPost {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+	}
+	switch path {
+	case "auth/approle/login":
+		if body["role_id"] != "panel" || body["secret_id"] != "secret-id-value" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fake.login(w, "approle")
+		return
+	case "auth/k8s/login":
+		require.Equal(t, "panel", body["role"])
+		require.Equal(t, "service-account-jwt", body["jwt"])
+		fake.login(w, "kubernetes")
+		return
+	case "auth/aws/login":
+		require.Equal(t, "panel", body["role"])
+		url, _ := base64.StdEncoding.DecodeString(body["iam_request_url"].(string))
+		require.Equal(t, "https://sts.eu-west-1.amazonaws.com/", string(url))
+		headersBz, _ := base64.StdEncoding.DecodeString(body["iam_request_headers"].(string))
+		headers := http.Header{}
+		require.NoError(t, json.Unmarshal(headersBz, &headers))
+		require.Contains(t, headers.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDPANEL/")
+		require.Equal(t, "vault.example.com", headers.Get("X-Vault-AWS-IAM-Server-ID"))
+		fake.login(w, "aws")
+		return
+	}
+
+	if !fake.tokens[r.Header.Get("X-Vault-Token")] {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"permission denied"}})
+		return
+	}
+	if mountPath, ok := strings.CutPrefix(path, "sys/internal/ui/mounts/"); ok {
+		mount := map[string]interface{}{"path": "secret/", "type": "kv", "options": map[string]interface{}{"version": "2"}}
+		if strings.HasPrefix(mountPath, "kv1/") {
+			mount = map[string]interface{}{"path": "kv1/", "type": "kv", "options": nil}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": mount})
+		return
+	}
+	// v2 data is always read and written under data/, v1 at the path itself
+	isV2 := strings.HasPrefix(path, "secret/")
+	if isV2 {
+		require.True(t, strings.HasPrefix(path, "secret/data/"), path)
+	}
+	switch r.Method {
+	case http.MethodGet:
+		data, ok := fake.kv[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if isV2 {
+			data = map[string]interface{}{"data": data}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	default:
+		if isV2 {
+			body, _ = body["data"].(map[string]interface{})
+		}
+		fake.kv[path] = body
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestVaultKvVersions(t *testing.T) {
+	fake, server := newFakeVault(t)
+	tokenFile := filepath.Join(t.TempDir(), "vault-token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("static-token\n"), 0600))
+	url := server.URL + "?auth=token&token_file=" + tokenFile
+
+	// v1 mounts are read and written at the path
+	v1 := secret.Secret(fmt.Sprintf("vault:%s,kv1/panel/ear", url))
+	require.NoError(t, v1.Store("phrase one"))
+	require.Equal(t, map[string]interface{}{"ear": "phrase one"}, fake.kv["kv1/panel"])
+	value, err := v1.Load()
+	require.NoError(t, err)
+	require.Equal(t, "phrase one", value)
+
+	// v2 mounts accept paths with or without data/
+	v2 := secret.Secret(fmt.Sprintf("vault:%s,secret/panel/ear", url))
+	require.NoError(t, v2.Store("phrase two"))
+	require.Equal(t, map[string]interface{}{"ear": "phrase two"}, fake.kv["secret/data/panel"])
+	for _, ref := range []secret.Secret{v2, secret.Secret(fmt.Sprintf("vault:%s,secret/data/panel/ear", url))} {
+		value, err := ref.Load()
+		require.NoError(t, err)
+		require.Equal(t, "phrase two", value)
+	}
+
+	// no token
+	_, err = secret.Secret(fmt.Sprintf("vault:%s,kv1/panel/ear", server.URL)).Load()
+	require.ErrorContains(t, err, "permission denied")
+}
+
+func TestVaultAppRole(t *testing.T) {
+	fake, server := newFakeVault(t)
+	t.Setenv("PANEL_TEST_SECRET_ID", "secret-id-value")
+	fake.kv["kv1/panel"] = map[string]interface{}{"ear": "phrase one"}
+
+	ref := secret.Secret(fmt.Sprintf("vault:%s?auth=approle&role_id=panel&secret_id=env:PANEL_TEST_SECRET_ID,kv1/panel/ear", server.URL))
+	for range 3 {
+		value, err := ref.Load()
+		require.NoError(t, err)
+		require.Equal(t, "phrase one", value)
+	}
+	// the login token is reused until it expires
+	require.Equal(t, 1, fake.logins["approle"])
+
+	_, err := secret.Secret(fmt.Sprintf("vault:%s?auth=approle&role_id=other&secret_id=env:PANEL_TEST_SECRET_ID,kv1/panel/ear", server.URL)).Load()
+	require.ErrorContains(t, err, "vault approle login failed")
+	_, err = secret.Secret(fmt.Sprintf("vault:%s?auth=approle&role_id=panel,kv1/panel/ear", server.URL)).Load()
+	require.ErrorContains(t, err, "requires role_id and secret_id")
+	_, err = secret.Secret(fmt.Sprintf("vault:%s?auth=ldap,kv1/panel/ear", server.URL)).Load()
+	require.ErrorContains(t, err, "unsupported vault auth method")
+	_, err = secret.Secret(fmt.Sprintf("vault:%s?unknown=1,kv1/panel/ear", server.URL)).Load()
+	require.ErrorContains(t, err, "invalid vault url parameters")
+}
+
+func TestVaultKubernetesPanelConfig(t *testing.T) {
+	fake, server := newFakeVault(t)
+	fake.namespace = "team/panel"
+	fake.kv["secret/data/panel"] = map[string]interface{}{"ear": "phrase one"}
+	jwtFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(jwtFile, []byte("service-account-jwt"), 0600))
+
+	// secrets without parameters use the panel config
+	secret.DefaultVaultAuth = &secret.VaultAuthConfig{
+		Method:    secret.VaultAuthKubernetes,
+		Mount:     "k8s",
+		Namespace: "team/panel",
+		Role:      "panel",
+		JwtFile:   jwtFile,
+	}
+	defer func() { secret.DefaultVaultAuth = nil }()
+
+	value, err := secret.Secret(fmt.Sprintf("vault:%s,secret/panel/ear", server.URL)).Load()
+	require.NoError(t, err)
+	require.Equal(t, "phrase one", value)
+	require.Equal(t, 1, fake.logins["kubernetes"])
+}
+
+func TestVaultAwsIam(t *testing.T) {
+	fake, server := newFakeVault(t)
+	fake.kv["kv1/panel"] = map[string]interface{}{"ear": "phrase one"}
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDPANEL")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "none"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "none"))
+
+	ref := secret.Secret(fmt.Sprintf("vault:%s?auth=aws&role=panel&aws_region=eu-west-1&aws_server_id=vault.example.com,kv1/panel/ear", server.URL))
+	value, err := ref.Load()
+	require.NoError(t, err)
+	require.Equal(t, "phrase one", value)
+	require.Equal(t, 1, fake.logins["aws"])
+}
@@ -0,0 +1,145 @@
+package shamir
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// Shamir's secret sharing over GF(2^8), byte-wise.  Each share is the polynomial evaluated for
+// every byte of the secret, followed by the share's x coordinate.
+
+const MaxParts = 255
+
+var expTable [255]byte
+var logTable [256]byte
+
+// multiply without tables, reducing by the AES polynomial x^8 + x^4 + x^3 + x + 1
+func mulSlow(a, b byte) byte {
+	var result byte
+	for b > 0 {
+		if b&1 == 1 {
+			result ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return result
+}
+
+func init() {
+	// 3 generates the multiplicative group
+	var x byte = 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = x
+		logTable[x] = byte(i)
+		x = mulSlow(x, 3)
+	}
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])+int(logTable[b]))%255]
+}
+
+func div(a, b byte) byte {
+	if b == 0 {
+		panic("shamir: division by zero")
+	}
+	if a == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])-int(logTable[b])+255)%255]
+}
+
+// Evaluate the polynomial with the given coefficients (lowest degree first) at x.
+func evaluate(coefficients []byte, x byte) byte {
+	var result byte
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		result = mul(result, x) ^ coefficients[i]
+	}
+	return result
+}
+
+// Split the secret into `parts` shares, any `threshold` of which reconstruct it.
+func Split(secret []byte, parts int, threshold int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("cannot split an empty secret")
+	}
+	if threshold < 2 {
+		return nil, errors.New("threshold must be at least 2")
+	}
+	if parts < threshold {
+		return nil, errors.New("parts cannot be less than the threshold")
+	}
+	if parts > MaxParts {
+		return nil, fmt.Errorf("parts cannot exceed %d", MaxParts)
+	}
+
+	shares := make([][]byte, parts)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = byte(i + 1)
+	}
+	coefficients := make([]byte, threshold)
+	defer clear(coefficients)
+	for index, secretByte := range secret {
+		coefficients[0] = secretByte
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			shares[i][index] = evaluate(coefficients, shares[i][len(secret)])
+		}
+	}
+	return shares, nil
+}
+
+// Combine at least threshold shares into the secret.  Combining too few (or mismatched) shares
+// yields a wrong value rather than an error, so callers should verify the result.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("at least 2 shares are required")
+	}
+	length := len(shares[0])
+	if length < 2 {
+		return nil, errors.New("shares are too short")
+	}
+	xs := make([]byte, len(shares))
+	seen := map[byte]bool{}
+	for i, share := range shares {
+		if len(share) != length {
+			return nil, errors.New("all shares must be the same length")
+		}
+		x := share[length-1]
+		if x == 0 || seen[x] {
+			return nil, errors.New("shares must have distinct, non-zero coordinates")
+		}
+		seen[x] = true
+		xs[i] = x
+	}
+
+	// Lagrange interpolation at x = 0
+	secret := make([]byte, length-1)
+	for index := range secret {
+		var value byte
+		for i, share := range shares {
+			var basis byte = 1
+			for j := range shares {
+				if i == j {
+					continue
+				}
+				basis = mul(basis, div(xs[j], xs[i]^xs[j]))
+			}
+			value ^= mul(share[index], basis)
+		}
+		secret[index] = value
+	}
+	return secret, nil
+}
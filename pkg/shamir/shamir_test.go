@@ -0,0 +1,55 @@
+package shamir_test
+
+import (
+	"testing"
+
+	"github.com/cordialsys/panel/pkg/shamir"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("abandon ability able about above absent absorb abstract absurd abuse access accident")
+	shares, err := shamir.Split(secret, 5, 3)
+	require.NoError(t, err)
+	require.Len(t, shares, 5)
+	for _, share := range shares {
+		require.Len(t, share, len(secret)+1)
+		require.NotContains(t, string(share), "abandon")
+	}
+
+	// any 3 shares, in any order
+	for _, indexes := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		subset := [][]byte{}
+		for _, i := range indexes {
+			subset = append(subset, shares[i])
+		}
+		combined, err := shamir.Combine(subset)
+		require.NoError(t, err)
+		require.Equal(t, secret, combined)
+	}
+
+	// too few shares give a wrong value
+	combined, err := shamir.Combine(shares[:2])
+	require.NoError(t, err)
+	require.NotEqual(t, secret, combined)
+}
+
+func TestSplitCombineErrors(t *testing.T) {
+	_, err := shamir.Split([]byte{}, 3, 2)
+	require.Error(t, err)
+	_, err = shamir.Split([]byte("secret"), 3, 1)
+	require.Error(t, err)
+	_, err = shamir.Split([]byte("secret"), 2, 3)
+	require.Error(t, err)
+	_, err = shamir.Split([]byte("secret"), 256, 3)
+	require.Error(t, err)
+
+	shares, err := shamir.Split([]byte("secret"), 3, 2)
+	require.NoError(t, err)
+	_, err = shamir.Combine(shares[:1])
+	require.Error(t, err)
+	_, err = shamir.Combine([][]byte{shares[0], shares[0]})
+	require.ErrorContains(t, err, "distinct")
+	_, err = shamir.Combine([][]byte{shares[0], shares[1][1:]})
+	require.ErrorContains(t, err, "same length")
+}
@@ -0,0 +1,76 @@
+package snapshot
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Entry is a snapshot in the backup bucket, parsed from its key.
+type Entry struct {
+	Key        string    `json:"key"`
+	Node       string    `json:"node"`
+	BakShortId string    `json:"bak_short_id"`
+	Id         string    `json:"id"`
+	Size       int64     `json:"size"`
+	UploadTime time.Time `json:"upload_time"`
+	// Read from the sidecar of the snapshot, or from `info.json` in the snapshot
+	Info *Info `json:"info,omitempty"`
+	// Why the info could not be read
+	InfoError string `json:"info_error,omitempty"`
+	// Hex SHA-256 of the snapshot, from its sidecar
+	Sha256 string `json:"sha256,omitempty"`
+	// The info and hash are from a sidecar signed by this panel, or by a key endorsed with the bak
+	Verified bool `json:"verified,omitempty"`
+}
+
+// Parse a `nodes/<node>/snapshots/<bak-short-id>/<id>.tar` key.
+func ParseKey(key string) (Entry, bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 5 || parts[0] != "nodes" || parts[2] != "snapshots" {
+		return Entry{}, false
+	}
+	id, ok := strings.CutSuffix(parts[4], ".tar")
+	if !ok || parts[1] == "" || parts[3] == "" || id == "" {
+		return Entry{}, false
+	}
+	return Entry{Key: key, Node: parts[1], BakShortId: parts[3], Id: id}, true
+}
+
+// Read `info.json` from a snapshot tar, which may be gzipped, stopping as soon as it is found.
+func ReadInfo(r io.Reader) (*Info, error) {
+	buffered := bufio.NewReader(r)
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = buffered
+	}
+	reader := tar.NewReader(r)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("snapshot has no info.json")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read snapshot: %v", err)
+		}
+		if strings.TrimPrefix(header.Name, "./") != "info.json" {
+			continue
+		}
+		var info Info
+		if err := json.NewDecoder(reader).Decode(&info); err != nil {
+			return nil, fmt.Errorf("failed to parse snapshot info: %v", err)
+		}
+		return &info, nil
+	}
+}
@@ -0,0 +1,228 @@
+package snapshot
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"filippo.io/age"
+)
+
+const sidecarSuffix = ".json"
+
+// Signing keys are endorsed with the bak next to the snapshots they sign, as
+// `signing-key-<hex public key>.mac`.
+const signingKeyPrefix = "signing-key-"
+const signingKeySuffix = ".mac"
+
+// HKDF info of the endorsement MAC key
+const endorsementInfo = "cordial panel snapshot signing key endorsement"
+
+var ErrUntrustedSidecar = errors.New("sidecar is signed by an untrusted key")
+
+// Sidecar describes a snapshot, so that it can be listed and selected without downloading it.
+type Sidecar struct {
+	Info Info `json:"info"`
+	// Hex SHA-256 of the snapshot tar
+	Sha256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+	// Age recipients the snapshot is encrypted to
+	Recipients []string `json:"recipients"`
+}
+
+// SignedSidecar is what is written next to the snapshot.
+type SignedSidecar struct {
+	// The JSON encoded sidecar, exactly as it was signed
+	Payload   json.RawMessage `json:"payload"`
+	PublicKey []byte          `json:"public_key"`
+	Signature []byte          `json:"signature"`
+}
+
+// The sidecar of `<id>.tar` is `<id>.tar.json`.
+func SidecarKey(snapshotKey string) string {
+	return snapshotKey + sidecarSuffix
+}
+
+// The snapshot a sidecar key belongs to.
+func ParseSidecarKey(key string) (string, bool) {
+	snapshotKey, ok := strings.CutSuffix(key, sidecarSuffix)
+	if !ok || !strings.HasSuffix(snapshotKey, ".tar") {
+		return "", false
+	}
+	return snapshotKey, true
+}
+
+// Hash a snapshot tar and describe it.
+func NewSidecar(info Info, tar io.Reader) (*Sidecar, error) {
+	hash := sha256.New()
+	size, err := io.Copy(hash, tar)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash snapshot: %v", err)
+	}
+	recipients := []string{}
+	if info.Bak != "" {
+		recipients = append(recipients, info.Bak)
+	}
+	return &Sidecar{
+		Info:       info,
+		Sha256:     hex.EncodeToString(hash.Sum(nil)),
+		Size:       size,
+		Recipients: recipients,
+	}, nil
+}
+
+func (s *Sidecar) Sign(key ed25519.PrivateKey) ([]byte, error) {
+	payload, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(SignedSidecar{
+		Payload:   payload,
+		PublicKey: key.Public().(ed25519.PublicKey),
+		Signature: ed25519.Sign(key, payload),
+	}, "", "  ")
+}
+
+// Parse a sidecar, checking it is signed by one of the trusted keys.
+func VerifySidecar(data []byte, trusted ...ed25519.PublicKey) (*Sidecar, error) {
+	var signed SignedSidecar
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return nil, fmt.Errorf("failed to parse sidecar: %v", err)
+	}
+	// the file is indented, payload included, so compact it back to what was signed
+	var payload bytes.Buffer
+	if err := json.Compact(&payload, signed.Payload); err != nil {
+		return nil, fmt.Errorf("failed to parse sidecar: %v", err)
+	}
+	if len(signed.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(signed.PublicKey, payload.Bytes(), signed.Signature) {
+		return nil, fmt.Errorf("sidecar has an invalid signature")
+	}
+	if !slices.ContainsFunc(trusted, func(key ed25519.PublicKey) bool { return key.Equal(ed25519.PublicKey(signed.PublicKey)) }) {
+		return nil, ErrUntrustedSidecar
+	}
+	var sidecar Sidecar
+	if err := json.Unmarshal(signed.Payload, &sidecar); err != nil {
+		return nil, fmt.Errorf("failed to parse sidecar payload: %v", err)
+	}
+	return &sidecar, nil
+}
+
+// Load the key sidecars are signed with, or generate (once) a new one.
+func LoadOrGenerateSigningKey(path string) (ed25519.PrivateKey, error) {
+	keyPem, err := os.ReadFile(path)
+	if err == nil {
+		key, err := parseSigningKey(keyPem)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	keyPem, err = marshalSigningKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, keyPem, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func marshalSigningKey(key ed25519.PrivateKey) ([]byte, error) {
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), nil
+}
+
+func parseSigningKey(keyPem []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(keyPem)
+	if block == nil {
+		return nil, fmt.Errorf("not a PEM file")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ed25519Key, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not an ed25519 key")
+	}
+	return ed25519Key, nil
+}
+
+// The name of the endorsement of a signing key, in the directory of the snapshots it signs.
+func SigningKeyName(key ed25519.PublicKey) string {
+	return signingKeyPrefix + hex.EncodeToString(key) + signingKeySuffix
+}
+
+// The public key named by the name of an endorsement.
+func ParseSigningKeyName(name string) (ed25519.PublicKey, bool) {
+	hexKey, ok := strings.CutPrefix(name, signingKeyPrefix)
+	if !ok {
+		return nil, false
+	}
+	hexKey, ok = strings.CutSuffix(hexKey, signingKeySuffix)
+	if !ok {
+		return nil, false
+	}
+	key, err := hex.DecodeString(hexKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, false
+	}
+	return key, true
+}
+
+// Endorse a signing key with the bak, so that whoever restores with the bak (e.g. a rebuilt node)
+// can trust the sidecars it signed.  The endorsement is a MAC of the key under a key derived from
+// the bak identity, as anyone can encrypt to the bak.
+func EndorseSigningKey(key ed25519.PublicKey, identity *age.X25519Identity) ([]byte, error) {
+	macKey, err := hkdf.Key(sha256.New, []byte(identity.String()), nil, endorsementInfo, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(key)
+	return []byte(hex.EncodeToString(mac.Sum(nil))), nil
+}
+
+// Check the endorsement of the signing key named by `name` with the bak, returning the key.
+func VerifyEndorsement(name string, endorsement []byte, identity *age.X25519Identity) (ed25519.PublicKey, error) {
+	key, ok := ParseSigningKeyName(name)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a signing key endorsement", name)
+	}
+	expected, err := EndorseSigningKey(key, identity)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(expected, bytes.TrimSpace(endorsement)) {
+		return nil, fmt.Errorf("signing key is not endorsed by the bak")
+	}
+	return key, nil
+}
@@ -0,0 +1,43 @@
+// Package snapshottest builds snapshot archives for tests, laid out as written by
+// `cord backup snapshot`.
+package snapshottest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/cordialsys/panel/pkg/snapshot"
+	"github.com/stretchr/testify/require"
+)
+
+// A snapshot with the given info and a placeholder signer.db, optionally gzipped.
+func Tar(t testing.TB, info snapshot.Info, gzipped bool) []byte {
+	infoBz, err := json.Marshal(info)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	var out io.Writer = &buf
+	var gz *gzip.Writer
+	if gzipped {
+		gz = gzip.NewWriter(&buf)
+		out = gz
+	}
+	writer := tar.NewWriter(out)
+	files := []struct {
+		name string
+		data []byte
+	}{{"./info.json", infoBz}, {"signer.db", bytes.Repeat([]byte("x"), 1024)}}
+	for _, file := range files {
+		require.NoError(t, writer.WriteHeader(&tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.data))}))
+		_, err = writer.Write(file.data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+	if gz != nil {
+		require.NoError(t, gz.Close())
+	}
+	return buf.Bytes()
+}
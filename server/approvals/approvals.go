@@ -0,0 +1,235 @@
+package approvals
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cordialsys/panel/pkg/nonce"
+	"github.com/cordialsys/panel/pkg/paths"
+	"github.com/cordialsys/panel/server/auth"
+)
+
+// How long a request may wait for approval, and then be executed once approved.
+const DefaultWindow = time.Hour
+
+// Approved requests are pruned from the approvals file after this long.
+const retention = 7 * 24 * time.Hour
+
+type State string
+
+const (
+	StatePending   State = "pending"
+	StateApproved  State = "approved"
+	StateExecuted  State = "executed"
+	StateCancelled State = "cancelled"
+	StateExpired   State = "expired"
+)
+
+var ErrNotFound = errors.New("approval request not found")
+
+// The token a request was made with, and the principal holding it.
+type Principal struct {
+	TokenId string `json:"token_id"`
+	Name    string `json:"name"`
+}
+
+func PrincipalOf(token *auth.Token) Principal {
+	return Principal{TokenId: token.Id, Name: token.PrincipalName()}
+}
+
+// A request to perform a destructive operation, which must be approved by a second principal.
+// The request is bound to the exact method, path, query and body of the original call.
+type Approval struct {
+	Id       string `json:"id"`
+	Action   string `json:"action"`
+	Method   string `json:"method"`
+	Path     string `json:"path"`
+	Query    string `json:"query,omitempty"`
+	BodyHash string `json:"body_hash,omitempty"`
+
+	State       State      `json:"state"`
+	RequestedBy Principal  `json:"requested_by"`
+	ApprovedBy  *Principal `json:"approved_by,omitempty"`
+	CancelledBy *Principal `json:"cancelled_by,omitempty"`
+
+	CreateTime  time.Time  `json:"create_time"`
+	ExpireTime  time.Time  `json:"expire_time"`
+	ApproveTime *time.Time `json:"approve_time,omitempty"`
+	ExecuteTime *time.Time `json:"execute_time,omitempty"`
+}
+
+func (a *Approval) Matches(method string, path string, query string, bodyHash string) bool {
+	return a.Method == method && a.Path == path && a.Query == query && a.BodyHash == bodyHash
+}
+
+// Mark pending/approved requests past their window as expired.
+func (a *Approval) refresh(now time.Time) {
+	if (a.State == StatePending || a.State == StateApproved) && now.After(a.ExpireTime) {
+		a.State = StateExpired
+	}
+}
+
+type approvalsFile struct {
+	Approvals []Approval `json:"approvals"`
+}
+
+// Store persists approval requests in the panel directory.
+type Store struct {
+	lock     sync.Mutex
+	panelDir paths.PanelHome
+	Window   time.Duration
+}
+
+func NewStore(panelDir paths.PanelHome) *Store {
+	return &Store{panelDir: panelDir, Window: DefaultWindow}
+}
+
+func (s *Store) load() ([]Approval, error) {
+	approvalsBz, err := os.ReadFile(s.panelDir.ApprovalsFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Approval{}, nil
+		}
+		return nil, err
+	}
+	var file approvalsFile
+	if err := json.Unmarshal(approvalsBz, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", s.panelDir.ApprovalsFile(), err)
+	}
+	now := time.Now()
+	for i := range file.Approvals {
+		file.Approvals[i].refresh(now)
+	}
+	if file.Approvals == nil {
+		file.Approvals = []Approval{}
+	}
+	return file.Approvals, nil
+}
+
+func (s *Store) save(approvals []Approval) error {
+	cutoff := time.Now().Add(-retention)
+	approvals = slices.DeleteFunc(approvals, func(a Approval) bool {
+		return a.State != StatePending && a.State != StateApproved && a.ExpireTime.Before(cutoff)
+	})
+	approvalsBz, err := json.MarshalIndent(approvalsFile{Approvals: approvals}, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(s.panelDir.String(), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.panelDir.ApprovalsFile(), approvalsBz, 0600)
+}
+
+func (s *Store) update(id string, cb func(approval *Approval) error) (*Approval, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	approvals, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	idx := slices.IndexFunc(approvals, func(a Approval) bool { return a.Id == id })
+	if idx < 0 {
+		return nil, ErrNotFound
+	}
+	if err := cb(&approvals[idx]); err != nil {
+		return nil, err
+	}
+	if err := s.save(approvals); err != nil {
+		return nil, err
+	}
+	updated := approvals[idx]
+	return &updated, nil
+}
+
+func (s *Store) List() ([]Approval, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.load()
+}
+
+func (s *Store) Get(id string) (*Approval, error) {
+	approvals, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	idx := slices.IndexFunc(approvals, func(a Approval) bool { return a.Id == id })
+	if idx < 0 {
+		return nil, ErrNotFound
+	}
+	return &approvals[idx], nil
+}
+
+// Create a new pending approval request.
+func (s *Store) Create(approval Approval) (*Approval, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	approvals, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	approval.Id = nonce.NewString()
+	approval.State = StatePending
+	approval.CreateTime = now
+	approval.ExpireTime = now.Add(s.Window)
+	approvals = append(approvals, approval)
+	if err := s.save(approvals); err != nil {
+		return nil, err
+	}
+	return &approval, nil
+}
+
+// Approve a pending request.  The approver must be a different principal than the requester, not
+// just another token of theirs.
+func (s *Store) Approve(id string, approver Principal) (*Approval, error) {
+	return s.update(id, func(approval *Approval) error {
+		if approval.State != StatePending {
+			return fmt.Errorf("approval request is %s", approval.State)
+		}
+		if approval.RequestedBy.TokenId == approver.TokenId || approval.RequestedBy.Name == approver.Name {
+			return fmt.Errorf("approval request must be approved by a different admin than the requester (%s)", approval.RequestedBy.Name)
+		}
+		now := time.Now().UTC()
+		approval.State = StateApproved
+		approval.ApprovedBy = &approver
+		approval.ApproveTime = &now
+		return nil
+	})
+}
+
+func (s *Store) Cancel(id string, by Principal) (*Approval, error) {
+	return s.update(id, func(approval *Approval) error {
+		if approval.State != StatePending && approval.State != StateApproved {
+			return fmt.Errorf("approval request is %s", approval.State)
+		}
+		approval.State = StateCancelled
+		approval.CancelledBy = &by
+		return nil
+	})
+}
+
+// Mark an approved request as executed, so that it cannot be used again.
+func (s *Store) Consume(id string, caller Principal, method string, path string, query string, bodyHash string) (*Approval, error) {
+	return s.update(id, func(approval *Approval) error {
+		if approval.State != StateApproved {
+			return fmt.Errorf("approval request is %s", approval.State)
+		}
+		if approval.RequestedBy.TokenId != caller.TokenId {
+			return fmt.Errorf("approved request may only be executed by the requester")
+		}
+		if !approval.Matches(method, path, query, bodyHash) {
+			return fmt.Errorf("request does not match the approved request (%s)", approval.Action)
+		}
+		now := time.Now().UTC()
+		approval.State = StateExecuted
+		approval.ExecuteTime = &now
+		return nil
+	})
+}
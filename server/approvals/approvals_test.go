@@ -0,0 +1,120 @@
+package approvals_test
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cordialsys/panel/pkg/paths"
+	"github.com/cordialsys/panel/server/approvals"
+	"github.com/cordialsys/panel/server/auth"
+	"github.com/cordialsys/panel/server/servererrors"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTwoPersonApproval(t *testing.T) {
+	panelDir := paths.PanelHome(t.TempDir())
+	aliceToken, alice, err := auth.Create(panelDir, "alice", "", auth.RoleCustodian)
+	require.NoError(t, err)
+	_, aliceLaptop, err := auth.Create(panelDir, "alice-laptop", "alice", auth.RoleCustodian)
+	require.NoError(t, err)
+	_, bob, err := auth.Create(panelDir, "bob", "", auth.RoleCustodian)
+	require.NoError(t, err)
+
+	store := approvals.NewStore(panelDir)
+	deleted := 0
+	app := fiber.New(fiber.Config{
+		ErrorHandler: func(c *fiber.Ctx, err error) error {
+			return err.(*servererrors.ErrorResponse).Send(c)
+		},
+	})
+	api := app.Group("/v1", auth.New(panelDir))
+	api.Delete("/treasury", approvals.Require(store, "delete treasury", func(c *fiber.Ctx) bool {
+		_, ok := c.Queries()["supervisor"]
+		return ok
+	}), func(c *fiber.Ctx) error {
+		deleted++
+		return c.SendString("ok")
+	})
+
+	do := func(path string, approvalId string) (int, string) {
+		req := httptest.NewRequest("DELETE", path, nil)
+		req.Header.Set("Authorization", "Bearer "+aliceToken)
+		if approvalId != "" {
+			req.Header.Set(approvals.HeaderApproval, approvalId)
+		}
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp.StatusCode, resp.Header.Get(approvals.HeaderApproval)
+	}
+
+	// approval only required when deleting the supervisor config
+	status, _ := do("/v1/treasury", "")
+	require.Equal(t, 200, status)
+	require.Equal(t, 1, deleted)
+
+	status, approvalId := do("/v1/treasury?supervisor", "")
+	require.Equal(t, 428, status)
+	require.NotEmpty(t, approvalId)
+	require.Equal(t, 1, deleted)
+
+	// not yet approved
+	status, _ = do("/v1/treasury?supervisor", approvalId)
+	require.Equal(t, 400, status)
+
+	// the requester may not approve their own request, even with another of their tokens
+	_, err = store.Approve(approvalId, approvals.PrincipalOf(alice))
+	require.Error(t, err)
+	_, err = store.Approve(approvalId, approvals.PrincipalOf(aliceLaptop))
+	require.ErrorContains(t, err, "different admin")
+	approval, err := store.Approve(approvalId, approvals.PrincipalOf(bob))
+	require.NoError(t, err)
+	require.Equal(t, approvals.StateApproved, approval.State)
+
+	// must match the approved request
+	status, _ = do("/v1/treasury", approvalId)
+	require.Equal(t, 200, status)
+	require.Equal(t, 2, deleted)
+	status, _ = do("/v1/treasury?supervisor&other", approvalId)
+	require.Equal(t, 400, status)
+
+	status, _ = do("/v1/treasury?supervisor", approvalId)
+	require.Equal(t, 200, status)
+	require.Equal(t, 3, deleted)
+
+	// approvals may only be used once
+	status, _ = do("/v1/treasury?supervisor", approvalId)
+	require.Equal(t, 400, status)
+	require.Equal(t, 3, deleted)
+
+	approval, err = store.Get(approvalId)
+	require.NoError(t, err)
+	require.Equal(t, approvals.StateExecuted, approval.State)
+}
+
+func TestApprovalExpiryAndCancel(t *testing.T) {
+	panelDir := paths.PanelHome(t.TempDir())
+	store := approvals.NewStore(panelDir)
+	alice := approvals.Principal{TokenId: "a", Name: "alice"}
+	bob := approvals.Principal{TokenId: "b", Name: "bob"}
+
+	store.Window = -time.Second
+	expired, err := store.Create(approvals.Approval{Action: "reset panel", RequestedBy: alice})
+	require.NoError(t, err)
+	_, err = store.Approve(expired.Id, bob)
+	require.ErrorContains(t, err, "expired")
+
+	store.Window = time.Hour
+	pending, err := store.Create(approvals.Approval{Action: "reset panel", RequestedBy: alice})
+	require.NoError(t, err)
+	cancelled, err := store.Cancel(pending.Id, alice)
+	require.NoError(t, err)
+	require.Equal(t, approvals.StateCancelled, cancelled.State)
+	_, err = store.Approve(pending.Id, bob)
+	require.ErrorContains(t, err, "cancelled")
+
+	list, err := store.List()
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+}
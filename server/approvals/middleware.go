@@ -0,0 +1,77 @@
+package approvals
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/cordialsys/panel/server/auth"
+	"github.com/cordialsys/panel/server/servererrors"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Header used to execute a previously approved request.
+const HeaderApproval = "X-Panel-Approval"
+
+func bodyHash(c *fiber.Ctx) string {
+	body := c.Body()
+	if len(body) == 0 {
+		return ""
+	}
+	digest := sha256.Sum256(body)
+	return hex.EncodeToString(digest[:])
+}
+
+// Middleware that requires a second admin to approve the request before the handler runs.
+// The first call creates a pending approval request and fails with 428 Precondition Required,
+// returning the approval id in the X-Panel-Approval header.  Once approved, the requester
+// repeats the same call with the X-Panel-Approval header set.
+//
+// If `when` is set, only requests for which it returns true require approval.
+func Require(store *Store, action string, when func(c *fiber.Ctx) bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if when != nil && !when(c) {
+			return c.Next()
+		}
+		token := auth.FromCtx(c)
+		if token == nil {
+			return servererrors.Unauthorizedf("admin token required")
+		}
+		caller := PrincipalOf(token)
+		method := c.Method()
+		path := c.Path()
+		query := string(c.Request().URI().QueryString())
+		hash := bodyHash(c)
+
+		if id := c.Get(HeaderApproval); id != "" {
+			_, err := store.Consume(id, caller, method, path, query, hash)
+			if err == ErrNotFound {
+				return servererrors.NotFoundf("approval request %s not found", id)
+			}
+			if err != nil {
+				return servererrors.FailedPreconditionf("cannot use approval request %s: %v", id, err)
+			}
+			return c.Next()
+		}
+
+		approval, err := store.Create(Approval{
+			Action:      action,
+			Method:      method,
+			Path:        path,
+			Query:       query,
+			BodyHash:    hash,
+			RequestedBy: caller,
+		})
+		if err != nil {
+			return servererrors.InternalErrorf("failed to create approval request: %v", err)
+		}
+		c.Set(HeaderApproval, approval.Id)
+		return servererrors.NewGrpcErrorf(
+			http.StatusPreconditionRequired,
+			servererrors.CodeFailedPrecondition,
+			"%s requires approval from a second admin: created approval request %s, "+
+				"approve with `panel approvals approve %s` then retry with the %s header (expires %s)",
+			action, approval.Id, approval.Id, HeaderApproval, approval.ExpireTime.Format("2006-01-02 15:04:05 MST"),
+		)
+	}
+}
@@ -0,0 +1,233 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cordialsys/panel/pkg/paths"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// Hash of the (non-existent) entry before the first entry.
+var GenesisHash = hex.EncodeToString(make([]byte, sha256.Size))
+
+type Caller struct {
+	TokenId    string `json:"token_id,omitempty"`
+	Name       string `json:"name,omitempty"`
+	Role       string `json:"role,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+}
+
+// A single audit log entry.  Each entry commits to the hash of the previous entry,
+// so any modification or removal of an entry breaks the chain.
+type Entry struct {
+	Seq      uint64    `json:"seq"`
+	Time     time.Time `json:"time"`
+	Caller   Caller    `json:"caller"`
+	Method   string    `json:"method"`
+	Endpoint string    `json:"endpoint"`
+	Path     string    `json:"path"`
+	// Redacted request parameters, kept as raw JSON so the hash is stable.
+	Params  json.RawMessage `json:"params,omitempty"`
+	Status  int             `json:"status"`
+	Outcome string          `json:"outcome"`
+	Error   string          `json:"error,omitempty"`
+
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+func (e *Entry) computeHash() (string, error) {
+	unhashed := *e
+	unhashed.Hash = ""
+	entryBz, err := json.Marshal(unhashed)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256(entryBz)
+	return hex.EncodeToString(digest[:]), nil
+}
+
+// Log appends entries to the audit log file in the panel directory.
+type Log struct {
+	lock     sync.Mutex
+	panelDir paths.PanelHome
+	loaded   bool
+	lastSeq  uint64
+	lastHash string
+}
+
+func Open(panelDir paths.PanelHome) *Log {
+	return &Log{panelDir: panelDir}
+}
+
+func (l *Log) loadTail() error {
+	if l.loaded {
+		return nil
+	}
+	l.lastHash = GenesisHash
+	err := iterate(l.panelDir, func(entry *Entry) error {
+		l.lastSeq = entry.Seq
+		l.lastHash = entry.Hash
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	l.loaded = true
+	return nil
+}
+
+// Append the entry to the log, filling in the sequence number and hashes.
+func (l *Log) Append(entry Entry) (*Entry, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err := l.loadTail(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %v", err)
+	}
+
+	entry.Seq = l.lastSeq + 1
+	entry.PrevHash = l.lastHash
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	hash, err := entry.computeHash()
+	if err != nil {
+		return nil, err
+	}
+	entry.Hash = hash
+	entryBz, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(l.panelDir.String(), 0755)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(l.panelDir.AuditLogFile(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(entryBz, '\n')); err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+
+	l.lastSeq = entry.Seq
+	l.lastHash = entry.Hash
+	return &entry, nil
+}
+
+// Caller recorded for events raised by the panel itself, rather than by an API call.
+var PanelCaller = Caller{Name: "panel"}
+
+const MethodEvent = "EVENT"
+
+// Record an event raised by the panel itself, e.g. a secret changing remotely.
+func (l *Log) AppendEvent(event string, params map[string]any) (*Entry, error) {
+	paramsBz, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	return l.Append(Entry{
+		Caller:   PanelCaller,
+		Method:   MethodEvent,
+		Endpoint: event,
+		Params:   paramsBz,
+		Outcome:  OutcomeSuccess,
+	})
+}
+
+func iterate(panelDir paths.PanelHome, cb func(entry *Entry) error) error {
+	f, err := os.Open(panelDir.AuditLogFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		lineBz := bytes.TrimSpace(scanner.Bytes())
+		if len(lineBz) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(lineBz, &entry); err != nil {
+			return fmt.Errorf("invalid audit entry on line %d: %v", line, err)
+		}
+		if err := cb(&entry); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// List entries with a sequence number of at least `fromSeq`, up to `limit` entries.
+// Returns the sequence number of the next page, or 0 if there are no more entries.
+func List(panelDir paths.PanelHome, fromSeq uint64, limit int) ([]Entry, uint64, error) {
+	entries := []Entry{}
+	var next uint64
+	errStop := fmt.Errorf("stop")
+	err := iterate(panelDir, func(entry *Entry) error {
+		if entry.Seq < fromSeq {
+			return nil
+		}
+		if len(entries) >= limit {
+			next = entry.Seq
+			return errStop
+		}
+		entries = append(entries, *entry)
+		return nil
+	})
+	if err != nil && err != errStop {
+		return nil, 0, err
+	}
+	return entries, next, nil
+}
+
+// Verify the hash chain of the entire audit log, returning the number of entries checked.
+func Verify(panelDir paths.PanelHome) (int, error) {
+	prevHash := GenesisHash
+	var prevSeq uint64
+	count := 0
+	err := iterate(panelDir, func(entry *Entry) error {
+		if entry.Seq != prevSeq+1 {
+			return fmt.Errorf("audit entry %d: expected sequence %d", entry.Seq, prevSeq+1)
+		}
+		if entry.PrevHash != prevHash {
+			return fmt.Errorf("audit entry %d: previous hash does not match entry %d", entry.Seq, prevSeq)
+		}
+		hash, err := entry.computeHash()
+		if err != nil {
+			return err
+		}
+		if hash != entry.Hash {
+			return fmt.Errorf("audit entry %d: hash mismatch, entry has been modified", entry.Seq)
+		}
+		prevSeq = entry.Seq
+		prevHash = entry.Hash
+		count++
+		return nil
+	})
+	return count, err
+}
@@ -0,0 +1,124 @@
+package audit_test
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cordialsys/panel/pkg/paths"
+	"github.com/cordialsys/panel/server/audit"
+	"github.com/cordialsys/panel/server/servererrors"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditChain(t *testing.T) {
+	panelDir := paths.PanelHome(t.TempDir())
+	log := audit.Open(panelDir)
+
+	for _, path := range []string{"/v1/treasury", "/v1/panel/seal", "/v1/panel/ear"} {
+		_, err := log.Append(audit.Entry{Method: "POST", Path: path, Outcome: audit.OutcomeSuccess})
+		require.NoError(t, err)
+	}
+	count, err := audit.Verify(panelDir)
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+
+	// a new log continues the existing chain
+	_, err = audit.Open(panelDir).Append(audit.Entry{Method: "DELETE", Path: "/v1/treasury"})
+	require.NoError(t, err)
+	count, err = audit.Verify(panelDir)
+	require.NoError(t, err)
+	require.Equal(t, 4, count)
+
+	entries, next, err := audit.List(panelDir, 0, 3)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	require.EqualValues(t, 4, next)
+	entries, next, err = audit.List(panelDir, next, 3)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.EqualValues(t, 0, next)
+	require.Equal(t, "DELETE", entries[0].Method)
+
+	// events raised by the panel itself are part of the same chain
+	event, err := audit.Open(panelDir).AppendEvent("secret.changed", map[string]any{"type": "vault"})
+	require.NoError(t, err)
+	require.EqualValues(t, 5, event.Seq)
+	require.Equal(t, audit.MethodEvent, event.Method)
+	require.Equal(t, audit.PanelCaller, event.Caller)
+	count, err = audit.Verify(panelDir)
+	require.NoError(t, err)
+	require.Equal(t, 5, count)
+
+	// tampering with an entry breaks the chain
+	logBz, err := os.ReadFile(panelDir.AuditLogFile())
+	require.NoError(t, err)
+	tampered := strings.Replace(string(logBz), "/v1/panel/seal", "/v1/panel/xxxx", 1)
+	require.NoError(t, os.WriteFile(panelDir.AuditLogFile(), []byte(tampered), 0600))
+	_, err = audit.Verify(panelDir)
+	require.ErrorContains(t, err, "audit entry 2")
+
+	// removing an entry breaks the chain
+	lines := strings.SplitAfter(string(logBz), "\n")
+	removed := lines[0] + strings.Join(lines[2:], "")
+	require.NoError(t, os.WriteFile(panelDir.AuditLogFile(), []byte(removed), 0600))
+	_, err = audit.Verify(panelDir)
+	require.Error(t, err)
+}
+
+func TestAuditMiddleware(t *testing.T) {
+	panelDir := paths.PanelHome(t.TempDir())
+	app := fiber.New(fiber.Config{
+		ErrorHandler: func(c *fiber.Ctx, err error) error {
+			if apiErr, ok := err.(*servererrors.ErrorResponse); ok {
+				return apiErr.Send(c)
+			}
+			return err
+		},
+	})
+	api := app.Group("/v1", audit.New(audit.Open(panelDir)))
+	api.Get("/treasury", func(c *fiber.Ctx) error { return c.SendString("OK") })
+	api.Post("/services/:service/:action", func(c *fiber.Ctx) error { return c.SendString("OK") })
+	api.Put("/panel/ear", func(c *fiber.Ctx) error {
+		return servererrors.FailedPreconditionf("not activated")
+	})
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/v1/treasury", nil))
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+
+	resp, err = app.Test(httptest.NewRequest("POST", "/v1/services/treasury.service/restart", nil))
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+
+	req := httptest.NewRequest("PUT", "/v1/panel/ear", strings.NewReader(`{"ear_secret":"raw:hunter2","note":"x"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = app.Test(req)
+	require.NoError(t, err)
+	require.Equal(t, 400, resp.StatusCode)
+
+	// reads are not audited
+	entries, _, err := audit.List(panelDir, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	require.Equal(t, "/v1/services/:service/:action", entries[0].Endpoint)
+	require.Equal(t, audit.OutcomeSuccess, entries[0].Outcome)
+	var params map[string]any
+	require.NoError(t, json.Unmarshal(entries[0].Params, &params))
+	require.Equal(t, "treasury.service", params["service"])
+	require.Equal(t, "restart", params["action"])
+
+	require.Equal(t, audit.OutcomeFailure, entries[1].Outcome)
+	require.Equal(t, 400, entries[1].Status)
+	require.Equal(t, "not activated", entries[1].Error)
+	require.NotContains(t, string(entries[1].Params), "hunter2")
+	require.Contains(t, string(entries[1].Params), `"note":"x"`)
+
+	count, err := audit.Verify(panelDir)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+}
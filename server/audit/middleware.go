@@ -0,0 +1,134 @@
+package audit
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strings"
+
+	"github.com/cordialsys/panel/server/auth"
+	"github.com/cordialsys/panel/server/servererrors"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Request bodies larger than this are not recorded (e.g. snapshot uploads).
+const maxRecordedBody = 64 * 1024
+
+const redacted = "<redacted>"
+
+// Any parameter with a name containing one of these is redacted.
+var sensitiveNames = []string{"key", "secret", "phrase", "password", "token", "mnemonic", "credential"}
+
+func isSensitive(name string) bool {
+	name = strings.ToLower(name)
+	for _, sensitive := range sensitiveNames {
+		if strings.Contains(name, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+func redact(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for name, inner := range v {
+			if isSensitive(name) {
+				v[name] = redacted
+			} else {
+				v[name] = redact(inner)
+			}
+		}
+		return v
+	case []any:
+		for i, inner := range v {
+			v[i] = redact(inner)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func requestParams(c *fiber.Ctx) json.RawMessage {
+	params := map[string]any{}
+	for name, value := range c.AllParams() {
+		params[name] = value
+	}
+	query := map[string]any{}
+	c.Context().QueryArgs().VisitAll(func(key, value []byte) {
+		query[string(key)] = string(value)
+	})
+	if len(query) > 0 {
+		params["query"] = query
+	}
+	body := c.Body()
+	if len(body) > 0 {
+		if len(body) <= maxRecordedBody && strings.HasPrefix(c.Get(fiber.HeaderContentType, fiber.MIMEApplicationJSON), fiber.MIMEApplicationJSON) {
+			var parsed any
+			if err := json.Unmarshal(body, &parsed); err == nil {
+				params["body"] = parsed
+			} else {
+				params["body_size"] = len(body)
+			}
+		} else {
+			params["body_size"] = len(body)
+		}
+	}
+	if len(params) == 0 {
+		return nil
+	}
+	paramsBz, err := json.Marshal(redact(params))
+	if err != nil {
+		return nil
+	}
+	return paramsBz
+}
+
+// Middleware that records every state-changing (non-GET) request to the audit log.
+// Must be installed after the auth middleware so the caller is known.
+func New(log *Log) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Method() == fiber.MethodGet || c.Method() == fiber.MethodHead || c.Method() == fiber.MethodOptions {
+			return c.Next()
+		}
+		caller := Caller{RemoteAddr: c.IP()}
+		if token := auth.FromCtx(c); token != nil {
+			caller.TokenId = token.Id
+			caller.Name = token.Name
+			caller.Role = string(token.EffectiveRole())
+		}
+		method := c.Method()
+		path := c.Path()
+
+		handlerErr := c.Next()
+
+		// route parameters are only known once the route has been matched
+		params := requestParams(c)
+		entry := Entry{
+			Caller:   caller,
+			Method:   method,
+			Endpoint: c.Route().Path,
+			Path:     path,
+			Params:   params,
+			Status:   c.Response().StatusCode(),
+			Outcome:  OutcomeSuccess,
+		}
+		if handlerErr != nil {
+			entry.Outcome = OutcomeFailure
+			entry.Error = handlerErr.Error()
+			entry.Status = fiber.StatusInternalServerError
+			if apiErr, ok := handlerErr.(*servererrors.ErrorResponse); ok {
+				entry.Status = apiErr.HttpStatus()
+				entry.Error = apiErr.Message
+			} else if fiberErr, ok := handlerErr.(*fiber.Error); ok {
+				entry.Status = fiberErr.Code
+			}
+		} else if entry.Status >= 400 {
+			entry.Outcome = OutcomeFailure
+		}
+		if _, err := log.Append(entry); err != nil {
+			slog.Error("failed to write audit log", "error", err, "path", path)
+		}
+		return handlerErr
+	}
+}
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"log/slog"
+	"strings"
+
+	"github.com/cordialsys/panel/pkg/paths"
+	"github.com/cordialsys/panel/server/servererrors"
+	"github.com/gofiber/fiber/v2"
+)
+
+const localsToken = "auth.token"
+
+// Read the bearer token from the Authorization header, if any.
+func BearerToken(c *fiber.Ctx) (string, bool) {
+	header := c.Get(fiber.HeaderAuthorization)
+	if header == "" {
+		return "", false
+	}
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// Middleware that rejects any request without a valid admin token.
+func New(panelDir paths.PanelHome) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		plaintext, ok := BearerToken(c)
+		if !ok {
+			return servererrors.Unauthorizedf("missing admin token; set 'Authorization: Bearer <token>'")
+		}
+		token, err := Verify(panelDir, plaintext)
+		if err != nil {
+			if err != ErrInvalidToken {
+				slog.Error("failed to verify admin token", "error", err)
+			}
+			return servererrors.Unauthorizedf("invalid admin token")
+		}
+		c.Locals(localsToken, token)
+		return c.Next()
+	}
+}
+
+// Returns the authenticated token for the request, if any.
+func FromCtx(c *fiber.Ctx) *Token {
+	token, _ := c.Locals(localsToken).(*Token)
+	return token
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"fmt"
+
+	"github.com/cordialsys/panel/server/servererrors"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Roles are ordered, each role includes the permissions of the roles before it.
+type Role string
+
+const (
+	// Read-only access to the panel, services and logs
+	RoleViewer Role = "viewer"
+	// Day-to-day operation, e.g. restarting services, taking snapshots, staging updates
+	RoleOperator Role = "operator"
+	// Destructive or key-touching operations, e.g. deleting the treasury, EAR, restoring backups
+	RoleCustodian Role = "custodian"
+)
+
+var Roles = []Role{RoleViewer, RoleOperator, RoleCustodian}
+
+func (r Role) level() int {
+	switch r {
+	case RoleViewer:
+		return 1
+	case RoleOperator:
+		return 2
+	case RoleCustodian:
+		return 3
+	}
+	return 0
+}
+
+func (r Role) Valid() bool {
+	return r.level() > 0
+}
+
+// Returns true if this role has at least the permissions of the other role.
+func (r Role) Includes(other Role) bool {
+	return r.Valid() && r.level() >= other.level()
+}
+
+func ParseRole(role string) (Role, error) {
+	if !Role(role).Valid() {
+		return "", fmt.Errorf("invalid role '%s', must be one of %v", role, Roles)
+	}
+	return Role(role), nil
+}
+
+// Tokens created before roles were introduced had full access.
+func (t *Token) EffectiveRole() Role {
+	if t.Role == "" {
+		return RoleCustodian
+	}
+	return t.Role
+}
+
+// Returns true if the authenticated caller has at least the given role.
+func HasRole(c *fiber.Ctx, role Role) bool {
+	token := FromCtx(c)
+	if token == nil {
+		return false
+	}
+	return token.EffectiveRole().Includes(role)
+}
+
+// Middleware that rejects callers without at least the given role.
+// Must be used after the authentication middleware.
+func Require(role Role) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		token := FromCtx(c)
+		if token == nil {
+			return servererrors.Unauthorizedf("missing admin token")
+		}
+		if !token.EffectiveRole().Includes(role) {
+			return servererrors.PermissionDeniedf(
+				"token '%s' has role '%s', but %s %s requires role '%s'",
+				token.Name, token.EffectiveRole(), c.Method(), c.Path(), role,
+			)
+		}
+		return c.Next()
+	}
+}
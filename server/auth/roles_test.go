@@ -0,0 +1,59 @@
+package auth_test
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cordialsys/panel/pkg/paths"
+	"github.com/cordialsys/panel/server/auth"
+	"github.com/cordialsys/panel/server/servererrors"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoleIncludes(t *testing.T) {
+	require.True(t, auth.RoleCustodian.Includes(auth.RoleViewer))
+	require.True(t, auth.RoleOperator.Includes(auth.RoleOperator))
+	require.False(t, auth.RoleViewer.Includes(auth.RoleOperator))
+	require.False(t, auth.Role("admin").Includes(auth.RoleViewer))
+
+	_, err := auth.ParseRole("admin")
+	require.Error(t, err)
+}
+
+func TestRequireRole(t *testing.T) {
+	panelDir := paths.PanelHome(t.TempDir())
+	viewerToken, _, err := auth.Create(panelDir, "viewer", "", auth.RoleViewer)
+	require.NoError(t, err)
+	custodianToken, _, err := auth.Create(panelDir, "custodian", "", auth.RoleCustodian)
+	require.NoError(t, err)
+
+	app := fiber.New(fiber.Config{
+		ErrorHandler: func(c *fiber.Ctx, err error) error {
+			return err.(*servererrors.ErrorResponse).Send(c)
+		},
+	})
+	api := app.Group("/v1", auth.New(panelDir))
+	api.Get("/panel", auth.Require(auth.RoleViewer), func(c *fiber.Ctx) error {
+		return c.SendString("ok")
+	})
+	api.Delete("/treasury", auth.Require(auth.RoleCustodian), func(c *fiber.Ctx) error {
+		return c.SendString("ok")
+	})
+
+	do := func(method string, path string, token string) int {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	require.Equal(t, 401, do("GET", "/v1/panel", ""))
+	require.Equal(t, 401, do("GET", "/v1/panel", "bad:token"))
+	require.Equal(t, 200, do("GET", "/v1/panel", viewerToken))
+	require.Equal(t, 403, do("DELETE", "/v1/treasury", viewerToken))
+	require.Equal(t, 200, do("DELETE", "/v1/treasury", custodianToken))
+}
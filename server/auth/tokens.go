@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cordialsys/panel/pkg/nonce"
+	"github.com/cordialsys/panel/pkg/paths"
+)
+
+const InitialTokenName = "initial"
+
+var ErrInvalidToken = errors.New("invalid admin token")
+
+// An admin token permitted to call the Panel API.  Only the hash of the secret is stored.
+// Several tokens may belong to the same principal (the person holding them), which is what
+// two-person approvals compare.
+type Token struct {
+	Id         string    `json:"id"`
+	Name       string    `json:"name"`
+	Principal  string    `json:"principal,omitempty"`
+	Role       Role      `json:"role,omitempty"`
+	Hash       string    `json:"hash"`
+	CreateTime time.Time `json:"create_time"`
+}
+
+type tokensFile struct {
+	Tokens []Token `json:"tokens"`
+}
+
+func hashSecret(secret string) string {
+	digest := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(digest[:])
+}
+
+// Tokens are formatted as <id>:<secret>, similar to API keys.
+func formatToken(id string, secret string) string {
+	return id + ":" + secret
+}
+
+func parseToken(token string) (id string, secret string, err error) {
+	parts := strings.SplitN(strings.TrimSpace(token), ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", ErrInvalidToken
+	}
+	return parts[0], parts[1], nil
+}
+
+// Returns the configured tokens.  No tokens are returned if the tokens file has not been created yet.
+func Load(panelDir paths.PanelHome) ([]Token, error) {
+	tokensBz, err := os.ReadFile(panelDir.AdminTokensFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Token{}, nil
+		}
+		return nil, err
+	}
+	var file tokensFile
+	if err := json.Unmarshal(tokensBz, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", panelDir.AdminTokensFile(), err)
+	}
+	if file.Tokens == nil {
+		file.Tokens = []Token{}
+	}
+	return file.Tokens, nil
+}
+
+func Save(panelDir paths.PanelHome, tokens []Token) error {
+	tokensBz, err := json.MarshalIndent(tokensFile{Tokens: tokens}, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(panelDir.String(), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(panelDir.AdminTokensFile(), tokensBz, 0600)
+}
+
+// Tokens created before principals were introduced are each their own principal.
+func (t *Token) PrincipalName() string {
+	if t.Principal == "" {
+		return t.Name
+	}
+	return t.Principal
+}
+
+// Create a new token for a principal (defaulting to the token name), returning the plaintext token.
+// The plaintext is not recoverable afterwards.
+func Create(panelDir paths.PanelHome, name string, principal string, role Role) (string, *Token, error) {
+	tokens, err := Load(panelDir)
+	if err != nil {
+		return "", nil, err
+	}
+	if name == "" {
+		return "", nil, fmt.Errorf("token name is required")
+	}
+	if !role.Valid() {
+		return "", nil, fmt.Errorf("invalid role '%s', must be one of %v", role, Roles)
+	}
+	for _, token := range tokens {
+		if token.Name == name {
+			return "", nil, fmt.Errorf("token with name '%s' already exists", name)
+		}
+	}
+	id := nonce.NewString()
+	secret := nonce.NewString() + nonce.NewString()
+	token := Token{
+		Id:         id,
+		Name:       name,
+		Principal:  principal,
+		Role:       role,
+		Hash:       hashSecret(secret),
+		CreateTime: time.Now().UTC(),
+	}
+	tokens = append(tokens, token)
+	if err := Save(panelDir, tokens); err != nil {
+		return "", nil, err
+	}
+	return formatToken(id, secret), &token, nil
+}
+
+// Revoke a token by id or name.
+func Revoke(panelDir paths.PanelHome, idOrName string) (*Token, error) {
+	tokens, err := Load(panelDir)
+	if err != nil {
+		return nil, err
+	}
+	idx := slices.IndexFunc(tokens, func(t Token) bool {
+		return t.Id == idOrName || t.Name == idOrName
+	})
+	if idx < 0 {
+		return nil, fmt.Errorf("token '%s' not found", idOrName)
+	}
+	revoked := tokens[idx]
+	tokens = slices.Delete(tokens, idx, idx+1)
+	if err := Save(panelDir, tokens); err != nil {
+		return nil, err
+	}
+	return &revoked, nil
+}
+
+// Verify the plaintext token against the stored hashes.
+// The tokens file is re-read each time so that tokens managed by the CLI take effect immediately.
+func Verify(panelDir paths.PanelHome, plaintext string) (*Token, error) {
+	id, secret, err := parseToken(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := Load(panelDir)
+	if err != nil {
+		return nil, err
+	}
+	hash := hashSecret(secret)
+	for _, token := range tokens {
+		if token.Id != id {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(token.Hash), []byte(hash)) == 1 {
+			return &token, nil
+		}
+	}
+	return nil, ErrInvalidToken
+}
+
+// Create the initial admin token if no tokens have ever been configured.
+// The plaintext is written to a root-only file so that the local CLI can pick it up.
+func EnsureInitial(panelDir paths.PanelHome) (created bool, err error) {
+	if _, err := os.Stat(panelDir.AdminTokensFile()); err == nil {
+		return false, nil
+	}
+	plaintext, _, err := Create(panelDir, InitialTokenName, "", RoleCustodian)
+	if err != nil {
+		return false, err
+	}
+	err = os.WriteFile(panelDir.AdminTokenFile(), []byte(plaintext+"\n"), 0600)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Read the local token file written by EnsureInitial, if any.
+func LoadLocal(panelDir paths.PanelHome) (string, error) {
+	tokenBz, err := os.ReadFile(panelDir.AdminTokenFile())
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(tokenBz)), nil
+}
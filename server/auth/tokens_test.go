@@ -0,0 +1,68 @@
+package auth_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/cordialsys/panel/pkg/paths"
+	"github.com/cordialsys/panel/server/auth"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokens(t *testing.T) {
+	panelDir := paths.PanelHome(t.TempDir())
+
+	tokens, err := auth.Load(panelDir)
+	require.NoError(t, err)
+	require.Empty(t, tokens)
+
+	plaintext, token, err := auth.Create(panelDir, "ops", "", auth.RoleOperator)
+	require.NoError(t, err)
+	require.NotContains(t, token.Hash, plaintext)
+
+	_, _, err = auth.Create(panelDir, "ops", "", auth.RoleOperator)
+	require.ErrorContains(t, err, "already exists")
+
+	verified, err := auth.Verify(panelDir, plaintext)
+	require.NoError(t, err)
+	require.Equal(t, token.Id, verified.Id)
+
+	_, err = auth.Verify(panelDir, plaintext+"x")
+	require.ErrorIs(t, err, auth.ErrInvalidToken)
+	_, err = auth.Verify(panelDir, "garbage")
+	require.ErrorIs(t, err, auth.ErrInvalidToken)
+
+	// plaintext is never stored
+	tokensBz, err := os.ReadFile(panelDir.AdminTokensFile())
+	require.NoError(t, err)
+	require.NotContains(t, string(tokensBz), plaintext)
+
+	_, err = auth.Revoke(panelDir, "ops")
+	require.NoError(t, err)
+	_, err = auth.Verify(panelDir, plaintext)
+	require.ErrorIs(t, err, auth.ErrInvalidToken)
+}
+
+func TestEnsureInitial(t *testing.T) {
+	panelDir := paths.PanelHome(t.TempDir())
+
+	created, err := auth.EnsureInitial(panelDir)
+	require.NoError(t, err)
+	require.True(t, created)
+
+	stat, err := os.Stat(panelDir.AdminTokenFile())
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+
+	plaintext, err := auth.LoadLocal(panelDir)
+	require.NoError(t, err)
+	_, err = auth.Verify(panelDir, plaintext)
+	require.NoError(t, err)
+
+	// only created once, even if revoked
+	_, err = auth.Revoke(panelDir, auth.InitialTokenName)
+	require.NoError(t, err)
+	created, err = auth.EnsureInitial(panelDir)
+	require.NoError(t, err)
+	require.False(t, created)
+}
@@ -0,0 +1,554 @@
+// Package catalog lists the snapshots in the backup bucket along with the info of each, read from
+// the signed sidecar written next to each snapshot.
+//
+// Sidecars are signed with a key kept in the panel directory.  Whenever the panel is given the bak
+// (e.g. to restore), it endorses its key with the bak next to the snapshots, and trusts the keys
+// endorsed there before, such as those of the panel it replaces (see `TrustBak`).
+package catalog
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+
+	"github.com/cordialsys/panel/pkg/paths"
+	"github.com/cordialsys/panel/pkg/s3client"
+	"github.com/cordialsys/panel/pkg/snapshot"
+)
+
+// How many snapshots are read at once to find their info
+const fetchConcurrency = 4
+
+// Reader is where sidecars are read from, e.g. the bucket or, failing it, its replicas.
+type Reader interface {
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// Bucket is where snapshots are listed and read from.
+type Bucket interface {
+	Reader
+	IterateObjects(ctx context.Context, prefix string) (<-chan s3client.Object, <-chan error)
+}
+
+// Writer is where sidecars are written, e.g. the bucket and its replicas.
+type Writer interface {
+	Put(ctx context.Context, key string, body io.ReadSeeker) error
+}
+
+var _ Bucket = &s3client.BackupS3Client{}
+var _ Reader = &s3client.Replicator{}
+var _ Writer = &s3client.Replicator{}
+
+type cachedInfo struct {
+	// The info is read again if the object changes size
+	Size     int64         `json:"size"`
+	Info     snapshot.Info `json:"info"`
+	Sha256   string        `json:"sha256,omitempty"`
+	Verified bool          `json:"verified,omitempty"`
+}
+
+type catalogFile struct {
+	// By object key
+	Snapshots map[string]cachedInfo `json:"snapshots"`
+	// Hex public keys of other panels, endorsed with a bak
+	TrustedKeys []string `json:"trusted_keys,omitempty"`
+}
+
+// Catalog keeps the info of each snapshot in the panel directory, so that listing does not read
+// each sidecar (or, without one, download the snapshot until `info.json` is found) every time.
+type Catalog struct {
+	lock       sync.Mutex
+	panelDir   paths.PanelHome
+	signingKey ed25519.PrivateKey
+}
+
+func New(panelDir paths.PanelHome) *Catalog {
+	return &Catalog{panelDir: panelDir}
+}
+
+func (c *Catalog) loadFile() (*catalogFile, error) {
+	catalogBz, err := os.ReadFile(c.panelDir.SnapshotCatalogFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &catalogFile{Snapshots: map[string]cachedInfo{}}, nil
+		}
+		return nil, err
+	}
+	var file catalogFile
+	if err := json.Unmarshal(catalogBz, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", c.panelDir.SnapshotCatalogFile(), err)
+	}
+	if file.Snapshots == nil {
+		file.Snapshots = map[string]cachedInfo{}
+	}
+	return &file, nil
+}
+
+func (c *Catalog) load() (map[string]cachedInfo, error) {
+	file, err := c.loadFile()
+	if err != nil {
+		return nil, err
+	}
+	return file.Snapshots, nil
+}
+
+func (c *Catalog) save(snapshots map[string]cachedInfo) error {
+	file, err := c.loadFile()
+	if err != nil {
+		return err
+	}
+	file.Snapshots = snapshots
+	return c.saveFile(file)
+}
+
+func (c *Catalog) saveFile(file *catalogFile) error {
+	catalogBz, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(c.panelDir.String(), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.panelDir.SnapshotCatalogFile(), catalogBz, 0600)
+}
+
+func (c *Catalog) update(cb func(snapshots map[string]cachedInfo) bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	snapshots, err := c.load()
+	if err != nil {
+		return err
+	}
+	if cb(snapshots) {
+		return c.save(snapshots)
+	}
+	return nil
+}
+
+// The key sidecars are signed with, generated on first use.
+func (c *Catalog) SigningKey() (ed25519.PrivateKey, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.signingKey == nil {
+		key, err := snapshot.LoadOrGenerateSigningKey(c.panelDir.SnapshotSigningKeyFile())
+		if err != nil {
+			return nil, fmt.Errorf("failed to load snapshot signing key: %v", err)
+		}
+		c.signingKey = key
+	}
+	return c.signingKey, nil
+}
+
+// The public keys sidecars are trusted from: this panel's, and those endorsed with a bak.
+func (c *Catalog) TrustedKeys() ([]ed25519.PublicKey, error) {
+	key, err := c.SigningKey()
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	file, err := c.loadFile()
+	c.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	trusted := []ed25519.PublicKey{key.Public().(ed25519.PublicKey)}
+	for _, hexKey := range file.TrustedKeys {
+		public, err := hex.DecodeString(hexKey)
+		if err != nil || len(public) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid trusted key %s in %s", hexKey, c.panelDir.SnapshotCatalogFile())
+		}
+		trusted = append(trusted, public)
+	}
+	return trusted, nil
+}
+
+// Trust the signing keys endorsed with the bak directly under a prefix (the snapshots of the bak),
+// e.g. those of the panel this one replaces, and endorse this panel's key there, so that its
+// sidecars are trusted after a rebuild.  Endorsements that do not verify are skipped.
+func (c *Catalog) TrustBak(ctx context.Context, bucket Bucket, writer Writer, prefix string, identity *age.X25519Identity) ([]ed25519.PublicKey, error) {
+	key, err := c.SigningKey()
+	if err != nil {
+		return nil, err
+	}
+	own := key.Public().(ed25519.PublicKey)
+	endorsed := []ed25519.PublicKey{}
+	objects, errs := bucket.IterateObjects(ctx, prefix)
+	for obj := range objects {
+		if path.Dir(obj.Key)+"/" != prefix {
+			continue
+		}
+		if _, ok := snapshot.ParseSigningKeyName(path.Base(obj.Key)); !ok {
+			continue
+		}
+		public, err := verifyEndorsement(ctx, bucket, obj.Key, identity)
+		if err != nil {
+			slog.Warn("ignoring signing key endorsement", "key", obj.Key, "error", err)
+			continue
+		}
+		endorsed = append(endorsed, public)
+	}
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+
+	if !slices.ContainsFunc(endorsed, func(public ed25519.PublicKey) bool { return public.Equal(own) }) {
+		endorsement, err := snapshot.EndorseSigningKey(own, identity)
+		if err != nil {
+			return nil, err
+		}
+		if err := writer.Put(ctx, prefix+snapshot.SigningKeyName(own), bytes.NewReader(endorsement)); err != nil {
+			return nil, fmt.Errorf("failed to write signing key endorsement: %v", err)
+		}
+		endorsed = append(endorsed, own)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	file, err := c.loadFile()
+	if err != nil {
+		return nil, err
+	}
+	changed := false
+	for _, public := range endorsed {
+		if hexKey := hex.EncodeToString(public); !public.Equal(own) && !slices.Contains(file.TrustedKeys, hexKey) {
+			file.TrustedKeys = append(file.TrustedKeys, hexKey)
+			changed = true
+		}
+	}
+	if changed {
+		if err := c.saveFile(file); err != nil {
+			return nil, err
+		}
+	}
+	return endorsed, nil
+}
+
+func verifyEndorsement(ctx context.Context, bucket Reader, key string, identity *age.X25519Identity) (ed25519.PublicKey, error) {
+	body, err := bucket.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	endorsement, err := io.ReadAll(io.LimitReader(body, 1<<10))
+	if err != nil {
+		return nil, err
+	}
+	return snapshot.VerifyEndorsement(path.Base(key), endorsement, identity)
+}
+
+// Sign and write the sidecar of a snapshot that is being uploaded, and remember its info.
+func (c *Catalog) PutSidecar(ctx context.Context, writer Writer, snapshotKey string, info snapshot.Info, tar io.ReadSeeker) (*snapshot.Sidecar, error) {
+	if _, err := tar.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	sidecar, err := snapshot.NewSidecar(info, tar)
+	if err != nil {
+		return nil, err
+	}
+	return sidecar, c.putSidecar(ctx, writer, snapshotKey, sidecar)
+}
+
+func (c *Catalog) putSidecar(ctx context.Context, writer Writer, snapshotKey string, sidecar *snapshot.Sidecar) error {
+	key, err := c.SigningKey()
+	if err != nil {
+		return err
+	}
+	sidecarBz, err := sidecar.Sign(key)
+	if err != nil {
+		return err
+	}
+	if err := writer.Put(ctx, snapshot.SidecarKey(snapshotKey), bytes.NewReader(sidecarBz)); err != nil {
+		return fmt.Errorf("failed to write sidecar: %v", err)
+	}
+	return c.update(func(snapshots map[string]cachedInfo) bool {
+		snapshots[snapshotKey] = cachedInfo{Size: sidecar.Size, Info: sidecar.Info, Sha256: sidecar.Sha256, Verified: true}
+		return true
+	})
+}
+
+// Read and verify the sidecar of a snapshot against the trusted keys.  If the snapshot has no
+// sidecar, the error satisfies `s3client.IsNotFound`.
+func (c *Catalog) ReadSidecar(ctx context.Context, bucket Reader, snapshotKey string) (*snapshot.Sidecar, error) {
+	trusted, err := c.TrustedKeys()
+	if err != nil {
+		return nil, err
+	}
+	return readSidecar(ctx, bucket, snapshotKey, trusted...)
+}
+
+func readSidecar(ctx context.Context, bucket Reader, snapshotKey string, trusted ...ed25519.PublicKey) (*snapshot.Sidecar, error) {
+	body, err := bucket.Get(ctx, snapshot.SidecarKey(snapshotKey))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	sidecarBz, err := io.ReadAll(io.LimitReader(body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return snapshot.VerifySidecar(sidecarBz, trusted...)
+}
+
+// List the snapshots and their sidecars under a prefix, in key order.  Other objects are skipped.
+func listSnapshots(ctx context.Context, bucket Bucket, prefix string) ([]snapshot.Entry, map[string]bool, error) {
+	entries := []snapshot.Entry{}
+	sidecars := map[string]bool{}
+	objects, errs := bucket.IterateObjects(ctx, prefix)
+	for obj := range objects {
+		if snapshotKey, ok := snapshot.ParseSidecarKey(obj.Key); ok {
+			sidecars[snapshotKey] = true
+			continue
+		}
+		entry, ok := snapshot.ParseKey(obj.Key)
+		if !ok {
+			continue
+		}
+		entry.Size = obj.Size
+		entry.UploadTime = obj.Modified
+		entries = append(entries, entry)
+	}
+	if err := <-errs; err != nil {
+		return nil, nil, err
+	}
+	return entries, sidecars, nil
+}
+
+// Run a function over the entries with bounded concurrency.
+func forEach(indices []int, cb func(i int)) {
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for range min(fetchConcurrency, len(indices)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				cb(i)
+			}
+		}()
+	}
+	for _, i := range indices {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+}
+
+// List the snapshots under a prefix (e.g. `nodes/<node>/snapshots/`), in key order.  Other
+// objects under the prefix are skipped.  With `withInfo`, the info of each snapshot is read from
+// its sidecar, or from the snapshot itself if it has no valid sidecar, unless it is already known;
+// snapshots whose info cannot be read have `InfoError` set.
+func (c *Catalog) List(ctx context.Context, bucket Bucket, prefix string, withInfo bool) ([]snapshot.Entry, error) {
+	entries, sidecars, err := listSnapshots(ctx, bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if !withInfo {
+		return entries, nil
+	}
+
+	c.lock.Lock()
+	known, err := c.load()
+	c.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	missing := []int{}
+	for i := range entries {
+		cached, ok := known[entries[i].Key]
+		// what was read from the snapshot itself is replaced once it has a sidecar
+		if ok && cached.Size == entries[i].Size && (cached.Verified || !sidecars[entries[i].Key]) {
+			info := cached.Info
+			entries[i].Info = &info
+			entries[i].Sha256 = cached.Sha256
+			entries[i].Verified = cached.Verified
+		} else {
+			missing = append(missing, i)
+		}
+	}
+	trusted, err := c.TrustedKeys()
+	if err != nil {
+		return nil, err
+	}
+	forEach(missing, func(i int) {
+		entry := &entries[i]
+		if sidecars[entry.Key] {
+			sidecar, err := readSidecar(ctx, bucket, entry.Key, trusted...)
+			if err == nil && sidecar.Size != entry.Size {
+				err = fmt.Errorf("sidecar is for a snapshot of %d bytes", sidecar.Size)
+			}
+			if err == nil {
+				entry.Info = &sidecar.Info
+				entry.Sha256 = sidecar.Sha256
+				entry.Verified = true
+				return
+			}
+			slog.Warn("ignoring snapshot sidecar", "key", entry.Key, "error", err)
+		}
+		info, err := readInfo(ctx, bucket, entry.Key)
+		if err != nil {
+			entry.InfoError = err.Error()
+		} else {
+			entry.Info = info
+		}
+	})
+
+	listed := map[string]bool{}
+	for _, entry := range entries {
+		listed[entry.Key] = true
+	}
+	err = c.update(func(snapshots map[string]cachedInfo) bool {
+		changed := false
+		for key := range snapshots {
+			// forget snapshots that have been deleted
+			if strings.HasPrefix(key, prefix) && !listed[key] {
+				delete(snapshots, key)
+				changed = true
+			}
+		}
+		for _, i := range missing {
+			entry := entries[i]
+			if entry.Info != nil {
+				snapshots[entry.Key] = cachedInfo{Size: entry.Size, Info: *entry.Info, Sha256: entry.Sha256, Verified: entry.Verified}
+				changed = true
+			}
+		}
+		return changed
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func readInfo(ctx context.Context, bucket Bucket, key string) (*snapshot.Info, error) {
+	body, err := bucket.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	// only read until info.json is found
+	defer body.Close()
+	return snapshot.ReadInfo(body)
+}
+
+// The snapshot with the greatest height, then the latest create time, among those with a verified
+// sidecar.
+func Latest(entries []snapshot.Entry) *snapshot.Entry {
+	var latest *snapshot.Entry
+	for i := range entries {
+		entry := &entries[i]
+		if !entry.Verified || entry.Info == nil {
+			continue
+		}
+		if latest == nil || cmp.Or(
+			cmp.Compare(entry.Info.Height, latest.Info.Height),
+			entry.Info.CreateTime.Compare(latest.Info.CreateTime),
+			strings.Compare(entry.Key, latest.Key),
+		) > 0 {
+			latest = entry
+		}
+	}
+	return latest
+}
+
+type BackfillFailure struct {
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+type BackfillResult struct {
+	Snapshots int `json:"snapshots"`
+	// Snapshots a sidecar was written for
+	Written []string          `json:"written"`
+	Failed  []BackfillFailure `json:"failed"`
+}
+
+// Write sidecars for the snapshots under a prefix that do not have one, downloading each snapshot
+// to hash it.  With `force`, the sidecars this panel signed are written again, as long as the
+// snapshot still matches them.  A sidecar that is invalid, or signed by another key, is never
+// replaced, so that a snapshot that has been tampered with is not signed.
+func (c *Catalog) Backfill(ctx context.Context, bucket Bucket, writer Writer, prefix string, force bool) (*BackfillResult, error) {
+	entries, sidecars, err := listSnapshots(ctx, bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	key, err := c.SigningKey()
+	if err != nil {
+		return nil, err
+	}
+	result := &BackfillResult{Snapshots: len(entries), Written: []string{}, Failed: []BackfillFailure{}}
+	for _, entry := range entries {
+		var existing *snapshot.Sidecar
+		if sidecars[entry.Key] {
+			existing, err = readSidecar(ctx, bucket, entry.Key, key.Public().(ed25519.PublicKey))
+			if errors.Is(err, snapshot.ErrUntrustedSidecar) {
+				err = fmt.Errorf("not replacing a sidecar signed by another key")
+			}
+			if err == nil && existing.Size != entry.Size {
+				err = fmt.Errorf("sidecar is for a snapshot of %d bytes", existing.Size)
+			}
+			if err != nil {
+				result.Failed = append(result.Failed, BackfillFailure{Key: entry.Key, Error: err.Error()})
+				continue
+			}
+			if !force {
+				continue
+			}
+		}
+		if err := c.backfill(ctx, bucket, writer, entry.Key, existing); err != nil {
+			result.Failed = append(result.Failed, BackfillFailure{Key: entry.Key, Error: err.Error()})
+			continue
+		}
+		result.Written = append(result.Written, entry.Key)
+	}
+	return result, nil
+}
+
+func (c *Catalog) backfill(ctx context.Context, bucket Bucket, writer Writer, snapshotKey string, existing *snapshot.Sidecar) error {
+	body, err := bucket.Get(ctx, snapshotKey)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	tmp, err := os.CreateTemp("", "snapshot-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if _, err := io.Copy(tmp, body); err != nil {
+		return fmt.Errorf("failed to download snapshot: %v", err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	info, err := snapshot.ReadInfo(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	sidecar, err := snapshot.NewSidecar(*info, tmp)
+	if err != nil {
+		return err
+	}
+	if existing != nil && sidecar.Sha256 != existing.Sha256 {
+		return fmt.Errorf("snapshot does not match the SHA-256 in its sidecar")
+	}
+	return c.putSidecar(ctx, writer, snapshotKey, sidecar)
+}
@@ -0,0 +1,321 @@
+package catalog_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cordialsys/panel/pkg/bak"
+	"github.com/cordialsys/panel/pkg/paths"
+	"github.com/cordialsys/panel/pkg/s3client"
+	"github.com/cordialsys/panel/pkg/s3client/s3test"
+	"github.com/cordialsys/panel/pkg/snapshot"
+	"github.com/cordialsys/panel/pkg/snapshot/snapshottest"
+	"github.com/cordialsys/panel/server/catalog"
+	"github.com/stretchr/testify/require"
+)
+
+// Counts the snapshots read, to check the info is only read once.
+type countingBucket struct {
+	*s3client.BackupS3Client
+	reads atomic.Int64
+}
+
+func (b *countingBucket) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	b.reads.Add(1)
+	return b.BackupS3Client.Get(ctx, key)
+}
+
+// The bak the test snapshots are encrypted to, which endorses the sidecar signing keys.
+var testBak = bak.GenerateEncryptionKey()
+
+func testBakRecipient() string {
+	recipient := testBak.Recipient()
+	return recipient.String()
+}
+
+func TestCatalog(t *testing.T) {
+	ctx := context.Background()
+	server := s3test.NewServer("backups")
+	defer server.Close()
+	server.MaxKeys = 2
+	client, err := s3client.NewBackupS3Client(s3client.BackupS3ClientOptions{
+		Endpoint: server.URL,
+		Node:     "3",
+		Bucket:   "backups",
+		Region:   "us-east-1",
+		S3Token:  "raw:AKIDPANEL:secret",
+	})
+	require.NoError(t, err)
+	bucket := &countingBucket{BackupS3Client: client}
+
+	bakRecipient := testBakRecipient()
+	created := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := range 3 {
+		info := snapshot.Info{Height: uint64(100 + i), Bak: bakRecipient, Participant: 3, CreateTime: created}
+		server.PutObject("backups", fmt.Sprintf("nodes/3/snapshots/age1bakkey/snap-%d.tar", i), snapshottest.Tar(t, info, i == 2))
+	}
+	server.PutObject("backups", "nodes/3/snapshots/age1bakkey/broken.tar", []byte("not a tar"))
+	server.PutObject("backups", "nodes/3/snapshots/age1bakkey/notes.txt", []byte("not a snapshot"))
+	server.PutObject("backups", "nodes/3/keys/nodes/3/age1bakkey/key@1.json", []byte("key"))
+
+	cat := catalog.New(paths.PanelHome(t.TempDir()))
+	entries, err := cat.List(ctx, bucket, "nodes/3/snapshots/", true)
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+	require.Equal(t, int64(4), bucket.reads.Load())
+
+	broken := entries[0]
+	require.Equal(t, "broken", broken.Id)
+	require.Nil(t, broken.Info)
+	require.Contains(t, broken.InfoError, "failed to read snapshot")
+
+	for i, entry := range entries[1:] {
+		require.Equal(t, fmt.Sprintf("nodes/3/snapshots/age1bakkey/snap-%d.tar", i), entry.Key)
+		require.Equal(t, "3", entry.Node)
+		require.Equal(t, "age1bakkey", entry.BakShortId)
+		require.Equal(t, fmt.Sprintf("snap-%d", i), entry.Id)
+		require.NotZero(t, entry.Size)
+		require.False(t, entry.UploadTime.IsZero())
+		require.NotNil(t, entry.Info, entry.InfoError)
+		require.Equal(t, uint64(100+i), entry.Info.Height)
+		require.Equal(t, snapshot.Int(3), entry.Info.Participant)
+		require.True(t, created.Equal(entry.Info.CreateTime))
+	}
+
+	// the info is remembered, so only the broken snapshot is read again
+	entries, err = cat.List(ctx, bucket, "nodes/3/snapshots/", true)
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+	require.Equal(t, int64(5), bucket.reads.Load())
+	require.Equal(t, uint64(102), entries[3].Info.Height)
+
+	// without info nothing is read
+	entries, err = cat.List(ctx, bucket, "nodes/3/snapshots/", false)
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+	require.Nil(t, entries[1].Info)
+	require.Equal(t, int64(5), bucket.reads.Load())
+
+	// info of uploaded snapshots is read from their sidecar, and is known without reading it again
+	uploaded := snapshottest.Tar(t, snapshot.Info{Height: 200, Bak: bakRecipient, Participant: 3}, false)
+	server.PutObject("backups", "nodes/3/snapshots/age1bakkey/snap-9.tar", uploaded)
+	sidecar, err := cat.PutSidecar(ctx, client, "nodes/3/snapshots/age1bakkey/snap-9.tar", snapshot.Info{Height: 200, Bak: bakRecipient}, bytes.NewReader(uploaded))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(uploaded)), sidecar.Size)
+	require.Equal(t, []string{bakRecipient}, sidecar.Recipients)
+	entries, err = cat.List(ctx, bucket, "nodes/3/snapshots/age1bakkey/", true)
+	require.NoError(t, err)
+	require.Len(t, entries, 5)
+	require.Equal(t, uint64(200), entries[4].Info.Height)
+	require.Equal(t, sidecar.Sha256, entries[4].Sha256)
+	require.True(t, entries[4].Verified)
+	require.Equal(t, int64(6), bucket.reads.Load())
+
+	// only snapshots with a verified sidecar are picked as the latest
+	require.Equal(t, "snap-9", catalog.Latest(entries).Id)
+	require.Nil(t, catalog.Latest(entries[:4]))
+
+	// a sidecar signed by another panel is ignored
+	other := catalog.New(paths.PanelHome(t.TempDir()))
+	_, err = other.PutSidecar(ctx, client, "nodes/3/snapshots/age1bakkey/snap-1.tar", snapshot.Info{Height: 999, Bak: bakRecipient}, bytes.NewReader([]byte("other")))
+	require.NoError(t, err)
+	entries, err = cat.List(ctx, bucket, "nodes/3/snapshots/age1bakkey/", true)
+	require.NoError(t, err)
+	require.Equal(t, uint64(101), entries[2].Info.Height)
+	require.False(t, entries[2].Verified)
+	require.Equal(t, "snap-9", catalog.Latest(entries).Id)
+
+	// backfill writes sidecars for the snapshots without one, but never replaces one signed by
+	// another key
+	result, err := cat.Backfill(ctx, bucket, client, "nodes/3/snapshots/", false)
+	require.NoError(t, err)
+	require.Equal(t, 5, result.Snapshots)
+	require.Equal(t, []string{
+		"nodes/3/snapshots/age1bakkey/snap-0.tar",
+		"nodes/3/snapshots/age1bakkey/snap-2.tar",
+	}, result.Written)
+	require.Len(t, result.Failed, 2)
+	require.Equal(t, "nodes/3/snapshots/age1bakkey/broken.tar", result.Failed[0].Key)
+	require.Equal(t, "nodes/3/snapshots/age1bakkey/snap-1.tar", result.Failed[1].Key)
+	require.Contains(t, result.Failed[1].Error, "signed by another key")
+
+	entries, err = cat.List(ctx, bucket, "nodes/3/snapshots/", true)
+	require.NoError(t, err)
+	for _, entry := range []snapshot.Entry{entries[1], entries[3], entries[4]} {
+		require.True(t, entry.Verified, entry.Key)
+		require.Len(t, entry.Sha256, 64)
+	}
+	require.False(t, entries[2].Verified)
+
+	result, err = cat.Backfill(ctx, bucket, client, "nodes/3/snapshots/", false)
+	require.NoError(t, err)
+	require.Empty(t, result.Written)
+	result, err = cat.Backfill(ctx, bucket, client, "nodes/3/snapshots/", true)
+	require.NoError(t, err)
+	require.Len(t, result.Written, 3)
+	require.Len(t, result.Failed, 2)
+
+	// a snapshot replaced since it was signed is not signed again, even with force
+	tampered := snapshottest.Tar(t, snapshot.Info{Height: 100, Bak: bakRecipient, Participant: 3, CreateTime: created}, false)
+	tampered[len(tampered)-1] ^= 1
+	server.PutObject("backups", "nodes/3/snapshots/age1bakkey/snap-0.tar", tampered)
+	result, err = cat.Backfill(ctx, bucket, client, "nodes/3/snapshots/age1bakkey/snap-0", true)
+	require.NoError(t, err)
+	require.Empty(t, result.Written)
+	require.Len(t, result.Failed, 1)
+	require.Contains(t, result.Failed[0].Error, "does not match")
+
+	// listing errors are returned
+	server.DenyMethods = []string{"GET"}
+	_, err = cat.List(ctx, bucket, "nodes/3/snapshots/", false)
+	require.ErrorContains(t, err, "AccessDenied")
+}
+
+func TestTrustBak(t *testing.T) {
+	ctx := context.Background()
+	server := s3test.NewServer("backups")
+	defer server.Close()
+	client, err := s3client.NewBackupS3Client(s3client.BackupS3ClientOptions{
+		Endpoint: server.URL,
+		Node:     "3",
+		Bucket:   "backups",
+		Region:   "us-east-1",
+		S3Token:  "raw:AKIDPANEL:secret",
+	})
+	require.NoError(t, err)
+
+	bakRecipient := testBakRecipient()
+	key := "nodes/3/snapshots/age1bakkey/snap.tar"
+	tarBz := snapshottest.Tar(t, snapshot.Info{Height: 7, Bak: bakRecipient}, false)
+	server.PutObject("backups", key, tarBz)
+	prefix := "nodes/3/snapshots/age1bakkey/"
+	previous := catalog.New(paths.PanelHome(t.TempDir()))
+	_, err = previous.PutSidecar(ctx, client, key, snapshot.Info{Height: 7, Bak: bakRecipient}, bytes.NewReader(tarBz))
+	require.NoError(t, err)
+	endorsed, err := previous.TrustBak(ctx, client, client, prefix, testBak.Identity())
+	require.NoError(t, err)
+	require.Len(t, endorsed, 1)
+	previousKey, err := previous.SigningKey()
+	require.NoError(t, err)
+	require.Contains(t, server.Objects("backups"), prefix+snapshot.SigningKeyName(previousKey.Public().(ed25519.PublicKey)))
+
+	// a key endorsed without the bak secret is never trusted, even though anyone can encrypt to it
+	forgedPublic, forgedKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	forgedEndorsement, err := snapshot.EndorseSigningKey(forgedPublic, bak.GenerateEncryptionKey().Identity())
+	require.NoError(t, err)
+	server.PutObject("backups", prefix+snapshot.SigningKeyName(forgedPublic), forgedEndorsement)
+	forged, err := snapshot.NewSidecar(snapshot.Info{Height: 8, Bak: bakRecipient}, bytes.NewReader(tarBz))
+	require.NoError(t, err)
+	forgedBz, err := forged.Sign(forgedKey)
+	require.NoError(t, err)
+	server.PutObject("backups", prefix+"forged.tar", tarBz)
+	server.PutObject("backups", snapshot.SidecarKey(prefix+"forged.tar"), forgedBz)
+
+	// a rebuilt panel does not trust the previous panel's sidecars
+	panelDir := paths.PanelHome(t.TempDir())
+	rebuilt := catalog.New(panelDir)
+	entries, err := rebuilt.List(ctx, client, "nodes/3/snapshots/", true)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.False(t, entries[1].Verified)
+	require.Nil(t, catalog.Latest(entries))
+	_, err = rebuilt.ReadSidecar(ctx, client, key)
+	require.ErrorIs(t, err, snapshot.ErrUntrustedSidecar)
+
+	// until given the bak the previous signing key was endorsed with, which also endorses its own
+	endorsed, err = rebuilt.TrustBak(ctx, client, client, prefix, bak.GenerateEncryptionKey().Identity())
+	require.NoError(t, err)
+	require.Len(t, endorsed, 1)
+	endorsed, err = rebuilt.TrustBak(ctx, client, client, prefix, testBak.Identity())
+	require.NoError(t, err)
+	require.Len(t, endorsed, 2)
+	require.Contains(t, endorsed, previousKey.Public())
+	_, err = rebuilt.ReadSidecar(ctx, client, prefix+"forged.tar")
+	require.ErrorIs(t, err, snapshot.ErrUntrustedSidecar)
+
+	// which is remembered
+	rebuilt = catalog.New(panelDir)
+	entries, err = rebuilt.List(ctx, client, "nodes/3/snapshots/", true)
+	require.NoError(t, err)
+	require.False(t, entries[0].Verified)
+	require.True(t, entries[1].Verified)
+	require.Equal(t, "snap", catalog.Latest(entries).Id)
+	sidecar, err := rebuilt.ReadSidecar(ctx, client, key)
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), sidecar.Info.Height)
+
+	// a missing sidecar is distinguished from an invalid one
+	_, err = rebuilt.ReadSidecar(ctx, client, "nodes/3/snapshots/age1bakkey/missing.tar")
+	require.True(t, s3client.IsNotFound(err), err)
+}
+
+func TestSidecar(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	sidecar, err := snapshot.NewSidecar(snapshot.Info{Height: 5, Bak: "age1bakkey"}, bytes.NewReader([]byte("snapshot")))
+	require.NoError(t, err)
+	require.Equal(t, int64(8), sidecar.Size)
+	sidecarBz, err := sidecar.Sign(key)
+	require.NoError(t, err)
+
+	verified, err := snapshot.VerifySidecar(sidecarBz, key.Public().(ed25519.PublicKey))
+	require.NoError(t, err)
+	require.Equal(t, sidecar, verified)
+
+	_, err = snapshot.VerifySidecar(sidecarBz, otherKey.Public().(ed25519.PublicKey))
+	require.ErrorIs(t, err, snapshot.ErrUntrustedSidecar)
+
+	tampered := bytes.Replace(sidecarBz, []byte(`"height": 5`), []byte(`"height": 6`), 1)
+	require.NotEqual(t, sidecarBz, tampered)
+	_, err = snapshot.VerifySidecar(tampered, key.Public().(ed25519.PublicKey))
+	require.ErrorContains(t, err, "invalid signature")
+
+	snapshotKey, ok := snapshot.ParseSidecarKey(snapshot.SidecarKey("nodes/3/snapshots/age1bakkey/snap.tar"))
+	require.True(t, ok)
+	require.Equal(t, "nodes/3/snapshots/age1bakkey/snap.tar", snapshotKey)
+	_, ok = snapshot.ParseSidecarKey("nodes/3/keys/age1bakkey/key@1.json")
+	require.False(t, ok)
+
+	// the signing key is generated once
+	path := filepath.Join(t.TempDir(), "signing.key")
+	generated, err := snapshot.LoadOrGenerateSigningKey(path)
+	require.NoError(t, err)
+	loaded, err := snapshot.LoadOrGenerateSigningKey(path)
+	require.NoError(t, err)
+	require.True(t, generated.Equal(loaded))
+}
+
+func TestParseKey(t *testing.T) {
+	entry, ok := snapshot.ParseKey("nodes/3/snapshots/age1bakkey/scheduled-1700000000.tar")
+	require.True(t, ok)
+	require.Equal(t, snapshot.Entry{
+		Key:        "nodes/3/snapshots/age1bakkey/scheduled-1700000000.tar",
+		Node:       "3",
+		BakShortId: "age1bakkey",
+		Id:         "scheduled-1700000000",
+	}, entry)
+
+	for _, key := range []string{
+		"nodes/3/snapshots/age1bakkey/snap.json",
+		"nodes/3/snapshots/snap.tar",
+		"nodes/3/keys/age1bakkey/snap.tar",
+		"nodes/3/snapshots/age1bakkey/nested/snap.tar",
+		"nodes//snapshots/age1bakkey/snap.tar",
+		"nodes/3/snapshots/age1bakkey/.tar",
+	} {
+		_, ok := snapshot.ParseKey(key)
+		require.False(t, ok, key)
+	}
+}
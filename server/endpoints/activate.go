@@ -12,6 +12,8 @@ import (
 	"github.com/cordialsys/panel/pkg/admin"
 	"github.com/cordialsys/panel/pkg/api"
 	"github.com/cordialsys/panel/pkg/client"
+	"github.com/cordialsys/panel/pkg/plog"
+	"github.com/cordialsys/panel/pkg/secret"
 	"github.com/cordialsys/panel/server/panel"
 	"github.com/cordialsys/panel/server/servererrors"
 	"github.com/gofiber/fiber/v2"
@@ -26,9 +28,20 @@ func (endpoints *Endpoints) ActivateApiKey(c *fiber.Ctx) error {
 		return servererrors.BadRequestf("failed to parse request: %v", err)
 	}
 
+	if request.ApiKeyRef != "" {
+		if request.ApiKeyRef.IsType(secret.Raw) {
+			return servererrors.BadRequestf("api_key_ref may not be a raw secret, pass the key as api_key instead")
+		}
+		apiKey, err := request.ApiKeyRef.Load()
+		if err != nil {
+			return servererrors.BadRequestf("failed to load api_key_ref: %v", err)
+		}
+		request.ApiKey = apiKey
+	}
 	if request.ApiKey == "" {
-		return servererrors.BadRequestf("api_key is required")
+		return servererrors.BadRequestf("api_key or api_key_ref is required")
 	}
+	plog.AddSecret(request.ApiKey)
 	client := admin.NewClient(request.ApiKey)
 
 	apiKeyId := ""
@@ -53,8 +66,6 @@ func (endpoints *Endpoints) ActivateApiKey(c *fiber.Ctx) error {
 		return servererrors.BadRequestf("api-key is not associated with a node")
 	}
 
-	endpoints.panel.ApiKey = request.ApiKey
-
 	parts := strings.Split(nodeName, "/")
 	if len(parts) != 4 {
 		return servererrors.BadRequestf("invalid node name: %s", nodeName)
@@ -99,12 +110,36 @@ func (endpoints *Endpoints) ActivateApiKey(c *fiber.Ctx) error {
 	}
 	endpoints.panel.TreasurySize = uint64(api.DerefOrZero(treas.Size))
 
+	// Only a reference to the API key is kept in the panel configuration
+	if request.ApiKeyRef != "" {
+		endpoints.panel.ApiKeyRef = request.ApiKeyRef
+		endpoints.panel.ApiKeyId = apiKeyId
+	} else {
+		validKey, err := validateAPIKey(request.ApiKey)
+		if err != nil {
+			return err
+		}
+		err = endpoints.panel.StoreApiKey(validKey)
+		if err != nil {
+			return servererrors.InternalErrorf("failed to store API key: %v", err)
+		}
+	}
+	endpoints.panel.LegacyApiKey = ""
+
 	err = panel.Save(endpoints.panel)
 	if err != nil {
 		return servererrors.InternalErrorf("failed to save panel: %v", err)
 	}
+	// the treasury and node are now known
+	endpoints.backupLock.Lock()
+	defer endpoints.backupLock.Unlock()
+	s3Client, err := newBackupS3Client(endpoints.panel)
+	if err != nil {
+		return servererrors.InternalErrorf("failed to create backup client: %v", err)
+	}
+	endpoints.setBackupClient(s3Client)
 
-	slog.Info("updated panel params", "panel", endpoints.panel, "path", endpoints.panel.PanelDir.PanelFile())
+	slog.Info("updated panel params", "node", endpoints.panel.NodeName(), "api_key_ref", endpoints.panel.ApiKeyRef, "path", endpoints.panel.PanelDir.PanelFile())
 	return c.JSON(endpoints.panel)
 }
 
@@ -147,7 +182,10 @@ func (endpoints *Endpoints) ActivateNetwork(c *fiber.Ctx) error {
 		// /activate/api-key must be called first
 		return servererrors.BadRequestf("the API key has not yet been activated")
 	}
-	client := admin.NewClient(endpoints.panel.ApiKey)
+	client, err := endpoints.AdminClient()
+	if err != nil {
+		return err
+	}
 
 	networkKey, err := client.GetNetworkKey(endpoints.panel.NodeName())
 	if err != nil {
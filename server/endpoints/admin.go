@@ -7,10 +7,14 @@ import (
 )
 
 func (endpoints *Endpoints) AdminUsers(c *fiber.Ctx) error {
-	if endpoints.panel.ApiKey == "" {
+	if !endpoints.panel.HasApiKey() {
 		return servererrors.FailedPreconditionf("not activated")
 	}
-	client := admin.NewClient(endpoints.panel.ApiKey)
+	apiKey, err := endpoints.ApiKey()
+	if err != nil {
+		return err
+	}
+	client := admin.NewClient(apiKey)
 	nextPageToken := c.Query("page_token")
 	usersPage, err := client.ListUsers(nextPageToken)
 	if err != nil {
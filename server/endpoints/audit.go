@@ -0,0 +1,42 @@
+package endpoints
+
+import (
+	"strconv"
+
+	"github.com/cordialsys/panel/server/audit"
+	"github.com/cordialsys/panel/server/servererrors"
+	"github.com/gofiber/fiber/v2"
+)
+
+const defaultAuditPageSize = 100
+const maxAuditPageSize = 1000
+
+type ListAuditResponse struct {
+	Entries       []audit.Entry `json:"entries"`
+	NextPageToken string        `json:"next_page_token,omitempty"`
+}
+
+// GET /v1/audit?page_token=<seq>&limit=<n>
+func (endpoints *Endpoints) ListAudit(c *fiber.Ctx) error {
+	var fromSeq uint64
+	var err error
+	if pageToken := c.Query("page_token"); pageToken != "" {
+		fromSeq, err = strconv.ParseUint(pageToken, 10, 64)
+		if err != nil {
+			return servererrors.BadRequestf("invalid page_token: %v", err)
+		}
+	}
+	limit := c.QueryInt("limit", defaultAuditPageSize)
+	if limit <= 0 || limit > maxAuditPageSize {
+		return servererrors.BadRequestf("limit must be between 1 and %d", maxAuditPageSize)
+	}
+	entries, next, err := audit.List(endpoints.panel.PanelDir, fromSeq, limit)
+	if err != nil {
+		return servererrors.InternalErrorf("failed to read audit log: %v", err)
+	}
+	response := ListAuditResponse{Entries: entries}
+	if next != 0 {
+		response.NextPageToken = strconv.FormatUint(next, 10)
+	}
+	return c.JSON(response)
+}
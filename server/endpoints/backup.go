@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -19,10 +21,13 @@ import (
 
 	"filippo.io/age"
 	"github.com/cordialsys/panel/pkg/bak"
+	"github.com/cordialsys/panel/pkg/plog"
 	"github.com/cordialsys/panel/pkg/resource"
 	"github.com/cordialsys/panel/pkg/s3client"
 	"github.com/cordialsys/panel/pkg/snapshot"
+	"github.com/cordialsys/panel/server/auth"
 	"github.com/cordialsys/panel/server/servererrors"
+	"github.com/cordialsys/panel/server/sessions"
 	"github.com/gofiber/fiber/v2"
 )
 
@@ -36,25 +41,41 @@ func NodeSpecificSignerBakPhrase(nodeId int) string {
 	return fmt.Sprintf("SIGNER_%d_BAK_PHRASE", nodeId)
 }
 
-func DecodeEncryptedSecretPhrase(identity *age.X25519Identity, encryptedSecretPhrase string) (string, error) {
+// Decrypt a secret phrase submitted for an operation.  It must be encrypted to a session recipient
+// minted for the operation by the same caller (see `CreateSessionRecipient`), which is then dropped.
+// The phrase is redacted from logs until `release` is called, once the operation is done with it.
+func (endpoints *Endpoints) DecodeEncryptedSecretPhrase(c *fiber.Ctx, operation sessions.Operation, sessionId string, encryptedSecretPhrase string) (mnemonic string, release func(), err error) {
+	if sessionId == "" {
+		return "", nil, servererrors.BadRequestf("missing session_id, create one with POST /v1/sessions/recipient")
+	}
+	tokenId := ""
+	if token := auth.FromCtx(c); token != nil {
+		tokenId = token.Id
+	}
+	identity, err := endpoints.sessions.Take(sessionId, operation, tokenId)
+	if err == sessions.ErrNotFound {
+		return "", nil, servererrors.FailedPreconditionf("session %s not found or expired, create a new one", sessionId)
+	}
+	if err != nil {
+		return "", nil, servererrors.PermissionDeniedf("%v", err)
+	}
 	encryptedBytes, err := base64.StdEncoding.DecodeString(encryptedSecretPhrase)
 	if err != nil {
-		return "", servererrors.InternalErrorf("failed to decode encrypted secret phrase as base64: %v", err)
+		return "", nil, servererrors.InternalErrorf("failed to decode encrypted secret phrase as base64: %v", err)
 	}
 	reader, err := age.Decrypt(bytes.NewReader(encryptedBytes), identity)
 	if err != nil {
-		return "", servererrors.InternalErrorf("failed to decrypt encrypted secret phrase: %v", err)
+		return "", nil, servererrors.InternalErrorf("failed to decrypt encrypted secret phrase: %v", err)
 	}
 	mnemonicBz, err := io.ReadAll(reader)
 	if err != nil {
-		return "", servererrors.InternalErrorf("failed to read secret phrase: %v", err)
+		return "", nil, servererrors.InternalErrorf("failed to read secret phrase: %v", err)
 	}
-	mnemonic := string(mnemonicBz)
-	mnemonic = FormatMnemonic(mnemonic)
+	mnemonic = FormatMnemonic(string(mnemonicBz))
 	if len(mnemonic) == 0 {
-		return "", servererrors.InternalErrorf("secret phrase is too short")
+		return "", nil, servererrors.InternalErrorf("secret phrase is too short")
 	}
-	return mnemonic, nil
+	return mnemonic, plog.AddSecret(string(mnemonicBz), mnemonic), nil
 }
 
 func FormatMnemonic(mnemonic string) string {
@@ -81,14 +102,14 @@ func BakShortId(bak string) string {
 }
 
 func (endpoints *Endpoints) ListObjects(c *fiber.Ctx) error {
-	if endpoints.panel.ApiKey == "" {
+	if !endpoints.panel.HasApiKey() {
 		return servererrors.FailedPreconditionf("not activated")
 	}
 	ctx := c.Context()
 	prefix := c.Query("prefix")
 	marker := c.Query("marker")
 
-	resp, err := endpoints.s3Client.ListObjects(ctx, s3client.ListObjectsOptions{
+	resp, err := endpoints.backupClient().ListObjects(ctx, s3client.ListObjectsOptions{
 		Prefix: prefix,
 		Marker: marker,
 	})
@@ -100,7 +121,7 @@ func (endpoints *Endpoints) ListObjects(c *fiber.Ctx) error {
 }
 
 func (endpoints *Endpoints) DownloadObject(c *fiber.Ctx) error {
-	if endpoints.panel.ApiKey == "" {
+	if !endpoints.panel.HasApiKey() {
 		return servererrors.FailedPreconditionf("not activated")
 	}
 	ctx := c.Context()
@@ -109,7 +130,7 @@ func (endpoints *Endpoints) DownloadObject(c *fiber.Ctx) error {
 		return servererrors.BadRequestf("missing key query param")
 	}
 
-	resp, err := endpoints.s3Client.GetObject(ctx, fileKey)
+	resp, err := endpoints.backupClient().GetObject(ctx, fileKey)
 	if err != nil {
 		return servererrors.InternalErrorf("failed to get object: %v", err)
 	}
@@ -127,7 +148,7 @@ func (endpoints *Endpoints) DownloadObject(c *fiber.Ctx) error {
 }
 
 func (endpoints *Endpoints) TakeSnapshot(c *fiber.Ctx) error {
-	if endpoints.panel.ApiKey == "" {
+	if !endpoints.panel.HasApiKey() {
 		return servererrors.FailedPreconditionf("not activated")
 	}
 	snapshotId, err := url.PathUnescape(c.Params("id"))
@@ -201,7 +222,7 @@ func (endpoints *Endpoints) TakeSnapshot(c *fiber.Ctx) error {
 				slog.Error("failed to stat snapshot", "path", path, "error", err)
 				return nil
 			}
-			fmt.Println(path)
+			slog.Debug("found snapshot", "path", path)
 			if mostRecentSnapshot.Path == "" {
 				mostRecentSnapshot = snapshotInfo{
 					Path: path,
@@ -232,7 +253,7 @@ func (endpoints *Endpoints) TakeSnapshot(c *fiber.Ctx) error {
 }
 
 func (endpoints *Endpoints) UploadSnapshot(c *fiber.Ctx) error {
-	if endpoints.panel.ApiKey == "" {
+	if !endpoints.panel.HasApiKey() {
 		return servererrors.FailedPreconditionf("not activated")
 	}
 	snapshotId, err := url.PathUnescape(c.Params("id"))
@@ -299,7 +320,7 @@ func (endpoints *Endpoints) UploadSnapshot(c *fiber.Ctx) error {
 	}
 	defer tmpSnapshotFile.Close()
 
-	_, err = endpoints.s3Client.PutSnapshot(c.Context(), relativePath, tmpSnapshotFile)
+	err = endpoints.uploadSnapshot(c.Context(), relativePath, tmpSnapshotFile, info)
 	if err != nil {
 		return servererrors.InternalErrorf("failed to upload snapshot: %v", err)
 	}
@@ -307,12 +328,34 @@ func (endpoints *Endpoints) UploadSnapshot(c *fiber.Ctx) error {
 	return c.JSON(nil)
 }
 
+// Upload a snapshot to the backup bucket and its replicas, along with its signed sidecar.
+func (endpoints *Endpoints) uploadSnapshot(ctx context.Context, relativePath string, snapshotFile *os.File, info snapshot.Info) error {
+	replicator := endpoints.replicator()
+	err := replicator.PutSnapshot(ctx, relativePath, snapshotFile)
+	if err != nil {
+		return err
+	}
+	// a missing sidecar is written by `BackfillSidecars`
+	_, err = endpoints.catalog.PutSidecar(ctx, replicator, replicator.Primary.SnapshotKey(relativePath), info, snapshotFile)
+	if err != nil {
+		slog.Warn("failed to write snapshot sidecar", "path", relativePath, "error", err)
+	}
+	endpoints.reconcileKeys(ctx, replicator)
+	return nil
+}
+
 type RestoreSnapshotRequest struct {
 	// Age encrypted mnemonic phrase
 	EncryptedSecretPhrase string `json:"encrypted_secret_phrase"`
+	// Session the phrase is encrypted to (POST /v1/sessions/recipient)
+	SessionId string `json:"session_id"`
 
 	// S3 File key
 	S3Key string `json:"s3_key"`
+	// Instead of `s3_key`, restore this node's snapshot with the greatest height, per the sidecars
+	Latest bool `json:"latest,omitempty"`
+	// With `latest`, only consider the snapshots of this backup key
+	Bak string `json:"bak,omitempty"`
 }
 
 // Restore from snapshot
@@ -320,7 +363,7 @@ type RestoreSnapshotRequest struct {
 // - Download the snapshot
 // - Restore the snapshot
 func (endpoints *Endpoints) RestoreFromSnapshot(c *fiber.Ctx) error {
-	if endpoints.panel.ApiKey == "" {
+	if !endpoints.panel.HasApiKey() {
 		return servererrors.FailedPreconditionf("not activated")
 	}
 	ctx := c.Context()
@@ -332,17 +375,52 @@ func (endpoints *Endpoints) RestoreFromSnapshot(c *fiber.Ctx) error {
 	if req.EncryptedSecretPhrase == "" {
 		return servererrors.BadRequestf("missing encrypted_mnemonic_phrase")
 	}
-	if req.S3Key == "" {
+	if req.Latest && req.S3Key != "" {
+		return servererrors.BadRequestf("only one of s3_key or latest may be set")
+	}
+	if !req.Latest && req.S3Key == "" {
 		return servererrors.BadRequestf("missing s3_key")
 	}
-	if !strings.Contains(req.S3Key, "/snapshots/") {
+	if req.S3Key != "" && !strings.Contains(req.S3Key, "/snapshots/") {
 		return servererrors.BadRequestf("file does not appear to be a snapshot")
 	}
 
-	mnemonic, err := DecodeEncryptedSecretPhrase(endpoints.identity, req.EncryptedSecretPhrase)
+	mnemonic, release, err := endpoints.DecodeEncryptedSecretPhrase(c, sessions.OperationRestoreSnapshot, req.SessionId, req.EncryptedSecretPhrase)
 	if err != nil {
 		return err
 	}
+	defer release()
+	bakKey, err := bak.NewEncryptionKey(strings.Split(mnemonic, " "))
+	if err != nil {
+		return servererrors.BadRequestf("failed to derive decryption key: %v", err)
+	}
+	bakRecipient := bakKey.Recipient()
+	if req.Bak != "" && BakShortId(req.Bak) != BakShortId(bakRecipient.String()) {
+		return servererrors.BadRequestf("bak does not match the secret phrase")
+	}
+	// trust the sidecars of the panels that endorsed their signing key with the bak, e.g. the one
+	// this node is being rebuilt from
+	if _, err := endpoints.trustBak(ctx, bakKey); err != nil {
+		slog.Warn("failed to endorse snapshot signing keys", "error", err)
+	}
+
+	if req.Latest {
+		entry, err := endpoints.latestSnapshot(ctx, bakRecipient.String())
+		if err != nil {
+			return err
+		}
+		req.S3Key = entry.Key
+	}
+	// the download is checked against the sidecar.  Snapshots uploaded before sidecars existed
+	// have none, but one that is present must be valid.
+	expectedSha256 := ""
+	if sidecar, err := endpoints.catalog.ReadSidecar(ctx, endpoints.replicator(), req.S3Key); err == nil {
+		expectedSha256 = sidecar.Sha256
+	} else if s3client.IsNotFound(err) {
+		slog.Warn("restoring snapshot without a sidecar", "s3_key", req.S3Key)
+	} else {
+		return servererrors.FailedPreconditionf("refusing to restore a snapshot with an invalid sidecar: %v", err)
+	}
 
 	tmpdir, err := os.MkdirTemp("", "snapshot-")
 	if err != nil {
@@ -361,19 +439,27 @@ func (endpoints *Endpoints) RestoreFromSnapshot(c *fiber.Ctx) error {
 
 	slog.Info("getting object", "s3_key", req.S3Key)
 
-	object, err := endpoints.s3Client.GetObject(ctx, req.S3Key)
+	// falls back to the backup replicas if the bucket is unavailable
+	object, err := endpoints.replicator().Get(ctx, req.S3Key)
 	if err != nil {
 		return servererrors.InternalErrorf("failed to get object: %v", err)
 	}
-	defer object.Body.Close()
+	defer object.Close()
 
-	_, err = io.Copy(outputFile, object.Body)
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(outputFile, hash), object)
 	if err != nil {
 		return servererrors.InternalErrorf("failed to download object to file: %v", err)
 	}
-	_ = object.Body.Close()
+	_ = object.Close()
+	if expectedSha256 != "" && hex.EncodeToString(hash.Sum(nil)) != expectedSha256 {
+		return servererrors.FailedPreconditionf("snapshot does not match the SHA-256 in its sidecar")
+	}
 	_ = outputFile.Close()
 
+	endpoints.restoring.Store(true)
+	defer endpoints.restoring.Store(false)
+
 	// stop treasury
 	_, err = stopSystemdServiceAndWait(ctx, ServiceTreasury)
 	if err != nil {
@@ -384,7 +470,7 @@ func (endpoints *Endpoints) RestoreFromSnapshot(c *fiber.Ctx) error {
 		"backup",
 		"restore",
 		"--snapshot", snapshotPath,
-	}, IncludeEar, fmt.Sprintf("%s=%s", ENV_SIGNER_BAK_PHRASE, mnemonic))
+	}, IncludeEar, ENV_SIGNER_BAK_PHRASE, mnemonic)
 	if err != nil {
 		return servererrors.InternalErrorf("failed to apply snapshot: %v", err)
 	}
@@ -401,6 +487,8 @@ func (endpoints *Endpoints) RestoreFromSnapshot(c *fiber.Ctx) error {
 type RestoreMissingKeysRequest struct {
 	// Age encrypted mnemonic phrase
 	EncryptedSecretPhrase string `json:"encrypted_secret_phrase"`
+	// Session the phrase is encrypted to (POST /v1/sessions/recipient)
+	SessionId string `json:"session_id"`
 }
 
 type RestoreMissingKeysResponse struct {
@@ -429,10 +517,11 @@ func (endpoints *Endpoints) RestoreMissingKeys(c *fiber.Ctx) error {
 	}
 
 	// Validate the mnemonic phrase decrypts
-	mnemonic, err := DecodeEncryptedSecretPhrase(endpoints.identity, req.EncryptedSecretPhrase)
+	mnemonic, release, err := endpoints.DecodeEncryptedSecretPhrase(c, sessions.OperationRestoreMissingKeys, req.SessionId, req.EncryptedSecretPhrase)
 	if err != nil {
 		return err
 	}
+	defer release()
 
 	bakKey, err := bak.NewEncryptionKey(strings.Split(mnemonic, " "))
 	if err != nil {
@@ -440,6 +529,23 @@ func (endpoints *Endpoints) RestoreMissingKeys(c *fiber.Ctx) error {
 	}
 	bakRecipient := bakKey.Recipient()
 	bak := bakRecipient.String()
+	nodeId := fmt.Sprintf("%d", endpoints.panel.NodeId)
+	prefix := fmt.Sprintf("nodes/%s/keys/nodes/%s/%s", nodeId, nodeId, BakShortId(bak))
+
+	// The treasury keeps uploading key backups to the backup service, so a bucket of the
+	// customer's own only has them if they were copied there.
+	if endpoints.panel.BackupDestination != nil {
+		objects, err := endpoints.backupClient().List(ctx, prefix)
+		if err != nil {
+			return servererrors.InternalErrorf("failed to list key backups: %v", err)
+		}
+		if len(objects) == 0 {
+			return servererrors.FailedPreconditionf("the backup destination has no key backups for this bak, as the treasury uploads them to the Cordial Systems backup service")
+		}
+	}
+
+	endpoints.restoring.Store(true)
+	defer endpoints.restoring.Store(false)
 
 	// stop treasury
 	_, err = stopSystemdServiceAndWait(ctx, ServiceTreasury)
@@ -452,7 +558,7 @@ func (endpoints *Endpoints) RestoreMissingKeys(c *fiber.Ctx) error {
 		"list-keys",
 		"--db", endpoints.panel.TreasuryHome.SignerDb(),
 	}
-	execCmd := exec.Command(signerBin, execList...)
+	execCmd := endpoints.newSecretCmd(signerBin, execList...)
 	err = endpoints.attachEarSecretToCmd(execCmd)
 	if err != nil {
 		return err
@@ -476,7 +582,6 @@ func (endpoints *Endpoints) RestoreMissingKeys(c *fiber.Ctx) error {
 	scanner := bufio.NewScanner(signerOut)
 	for scanner.Scan() {
 		line := scanner.Text()
-		fmt.Println(line)
 		var key resource.Key
 		if err := json.Unmarshal([]byte(line), &key); err != nil {
 			slog.Warn("failed to unmarshal key", "line", line, "error", err)
@@ -494,11 +599,9 @@ func (endpoints *Endpoints) RestoreMissingKeys(c *fiber.Ctx) error {
 	}
 
 	// now scan all of the keys in the s3 bucket
-	nodeId := fmt.Sprintf("%d", endpoints.panel.NodeId)
-	prefix := fmt.Sprintf("nodes/%s/keys/nodes/%s/%s", nodeId, nodeId, BakShortId(bak))
-	fmt.Println("prefix", prefix)
+	slog.Debug("scanning backed up keys", "prefix", prefix)
 
-	s3FileIter, err := endpoints.s3Client.IterateFiles(ctx, prefix)
+	s3FileIter, err := endpoints.backupClient().IterateFiles(ctx, prefix)
 	if err != nil {
 		return servererrors.InternalErrorf("failed to iterate s3 files: %v", err)
 	}
@@ -522,7 +625,7 @@ func (endpoints *Endpoints) RestoreMissingKeys(c *fiber.Ctx) error {
 		for {
 			select {
 			case missingKey := <-missingKeys:
-				object, err := endpoints.s3Client.GetObject(ctxDownload, missingKey.fileKey)
+				object, err := endpoints.backupClient().GetObject(ctxDownload, missingKey.fileKey)
 				if err != nil {
 					slog.Warn("failed to get object", "file_key", missingKey.fileKey, "error", err)
 					continue
@@ -568,7 +671,7 @@ func (endpoints *Endpoints) RestoreMissingKeys(c *fiber.Ctx) error {
 				fileKey: filepath.Join(prefix, s3File),
 			}
 		}
-		fmt.Printf("%s exists=%t\n", s3File, exists)
+		slog.Debug("backed up key", "file", s3File, "exists", exists)
 	}
 	completedScan <- true
 	<-completedDownload
@@ -589,12 +692,9 @@ func (endpoints *Endpoints) RestoreMissingKeys(c *fiber.Ctx) error {
 			"--db", endpoints.panel.TreasuryHome.SignerDb(),
 			"--import-dir", tmpdir,
 		}
-		execCmd := exec.Command(signerBin, execList...)
-		execCmd.Env = append(
-			os.Environ(),
-			fmt.Sprintf("%s=%s", ENV_SIGNER_BAK_PHRASE, mnemonic),
-			fmt.Sprintf("%s=%s", NodeSpecificSignerBakPhrase(int(endpoints.panel.NodeId)), mnemonic),
-		)
+		execCmd := endpoints.newSecretCmd(signerBin, execList...)
+		execCmd.AddSecret(ENV_SIGNER_BAK_PHRASE, mnemonic)
+		execCmd.AddSecret(NodeSpecificSignerBakPhrase(int(endpoints.panel.NodeId)), mnemonic)
 		err = endpoints.attachEarSecretToCmd(execCmd)
 		if err != nil {
 			return err
@@ -0,0 +1,150 @@
+package endpoints
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/cordialsys/panel/pkg/bak"
+	"github.com/cordialsys/panel/pkg/snapshot"
+	"github.com/cordialsys/panel/server/catalog"
+	"github.com/cordialsys/panel/server/panel"
+	"github.com/cordialsys/panel/server/servererrors"
+	"github.com/cordialsys/panel/server/sessions"
+	"github.com/gofiber/fiber/v2"
+)
+
+// List the snapshots in the backup bucket, joined with the info read from each.
+// - `node`: defaults to this node, or `all`
+// - `bak`: only the snapshots of this backup key, or short id of one
+// - `info=false`: do not read the info of snapshots not seen before
+// - `latest=true`: only the snapshot with the greatest height, per the sidecars
+func (endpoints *Endpoints) ListBackupSnapshots(c *fiber.Ctx) error {
+	if !endpoints.panel.HasApiKey() {
+		return servererrors.FailedPreconditionf("not activated")
+	}
+	node := c.Query("node", fmt.Sprint(endpoints.panel.NodeId))
+	bakShortId := BakShortId(c.Query("bak"))
+	prefix := "nodes/"
+	if node != "all" {
+		prefix = fmt.Sprintf("nodes/%s/snapshots/", node)
+		if bakShortId != "" {
+			prefix += bakShortId + "/"
+		}
+	}
+
+	entries, err := endpoints.catalog.List(c.Context(), endpoints.backupClient(), prefix, c.QueryBool("info", true))
+	if err != nil {
+		return servererrors.InternalErrorf("failed to list snapshots: %v", err)
+	}
+	if bakShortId != "" {
+		entries = slices.DeleteFunc(entries, func(entry snapshot.Entry) bool { return entry.BakShortId != bakShortId })
+	}
+	if c.QueryBool("latest") {
+		latest := catalog.Latest(entries)
+		entries = []snapshot.Entry{}
+		if latest != nil {
+			entries = append(entries, *latest)
+		}
+	}
+	return c.JSON(entries)
+}
+
+// This node's snapshot with the greatest height, among those with a verified sidecar.
+func (endpoints *Endpoints) latestSnapshot(ctx context.Context, bak string) (*snapshot.Entry, error) {
+	prefix := endpoints.backupClient().NodePrefix() + "snapshots/"
+	if bak != "" {
+		prefix += BakShortId(bak) + "/"
+	}
+	entries, err := endpoints.catalog.List(ctx, endpoints.backupClient(), prefix, true)
+	if err != nil {
+		return nil, servererrors.InternalErrorf("failed to list snapshots: %v", err)
+	}
+	latest := catalog.Latest(entries)
+	if latest == nil {
+		return nil, servererrors.NotFoundf("no snapshot with a verified sidecar under %s", prefix)
+	}
+	return latest, nil
+}
+
+// Write signed sidecars for this node's snapshots that were uploaded without one.  With `force`,
+// the sidecars this panel signed are written again.  Sidecars signed by another key are never
+// replaced.
+func (endpoints *Endpoints) BackfillSidecars(c *fiber.Ctx) error {
+	if !endpoints.panel.HasApiKey() {
+		return servererrors.FailedPreconditionf("not activated")
+	}
+	_, force := c.Queries()["force"]
+	replicator := endpoints.replicator()
+	prefix := replicator.Primary.NodePrefix() + "snapshots/"
+	result, err := endpoints.catalog.Backfill(c.Context(), replicator.Primary, replicator, prefix, force)
+	if err != nil {
+		return servererrors.InternalErrorf("failed to list snapshots: %v", err)
+	}
+	slog.Info("backfilled snapshot sidecars", "snapshots", result.Snapshots, "written", len(result.Written), "failed", len(result.Failed))
+	return c.JSON(result)
+}
+
+// Endorse this panel's signing key with the bak next to this node's snapshots of it, and trust the
+// keys endorsed there before.
+func (endpoints *Endpoints) trustBak(ctx context.Context, bakKey *bak.SecretKey) ([]ed25519.PublicKey, error) {
+	recipient := bakKey.Recipient()
+	replicator := endpoints.replicator()
+	prefix := replicator.Primary.SnapshotPrefix(BakShortId(recipient.String()))
+	return endpoints.catalog.TrustBak(ctx, replicator.Primary, replicator, prefix, bakKey.Identity())
+}
+
+type EndorseSigningKeyRequest struct {
+	// Age encrypted mnemonic phrase of the bak
+	EncryptedSecretPhrase string `json:"encrypted_secret_phrase"`
+	// Session the phrase is encrypted to (POST /v1/sessions/recipient)
+	SessionId string `json:"session_id"`
+}
+
+type EndorseSigningKeyResponse struct {
+	// Hex public keys endorsed with the bak, including this panel's
+	EndorsedKeys []string `json:"endorsed_keys"`
+}
+
+// Endorse this panel's sidecar signing key with a bak, so that a panel rebuilt later trusts the
+// sidecars it signed.  Restoring with the bak does the same.
+func (endpoints *Endpoints) EndorseSigningKey(c *fiber.Ctx) error {
+	if !endpoints.panel.HasApiKey() {
+		return servererrors.FailedPreconditionf("not activated")
+	}
+	req := EndorseSigningKeyRequest{}
+	if err := json.Unmarshal(c.Body(), &req); err != nil {
+		return servererrors.BadRequestf("failed to parse request: %v", err)
+	}
+	if req.EncryptedSecretPhrase == "" {
+		return servererrors.BadRequestf("missing encrypted_secret_phrase")
+	}
+	mnemonic, release, err := endpoints.DecodeEncryptedSecretPhrase(c, sessions.OperationEndorseSigningKey, req.SessionId, req.EncryptedSecretPhrase)
+	if err != nil {
+		return err
+	}
+	defer release()
+	bakKey, err := bak.NewEncryptionKey(strings.Split(mnemonic, " "))
+	if err != nil {
+		return servererrors.BadRequestf("failed to derive bak: %v", err)
+	}
+	recipient := bakKey.Recipient()
+	if !slices.ContainsFunc(endpoints.panel.Baks, func(b panel.Bak) bool { return b.Key == recipient.String() }) {
+		return servererrors.BadRequestf("secret phrase is not for any of the backup keys")
+	}
+	endorsed, err := endpoints.trustBak(c.Context(), bakKey)
+	if err != nil {
+		return servererrors.InternalErrorf("failed to endorse signing key: %v", err)
+	}
+	resp := EndorseSigningKeyResponse{EndorsedKeys: []string{}}
+	for _, key := range endorsed {
+		resp.EndorsedKeys = append(resp.EndorsedKeys, hex.EncodeToString(key))
+	}
+	slog.Info("endorsed snapshot signing key", "bak", BakShortId(recipient.String()), "endorsed", len(endorsed))
+	return c.JSON(resp)
+}
@@ -0,0 +1,148 @@
+package endpoints_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cordialsys/panel/pkg/s3client/s3test"
+	"github.com/cordialsys/panel/pkg/snapshot"
+	"github.com/cordialsys/panel/pkg/snapshot/snapshottest"
+	"github.com/cordialsys/panel/server/catalog"
+	"github.com/cordialsys/panel/server/endpoints"
+	"github.com/cordialsys/panel/server/sessions"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListBackupSnapshots(t *testing.T) {
+	server := s3test.NewServer("customer-backups")
+	defer server.Close()
+	app := newTestApp(t, newTestPanel(t, customerBucket(t, server)))
+
+	bakRecipient, bakShortId := testBakRecipient()
+	tarBz := snapshottest.Tar(t, snapshot.Info{Height: 10, Bak: bakRecipient, Participant: 3, CreateTime: time.Now()}, false)
+	status, body := app.do("PUT", "/v1/backup/snapshot/snap-1", tarBz)
+	require.Equal(t, http.StatusOK, status, string(body))
+	key := "nodes/3/snapshots/" + bakShortId + "/snap-1.tar"
+	require.Contains(t, server.Objects("customer-backups"), snapshot.SidecarKey(key))
+	server.PutObject("customer-backups", "nodes/4/snapshots/"+bakShortId+"/snap-2.tar", tarBz)
+
+	// the catalog parses the key and knows the info of the uploaded snapshot
+	status, body = app.do("GET", "/v1/backup/snapshots?bak="+bakShortId, nil)
+	require.Equal(t, http.StatusOK, status, string(body))
+	var entries []snapshot.Entry
+	require.NoError(t, json.Unmarshal(body, &entries))
+	require.Len(t, entries, 1)
+	require.Equal(t, "snap-1", entries[0].Id)
+	require.Equal(t, "3", entries[0].Node)
+	require.Equal(t, int64(len(tarBz)), entries[0].Size)
+	require.Equal(t, uint64(10), entries[0].Info.Height)
+	require.True(t, entries[0].Verified)
+	require.Len(t, entries[0].Sha256, 64)
+
+	status, body = app.do("GET", "/v1/backup/snapshots?node=all&bak=age1other", nil)
+	require.Equal(t, http.StatusOK, status, string(body))
+	require.Equal(t, "[]", string(body))
+	status, body = app.do("GET", "/v1/backup/snapshots?node=all", nil)
+	require.Equal(t, http.StatusOK, status, string(body))
+	require.NoError(t, json.Unmarshal(body, &entries))
+	require.Len(t, entries, 2)
+	require.Equal(t, "4", entries[1].Node)
+	require.False(t, entries[1].Verified)
+}
+
+func TestBackfillSidecars(t *testing.T) {
+	server := s3test.NewServer("customer-backups")
+	defer server.Close()
+	app := newTestApp(t, newTestPanel(t, customerBucket(t, server)))
+
+	bakRecipient, bakShortId := testBakRecipient()
+	status, body := app.do("PUT", "/v1/backup/snapshot/snap-1", snapshottest.Tar(t, snapshot.Info{Height: 10, Bak: bakRecipient, Participant: 3, CreateTime: time.Now()}, false))
+	require.Equal(t, http.StatusOK, status, string(body))
+
+	// snapshots written without a sidecar are only picked as the latest once backfilled
+	newerBz := snapshottest.Tar(t, snapshot.Info{Height: 20, Bak: bakRecipient, Participant: 3, CreateTime: time.Now()}, false)
+	server.PutObject("customer-backups", "nodes/3/snapshots/"+bakShortId+"/snap-3.tar", newerBz)
+	status, body = app.do("GET", "/v1/backup/snapshots?latest=true", nil)
+	require.Equal(t, http.StatusOK, status, string(body))
+	var entries []snapshot.Entry
+	require.NoError(t, json.Unmarshal(body, &entries))
+	require.Len(t, entries, 1)
+	require.Equal(t, "snap-1", entries[0].Id)
+
+	status, body = app.do("POST", "/v1/backup/snapshots/sidecars", nil)
+	require.Equal(t, http.StatusOK, status, string(body))
+	var backfill catalog.BackfillResult
+	require.NoError(t, json.Unmarshal(body, &backfill))
+	require.Equal(t, 2, backfill.Snapshots)
+	require.Equal(t, []string{"nodes/3/snapshots/" + bakShortId + "/snap-3.tar"}, backfill.Written)
+	require.Empty(t, backfill.Failed)
+
+	status, body = app.do("GET", "/v1/backup/snapshots?latest=true", nil)
+	require.Equal(t, http.StatusOK, status, string(body))
+	require.NoError(t, json.Unmarshal(body, &entries))
+	require.Equal(t, "snap-3", entries[0].Id)
+	require.Equal(t, uint64(20), entries[0].Info.Height)
+}
+
+func TestRestoreSnapshotSidecar(t *testing.T) {
+	server := s3test.NewServer("customer-backups")
+	defer server.Close()
+	destination := customerBucket(t, server)
+
+	bakRecipient, bakShortId := testBakRecipient()
+	info := snapshot.Info{Height: 10, Bak: bakRecipient, Participant: 3, CreateTime: time.Now()}
+	tarBz := snapshottest.Tar(t, info, false)
+	original := newTestApp(t, newTestPanel(t, destination))
+	status, body := original.do("PUT", "/v1/backup/snapshot/snap-1", tarBz)
+	require.Equal(t, http.StatusOK, status, string(body))
+	key := "nodes/3/snapshots/" + bakShortId + "/snap-1.tar"
+
+	// a rebuilt panel only trusts sidecars signed by a key endorsed with the bak
+	status, body = newTestApp(t, newTestPanel(t, destination)).restore(endpoints.RestoreSnapshotRequest{Latest: true})
+	require.Equal(t, http.StatusNotFound, status, string(body))
+	var endorse endpoints.EndorseSigningKeyRequest
+	endorse.SessionId, endorse.EncryptedSecretPhrase = original.encryptSecretPhrase(sessions.OperationEndorseSigningKey)
+	status, body = original.do("POST", "/v1/backup/snapshots/endorse", endorse)
+	require.Equal(t, http.StatusOK, status, string(body))
+	var endorsed endpoints.EndorseSigningKeyResponse
+	require.NoError(t, json.Unmarshal(body, &endorsed))
+	require.Len(t, endorsed.EndorsedKeys, 2)
+
+	// so once endorsed, the latest snapshot is found (and then refused, as it was replaced after
+	// it was signed)
+	tampered := bytes.Clone(tarBz)
+	tampered[len(tampered)-1] ^= 1
+	server.PutObject("customer-backups", key, tampered)
+	rebuilt := newTestApp(t, newTestPanel(t, destination))
+	status, body = rebuilt.restore(endpoints.RestoreSnapshotRequest{Latest: true})
+	require.Equal(t, http.StatusBadRequest, status, string(body))
+	require.Contains(t, string(body), "does not match the SHA-256 in its sidecar")
+
+	// a sidecar that is present but not signed by a trusted key is refused
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	sidecar, err := snapshot.NewSidecar(info, bytes.NewReader(tarBz))
+	require.NoError(t, err)
+	sidecarBz, err := sidecar.Sign(otherKey)
+	require.NoError(t, err)
+	server.PutObject("customer-backups", key, tarBz)
+	server.PutObject("customer-backups", snapshot.SidecarKey(key), sidecarBz)
+	status, body = rebuilt.restore(endpoints.RestoreSnapshotRequest{S3Key: key})
+	require.Equal(t, http.StatusBadRequest, status, string(body))
+	require.Contains(t, string(body), "invalid sidecar")
+	require.Contains(t, string(body), "untrusted key")
+	// even when picked as the latest from what was remembered of the previous sidecar
+	status, body = rebuilt.restore(endpoints.RestoreSnapshotRequest{Latest: true})
+	require.Equal(t, http.StatusBadRequest, status, string(body))
+	require.Contains(t, string(body), "untrusted key")
+
+	// the bak must be the one the secret phrase is for
+	status, body = rebuilt.restore(endpoints.RestoreSnapshotRequest{Latest: true, Bak: "age1other"})
+	require.Equal(t, http.StatusBadRequest, status, string(body))
+	require.Contains(t, string(body), "does not match the secret phrase")
+}
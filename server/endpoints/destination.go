@@ -0,0 +1,76 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"log/slog"
+
+	"github.com/cordialsys/panel/server/panel"
+	"github.com/cordialsys/panel/server/servererrors"
+	"github.com/gofiber/fiber/v2"
+)
+
+func (endpoints *Endpoints) parseBackupDestination(c *fiber.Ctx) (*panel.BackupDestination, error) {
+	var destination panel.BackupDestination
+	if err := json.Unmarshal(c.Body(), &destination); err != nil {
+		return nil, servererrors.BadRequestf("failed to parse request: %v", err)
+	}
+	if err := destination.Validate(); err != nil {
+		return nil, servererrors.BadRequestf("invalid backup destination: %v", err)
+	}
+	return &destination, nil
+}
+
+// Test connectivity and permissions of the current backup destination.  Other destinations are
+// only tested when set, as testing one sends the panel's credentials (or instance role) to it.
+func (endpoints *Endpoints) TestBackupDestination(c *fiber.Ctx) error {
+	if len(c.Body()) > 0 {
+		return servererrors.BadRequestf("only the current backup destination can be tested, a new one is tested when it is set")
+	}
+	return c.JSON(endpoints.backupClient().Test(c.Context()))
+}
+
+// Keep snapshots and key backups in the customer's own bucket.  The destination must pass
+// its checks first, unless `force` is set.
+func (endpoints *Endpoints) SetBackupDestination(c *fiber.Ctx) error {
+	if !endpoints.panel.HasNodeSet() {
+		return servererrors.FailedPreconditionf("not activated")
+	}
+	destination, err := endpoints.parseBackupDestination(c)
+	if err != nil {
+		return err
+	}
+	client, err := newDestinationS3Client(destination, endpoints.panel.NodeId)
+	if err != nil {
+		return servererrors.BadRequestf("failed to create backup client: %v", err)
+	}
+	result := client.Test(c.Context())
+	if _, force := c.Queries()["force"]; !result.Ok && !force {
+		return servererrors.FailedPreconditionf("backup destination failed its checks (%s), or set `force` to use it anyway", result.Error())
+	}
+
+	endpoints.backupLock.Lock()
+	defer endpoints.backupLock.Unlock()
+	endpoints.panel.BackupDestination = destination
+	if err := panel.Save(endpoints.panel); err != nil {
+		return servererrors.InternalErrorf("failed to save panel: %v", err)
+	}
+	endpoints.setBackupClient(client)
+	slog.Info("set backup destination", "endpoint", destination.Endpoint, "bucket", destination.Bucket)
+	return c.JSON(result)
+}
+
+// Go back to the Cordial Systems backup service.  Objects in the previous bucket are left as they are.
+func (endpoints *Endpoints) DeleteBackupDestination(c *fiber.Ctx) error {
+	endpoints.backupLock.Lock()
+	defer endpoints.backupLock.Unlock()
+	endpoints.panel.BackupDestination = nil
+	if err := panel.Save(endpoints.panel); err != nil {
+		return servererrors.InternalErrorf("failed to save panel: %v", err)
+	}
+	client, err := newBackupS3Client(endpoints.panel)
+	if err != nil {
+		return servererrors.InternalErrorf("failed to create backup client: %v", err)
+	}
+	endpoints.setBackupClient(client)
+	return c.JSON(nil)
+}
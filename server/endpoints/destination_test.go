@@ -0,0 +1,95 @@
+package endpoints_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cordialsys/panel/pkg/s3client"
+	"github.com/cordialsys/panel/pkg/s3client/s3test"
+	"github.com/cordialsys/panel/pkg/snapshot"
+	"github.com/cordialsys/panel/pkg/snapshot/snapshottest"
+	"github.com/cordialsys/panel/server/endpoints"
+	"github.com/cordialsys/panel/server/panel"
+	"github.com/cordialsys/panel/server/sessions"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupDestination(t *testing.T) {
+	// the default backup service client would otherwise probe for instance credentials
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	server := s3test.NewServer("customer-backups")
+	defer server.Close()
+	server.AccessKeyId = "AKIDPANEL"
+	destination := customerBucket(t, server)
+	params := newTestPanel(t, nil)
+	app := newTestApp(t, params)
+
+	status, body := app.do("PUT", "/v1/backup/destination", panel.BackupDestination{Endpoint: server.URL})
+	require.Equal(t, http.StatusBadRequest, status, string(body))
+	require.Contains(t, string(body), "bucket is required")
+
+	// a destination is only tested when it is set, as the test is sent the credentials
+	status, body = app.do("POST", "/v1/backup/destination/test", destination)
+	require.Equal(t, http.StatusBadRequest, status, string(body))
+	require.Contains(t, string(body), "only the current backup destination")
+
+	// a destination that fails its checks is refused, unless forced
+	server.DenyMethods = []string{http.MethodPut}
+	status, body = app.do("PUT", "/v1/backup/destination", destination)
+	require.Equal(t, http.StatusBadRequest, status, string(body))
+	require.Contains(t, string(body), "FailedPrecondition")
+	require.Contains(t, string(body), "write: ")
+	require.Nil(t, params.BackupDestination)
+	server.DenyMethods = nil
+
+	status, body = app.do("PUT", "/v1/backup/destination", destination)
+	require.Equal(t, http.StatusOK, status, string(body))
+	require.Equal(t, "customer-backups", params.BackupDestination.Bucket)
+	saved, err := panel.Load(params.PanelDir)
+	require.NoError(t, err)
+	require.Equal(t, destination, saved.BackupDestination)
+
+	// the current destination is tested without a body
+	status, body = app.do("POST", "/v1/backup/destination/test", nil)
+	require.Equal(t, http.StatusOK, status, string(body))
+	var result s3client.TestResult
+	require.NoError(t, json.Unmarshal(body, &result))
+	require.True(t, result.Ok, result.Error())
+	require.Equal(t, "customer-backups", result.Bucket)
+
+	// uploads, listings and downloads go to the bucket
+	bakRecipient, bakShortId := testBakRecipient()
+	tarBz := snapshottest.Tar(t, snapshot.Info{Height: 10, Bak: bakRecipient, Participant: 3, CreateTime: time.Now()}, false)
+	status, body = app.do("PUT", "/v1/backup/snapshot/snap-1", tarBz)
+	require.Equal(t, http.StatusOK, status, string(body))
+	key := "nodes/3/snapshots/" + bakShortId + "/snap-1.tar"
+	require.Equal(t, tarBz, server.Objects("customer-backups")[key])
+	status, body = app.do("GET", "/v1/s3/objects?prefix=nodes/3/snapshots/", nil)
+	require.Equal(t, http.StatusOK, status, string(body))
+	require.Contains(t, string(body), key)
+	status, body = app.do("GET", "/v1/s3/object?key="+key, nil)
+	require.Equal(t, http.StatusOK, status, string(body))
+	require.Equal(t, tarBz, body)
+
+	// the treasury uploads key backups to the backup service, so they are not in the bucket
+	var req endpoints.RestoreMissingKeysRequest
+	req.SessionId, req.EncryptedSecretPhrase = app.encryptSecretPhrase(sessions.OperationRestoreMissingKeys)
+	status, body = app.do("POST", "/v1/backup/restore-missing-keys", req)
+	require.Equal(t, http.StatusBadRequest, status, string(body))
+	require.Contains(t, string(body), "has no key backups")
+
+	// raw credentials are hidden
+	params.BackupDestination.Credentials = "raw:AKIDPANEL:secret"
+	status, body = app.do("GET", "/v1/panel", nil)
+	require.Equal(t, http.StatusOK, status, string(body))
+	var panelData panel.Panel
+	require.NoError(t, json.Unmarshal(body, &panelData))
+	require.Equal(t, "raw:<hidden>", string(panelData.BackupDestination.Credentials))
+	require.NotContains(t, string(body), "AKIDPANEL:secret")
+
+	status, body = app.do("DELETE", "/v1/backup/destination", nil)
+	require.Equal(t, http.StatusOK, status, string(body))
+	require.Nil(t, params.BackupDestination)
+}
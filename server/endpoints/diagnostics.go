@@ -0,0 +1,49 @@
+package endpoints
+
+import (
+	"errors"
+	"os"
+
+	"github.com/cordialsys/panel/pkg/diagnostics"
+	"github.com/cordialsys/panel/server/servererrors"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Only the directories managed by the panel may be browsed.
+func (endpoints *Endpoints) diagnosticsBrowser() *diagnostics.Browser {
+	return diagnostics.NewBrowser([]diagnostics.Root{
+		{Name: "treasury", Path: string(endpoints.panel.TreasuryHome)},
+		{Name: "supervisor", Path: string(endpoints.panel.SupervisorHome)},
+		{Name: "backup", Path: endpoints.panel.BackupDir},
+		{Name: "panel", Path: string(endpoints.panel.PanelDir)},
+		{Name: "binaries", Path: endpoints.panel.BinaryDir},
+	})
+}
+
+// GET /v1/diagnostics/files
+func (endpoints *Endpoints) ListDiagnosticsRoots(c *fiber.Ctx) error {
+	return c.JSON(endpoints.diagnosticsBrowser().Roots())
+}
+
+// GET /v1/diagnostics/files/:root?path=<relative path>&depth=<n>
+// - Returns metadata (size, mode, owner, mtime) only, never file contents.
+func (endpoints *Endpoints) ListDiagnosticsFiles(c *fiber.Ctx) error {
+	root := c.Params("root")
+	path := c.Query("path", ".")
+	depth := c.QueryInt("depth", diagnostics.DefaultDepth)
+
+	entry, err := endpoints.diagnosticsBrowser().List(root, path, depth)
+	if err != nil {
+		if errors.Is(err, diagnostics.ErrUnknownRoot) {
+			return servererrors.NotFoundf("unknown root '%s'", root)
+		}
+		if errors.Is(err, diagnostics.ErrOutsideRoot) {
+			return servererrors.BadRequestf("path '%s' is outside of root '%s'", path, root)
+		}
+		if os.IsNotExist(err) {
+			return servererrors.NotFoundf("path '%s' does not exist in root '%s'", path, root)
+		}
+		return servererrors.BadRequestf("%v", err)
+	}
+	return c.JSON(entry)
+}
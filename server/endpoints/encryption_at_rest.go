@@ -2,12 +2,14 @@ package endpoints
 
 import (
 	"encoding/json"
-	"fmt"
-	"os"
-	"os/exec"
+	"log/slog"
 	"path/filepath"
+	"slices"
 	"strings"
 
+	"github.com/cordialsys/panel/pkg/bak"
+	"github.com/cordialsys/panel/pkg/client"
+	"github.com/cordialsys/panel/pkg/plog"
 	"github.com/cordialsys/panel/pkg/secret"
 	"github.com/cordialsys/panel/server/panel"
 	"github.com/cordialsys/panel/server/servererrors"
@@ -15,11 +17,11 @@ import (
 )
 
 type SetEncryptionAtRestRequest struct {
-	EarSecret secret.Secret `json:"ear_secret"`
+	EarSecret secret.Ref `json:"ear_secret"`
 }
 
-func (endpoints *Endpoints) attachEarSecretToCmd(cmd *exec.Cmd) error {
-	if endpoints.panel.EarSecret == "" {
+func (endpoints *Endpoints) attachEarSecretToCmd(cmd *SecretCmd) error {
+	if endpoints.panel.EarSecret.IsZero() {
 		return nil
 	}
 	secretValue, err := endpoints.panel.EarSecret.Load()
@@ -27,14 +29,37 @@ func (endpoints *Endpoints) attachEarSecretToCmd(cmd *exec.Cmd) error {
 		return servererrors.BadRequestf("failed to load ear secret: %v", err)
 	}
 	secretValue = FormatMnemonic(secretValue)
-	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", ENV_SIGNER_EAR_PHRASE, secretValue))
+	plog.AddSecret(secretValue)
+	cmd.AddSecret(ENV_SIGNER_EAR_PHRASE, secretValue)
+	return nil
+}
+
+// Encrypt signer.db with the new phrase, or re-encrypt it if it is currently encrypted with the existing phrase.
+// The treasury must be stopped.
+func (endpoints *Endpoints) encryptSignerDb(existingSecret string, newSecret string) error {
+	signerBin := filepath.Join(endpoints.panel.BinaryDir, "signer")
+	var cmd *SecretCmd
+	if existingSecret != "" {
+		cmd = endpoints.newSecretCmd(signerBin, "recrypt-in-place", "--db", endpoints.panel.TreasuryHome.SignerDb())
+		cmd.AddSecret(ENV_SIGNER_EAR_PHRASE, existingSecret)
+		cmd.AddSecret(ENV_SIGNER_NEW_EAR_PHRASE, newSecret)
+	} else {
+		cmd = endpoints.newSecretCmd(signerBin, "encrypt-in-place", "--db", endpoints.panel.TreasuryHome.SignerDb())
+		cmd.AddSecret(ENV_SIGNER_NEW_EAR_PHRASE, newSecret)
+	}
+
+	// Run the command
+	outputBz, err := cmd.CombinedOutput()
+	if err != nil {
+		return servererrors.InternalErrorf("failed to run `%s`: %v", cmd.String(), string(outputBz))
+	}
 	return nil
 }
 
 // PUT /v1/panel/ear
 func (endpoints *Endpoints) SetEncryptionAtRest(c *fiber.Ctx) error {
 	var err error
-	if endpoints.panel.ApiKey == "" {
+	if !endpoints.panel.HasApiKey() {
 		return servererrors.FailedPreconditionf("not activated")
 	}
 	ctx := c.Context()
@@ -44,10 +69,10 @@ func (endpoints *Endpoints) SetEncryptionAtRest(c *fiber.Ctx) error {
 		return servererrors.BadRequestf("failed to parse request: %v", err)
 	}
 
-	if req.EarSecret == "" {
+	if req.EarSecret.IsZero() {
 		return servererrors.BadRequestf("missing ear_secret")
 	}
-	if secretType, _ := req.EarSecret.Type(); secretType == secret.File {
+	if req.EarSecret.IsType(secret.File) {
 		return servererrors.BadRequestf("file type secret is not allowed")
 	}
 
@@ -60,13 +85,14 @@ func (endpoints *Endpoints) SetEncryptionAtRest(c *fiber.Ctx) error {
 	}
 
 	secret = FormatMnemonic(secret)
+	plog.AddSecret(secret)
 	if len(strings.Split(secret, " ")) != 12 {
 		return servererrors.BadRequestf("ear_secret must be a valid 12-word bip39 phrase (e.g. from `cord backup bak`)")
 	}
 
 	// check if we have an existing ear secret
 	existingSecret := ""
-	if endpoints.panel.EarSecret != "" {
+	if !endpoints.panel.EarSecret.IsZero() {
 		existingSecret, err = endpoints.panel.EarSecret.Load()
 		if err != nil {
 			return servererrors.BadRequestf("failed to load existing ear_secret: %v", err)
@@ -77,9 +103,15 @@ func (endpoints *Endpoints) SetEncryptionAtRest(c *fiber.Ctx) error {
 		}
 	}
 
-	signerBin := filepath.Join(endpoints.panel.BinaryDir, "signer")
 	if existingSecret == secret {
-		// okay, nothing to do
+		// nothing to re-encrypt, but the phrase may have moved (e.g. split into shares)
+		if !endpoints.panel.EarSecret.Equal(req.EarSecret) {
+			endpoints.panel.EarSecret = req.EarSecret
+			err = panel.Save(endpoints.panel)
+			if err != nil {
+				return servererrors.InternalErrorf("failed to save panel: %v", err)
+			}
+		}
 	} else {
 		// Stop treasury
 		didIssueStop, err := stopSystemdServiceAndWait(ctx, ServiceTreasury)
@@ -87,24 +119,9 @@ func (endpoints *Endpoints) SetEncryptionAtRest(c *fiber.Ctx) error {
 			return err
 		}
 
-		localEnv := os.Environ()
-
-		var cmd *exec.Cmd
-		if existingSecret != "" {
-			cmd = exec.Command(signerBin, "recrypt-in-place", "--db", endpoints.panel.TreasuryHome.SignerDb())
-			cmd.Env = localEnv
-			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", ENV_SIGNER_EAR_PHRASE, existingSecret))
-			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", ENV_SIGNER_NEW_EAR_PHRASE, secret))
-		} else {
-			cmd = exec.Command(signerBin, "encrypt-in-place", "--db", endpoints.panel.TreasuryHome.SignerDb())
-			cmd.Env = localEnv
-			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", ENV_SIGNER_NEW_EAR_PHRASE, secret))
-		}
-
-		// Run the command
-		outputBz, err := cmd.CombinedOutput()
+		err = endpoints.encryptSignerDb(existingSecret, secret)
 		if err != nil {
-			return servererrors.InternalErrorf("failed to run `%s`: %v", cmd.String(), string(outputBz))
+			return err
 		}
 
 		// Save the new ear secret
@@ -126,12 +143,12 @@ func (endpoints *Endpoints) SetEncryptionAtRest(c *fiber.Ctx) error {
 // DELETE /v1/panel/ear
 func (endpoints *Endpoints) DeleteEncryptionAtRest(c *fiber.Ctx) error {
 	var err error
-	if endpoints.panel.ApiKey == "" {
+	if !endpoints.panel.HasApiKey() {
 		return servererrors.FailedPreconditionf("not activated")
 	}
 	ctx := c.Context()
 
-	if endpoints.panel.EarSecret == "" {
+	if endpoints.panel.EarSecret.IsZero() {
 		return servererrors.BadRequestf("no ear secret to delete")
 	}
 
@@ -151,12 +168,8 @@ func (endpoints *Endpoints) DeleteEncryptionAtRest(c *fiber.Ctx) error {
 		return err
 	}
 
-	localEnv := os.Environ()
-
-	var cmd *exec.Cmd
-	cmd = exec.Command(signerBin, "decrypt-in-place", "--db", endpoints.panel.TreasuryHome.SignerDb())
-	cmd.Env = localEnv
-	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", ENV_SIGNER_EAR_PHRASE, existingSecret))
+	cmd := endpoints.newSecretCmd(signerBin, "decrypt-in-place", "--db", endpoints.panel.TreasuryHome.SignerDb())
+	cmd.AddSecret(ENV_SIGNER_EAR_PHRASE, existingSecret)
 
 	// Run the command
 	outputBz, err := cmd.CombinedOutput()
@@ -165,7 +178,7 @@ func (endpoints *Endpoints) DeleteEncryptionAtRest(c *fiber.Ctx) error {
 	}
 
 	// Remove the ear secret
-	endpoints.panel.EarSecret = ""
+	endpoints.panel.EarSecret = secret.Ref{}
 	err = panel.Save(endpoints.panel)
 	if err != nil {
 		return servererrors.InternalErrorf("failed to save panel: %v", err)
@@ -178,3 +191,94 @@ func (endpoints *Endpoints) DeleteEncryptionAtRest(c *fiber.Ctx) error {
 
 	return c.JSON(nil)
 }
+
+// POST /v1/panel/ear/rotate
+// Generate a new phrase, store it as a new version of the EAR secret, and re-encrypt signer.db with it.
+func (endpoints *Endpoints) RotateEncryptionAtRest(c *fiber.Ctx) error {
+	if !endpoints.panel.HasApiKey() {
+		return servererrors.FailedPreconditionf("not activated")
+	}
+	ctx := c.Context()
+
+	var req client.RequestRotateEncryptionAtRest
+	if len(c.Body()) > 0 {
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return servererrors.BadRequestf("failed to parse request: %v", err)
+		}
+	}
+	target := req.EarSecret
+	if target.IsZero() {
+		target = endpoints.panel.EarSecret
+	}
+	if target.IsZero() {
+		return servererrors.BadRequestf("no ear secret to rotate, set ear_secret to where the new phrase should be stored")
+	}
+	secretType := target.Type
+	if !slices.Contains(secret.WritableTypes, secretType) {
+		return servererrors.BadRequestf("ear_secret must be one of %v to be rotated", secret.WritableTypes)
+	}
+	// the panel runs as root, so should not write arbitrary paths
+	if secretType == secret.File || secretType == secret.EnvFile {
+		return servererrors.BadRequestf("%s type secret is not allowed", secretType)
+	}
+	if secretType == secret.AgeFile && !target.Equal(endpoints.panel.EarSecret) {
+		return servererrors.BadRequestf("%s secret can only be rotated in place, seal a new file with `panel secret seal`", secretType)
+	}
+
+	existingSecret := ""
+	if !endpoints.panel.EarSecret.IsZero() {
+		value, err := endpoints.panel.EarSecret.Load()
+		if err != nil {
+			return servererrors.BadRequestf("failed to load existing ear_secret: %v", err)
+		}
+		existingSecret = FormatMnemonic(value)
+		if existingSecret == "" {
+			return servererrors.BadRequestf("existing ear_secret loaded an empty value")
+		}
+	}
+
+	newSecret := strings.Join(bak.GenerateEncryptionKey().Words(), " ")
+	plog.AddSecret(newSecret)
+
+	// Store the new phrase first, so it can never be lost once signer.db is encrypted with it.
+	var previous string
+	var err error
+	if target.Equal(endpoints.panel.EarSecret) {
+		previous, err = target.Rotate(newSecret)
+	} else {
+		// a different backend: keep any value it had, in case of rollback
+		previous, _ = target.Load()
+		err = target.Store(newSecret)
+	}
+	if err != nil {
+		return servererrors.InternalErrorf("failed to store new ear secret: %v", err)
+	}
+
+	didIssueStop, err := stopSystemdServiceAndWait(ctx, ServiceTreasury)
+	if err == nil {
+		err = endpoints.encryptSignerDb(existingSecret, newSecret)
+	}
+	if err != nil {
+		// signer.db is still encrypted with the existing phrase, so restore the previous value
+		if previous != "" {
+			if rollbackErr := target.Store(previous); rollbackErr != nil {
+				slog.Error("failed to restore previous ear secret", "error", rollbackErr)
+			}
+		}
+		if didIssueStop {
+			updateSystemdService(ctx, ServiceTreasury, ServiceActionStart)
+		}
+		return err
+	}
+
+	endpoints.panel.EarSecret = target
+	err = panel.Save(endpoints.panel)
+	if err != nil {
+		return servererrors.InternalErrorf("failed to save panel: %v", err)
+	}
+
+	if didIssueStop {
+		updateSystemdService(ctx, ServiceTreasury, ServiceActionStart)
+	}
+	return c.JSON(nil)
+}
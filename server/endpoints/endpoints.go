@@ -2,57 +2,168 @@ package endpoints
 
 import (
 	"fmt"
-	"log/slog"
+	"sync"
+	"sync/atomic"
 
-	"filippo.io/age"
 	"github.com/cordialsys/panel/pkg/admin"
 	"github.com/cordialsys/panel/pkg/s3client"
-	"github.com/cordialsys/panel/pkg/secret"
+	"github.com/cordialsys/panel/server/approvals"
+	"github.com/cordialsys/panel/server/catalog"
 	"github.com/cordialsys/panel/server/panel"
+	"github.com/cordialsys/panel/server/schedule"
 	"github.com/cordialsys/panel/server/servererrors"
+	"github.com/cordialsys/panel/server/sessions"
 )
 
+// The backup bucket and the further destinations that uploads are copied to.  It is replaced as
+// a whole when either changes, as the scheduler reads it while the API may be changing it.
+type backupTargets struct {
+	client   *s3client.BackupS3Client
+	replicas []s3client.Replica
+}
+
 type Endpoints struct {
-	panel    *panel.Panel
-	identity *age.X25519Identity
-	s3Client *s3client.BackupS3Client
+	panel *panel.Panel
+	// See `backupClient` and `replicator`
+	backup atomic.Pointer[backupTargets]
+	// Held while changing the backup destination or replicas
+	backupLock  sync.Mutex
+	replication *s3client.ReplicationState
+	catalog     *catalog.Catalog
+	approvals   *approvals.Store
+	sessions    *sessions.Store
+	scheduler   *schedule.Scheduler
+	// Set while a restore has the treasury stopped, so scheduled snapshots are skipped
+	restoring atomic.Bool
 }
 
-func NewEndpoints(panel *panel.Panel, identity *age.X25519Identity) *Endpoints {
-	if panel.ApiKey != "" {
-		valid, err := validateAPIKey(panel.ApiKey)
-		if err != nil {
-			slog.Error("invalid API key", "error", err)
-		} else {
-			panel.ApiKey = valid
-		}
+func NewEndpoints(panel *panel.Panel) *Endpoints {
+	cli, err := newBackupS3Client(panel)
+	if err != nil {
+		panic(err)
 	}
-	cli, err := s3client.NewBackupS3Client(s3client.BackupS3ClientOptions{
+	replicas, err := newBackupReplicas(panel)
+	if err != nil {
+		panic(err)
+	}
+	endpoints := &Endpoints{
+		panel:       panel,
+		replication: s3client.NewReplicationState(panel.PanelDir.ReplicationFile()),
+		catalog:     catalog.New(panel.PanelDir),
+		approvals:   approvals.NewStore(panel.PanelDir),
+		sessions:    sessions.NewStore(),
+	}
+	endpoints.backup.Store(&backupTargets{client: cli, replicas: replicas})
+	endpoints.scheduler = schedule.NewScheduler(schedule.NewStore(panel.PanelDir), snapshotRunner{endpoints})
+	return endpoints
+}
+
+func newBackupS3Client(panel *panel.Panel) (*s3client.BackupS3Client, error) {
+	if panel.BackupDestination != nil {
+		return newDestinationS3Client(panel.BackupDestination, panel.NodeId)
+	}
+	return s3client.NewBackupS3Client(s3client.BackupS3ClientOptions{
 		Endpoint: DefaultBackupUrl,
 		Treasury: panel.TreasuryId,
 		Node:     fmt.Sprint(panel.NodeId),
-		ApiKey:   secret.NewRawSecret(panel.ApiKey),
+		// resolved by the client on each request
+		ApiKey: panel.ApiKeyRef,
+		Debug:  false,
+	})
+}
 
-		// TODO
-		S3Token: "",
-		Bucket:  "",
-		Region:  "",
-		Debug:   false,
+// A customer's own bucket, which is never sent the treasury API key.
+func newDestinationS3Client(destination *panel.BackupDestination, nodeId uint64) (*s3client.BackupS3Client, error) {
+	region := destination.Region
+	if region == "" {
+		// GCS and MinIO accept any region in the signature
+		region = "us-east-1"
+	}
+	return s3client.NewBackupS3Client(s3client.BackupS3ClientOptions{
+		Endpoint: destination.Endpoint,
+		Node:     fmt.Sprint(nodeId),
+		Bucket:   destination.Bucket,
+		Region:   region,
+		S3Token:  destination.Credentials,
 	})
+}
+
+func newBackupReplica(replica *panel.BackupReplica, nodeId uint64) (s3client.Replica, error) {
+	if replica.Dir != "" {
+		return s3client.Replica{Name: replica.Name, Destination: s3client.DirDestination(replica.Dir), Prune: replica.Prune}, nil
+	}
+	client, err := newDestinationS3Client(replica.S3, nodeId)
 	if err != nil {
-		panic(err)
+		return s3client.Replica{}, err
 	}
-	return &Endpoints{
-		panel,
-		identity,
-		cli,
+	return s3client.Replica{Name: replica.Name, Destination: client, Prune: replica.Prune}, nil
+}
+
+func newBackupReplicas(panel *panel.Panel) ([]s3client.Replica, error) {
+	replicas := []s3client.Replica{}
+	for _, replica := range panel.BackupReplicas {
+		destination, err := newBackupReplica(&replica, panel.NodeId)
+		if err != nil {
+			return nil, fmt.Errorf("backup replica %s: %v", replica.Name, err)
+		}
+		replicas = append(replicas, destination)
+	}
+	return replicas, nil
+}
+
+// The client of the backup bucket.
+func (endpoints *Endpoints) backupClient() *s3client.BackupS3Client {
+	return endpoints.backup.Load().client
+}
+
+// Uploads go through the replicator, so they are copied to every backup replica.
+func (endpoints *Endpoints) replicator() *s3client.Replicator {
+	backup := endpoints.backup.Load()
+	return &s3client.Replicator{
+		Primary:  backup.client,
+		Replicas: backup.replicas,
+		State:    endpoints.replication,
+	}
+}
+
+// Use a new backup bucket, keeping the replicas.  The caller holds `backupLock`.
+func (endpoints *Endpoints) setBackupClient(client *s3client.BackupS3Client) {
+	endpoints.backup.Store(&backupTargets{client: client, replicas: endpoints.backup.Load().replicas})
+}
+
+// Resolve the API key for calling Cordial Systems APIs.
+func (endpoints *Endpoints) ApiKey() (string, error) {
+	apiKey, err := endpoints.panel.LoadApiKey()
+	if err != nil {
+		return "", servererrors.FailedPreconditionf("%v", err)
+	}
+	apiKey, err = validateAPIKey(apiKey)
+	if err != nil {
+		return "", err
 	}
+	return apiKey, nil
+}
+
+func (endpoints *Endpoints) Approvals() *approvals.Store {
+	return endpoints.approvals
+}
+
+func (endpoints *Endpoints) Sessions() *sessions.Store {
+	return endpoints.sessions
+}
+
+func (endpoints *Endpoints) Scheduler() *schedule.Scheduler {
+	return endpoints.scheduler
 }
 
 func (endpoints *Endpoints) AdminClient() (*admin.Client, error) {
 	if !endpoints.panel.HasNodeSet() {
 		return nil, servererrors.BadRequestf("the API key has not yet been activated")
 	}
-	client := admin.NewClient(endpoints.panel.ApiKey)
+	apiKey, err := endpoints.ApiKey()
+	if err != nil {
+		return nil, err
+	}
+	client := admin.NewClient(apiKey)
 	return client, nil
 }
@@ -0,0 +1,135 @@
+package endpoints_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/cordialsys/panel/pkg/bak"
+	"github.com/cordialsys/panel/pkg/paths"
+	"github.com/cordialsys/panel/pkg/s3client/s3test"
+	"github.com/cordialsys/panel/server/endpoints"
+	"github.com/cordialsys/panel/server/panel"
+	"github.com/cordialsys/panel/server/servererrors"
+	"github.com/cordialsys/panel/server/sessions"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// The bak snapshots are uploaded with, which endorses the signing keys of the panels.
+var testBak = bak.GenerateEncryptionKey()
+
+// The recipient of the test bak, and the short id its snapshots are kept under.
+func testBakRecipient() (string, string) {
+	recipient := testBak.Recipient()
+	return recipient.String(), endpoints.BakShortId(recipient.String())
+}
+
+// The `customer-backups` bucket of the fake server, with credentials from $BUCKET_TOKEN.
+func customerBucket(t *testing.T, server *s3test.Server) *panel.BackupDestination {
+	t.Setenv("BUCKET_TOKEN", "AKIDPANEL:secret")
+	return &panel.BackupDestination{
+		Endpoint:    server.URL,
+		Bucket:      "customer-backups",
+		Credentials: "env:BUCKET_TOKEN",
+	}
+}
+
+// An activated panel of node 3, in a fresh panel directory.
+func newTestPanel(t *testing.T, destination *panel.BackupDestination) *panel.Panel {
+	params := panel.New()
+	params.PanelDir = paths.PanelHome(t.TempDir())
+	params.NodeId = 3
+	params.TreasuryId = "treasuries/abc"
+	params.ApiKeyRef = "raw:key:secret"
+	params.BackupDestination = destination
+	bakRecipient, _ := testBakRecipient()
+	params.Baks = []panel.Bak{{Id: "test", Key: bakRecipient}}
+	return params
+}
+
+// Serves the backup endpoints of a panel, without authentication or approvals.
+type testApp struct {
+	t   *testing.T
+	app *fiber.App
+}
+
+func newTestApp(t *testing.T, params *panel.Panel) *testApp {
+	handler := endpoints.NewEndpoints(params)
+	app := fiber.New(fiber.Config{
+		ErrorHandler: func(c *fiber.Ctx, err error) error {
+			return err.(*servererrors.ErrorResponse).Send(c)
+		},
+	})
+	app.Get("/v1/panel", handler.GetPanel)
+	app.Post("/v1/sessions/recipient", handler.CreateSessionRecipient)
+	app.Get("/v1/s3/objects", handler.ListObjects)
+	app.Get("/v1/s3/object", handler.DownloadObject)
+	app.Put("/v1/backup/destination", handler.SetBackupDestination)
+	app.Delete("/v1/backup/destination", handler.DeleteBackupDestination)
+	app.Post("/v1/backup/destination/test", handler.TestBackupDestination)
+	app.Put("/v1/backup/replicas/:name", handler.PutBackupReplica)
+	app.Delete("/v1/backup/replicas/:name", handler.DeleteBackupReplica)
+	app.Get("/v1/backup/replication", handler.GetReplication)
+	app.Post("/v1/backup/reconcile", handler.ReconcileBackups)
+	app.Put("/v1/backup/snapshot/:id", handler.UploadSnapshot)
+	app.Get("/v1/backup/snapshots", handler.ListBackupSnapshots)
+	app.Post("/v1/backup/snapshots/sidecars", handler.BackfillSidecars)
+	app.Post("/v1/backup/snapshots/endorse", handler.EndorseSigningKey)
+	app.Post("/v1/backup/restore", handler.RestoreFromSnapshot)
+	app.Post("/v1/backup/restore-missing-keys", handler.RestoreMissingKeys)
+	return &testApp{t: t, app: app}
+}
+
+// Send a request, with a body of raw bytes or JSON, returning the status and response body.
+func (a *testApp) do(method string, path string, body any) (int, []byte) {
+	var reader io.Reader
+	switch body := body.(type) {
+	case nil:
+	case []byte:
+		reader = bytes.NewReader(body)
+	default:
+		bz, err := json.Marshal(body)
+		require.NoError(a.t, err)
+		reader = bytes.NewReader(bz)
+	}
+	resp, err := a.app.Test(httptest.NewRequest(method, path, reader), -1)
+	require.NoError(a.t, err)
+	respBz, err := io.ReadAll(resp.Body)
+	require.NoError(a.t, err)
+	return resp.StatusCode, respBz
+}
+
+// Encrypt the secret phrase of the test bak to a new session for the operation.
+func (a *testApp) encryptSecretPhrase(operation sessions.Operation) (sessionId string, encrypted string) {
+	status, body := a.do("POST", "/v1/sessions/recipient", endpoints.CreateSessionRecipientRequest{Operation: operation})
+	require.Equal(a.t, http.StatusOK, status, string(body))
+	var session sessions.Session
+	require.NoError(a.t, json.Unmarshal(body, &session))
+	return session.Id, encryptTo(a.t, session.Recipient)
+}
+
+// Encrypt the secret phrase of the test bak to a session recipient.
+func encryptTo(t *testing.T, sessionRecipient string) string {
+	recipient, err := age.ParseX25519Recipient(sessionRecipient)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	writer, err := age.Encrypt(&buf, recipient)
+	require.NoError(t, err)
+	_, err = writer.Write([]byte(strings.Join(testBak.Words(), " ")))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+// Restore with the secret phrase of the test bak.
+func (a *testApp) restore(req endpoints.RestoreSnapshotRequest) (int, []byte) {
+	req.SessionId, req.EncryptedSecretPhrase = a.encryptSecretPhrase(sessions.OperationRestoreSnapshot)
+	return a.do("POST", "/v1/backup/restore", req)
+}
@@ -113,11 +113,15 @@ func DownloadAndUntar(panel *panel.Panel, url, destPath string, verify bool) err
 	log := slog.With("url", url)
 	log.Info("downloading")
 	t1 := time.Now()
+	apiKey, err := panel.LoadApiKey()
+	if err != nil {
+		return servererrors.FailedPreconditionf("%v", err)
+	}
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return servererrors.InternalErrorf("failed to create request: %v", err)
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("Basic %s", encodeApiKey(panel.ApiKey)))
+	req.Header.Set("Authorization", fmt.Sprintf("Basic %s", encodeApiKey(apiKey)))
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -131,7 +135,7 @@ func DownloadAndUntar(panel *panel.Panel, url, destPath string, verify bool) err
 	}
 
 	if verify {
-		sig, err := DownloadSigFor(panel.ApiKey, url)
+		sig, err := DownloadSigFor(apiKey, url)
 		if err != nil {
 			return servererrors.InternalErrorf("failed to download signature: %v", err)
 		}
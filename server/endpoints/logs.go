@@ -0,0 +1,10 @@
+package endpoints
+
+import (
+	"github.com/cordialsys/panel/pkg/plog"
+	"github.com/gofiber/fiber/v2"
+)
+
+func (endpoints *Endpoints) Logs(c *fiber.Ctx) error {
+	return c.JSON(plog.LogHistory)
+}
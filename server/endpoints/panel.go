@@ -15,6 +15,7 @@ import (
 
 	"github.com/cordialsys/panel/pkg/admin"
 	"github.com/cordialsys/panel/pkg/nonce"
+	"github.com/cordialsys/panel/pkg/plog"
 	"github.com/cordialsys/panel/pkg/resource"
 	"github.com/cordialsys/panel/pkg/secret"
 	"github.com/cordialsys/panel/pkg/treasury"
@@ -25,13 +26,37 @@ import (
 
 func (endpoints *Endpoints) GetPanel(c *fiber.Ctx) error {
 	panelData := *endpoints.panel
-	// hide the secret
-	panelData.ApiKeyId = strings.Split(panelData.ApiKey, ":")[0]
-	panelData.ApiKey = ""
+	// hide the reference if it's "raw:"
+	if endpoints.panel.ApiKeyRef.IsType(secret.Raw) {
+		panelData.ApiKeyRef = "raw:<hidden>"
+	}
+
+	// hide any "raw:" values of the ear secret, including those of shares
+	panelData.EarSecret = endpoints.panel.EarSecret.Redacted()
 
-	// hide the ear secret if it's "raw:"
-	if endpoints.panel.EarSecret.IsType(secret.Raw) {
-		panelData.EarSecret = "raw:<hidden>"
+	if endpoints.panel.Vault != nil && endpoints.panel.Vault.SecretId.IsType(secret.Raw) {
+		vaultAuth := *endpoints.panel.Vault
+		vaultAuth.SecretId = "raw:<hidden>"
+		panelData.Vault = &vaultAuth
+	}
+
+	if endpoints.panel.BackupDestination != nil {
+		destination := *endpoints.panel.BackupDestination
+		if ref, err := destination.Credentials.Ref(); err == nil {
+			destination.Credentials = ref.Redacted().Secret()
+		}
+		panelData.BackupDestination = &destination
+	}
+	panelData.BackupReplicas = nil
+	for _, replica := range endpoints.panel.BackupReplicas {
+		if replica.S3 != nil {
+			destination := *replica.S3
+			if ref, err := destination.Credentials.Ref(); err == nil {
+				destination.Credentials = ref.Redacted().Secret()
+			}
+			replica.S3 = &destination
+		}
+		panelData.BackupReplicas = append(panelData.BackupReplicas, replica)
 	}
 
 	var hasGenesis = false
@@ -92,8 +117,6 @@ func (endpoints *Endpoints) GetPanel(c *fiber.Ctx) error {
 		panelData.State = panel.StateInactive
 	}
 
-	panelData.Recipient = endpoints.identity.Recipient().String()
-
 	return c.JSON(panelData)
 }
 
@@ -133,7 +156,7 @@ type SealPanelRequest struct {
 }
 
 func (endpoints *Endpoints) SealPanel(c *fiber.Ctx) error {
-	if endpoints.panel.ApiKey == "" {
+	if !endpoints.panel.HasApiKey() {
 		return servererrors.FailedPreconditionf("not activated")
 	}
 	var req SealPanelRequest
@@ -182,6 +205,7 @@ func (endpoints *Endpoints) SealPanel(c *fiber.Ctx) error {
 			}
 			webInvite := nonce.NewString()
 			cliInvite := nonce.NewString()
+			plog.AddSecret(webInvite, cliInvite)
 			userCode := fmt.Sprintf("%s;cli=%s;web=%s", email, cliInvite, webInvite)
 			args = append(args, "--user", userCode)
 
@@ -196,16 +220,20 @@ func (endpoints *Endpoints) SealPanel(c *fiber.Ctx) error {
 	}
 	slog.Info("generating blueprint", "args", args)
 
+	apiKey, err := endpoints.ApiKey()
+	if err != nil {
+		return err
+	}
 	cmd := exec.Command(treasuryBin, args...)
 	// Include API key so that treasury can lookup user info, etc
-	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%s", panel.ENV_API_KEY, endpoints.panel.ApiKey))
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%s", panel.ENV_API_KEY, apiKey))
 	outputBz, err := cmd.CombinedOutput()
 	if err != nil {
 		return servererrors.BadRequestf("failed to generate blueprint: %v: %s", err, string(outputBz))
 	}
 	slog.Info("generated blueprint", "output", string(outputBz))
 
-	err = os.WriteFile(endpoints.panel.PanelDir.BlueprintFile(), []byte(outputBz), 0644)
+	err = panel.WriteStateFile(endpoints.panel.PanelDir, endpoints.panel.PanelDir.BlueprintFile(), []byte(outputBz), 0644)
 	if err != nil {
 		return servererrors.InternalErrorf("failed to write blueprint: %v", err)
 	}
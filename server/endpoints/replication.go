@@ -0,0 +1,123 @@
+package endpoints
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/cordialsys/panel/pkg/s3client"
+	"github.com/cordialsys/panel/server/panel"
+	"github.com/cordialsys/panel/server/servererrors"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Add or replace a backup replica that uploads are copied to.  The replica must pass its checks
+// first, unless `force` is set.  Existing backups are copied to it by `ReconcileBackups`.
+func (endpoints *Endpoints) PutBackupReplica(c *fiber.Ctx) error {
+	if !endpoints.panel.HasNodeSet() {
+		return servererrors.FailedPreconditionf("not activated")
+	}
+	var replica panel.BackupReplica
+	if err := json.Unmarshal(c.Body(), &replica); err != nil {
+		return servererrors.BadRequestf("failed to parse request: %v", err)
+	}
+	// copied, as fiber reuses the request buffer and the replica is kept
+	replica.Name = strings.Clone(c.Params("name"))
+	if err := replica.Validate(); err != nil {
+		return servererrors.BadRequestf("invalid backup replica: %v", err)
+	}
+	destination, err := newBackupReplica(&replica, endpoints.panel.NodeId)
+	if err != nil {
+		return servererrors.BadRequestf("failed to create backup client: %v", err)
+	}
+	result := destination.Test(c.Context())
+	if _, force := c.Queries()["force"]; !result.Ok && !force {
+		return servererrors.FailedPreconditionf("backup replica failed its checks (%s), or set `force` to use it anyway", result.Error())
+	}
+
+	endpoints.backupLock.Lock()
+	defer endpoints.backupLock.Unlock()
+	backup := endpoints.backup.Load()
+	replicas := slices.Clone(endpoints.panel.BackupReplicas)
+	destinations := slices.Clone(backup.replicas)
+	idx := slices.IndexFunc(replicas, func(existing panel.BackupReplica) bool { return existing.Name == replica.Name })
+	if idx < 0 {
+		replicas = append(replicas, replica)
+		destinations = append(destinations, destination)
+	} else {
+		replicas[idx] = replica
+		destinations[idx] = destination
+	}
+	endpoints.panel.BackupReplicas = replicas
+	if err := panel.Save(endpoints.panel); err != nil {
+		return servererrors.InternalErrorf("failed to save panel: %v", err)
+	}
+	endpoints.backup.Store(&backupTargets{client: backup.client, replicas: destinations})
+	slog.Info("set backup replica", "name", replica.Name, "destination", destination.Destination.String())
+	return c.JSON(result)
+}
+
+// Stop copying uploads to a backup replica.  Objects already there are left as they are.
+func (endpoints *Endpoints) DeleteBackupReplica(c *fiber.Ctx) error {
+	name := c.Params("name")
+	endpoints.backupLock.Lock()
+	defer endpoints.backupLock.Unlock()
+	backup := endpoints.backup.Load()
+	idx := slices.IndexFunc(endpoints.panel.BackupReplicas, func(existing panel.BackupReplica) bool { return existing.Name == name })
+	if idx < 0 {
+		return servererrors.NotFoundf("no backup replica %s", name)
+	}
+	endpoints.panel.BackupReplicas = slices.Delete(slices.Clone(endpoints.panel.BackupReplicas), idx, idx+1)
+	if err := panel.Save(endpoints.panel); err != nil {
+		return servererrors.InternalErrorf("failed to save panel: %v", err)
+	}
+	endpoints.backup.Store(&backupTargets{client: backup.client, replicas: slices.Delete(slices.Clone(backup.replicas), idx, idx+1)})
+	return c.JSON(nil)
+}
+
+// Summarize how many backup objects each destination has, and which objects are not yet everywhere.
+func (endpoints *Endpoints) GetReplication(c *fiber.Ctx) error {
+	names := []string{}
+	for _, destination := range endpoints.replicator().Destinations() {
+		names = append(names, destination.Name)
+	}
+	summary, err := endpoints.replication.Summary(names)
+	if err != nil {
+		return servererrors.InternalErrorf("failed to load replication state: %v", err)
+	}
+	return c.JSON(summary)
+}
+
+// The treasury uploads its key backups to the bucket itself, so they are copied to the replicas
+// after each snapshot upload.  Failures are left for the next run, or `ReconcileBackups`.
+func (endpoints *Endpoints) reconcileKeys(ctx context.Context, replicator *s3client.Replicator) {
+	if len(replicator.Replicas) == 0 {
+		return
+	}
+	result, err := replicator.Reconcile(ctx, replicator.Primary.KeyPrefix())
+	if err != nil {
+		slog.Warn("failed to reconcile key backups", "error", err)
+		return
+	}
+	if len(result.Failed) > 0 {
+		slog.Warn("failed to copy key backups to every replica", "copied", len(result.Copied), "failed", len(result.Failed))
+	} else if len(result.Copied) > 0 {
+		slog.Info("copied key backups to replicas", "copied", len(result.Copied))
+	}
+}
+
+// Copy any of this node's backups that are missing from a destination, including the key
+// backups the treasury uploads to the bucket itself.
+func (endpoints *Endpoints) ReconcileBackups(c *fiber.Ctx) error {
+	if !endpoints.panel.HasNodeSet() {
+		return servererrors.FailedPreconditionf("not activated")
+	}
+	result, err := endpoints.replicator().Reconcile(c.Context(), endpoints.backupClient().NodePrefix())
+	if err != nil {
+		return servererrors.InternalErrorf("%v", err)
+	}
+	slog.Info("reconciled backups", "objects", result.Objects, "copied", len(result.Copied), "failed", len(result.Failed))
+	return c.JSON(result)
+}
@@ -0,0 +1,108 @@
+package endpoints_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cordialsys/panel/pkg/s3client"
+	"github.com/cordialsys/panel/pkg/s3client/s3test"
+	"github.com/cordialsys/panel/pkg/snapshot"
+	"github.com/cordialsys/panel/pkg/snapshot/snapshottest"
+	"github.com/cordialsys/panel/server/panel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupReplicas(t *testing.T) {
+	server := s3test.NewServer("customer-backups", "offsite")
+	defer server.Close()
+	nfs := t.TempDir()
+	params := newTestPanel(t, customerBucket(t, server))
+	app := newTestApp(t, params)
+
+	status, body := app.do("PUT", "/v1/backup/replicas/primary", panel.BackupReplica{Dir: nfs})
+	require.Equal(t, http.StatusBadRequest, status, string(body))
+	require.Contains(t, string(body), "reserved")
+	status, body = app.do("PUT", "/v1/backup/replicas/nfs", panel.BackupReplica{Dir: "relative/path"})
+	require.Equal(t, http.StatusBadRequest, status, string(body))
+	require.Contains(t, string(body), "absolute")
+	status, body = app.do("PUT", "/v1/backup/replicas/nfs", panel.BackupReplica{Dir: filepath.Join(nfs, "missing")})
+	require.Equal(t, http.StatusBadRequest, status, string(body))
+	require.Contains(t, string(body), "FailedPrecondition")
+
+	status, body = app.do("PUT", "/v1/backup/replicas/nfs", panel.BackupReplica{Dir: nfs})
+	require.Equal(t, http.StatusOK, status, string(body))
+	status, body = app.do("PUT", "/v1/backup/replicas/offsite", panel.BackupReplica{S3: &panel.BackupDestination{
+		Endpoint:    server.URL,
+		Bucket:      "offsite",
+		Credentials: "raw:AKIDPANEL:secret",
+	}})
+	require.Equal(t, http.StatusOK, status, string(body))
+	saved, err := panel.Load(params.PanelDir)
+	require.NoError(t, err)
+	require.Len(t, saved.BackupReplicas, 2)
+
+	// uploads are copied to every replica
+	bakRecipient, bakShortId := testBakRecipient()
+	tarBz := snapshottest.Tar(t, snapshot.Info{Height: 10, Bak: bakRecipient, Participant: 3, CreateTime: time.Now()}, false)
+	status, body = app.do("PUT", "/v1/backup/snapshot/snap-1", tarBz)
+	require.Equal(t, http.StatusOK, status, string(body))
+	key := "nodes/3/snapshots/" + bakShortId + "/snap-1.tar"
+	require.Equal(t, tarBz, server.Objects("customer-backups")[key])
+	require.Equal(t, tarBz, server.Objects("offsite")[key])
+	data, err := os.ReadFile(filepath.Join(nfs, key))
+	require.NoError(t, err)
+	require.Equal(t, tarBz, data)
+	require.Contains(t, server.Objects("offsite"), snapshot.SidecarKey(key))
+	require.FileExists(t, filepath.Join(nfs, snapshot.SidecarKey(key)))
+
+	// key backups written to the bucket by the treasury are copied by reconciling
+	keyFile := "nodes/3/keys/nodes/3/" + bakShortId + "/key-1@1.json"
+	server.PutObject("customer-backups", keyFile, []byte("key"))
+	status, body = app.do("POST", "/v1/backup/reconcile", nil)
+	require.Equal(t, http.StatusOK, status, string(body))
+	var result s3client.ReconcileResult
+	require.NoError(t, json.Unmarshal(body, &result))
+	require.Equal(t, 3, result.Objects)
+	require.Len(t, result.Copied, 2)
+	require.Empty(t, result.Failed)
+	require.FileExists(t, filepath.Join(nfs, keyFile))
+	require.Contains(t, server.Objects("offsite"), keyFile)
+
+	status, body = app.do("GET", "/v1/backup/replication", nil)
+	require.Equal(t, http.StatusOK, status, string(body))
+	var summary s3client.ReplicationSummary
+	require.NoError(t, json.Unmarshal(body, &summary))
+	require.Equal(t, []s3client.DestinationSummary{
+		{Name: "primary", Replicated: 3},
+		{Name: "nfs", Replicated: 3},
+		{Name: "offsite", Replicated: 3},
+	}, summary.Destinations)
+	require.Empty(t, summary.Pending)
+
+	// and after each upload, without reconciling by hand
+	keyFile = "nodes/3/keys/nodes/3/" + bakShortId + "/key-2@1.json"
+	server.PutObject("customer-backups", keyFile, []byte("key"))
+	status, body = app.do("PUT", "/v1/backup/snapshot/snap-2", tarBz)
+	require.Equal(t, http.StatusOK, status, string(body))
+	require.FileExists(t, filepath.Join(nfs, keyFile))
+	require.Contains(t, server.Objects("offsite"), keyFile)
+
+	// raw credentials of replicas are hidden
+	status, body = app.do("GET", "/v1/panel", nil)
+	require.Equal(t, http.StatusOK, status, string(body))
+	require.NotContains(t, string(body), "AKIDPANEL:secret")
+
+	status, body = app.do("DELETE", "/v1/backup/replicas/offsite", nil)
+	require.Equal(t, http.StatusOK, status, string(body))
+	status, body = app.do("DELETE", "/v1/backup/replicas/offsite", nil)
+	require.Equal(t, http.StatusNotFound, status, string(body))
+	require.Len(t, params.BackupReplicas, 1)
+	status, body = app.do("GET", "/v1/backup/replication", nil)
+	require.Equal(t, http.StatusOK, status, string(body))
+	require.NoError(t, json.Unmarshal(body, &summary))
+	require.Len(t, summary.Destinations, 2)
+}
@@ -0,0 +1,235 @@
+package endpoints
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/cordialsys/panel/pkg/client"
+	"github.com/cordialsys/panel/pkg/s3client"
+	"github.com/cordialsys/panel/pkg/snapshot"
+	"github.com/cordialsys/panel/server/panel"
+	"github.com/cordialsys/panel/server/schedule"
+	"github.com/cordialsys/panel/server/servererrors"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Takes the scheduled snapshots the same way as `TakeSnapshot`, and copies them to the backup service.
+type snapshotRunner struct {
+	endpoints *Endpoints
+}
+
+var _ schedule.Runner = snapshotRunner{}
+
+func (r snapshotRunner) Ready(ctx context.Context) error {
+	if !r.endpoints.panel.HasApiKey() {
+		return fmt.Errorf("not activated")
+	}
+	if r.endpoints.restoring.Load() {
+		return fmt.Errorf("a restore is in progress")
+	}
+	treasury, err := getSystemdService(ctx, ServiceTreasury)
+	if err != nil {
+		return err
+	}
+	if treasury.ActiveState != client.ServiceStateActive {
+		return fmt.Errorf("treasury is %s", treasury.ActiveState)
+	}
+	return nil
+}
+
+func (r snapshotRunner) Snapshot(ctx context.Context, bak string, id string) error {
+	err := r.endpoints.execCordWithHome([]string{
+		"backup",
+		"snapshot",
+		"--output-dir", r.endpoints.panel.BackupDir,
+		"--bak", bak,
+		"--id", id,
+	}, IncludeEar)
+	if err != nil {
+		return err
+	}
+	path, err := r.local().find(bak, id)
+	if err != nil {
+		return err
+	}
+	snapshotFile, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer snapshotFile.Close()
+	info, err := snapshot.ReadInfo(snapshotFile)
+	if err != nil {
+		return err
+	}
+	err = r.endpoints.uploadSnapshot(ctx, fmt.Sprintf("%s/%s.tar", BakShortId(bak), id), snapshotFile, *info)
+	if err != nil {
+		return fmt.Errorf("failed to upload snapshot: %v", err)
+	}
+	return nil
+}
+
+func (r snapshotRunner) local() localSnapshots {
+	return localSnapshots(filepath.Join(r.endpoints.panel.BackupDir, "snapshots"))
+}
+
+// The local tree and the bucket are pruned, replicas only if configured to be.
+func (r snapshotRunner) Locations() []schedule.Location {
+	locations := []schedule.Location{r.local()}
+	replicator := r.endpoints.replicator()
+	for _, destination := range replicator.Destinations() {
+		if destination.Name == s3client.PrimaryName || destination.Prune {
+			locations = append(locations, replicaSnapshots{replicator, destination})
+		}
+	}
+	return locations
+}
+
+// The `BackupDir/snapshots` tree written by `cord backup snapshot`.
+type localSnapshots string
+
+func (l localSnapshots) String() string {
+	return string(l)
+}
+
+func (l localSnapshots) walk(bak string, cb func(id string, path string)) error {
+	err := filepath.WalkDir(string(l), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || filepath.Base(filepath.Dir(path)) != BakShortId(bak) {
+			return nil
+		}
+		if id, ok := strings.CutSuffix(d.Name(), ".tar"); ok {
+			cb(id, path)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (l localSnapshots) find(bak string, id string) (string, error) {
+	found := ""
+	err := l.walk(bak, func(snapshotId string, path string) {
+		if snapshotId == id {
+			found = path
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	if found == "" {
+		return "", fmt.Errorf("unable to locate snapshot %s in %s", id, l)
+	}
+	return found, nil
+}
+
+func (l localSnapshots) List(ctx context.Context, bak string) ([]string, error) {
+	ids := []string{}
+	err := l.walk(bak, func(id string, path string) {
+		ids = append(ids, id)
+	})
+	return ids, err
+}
+
+func (l localSnapshots) Delete(ctx context.Context, bak string, id string) error {
+	path, err := l.find(bak, id)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// The `nodes/<id>/snapshots/` prefix of the backup bucket, or of a backup replica.
+type replicaSnapshots struct {
+	replicator *s3client.Replicator
+	replica    s3client.Replica
+}
+
+func (s replicaSnapshots) String() string {
+	return fmt.Sprintf("%s (%s)", s.replica.Name, s.replica.Destination)
+}
+
+func (s replicaSnapshots) List(ctx context.Context, bak string) ([]string, error) {
+	return s3client.ListSnapshots(ctx, s.replica, s.replicator.Primary.SnapshotPrefix(BakShortId(bak)))
+}
+
+func (s replicaSnapshots) Delete(ctx context.Context, bak string, id string) error {
+	key := s.replicator.Primary.SnapshotPrefix(BakShortId(bak)) + id + ".tar"
+	for _, key := range []string{snapshot.SidecarKey(key), key} {
+		if err := s.replica.Delete(ctx, key); err != nil {
+			return err
+		}
+		if err := s.replicator.State.Forget(key, s.replica.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (endpoints *Endpoints) ListSchedules(c *fiber.Ctx) error {
+	schedules, err := endpoints.scheduler.Store().List()
+	if err != nil {
+		return servererrors.InternalErrorf("failed to load schedules: %v", err)
+	}
+	return c.JSON(schedules)
+}
+
+// Whether a schedule request would prune snapshots that the current schedule keeps, so that it
+// needs approval: a new retention policy, one that keeps fewer snapshots, or removing the schedule.
+func (endpoints *Endpoints) ScheduleNeedsApproval(c *fiber.Ctx) bool {
+	if c.Method() == fiber.MethodDelete {
+		return true
+	}
+	var req schedule.Schedule
+	if err := json.Unmarshal(c.Body(), &req); err != nil || req.Retention.IsZero() {
+		// invalid requests are refused by the handler
+		return false
+	}
+	schedules, err := endpoints.scheduler.Store().List()
+	if err != nil {
+		return true
+	}
+	idx := slices.IndexFunc(schedules, func(s schedule.Schedule) bool { return s.Bak == c.Params("bak") })
+	return idx < 0 || !req.Retention.Keeps(schedules[idx].Retention)
+}
+
+func (endpoints *Endpoints) PutSchedule(c *fiber.Ctx) error {
+	var req schedule.Schedule
+	if err := json.Unmarshal(c.Body(), &req); err != nil {
+		return servererrors.BadRequestf("failed to parse request: %v", err)
+	}
+	req.Bak = c.Params("bak")
+	if !slices.ContainsFunc(endpoints.panel.Baks, func(b panel.Bak) bool { return b.Key == req.Bak }) {
+		return servererrors.BadRequestf("bak does not match any existing backup key")
+	}
+	if err := req.Validate(); err != nil {
+		return servererrors.BadRequestf("invalid schedule: %v", err)
+	}
+	updated, err := endpoints.scheduler.Store().Put(req)
+	if err != nil {
+		return servererrors.InternalErrorf("failed to save schedule: %v", err)
+	}
+	endpoints.scheduler.Reload()
+	return c.JSON(updated)
+}
+
+func (endpoints *Endpoints) DeleteSchedule(c *fiber.Ctx) error {
+	err := endpoints.scheduler.Store().Delete(c.Params("bak"))
+	if err == schedule.ErrNotFound {
+		return servererrors.NotFoundf("no schedule for bak %s", c.Params("bak"))
+	}
+	if err != nil {
+		return servererrors.InternalErrorf("failed to delete schedule: %v", err)
+	}
+	endpoints.scheduler.Reload()
+	return c.JSON(nil)
+}
@@ -0,0 +1,133 @@
+package endpoints
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// Secrets are passed to cord/signer as `<NAME>_FILE=/dev/fd/<n>`, naming an inherited pipe that
+// the secret is read from, rather than as `<NAME>` in the environment where `/proc/<pid>/environ`
+// exposes it for the lifetime of the process.
+const SecretFileSuffix = "_FILE"
+
+// The secret is written to the pipe before the child starts, so must fit in the pipe buffer.
+const maxPipeSecretSize = 16 * 1024
+
+// Secret environment variables that are never inherited from the panel's own environment.
+var secretEnvNames = []string{ENV_SIGNER_EAR_PHRASE, ENV_SIGNER_NEW_EAR_PHRASE, ENV_SIGNER_BAK_PHRASE}
+
+type execSecret struct {
+	name  string
+	value []byte
+}
+
+// A command that secrets may be passed to.  Use `CombinedOutput`, or `Start` followed by `Wait`,
+// as with `exec.Cmd`; the secret buffers are zeroed once the child has been started.
+type SecretCmd struct {
+	*exec.Cmd
+	// Compatibility with cord/signer versions that only read secrets from the environment
+	SecretsInEnv bool
+	secrets      []execSecret
+}
+
+func NewSecretCmd(name string, args ...string) *SecretCmd {
+	cmd := exec.Command(name, args...)
+	cmd.Env = slices.DeleteFunc(os.Environ(), func(env string) bool {
+		key, _, _ := strings.Cut(env, "=")
+		return isSecretEnv(key)
+	})
+	return &SecretCmd{Cmd: cmd}
+}
+
+func (endpoints *Endpoints) newSecretCmd(name string, args ...string) *SecretCmd {
+	cmd := NewSecretCmd(name, args...)
+	cmd.SecretsInEnv = endpoints.panel.SecretsInEnv
+	return cmd
+}
+
+func isSecretEnv(key string) bool {
+	key = strings.TrimSuffix(key, SecretFileSuffix)
+	if slices.Contains(secretEnvNames, key) {
+		return true
+	}
+	// SIGNER_<n>_BAK_PHRASE
+	return strings.HasPrefix(key, "SIGNER_") && strings.HasSuffix(key, "_BAK_PHRASE")
+}
+
+// Pass a secret to the child process, as the environment variable `name` (suffixed with `_FILE`).
+func (cmd *SecretCmd) AddSecret(name string, value string) {
+	cmd.secrets = append(cmd.secrets, execSecret{name: name, value: []byte(value)})
+}
+
+// Attach the secrets to the command, returning the read ends of the pipes to close once the
+// child has started.
+func (cmd *SecretCmd) attach() ([]*os.File, error) {
+	if cmd.SecretsInEnv {
+		for _, secret := range cmd.secrets {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", secret.name, secret.value))
+		}
+		return nil, nil
+	}
+	readers := []*os.File{}
+	for _, secret := range cmd.secrets {
+		if len(secret.value) > maxPipeSecretSize {
+			closeAll(readers)
+			return nil, fmt.Errorf("secret %s is too large to pass to a child process", secret.name)
+		}
+		reader, writer, err := os.Pipe()
+		if err != nil {
+			closeAll(readers)
+			return nil, fmt.Errorf("failed to create pipe for %s: %v", secret.name, err)
+		}
+		_, err = writer.Write(secret.value)
+		writer.Close()
+		if err != nil {
+			reader.Close()
+			closeAll(readers)
+			return nil, fmt.Errorf("failed to write %s to pipe: %v", secret.name, err)
+		}
+		readers = append(readers, reader)
+		// fds 0-2 are stdio, ExtraFiles start at 3
+		fd := 3 + len(cmd.ExtraFiles)
+		cmd.ExtraFiles = append(cmd.ExtraFiles, reader)
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s%s=/dev/fd/%d", secret.name, SecretFileSuffix, fd))
+	}
+	return readers, nil
+}
+
+func (cmd *SecretCmd) zero() {
+	for _, secret := range cmd.secrets {
+		clear(secret.value)
+	}
+	cmd.secrets = nil
+}
+
+func closeAll(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+func (cmd *SecretCmd) Start() error {
+	defer cmd.zero()
+	readers, err := cmd.attach()
+	if err != nil {
+		return err
+	}
+	// the child has its own copy of the read ends
+	defer closeAll(readers)
+	return cmd.Cmd.Start()
+}
+
+func (cmd *SecretCmd) CombinedOutput() ([]byte, error) {
+	defer cmd.zero()
+	readers, err := cmd.attach()
+	if err != nil {
+		return nil, err
+	}
+	defer closeAll(readers)
+	return cmd.Cmd.CombinedOutput()
+}
@@ -0,0 +1,42 @@
+package endpoints_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cordialsys/panel/server/endpoints"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecretCmd(t *testing.T) {
+	earPhrase := "abandon ability able about above absent absorb abstract absurd abuse access accident"
+	bakPhrase := "zoo zone youth young yellow year wrong write wrist world worth wreck"
+	// not inherited from the panel's environment
+	t.Setenv(endpoints.ENV_SIGNER_BAK_PHRASE, "inherited")
+	t.Setenv("SIGNER_7_BAK_PHRASE", "inherited")
+
+	script := `cat "$SIGNER_EAR_PHRASE_FILE"; echo; cat "$SIGNER_BAK_PHRASE_FILE"; echo; cat /proc/self/environ | tr '\0' '\n'`
+	cmd := endpoints.NewSecretCmd("sh", "-c", script)
+	cmd.AddSecret(endpoints.ENV_SIGNER_EAR_PHRASE, earPhrase)
+	cmd.AddSecret(endpoints.ENV_SIGNER_BAK_PHRASE, bakPhrase)
+	output, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(output))
+
+	lines := strings.Split(string(output), "\n")
+	require.Equal(t, earPhrase, lines[0])
+	require.Equal(t, bakPhrase, lines[1])
+	environ := strings.Join(lines[2:], "\n")
+	require.NotContains(t, environ, earPhrase)
+	require.NotContains(t, environ, bakPhrase)
+	require.NotContains(t, environ, "inherited")
+	require.Contains(t, environ, "SIGNER_EAR_PHRASE_FILE=/dev/fd/3")
+	require.Contains(t, environ, "SIGNER_BAK_PHRASE_FILE=/dev/fd/4")
+
+	// compatibility
+	cmd = endpoints.NewSecretCmd("sh", "-c", `echo "$SIGNER_EAR_PHRASE"`)
+	cmd.SecretsInEnv = true
+	cmd.AddSecret(endpoints.ENV_SIGNER_EAR_PHRASE, earPhrase)
+	output, err = cmd.CombinedOutput()
+	require.NoError(t, err)
+	require.Equal(t, earPhrase+"\n", string(output))
+}
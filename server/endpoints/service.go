@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/cordialsys/panel/pkg/client"
+	"github.com/cordialsys/panel/server/auth"
 	"github.com/cordialsys/panel/server/servererrors"
 	"github.com/coreos/go-systemd/v22/dbus"
 	"github.com/gofiber/fiber/v2"
@@ -17,6 +18,8 @@ type serviceDescription struct {
 	// not writable from the API
 	ReadOnly bool `json:"read_only"`
 	Logs     bool `json:"logs"`
+	// minimum role needed to start/stop/etc the service
+	WriteRole auth.Role `json:"write_role,omitempty"`
 }
 type serviceDescriptions []serviceDescription
 
@@ -47,6 +50,15 @@ func (s serviceDescriptions) canWrite(name string) bool {
 	return false
 }
 
+func (s serviceDescriptions) writeRole(name string) auth.Role {
+	for _, srv := range s {
+		if srv.Name == name && srv.WriteRole != "" {
+			return srv.WriteRole
+		}
+	}
+	return auth.RoleOperator
+}
+
 const ServiceTreasury = "treasury.service"
 const ServiceStartTreasury = "start-treasury.service"
 const ServiceBlueprint = "blueprint.service"
@@ -55,10 +67,12 @@ const ServiceBlueprint = "blueprint.service"
 // want to expose to the API.
 var SERVICES = serviceDescriptions{
 	{
-		Name: "docker.socket",
+		Name:      "docker.socket",
+		WriteRole: auth.RoleCustodian,
 	},
 	{
-		Name: "docker.service",
+		Name:      "docker.service",
+		WriteRole: auth.RoleCustodian,
 	},
 	{
 		Name: ServiceTreasury,
@@ -71,10 +85,14 @@ var SERVICES = serviceDescriptions{
 	{
 		Name: "treasury-firewall.service",
 		Logs: true,
+		// disabling the firewall exposes the treasury
+		WriteRole: auth.RoleCustodian,
 	},
 	{
 		Name: ServiceBlueprint,
 		Logs: true,
+		// applies the treasury policy
+		WriteRole: auth.RoleCustodian,
 	},
 	{
 		Name:     "panel.service",
@@ -280,6 +298,9 @@ func (endpoints *Endpoints) UpdateService(c *fiber.Ctx) error {
 	if !SERVICES.canWrite(serviceName) {
 		return servererrors.BadRequestf("service %s not found", serviceName)
 	}
+	if role := SERVICES.writeRole(serviceName); !auth.HasRole(c, role) {
+		return servererrors.PermissionDeniedf("%s on %s requires role '%s'", action, serviceName, role)
+	}
 
 	srv, err := updateSystemdService(ctx, serviceName, ServiceAction(action))
 	if err != nil {
@@ -0,0 +1,68 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"log/slog"
+
+	"github.com/cordialsys/panel/server/approvals"
+	"github.com/cordialsys/panel/server/auth"
+	"github.com/cordialsys/panel/server/servererrors"
+	"github.com/cordialsys/panel/server/sessions"
+	"github.com/gofiber/fiber/v2"
+)
+
+type CreateSessionRecipientRequest struct {
+	// The operation the recipient will be used for, e.g. "restore-snapshot"
+	Operation sessions.Operation `json:"operation"`
+}
+
+// POST /v1/sessions/recipient
+// Mint an ephemeral age recipient to encrypt a secret phrase to, for a single operation.
+func (endpoints *Endpoints) CreateSessionRecipient(c *fiber.Ctx) error {
+	req := CreateSessionRecipientRequest{}
+	if err := json.Unmarshal(c.Body(), &req); err != nil {
+		return servererrors.BadRequestf("failed to parse request: %v", err)
+	}
+	if !req.Operation.Valid() {
+		return servererrors.BadRequestf("invalid operation %q, must be one of %v", req.Operation, sessions.Operations)
+	}
+	tokenId := ""
+	if token := auth.FromCtx(c); token != nil {
+		tokenId = token.Id
+	}
+	session, err := endpoints.sessions.Create(req.Operation, tokenId)
+	if err != nil {
+		return servererrors.FailedPreconditionf("failed to create session: %v", err)
+	}
+	return c.JSON(session)
+}
+
+// Middleware placed before an approval requirement: when the request creates an approval request,
+// the session it was encrypted to is held until the approval expires, so the approved request
+// can be retried with the same body.
+func (endpoints *Endpoints) HoldSessionForApproval(c *fiber.Ctx) error {
+	err := c.Next()
+	approvalId := c.GetRespHeader(approvals.HeaderApproval)
+	if approvalId == "" || c.Get(approvals.HeaderApproval) != "" {
+		return err
+	}
+	var req struct {
+		SessionId string `json:"session_id"`
+	}
+	if json.Unmarshal(c.Body(), &req) != nil || req.SessionId == "" {
+		return err
+	}
+	approval, getErr := endpoints.approvals.Get(approvalId)
+	if getErr != nil {
+		slog.Warn("failed to hold session for approval", "approval", approvalId, "error", getErr)
+		return err
+	}
+	tokenId := ""
+	if token := auth.FromCtx(c); token != nil {
+		tokenId = token.Id
+	}
+	if holdErr := endpoints.sessions.Hold(req.SessionId, tokenId, approvalId, approval.ExpireTime); holdErr != nil {
+		slog.Warn("failed to hold session for approval", "approval", approvalId, "error", holdErr)
+	}
+	return err
+}
@@ -0,0 +1,85 @@
+package endpoints_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cordialsys/panel/pkg/s3client/s3test"
+	"github.com/cordialsys/panel/server/approvals"
+	"github.com/cordialsys/panel/server/auth"
+	"github.com/cordialsys/panel/server/endpoints"
+	"github.com/cordialsys/panel/server/servererrors"
+	"github.com/cordialsys/panel/server/sessions"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionHeldForApproval(t *testing.T) {
+	server := s3test.NewServer("customer-backups")
+	defer server.Close()
+	params := newTestPanel(t, customerBucket(t, server))
+	aliceToken, _, err := auth.Create(params.PanelDir, "alice", "", auth.RoleCustodian)
+	require.NoError(t, err)
+	_, bob, err := auth.Create(params.PanelDir, "bob", "", auth.RoleCustodian)
+	require.NoError(t, err)
+
+	handler := endpoints.NewEndpoints(params)
+	handler.Sessions().TTL = 10 * time.Millisecond
+	app := fiber.New(fiber.Config{
+		ErrorHandler: func(c *fiber.Ctx, err error) error {
+			return err.(*servererrors.ErrorResponse).Send(c)
+		},
+	})
+	api := app.Group("/v1", auth.New(params.PanelDir))
+	api.Post("/sessions/recipient", handler.CreateSessionRecipient)
+	api.Post("/backup/restore", handler.HoldSessionForApproval, approvals.Require(handler.Approvals(), "restore from snapshot", nil), handler.RestoreFromSnapshot)
+	api.Delete("/approvals/:id", handler.CancelApproval)
+	do := func(method string, path string, body any, approvalId string) (int, string, []byte) {
+		bz, err := json.Marshal(body)
+		require.NoError(t, err)
+		req := httptest.NewRequest(method, path, bytes.NewReader(bz))
+		req.Header.Set("Authorization", "Bearer "+aliceToken)
+		if approvalId != "" {
+			req.Header.Set(approvals.HeaderApproval, approvalId)
+		}
+		resp, err := app.Test(req, -1)
+		require.NoError(t, err)
+		respBz := new(bytes.Buffer)
+		_, err = respBz.ReadFrom(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, resp.Header.Get(approvals.HeaderApproval), respBz.Bytes()
+	}
+	restoreRequest := func() endpoints.RestoreSnapshotRequest {
+		status, _, body := do("POST", "/v1/sessions/recipient", endpoints.CreateSessionRecipientRequest{Operation: sessions.OperationRestoreSnapshot}, "")
+		require.Equal(t, http.StatusOK, status, string(body))
+		var session sessions.Session
+		require.NoError(t, json.Unmarshal(body, &session))
+		return endpoints.RestoreSnapshotRequest{SessionId: session.Id, EncryptedSecretPhrase: encryptTo(t, session.Recipient), Latest: true}
+	}
+
+	// the session outlives its TTL while the approval request is open
+	req := restoreRequest()
+	status, approvalId, body := do("POST", "/v1/backup/restore", req, "")
+	require.Equal(t, http.StatusPreconditionRequired, status, string(body))
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, 1, handler.Sessions().Len())
+	_, err = handler.Approvals().Approve(approvalId, approvals.PrincipalOf(bob))
+	require.NoError(t, err)
+	status, _, body = do("POST", "/v1/backup/restore", req, approvalId)
+	require.Equal(t, http.StatusNotFound, status, string(body))
+	// past the session, to finding the snapshot
+	require.Contains(t, string(body), "no snapshot with a verified sidecar")
+	require.Equal(t, 0, handler.Sessions().Len())
+
+	// and is dropped once the approval request is cancelled
+	status, approvalId, body = do("POST", "/v1/backup/restore", restoreRequest(), "")
+	require.Equal(t, http.StatusPreconditionRequired, status, string(body))
+	require.Equal(t, 1, handler.Sessions().Len())
+	status, _, body = do("DELETE", "/v1/approvals/"+approvalId, nil, "")
+	require.Equal(t, http.StatusOK, status, string(body))
+	require.Equal(t, 0, handler.Sessions().Len())
+}
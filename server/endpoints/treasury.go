@@ -18,6 +18,7 @@ import (
 	"github.com/cordialsys/panel/pkg/client"
 	"github.com/cordialsys/panel/pkg/genesis"
 	"github.com/cordialsys/panel/pkg/names"
+	"github.com/cordialsys/panel/pkg/secret"
 	"github.com/cordialsys/panel/server/panel"
 	"github.com/cordialsys/panel/server/servererrors"
 	"github.com/coreos/go-systemd/v22/dbus"
@@ -66,16 +67,19 @@ const (
 	NoEarNeeded ExecType = "signer"
 )
 
-// Executes a cord command, adding the --home flag to the command
-func (endpoints *Endpoints) execCordWithHome(cmd []string, execType ExecType, envs ...string) error {
+// Executes a cord command, adding the --home flag to the command.
+// Secrets are passed as pairs of environment variable name and value.
+func (endpoints *Endpoints) execCordWithHome(cmd []string, execType ExecType, secrets ...string) error {
 	params := endpoints.panel
 	binaryDir := params.BinaryDir
 	cord := filepath.Join(binaryDir, "cord")
 
 	execList := append(cmd, "--home", string(params.TreasuryHome))
 
-	execCmd := exec.Command(cord, execList...)
-	execCmd.Env = append(os.Environ(), envs...)
+	execCmd := endpoints.newSecretCmd(cord, execList...)
+	for i := 0; i+1 < len(secrets); i += 2 {
+		execCmd.AddSecret(secrets[i], secrets[i+1])
+	}
 
 	if execType == IncludeEar {
 		err := endpoints.attachEarSecretToCmd(execCmd)
@@ -261,7 +265,7 @@ func (endpoints *Endpoints) DeleteTreasury(c *fiber.Ctx) error {
 		if err != nil {
 			return servererrors.InternalErrorf("failed to delete supervisor config: %v", err)
 		}
-		endpoints.panel.EarSecret = ""
+		endpoints.panel.EarSecret = secret.Ref{}
 	}
 
 	// Reset panel settings relating to backups + blueprint
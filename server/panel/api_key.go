@@ -0,0 +1,104 @@
+package panel
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/cordialsys/panel/pkg/secret"
+)
+
+func (p *Panel) HasApiKey() bool {
+	return p.ApiKeyRef != ""
+}
+
+// Reference to the API key systemd credential.
+func ApiKeyCredentialRef() secret.Secret {
+	return secret.Secret(fmt.Sprintf("%s:%s", secret.Creds, CredentialApiKey))
+}
+
+// Whether the API key is supplied as the systemd credential that the units import themselves.
+func (p *Panel) UsesCredentials() bool {
+	return p.ApiKeyRef == ApiKeyCredentialRef()
+}
+
+// Resolve the API key from its secret reference.
+func (p *Panel) LoadApiKey() (string, error) {
+	if p.ApiKeyRef == "" {
+		return "", fmt.Errorf("not activated")
+	}
+	apiKey, err := p.ApiKeyRef.Load()
+	if err != nil {
+		return "", fmt.Errorf("failed to load API key: %v", err)
+	}
+	if apiKey == "" {
+		return "", fmt.Errorf("API key reference resolved to an empty value")
+	}
+	return apiKey, nil
+}
+
+// Store the API key in a file in the panel directory, readable only by root and the treasury user,
+// and reference it.
+func (p *Panel) StoreApiKey(apiKey string) error {
+	path := p.PanelDir.ApiKeyFile()
+	err := os.MkdirAll(p.PanelDir.String(), 0755)
+	if err != nil {
+		return err
+	}
+	// restrict to root first (WriteFile keeps the mode of an existing file), then widen to the treasury group
+	err = os.WriteFile(path, []byte(apiKey+"\n"), 0600)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		return err
+	}
+	if gid, ok := lookupGid(p.TreasuryUser); ok {
+		if err := os.Chown(path, 0, gid); err != nil {
+			slog.Warn("could not grant treasury user access to API key file", "path", path, "error", err)
+		} else if err := os.Chmod(path, 0640); err != nil {
+			return err
+		}
+	}
+	p.ApiKeyRef = secret.Secret(string(secret.File) + ":" + path)
+	p.ApiKeyId = ApiKeyId(apiKey)
+	return nil
+}
+
+func lookupGid(username string) (int, bool) {
+	if username == "" {
+		return 0, false
+	}
+	u, err := user.Lookup(username)
+	if err != nil {
+		return 0, false
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return 0, false
+	}
+	return gid, true
+}
+
+// The non-secret id portion of the API key.
+func ApiKeyId(apiKey string) string {
+	return strings.Split(apiKey, ":")[0]
+}
+
+// Move a plaintext API key written by an older version into the API key file.
+// Returns true if the panel was updated and should be saved.
+func (p *Panel) MigrateApiKey() (bool, error) {
+	if p.LegacyApiKey == "" {
+		return false, nil
+	}
+	if p.ApiKeyRef == "" {
+		if err := p.StoreApiKey(p.LegacyApiKey); err != nil {
+			return false, err
+		}
+	}
+	p.LegacyApiKey = ""
+	return true, nil
+}
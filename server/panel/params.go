@@ -5,7 +5,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
 
 	"github.com/cordialsys/panel/pkg/admin"
 	"github.com/cordialsys/panel/pkg/paths"
@@ -16,6 +19,13 @@ import (
 
 const ENV_TREASURY_HOME = "TREASURY_HOME"
 const ENV_API_KEY = "TREASURY_API_KEY"
+
+// Secret reference for the API key, written to the env file instead of the key itself
+const ENV_API_KEY_REF = "TREASURY_API_KEY_REF"
+
+// Name of the systemd credential holding the API key, imported by panel.service and treasury.service
+const CredentialApiKey = "panel.api-key"
+
 const ENV_SUPERVISOR_HOME = "SUPERVISOR_HOME"
 const ENV_TRIPLES_COUNT = "TRIPLES_COUNT"
 const ENV_TREASURY_BACKUP_DIR = "TREASURY_BACKUP_DIR"
@@ -32,6 +42,76 @@ type Bak struct {
 	Key string `json:"key" toml:"key"`
 }
 
+// An S3-compatible bucket (AWS S3, GCS interoperability, MinIO, ...) to keep snapshots and key
+// backups in, instead of the Cordial Systems backup service.  Objects are written under
+// `nodes/<node-id>/`, so the bucket should be dedicated to one treasury.  The treasury itself still
+// uploads its key backups to the backup service, so they are only in the bucket once copied there.
+type BackupDestination struct {
+	// S3 API url, e.g. `https://storage.googleapis.com` or a MinIO url.  Defaults to AWS S3 for the region.
+	Endpoint string `json:"endpoint,omitempty"`
+	Bucket   string `json:"bucket"`
+	Region   string `json:"region,omitempty"`
+	// Secret reference to `<access-key-id>:<secret-access-key>[:<session-token>]`.
+	// If not set, credentials are taken from the environment (e.g. an instance role).
+	Credentials secret.Secret `json:"credentials,omitempty"`
+}
+
+func (d *BackupDestination) Validate() error {
+	if d.Bucket == "" {
+		return fmt.Errorf("bucket is required")
+	}
+	if d.Endpoint != "" {
+		endpoint, err := url.Parse(d.Endpoint)
+		if err != nil || (endpoint.Scheme != "https" && endpoint.Scheme != "http") || endpoint.Host == "" {
+			return fmt.Errorf("endpoint must be an http(s) url")
+		}
+	} else if d.Region == "" {
+		return fmt.Errorf("region is required for AWS S3")
+	}
+	if d.Credentials != "" {
+		if _, err := d.Credentials.Ref(); err != nil {
+			return fmt.Errorf("invalid credentials: %v", err)
+		}
+	}
+	return nil
+}
+
+var replicaNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// A further destination that snapshots and key backups are copied to, in addition to the
+// backup bucket.  Exactly one of `dir` or `s3` is set.
+type BackupReplica struct {
+	Name string `json:"name"`
+	// Absolute path of a local directory or NFS mount
+	Dir string             `json:"dir,omitempty"`
+	S3  *BackupDestination `json:"s3,omitempty"`
+	// Also delete the scheduled snapshots that retention policies prune from the bucket.  Off by
+	// default, so a replica keeps every snapshot copied to it.
+	Prune bool `json:"prune,omitempty"`
+}
+
+func (r *BackupReplica) Validate() error {
+	if !replicaNameRegex.MatchString(r.Name) || len(r.Name) > 64 {
+		return fmt.Errorf("name must be lowercase letters, digits, '-' or '_'")
+	}
+	if r.Name == "primary" {
+		return fmt.Errorf("name %q is reserved for the backup bucket", r.Name)
+	}
+	switch {
+	case r.Dir != "" && r.S3 != nil:
+		return fmt.Errorf("only one of dir or s3 may be set")
+	case r.Dir != "":
+		if !filepath.IsAbs(r.Dir) {
+			return fmt.Errorf("dir must be an absolute path")
+		}
+	case r.S3 != nil:
+		return r.S3.Validate()
+	default:
+		return fmt.Errorf("one of dir or s3 is required")
+	}
+	return nil
+}
+
 type State string
 
 const (
@@ -71,19 +151,29 @@ type Panel struct {
 	PanelDir       paths.PanelHome      `json:"panel_dir"`
 	BackupDir      string               `json:"backup_dir"`
 	TreasuryUser   string               `json:"treasury_user"`
+	// Authentication for `vault:` secrets that do not set it in their url
+	Vault          *secret.VaultAuthConfig `json:"vault,omitempty"`
 	binaryVerifier sigstore.Verifier
 	////
 
 	//// These are updated via panel API endpoints:
 	// Updates via POST /activate
-	ApiKey   string `json:"api_key,omitempty"`
-	ApiKeyId string `json:"api_key_id,omitempty"`
+	// Secret reference to the API key, resolved whenever the key is needed.
+	ApiKeyRef secret.Secret `json:"api_key_ref,omitempty"`
+	ApiKeyId  string        `json:"api_key_id,omitempty"`
+	// Deprecated: plaintext API key written by older versions, migrated to ApiKeyRef on start.
+	LegacyApiKey string `json:"api_key,omitempty"`
 	// Updates via POST /activate
 	NodeId     uint64 `json:"node_id,omitempty"`
 	TreasuryId string `json:"treasury_id,omitempty"`
 	// Updates via POST /activate/backup
 	Baks []Bak `json:"baks,omitempty"`
 
+	// Updates via PUT/DELETE of /backup/destination, the Cordial Systems backup service if not set
+	BackupDestination *BackupDestination `json:"backup_destination,omitempty"`
+	// Updates via PUT/DELETE of /backup/replicas/:name
+	BackupReplicas []BackupReplica `json:"backup_replicas,omitempty"`
+
 	// Updates via POST /activate
 	Connector bool `json:"connector,omitempty"`
 	// Updates via POST /activate
@@ -94,17 +184,19 @@ type Panel struct {
 	OtelEnabled  bool   `json:"otel_enabled,omitempty"`
 	TreasurySize uint64 `json:"treasury_size,omitempty"`
 	// Updates via PUT/DELETE of /panel/ear
-	EarSecret secret.Secret `json:"ear_secret,omitempty"`
+	EarSecret secret.Ref `json:"ear_secret,omitzero"`
 	// Updates via POST /panel/seal
 	Users     []UserWithInvite `json:"users,omitempty"`
 	Blueprint Blueprint        `json:"blueprint,omitempty"`
 	////
 
+	// Pass secrets to cord/signer in the environment rather than over a pipe, for older
+	// versions.  Set by `panel start --secrets-in-env`, not persisted.
+	SecretsInEnv bool `json:"-"`
+
 	//// Calculated at query time
 	// State figured out based on current environment
 	State State `json:"state"`
-	// Age recipient for sending encrypted backups to the panel server / "identity"
-	Recipient string `json:"recipient,omitempty"`
 }
 
 func (p *Panel) SetBinaryVerifier(verifier sigstore.Verifier) {
@@ -183,7 +275,7 @@ func New() *Panel {
 		PanelDir:     "/etc/panel",
 		TreasuryUser: "cordial",
 
-		ApiKey: envOrDefault(ENV_API_KEY, ""),
+		ApiKeyRef: secret.Secret(envOrDefault(ENV_API_KEY_REF, "")),
 	}
 }
 
@@ -200,7 +292,8 @@ func Save(panel *Panel) error {
 	if err != nil {
 		return err
 	}
-	err = os.WriteFile(panel.PanelDir.PanelFile(), panelBz, 0644)
+	// encrypted if sealed-state is enabled
+	err = WriteStateFile(panel.PanelDir, panel.PanelDir.PanelFile(), panelBz, 0644)
 	if err != nil {
 		return err
 	}
@@ -209,10 +302,13 @@ func Save(panel *Panel) error {
 	envContents := fmt.Sprintf(
 		ENV_TREASURY_HOME+"=%s\n"+
 			ENV_SUPERVISOR_HOME+"=%s\n"+
-			ENV_API_KEY+"=%s\n"+
 			ENV_TREASURY_BACKUP_DIR+"=%s\n",
-		panel.TreasuryHome, panel.SupervisorHome, panel.ApiKey, panel.BackupDir,
+		panel.TreasuryHome, panel.SupervisorHome, panel.BackupDir,
 	)
+	// with systemd credentials, units load the API key themselves and the env file holds no secrets
+	if !panel.UsesCredentials() {
+		envContents += fmt.Sprintf("%s=%s\n", ENV_API_KEY_REF, panel.ApiKeyRef)
+	}
 
 	if panel.Connector {
 		envContents += fmt.Sprintf("%s=1\n", ENV_TREASURY_ENABLE_CONNECTOR)
@@ -237,7 +333,7 @@ func Save(panel *Panel) error {
 }
 
 func Load(panelDir paths.PanelHome) (*Panel, error) {
-	panelBz, err := os.ReadFile(panelDir.PanelFile())
+	panelBz, err := ReadStateFile(panelDir, panelDir.PanelFile())
 	if err != nil {
 		return nil, err
 	}
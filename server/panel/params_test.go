@@ -2,8 +2,11 @@ package panel_test
 
 import (
 	"bytes"
+	"os"
 	"testing"
 
+	"github.com/cordialsys/panel/pkg/paths"
+	"github.com/cordialsys/panel/pkg/secret"
 	"github.com/cordialsys/panel/server/panel"
 	"github.com/pelletier/go-toml/v2"
 	"github.com/stretchr/testify/assert"
@@ -57,3 +60,62 @@ key = 'age1y6cj8x6934lckm3ljzyg3c3z9kldvv2af6sk7u0szew3r7a03c3szzwk33'
 	assert.NoError(t, err)
 	assert.Equal(t, config.Backup.Bak, decoded.Backup.Bak, "Deserialized data should match original")
 }
+
+func TestApiKeyMigration(t *testing.T) {
+	dir := paths.PanelHome(t.TempDir())
+	p := panel.New()
+	p.PanelDir = dir
+	p.TreasuryUser = ""
+	p.LegacyApiKey = "key-id:key-secret"
+
+	migrated, err := p.MigrateApiKey()
+	assert.NoError(t, err)
+	assert.True(t, migrated)
+	assert.Equal(t, "", p.LegacyApiKey)
+	assert.Equal(t, "key-id", p.ApiKeyId)
+	assert.Equal(t, secret.Secret("file:"+dir.ApiKeyFile()), p.ApiKeyRef)
+
+	stat, err := os.Stat(dir.ApiKeyFile())
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+
+	apiKey, err := p.LoadApiKey()
+	assert.NoError(t, err)
+	assert.Equal(t, "key-id:key-secret", apiKey)
+
+	// the key is not written to the panel configuration or env file
+	assert.NoError(t, panel.Save(p))
+	for _, file := range []string{dir.PanelFile(), dir.EnvFile()} {
+		contents, err := os.ReadFile(file)
+		assert.NoError(t, err)
+		assert.NotContains(t, string(contents), "key-secret")
+		assert.Contains(t, string(contents), dir.ApiKeyFile())
+	}
+
+	migrated, err = p.MigrateApiKey()
+	assert.NoError(t, err)
+	assert.False(t, migrated)
+}
+
+func TestApiKeyCredential(t *testing.T) {
+	credentials := t.TempDir()
+	t.Setenv(secret.ENV_CREDENTIALS_DIRECTORY, credentials)
+	assert.NoError(t, os.WriteFile(credentials+"/"+panel.CredentialApiKey, []byte("key-id:key-secret\n"), 0400))
+
+	dir := paths.PanelHome(t.TempDir())
+	p := panel.New()
+	p.PanelDir = dir
+	p.ApiKeyRef = panel.ApiKeyCredentialRef()
+	assert.True(t, p.UsesCredentials())
+
+	apiKey, err := p.LoadApiKey()
+	assert.NoError(t, err)
+	assert.Equal(t, "key-id:key-secret", apiKey)
+
+	// the units import the credential themselves, so the env file references no secrets
+	assert.NoError(t, panel.Save(p))
+	contents, err := os.ReadFile(dir.EnvFile())
+	assert.NoError(t, err)
+	assert.NotContains(t, string(contents), panel.ENV_API_KEY_REF)
+	assert.Contains(t, string(contents), panel.ENV_TREASURY_HOME)
+}
@@ -0,0 +1,210 @@
+package panel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"filippo.io/age"
+	"github.com/cordialsys/panel/pkg/paths"
+	"github.com/cordialsys/panel/pkg/secret"
+)
+
+// Header of age encrypted files, used to detect sealed state files.
+const ageHeader = "age-encryption.org/v1"
+
+// The state key is loaded from a secret on every read/write, so a modest work factor is used.
+const stateWorkFactor = 15
+
+// Configuration of sealed-state mode.  This file itself is never encrypted, as it is needed to
+// find the key.
+type StateConfig struct {
+	// If set, panel.json and blueprint.csl are encrypted under the secret.
+	Sealed bool          `json:"sealed"`
+	Secret secret.Secret `json:"secret,omitempty"`
+}
+
+func LoadStateConfig(panelDir paths.PanelHome) (*StateConfig, error) {
+	configBz, err := os.ReadFile(panelDir.StateConfigFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &StateConfig{}, nil
+		}
+		return nil, err
+	}
+	var config StateConfig
+	if err := json.Unmarshal(configBz, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", panelDir.StateConfigFile(), err)
+	}
+	return &config, nil
+}
+
+func SaveStateConfig(panelDir paths.PanelHome, config *StateConfig) error {
+	configBz, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(panelDir.String(), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(panelDir.StateConfigFile(), configBz, 0600)
+}
+
+func (config *StateConfig) loadPassphrase() (string, error) {
+	if config.Secret == "" {
+		return "", fmt.Errorf("sealed state is enabled but no secret is configured")
+	}
+	passphrase, err := config.Secret.Load()
+	if err != nil {
+		return "", fmt.Errorf("failed to load state secret: %v", err)
+	}
+	if passphrase == "" {
+		return "", fmt.Errorf("state secret resolved to an empty value")
+	}
+	return passphrase, nil
+}
+
+func IsSealedData(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(ageHeader))
+}
+
+// Decrypt the data if it is sealed, otherwise return it as is.
+func (config *StateConfig) Open(data []byte) ([]byte, error) {
+	if !IsSealedData(data) {
+		return data, nil
+	}
+	passphrase, err := config.loadPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	identity, err := age.NewScryptIdentity(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := age.Decrypt(bytes.NewReader(data), identity)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt state: %v", err)
+	}
+	return io.ReadAll(reader)
+}
+
+// Encrypt the data if sealed-state is enabled, otherwise return it as is.
+func (config *StateConfig) Seal(data []byte) ([]byte, error) {
+	if !config.Sealed {
+		return data, nil
+	}
+	passphrase, err := config.loadPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	recipient, err := age.NewScryptRecipient(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	recipient.SetWorkFactor(stateWorkFactor)
+	var buf bytes.Buffer
+	writer, err := age.Encrypt(&buf, recipient)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Read a state file from the panel directory, decrypting it if it is sealed.  In sealed-state
+// mode a plaintext file is refused, as it was not written by the panel.
+func ReadStateFile(panelDir paths.PanelHome, path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config, err := LoadStateConfig(panelDir)
+	if err != nil {
+		return nil, err
+	}
+	if config.Sealed && !IsSealedData(data) {
+		return nil, fmt.Errorf("%s is not sealed, but sealed state is enabled", path)
+	}
+	return config.Open(data)
+}
+
+// Write a state file to the panel directory, encrypting it if sealed-state is enabled.
+// Sealed files are always written with mode 0600.
+func WriteStateFile(panelDir paths.PanelHome, path string, data []byte, mode os.FileMode) error {
+	config, err := LoadStateConfig(panelDir)
+	if err != nil {
+		return err
+	}
+	if config.Sealed {
+		data, err = config.Seal(data)
+		if err != nil {
+			return err
+		}
+		mode = 0600
+	}
+	err = os.WriteFile(path, data, mode)
+	if err != nil {
+		return err
+	}
+	// WriteFile does not change the mode of an existing file
+	return os.Chmod(path, mode)
+}
+
+// The state files that are encrypted in sealed-state mode.
+func StateFiles(panelDir paths.PanelHome) []string {
+	return []string{panelDir.PanelFile(), panelDir.BlueprintFile()}
+}
+
+// Enable (or change the secret of) sealed-state mode, re-encrypting any existing state files.
+// With `config.Sealed` false, the state files are decrypted instead.
+func MigrateState(panelDir paths.PanelHome, config *StateConfig) ([]string, error) {
+	current, err := LoadStateConfig(panelDir)
+	if err != nil {
+		return nil, err
+	}
+	if config.Sealed {
+		// the key would be kept next to the state it seals, or be lost with the environment
+		if config.Secret.IsPlaintextAtRest() {
+			secretType, _ := config.Secret.Type()
+			return nil, fmt.Errorf("%s type secret is not allowed for the state key", secretType)
+		}
+		// check the new secret before touching anything
+		if _, err := config.loadPassphrase(); err != nil {
+			return nil, err
+		}
+	}
+	plaintexts := map[string][]byte{}
+	files := []string{}
+	for _, path := range StateFiles(panelDir) {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := current.Open(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %v", path, err)
+		}
+		plaintexts[path] = plaintext
+		files = append(files, path)
+	}
+	if err := SaveStateConfig(panelDir, config); err != nil {
+		return nil, err
+	}
+	for _, path := range files {
+		if err := WriteStateFile(panelDir, path, plaintexts[path], 0644); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %v", path, err)
+		}
+	}
+	return files, nil
+}
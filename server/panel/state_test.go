@@ -0,0 +1,84 @@
+package panel_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cordialsys/panel/pkg/paths"
+	"github.com/cordialsys/panel/pkg/secret"
+	"github.com/cordialsys/panel/server/panel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A state key from a systemd credential.
+func stateCredential(t *testing.T, passphrase string) secret.Secret {
+	credentials := t.TempDir()
+	t.Setenv(secret.ENV_CREDENTIALS_DIRECTORY, credentials)
+	require.NoError(t, os.WriteFile(filepath.Join(credentials, "state-key"), []byte(passphrase), 0400))
+	return secret.Secret("creds:state-key")
+}
+
+func TestSealedState(t *testing.T) {
+	dir := paths.PanelHome(t.TempDir())
+	p := panel.New()
+	p.PanelDir = dir
+	p.TreasuryId = "treasury-1"
+	require.NoError(t, panel.Save(p))
+	require.NoError(t, os.WriteFile(dir.BlueprintFile(), []byte("blueprint"), 0644))
+
+	// the state key may not be kept in the clear
+	for _, notAllowed := range []secret.Secret{secret.NewRawSecret("state passphrase"), "env:STATE_PASSPHRASE"} {
+		_, err := panel.MigrateState(dir, &panel.StateConfig{Sealed: true, Secret: notAllowed})
+		require.ErrorContains(t, err, "not allowed")
+	}
+	stateKey := stateCredential(t, "state passphrase")
+	files, err := panel.MigrateState(dir, &panel.StateConfig{Sealed: true, Secret: stateKey})
+	require.NoError(t, err)
+	assert.Equal(t, []string{dir.PanelFile(), dir.BlueprintFile()}, files)
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		require.NoError(t, err)
+		assert.True(t, panel.IsSealedData(data))
+		assert.NotContains(t, string(data), "treasury-1")
+		stat, err := os.Stat(file)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+	}
+
+	loaded, err := panel.Load(dir)
+	require.NoError(t, err)
+	assert.Equal(t, "treasury-1", loaded.TreasuryId)
+
+	// writes are sealed too
+	loaded.TreasuryId = "treasury-2"
+	require.NoError(t, panel.Save(loaded))
+	loaded, err = panel.Load(dir)
+	require.NoError(t, err)
+	assert.Equal(t, "treasury-2", loaded.TreasuryId)
+
+	// wrong secret
+	require.NoError(t, panel.SaveStateConfig(dir, &panel.StateConfig{Sealed: true, Secret: secret.NewRawSecret("wrong")}))
+	_, err = panel.Load(dir)
+	require.Error(t, err)
+	require.NoError(t, panel.SaveStateConfig(dir, &panel.StateConfig{Sealed: true, Secret: stateKey}))
+
+	// a plaintext file put in place of a sealed one is refused
+	sealedBz, err := os.ReadFile(dir.PanelFile())
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(dir.PanelFile(), []byte(`{"treasury_id":"forged"}`), 0600))
+	_, err = panel.Load(dir)
+	require.ErrorContains(t, err, "is not sealed")
+	require.NoError(t, os.WriteFile(dir.PanelFile(), sealedBz, 0600))
+
+	_, err = panel.MigrateState(dir, &panel.StateConfig{})
+	require.NoError(t, err)
+	blueprintBz, err := os.ReadFile(dir.BlueprintFile())
+	require.NoError(t, err)
+	assert.Equal(t, "blueprint", string(blueprintBz))
+	loaded, err = panel.Load(dir)
+	require.NoError(t, err)
+	assert.Equal(t, "treasury-2", loaded.TreasuryId)
+}
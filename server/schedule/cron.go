@@ -0,0 +1,165 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron is a standard 5-field cron expression (`minute hour day-of-month month day-of-week`),
+// evaluated in UTC.  Fields may be `*`, a value, a range `a-b`, a step `*/n` or `a-b/n`,
+// or a comma separated list of these.  Day-of-week is 0-6 from Sunday, with 7 also Sunday.
+type Cron struct {
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	// Whether day-of-month and day-of-week are unrestricted.  If both are restricted, either may match.
+	domStar bool
+	dowStar bool
+}
+
+var cronMacros = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+type cronField struct {
+	name string
+	min  int
+	max  int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day-of-month", 1, 31},
+	{"month", 1, 12},
+	{"day-of-week", 0, 7},
+}
+
+func ParseCron(spec string) (*Cron, error) {
+	spec = strings.TrimSpace(spec)
+	if expanded, ok := cronMacros[strings.ToLower(spec)]; ok {
+		spec = expanded
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("cron expression %q has %d fields, expected %d", spec, len(fields), len(cronFields))
+	}
+	bits := make([]uint64, len(fields))
+	for i, field := range fields {
+		var err error
+		bits[i], err = parseCronField(field, cronFields[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Sunday may be 0 or 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] = (bits[4] | 1) &^ (1 << 7)
+	}
+	cron := &Cron{
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: strings.HasPrefix(fields[2], "*"),
+		dowStar: strings.HasPrefix(fields[4], "*"),
+	}
+	// e.g. `0 0 30 2 *`
+	if cron.Next(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)).IsZero() {
+		return nil, fmt.Errorf("cron expression %q never matches", spec)
+	}
+	return cron, nil
+}
+
+func parseCronField(field string, spec cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q in cron %s field", stepPart, spec.name)
+			}
+		}
+		low, high := spec.min, spec.max
+		if rangePart != "*" {
+			lowPart, highPart, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if low, err = parseCronValue(lowPart, spec); err != nil {
+				return 0, err
+			}
+			high = low
+			if isRange {
+				if high, err = parseCronValue(highPart, spec); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				// `a/n` runs from a to the end of the range
+				high = spec.max
+			}
+			if low > high {
+				return 0, fmt.Errorf("invalid range %q in cron %s field", rangePart, spec.name)
+			}
+		}
+		for value := low; value <= high; value += step {
+			bits |= 1 << value
+		}
+	}
+	return bits, nil
+}
+
+func parseCronValue(value string, spec cronField) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < spec.min || n > spec.max {
+		return 0, fmt.Errorf("invalid value %q in cron %s field, must be %d-%d", value, spec.name, spec.min, spec.max)
+	}
+	return n, nil
+}
+
+func (c *Cron) matchDay(t time.Time) bool {
+	domMatch := c.dom&(1<<t.Day()) != 0
+	dowMatch := c.dow&(1<<t.Weekday()) != 0
+	if c.domStar || c.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// The first time strictly after t that matches, or the zero time if there is none within 5 years.
+func (c *Cron) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.month&(1<<t.Month()) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !c.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if c.hour&(1<<t.Hour()) == 0 {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if c.minute&(1<<t.Minute()) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
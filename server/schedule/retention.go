@@ -0,0 +1,127 @@
+package schedule
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scheduled snapshots are named `scheduled-<unix seconds>`.  Only these are subject to the
+// retention policy, snapshots taken or uploaded by hand are never pruned.
+const SnapshotPrefix = "scheduled-"
+
+func SnapshotId(t time.Time) string {
+	return fmt.Sprintf("%s%d", SnapshotPrefix, t.Unix())
+}
+
+// The time of a scheduled snapshot, from its id.
+func ParseSnapshotId(id string) (time.Time, bool) {
+	unix, ok := strings.CutPrefix(id, SnapshotPrefix)
+	if !ok {
+		return time.Time{}, false
+	}
+	seconds, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0).UTC(), true
+}
+
+// Retention keeps the most recent snapshots, plus the newest snapshot of each of the most
+// recent days, weeks and months (in UTC).  A snapshot counts towards every rule it satisfies.
+// If no rule is set, nothing is pruned.
+type Retention struct {
+	KeepLast    int `json:"keep_last,omitempty"`
+	KeepDaily   int `json:"keep_daily,omitempty"`
+	KeepWeekly  int `json:"keep_weekly,omitempty"`
+	KeepMonthly int `json:"keep_monthly,omitempty"`
+}
+
+func (r Retention) IsZero() bool {
+	return r == Retention{}
+}
+
+// Whether this policy keeps at least every snapshot the other one keeps.
+func (r Retention) Keeps(other Retention) bool {
+	if r.IsZero() {
+		return true
+	}
+	return !other.IsZero() &&
+		r.KeepLast >= other.KeepLast &&
+		r.KeepDaily >= other.KeepDaily &&
+		r.KeepWeekly >= other.KeepWeekly &&
+		r.KeepMonthly >= other.KeepMonthly
+}
+
+func (r Retention) Validate() error {
+	if r.KeepLast < 0 || r.KeepDaily < 0 || r.KeepWeekly < 0 || r.KeepMonthly < 0 {
+		return fmt.Errorf("retention counts cannot be negative")
+	}
+	return nil
+}
+
+func (r Retention) String() string {
+	if r.IsZero() {
+		return "keep all"
+	}
+	return fmt.Sprintf("last %d, daily %d, weekly %d, monthly %d", r.KeepLast, r.KeepDaily, r.KeepWeekly, r.KeepMonthly)
+}
+
+// Select the snapshot ids to prune.  Ids that are not scheduled snapshots are ignored.
+func (r Retention) Prune(ids []string) []string {
+	if r.IsZero() {
+		return nil
+	}
+	type snapshot struct {
+		id   string
+		time time.Time
+	}
+	snapshots := []snapshot{}
+	for _, id := range ids {
+		if t, ok := ParseSnapshotId(id); ok {
+			snapshots = append(snapshots, snapshot{id, t})
+		}
+	}
+	// newest first
+	slices.SortFunc(snapshots, func(a, b snapshot) int {
+		return b.time.Compare(a.time)
+	})
+
+	keep := map[string]bool{}
+	for i := 0; i < len(snapshots) && i < r.KeepLast; i++ {
+		keep[snapshots[i].id] = true
+	}
+	keepPeriods := func(count int, period func(t time.Time) string) {
+		seen := map[string]bool{}
+		for _, s := range snapshots {
+			if len(seen) >= count {
+				return
+			}
+			p := period(s.time)
+			if !seen[p] {
+				seen[p] = true
+				keep[s.id] = true
+			}
+		}
+	}
+	keepPeriods(r.KeepDaily, func(t time.Time) string {
+		return t.Format(time.DateOnly)
+	})
+	keepPeriods(r.KeepWeekly, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-%d", year, week)
+	})
+	keepPeriods(r.KeepMonthly, func(t time.Time) string {
+		return t.Format("2006-01")
+	})
+
+	prune := []string{}
+	for _, s := range snapshots {
+		if !keep[s.id] {
+			prune = append(prune, s.id)
+		}
+	}
+	return prune
+}
@@ -0,0 +1,206 @@
+package schedule_test
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/cordialsys/panel/pkg/paths"
+	"github.com/cordialsys/panel/server/schedule"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCronNext(t *testing.T) {
+	at := func(value string) time.Time {
+		t, err := time.Parse(time.DateTime, value)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	for _, tc := range []struct {
+		spec     string
+		from     string
+		expected string
+	}{
+		{"0 3 * * *", "2026-10-16 02:59:30", "2026-10-16 03:00:00"},
+		{"0 3 * * *", "2026-10-16 03:00:00", "2026-10-17 03:00:00"},
+		{"*/15 * * * *", "2026-10-16 10:07:00", "2026-10-16 10:15:00"},
+		{"30 1-5/2 * * *", "2026-10-16 03:31:00", "2026-10-16 05:30:00"},
+		{"0 0 * * 0", "2026-10-16 12:00:00", "2026-10-18 00:00:00"},
+		{"0 0 * * 7", "2026-10-16 12:00:00", "2026-10-18 00:00:00"},
+		{"@monthly", "2026-12-15 00:00:00", "2027-01-01 00:00:00"},
+		{"0 0 29 2 *", "2026-03-01 00:00:00", "2028-02-29 00:00:00"},
+		// either day-of-month or day-of-week matches when both are restricted
+		{"0 0 1 * 1", "2026-10-16 00:00:00", "2026-10-19 00:00:00"},
+		{"0 12 1,15 6 *", "2026-06-02 00:00:00", "2026-06-15 12:00:00"},
+	} {
+		t.Run(tc.spec+" from "+tc.from, func(t *testing.T) {
+			cron, err := schedule.ParseCron(tc.spec)
+			require.NoError(t, err)
+			require.Equal(t, at(tc.expected), cron.Next(at(tc.from)))
+		})
+	}
+
+	for _, tc := range []struct {
+		spec  string
+		error string
+	}{
+		{"0 3 * *", "has 4 fields"},
+		{"60 * * * *", `invalid value "60" in cron minute field`},
+		{"* * 0 * *", "day-of-month field, must be 1-31"},
+		{"*/0 * * * *", "invalid step"},
+		{"5-1 * * * *", "invalid range"},
+		{"0 0 30 2 *", "never matches"},
+	} {
+		_, err := schedule.ParseCron(tc.spec)
+		require.ErrorContains(t, err, tc.error, tc.spec)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	start := time.Date(2026, 1, 1, 3, 0, 0, 0, time.UTC)
+	ids := []string{"manual-snapshot-1", "imported"}
+	// two snapshots a day for 90 days
+	for day := 0; day < 90; day++ {
+		for _, hour := range []int{0, 12} {
+			ids = append(ids, schedule.SnapshotId(start.AddDate(0, 0, day).Add(time.Duration(hour)*time.Hour)))
+		}
+	}
+	kept := func(retention schedule.Retention) []string {
+		prune := retention.Prune(ids)
+		return slices.DeleteFunc(slices.Clone(ids), func(id string) bool {
+			return slices.Contains(prune, id)
+		})
+	}
+
+	require.Equal(t, ids, kept(schedule.Retention{}))
+
+	last := kept(schedule.Retention{KeepLast: 3})
+	require.Equal(t, []string{
+		"manual-snapshot-1", "imported",
+		schedule.SnapshotId(start.AddDate(0, 0, 88).Add(12 * time.Hour)),
+		schedule.SnapshotId(start.AddDate(0, 0, 89)),
+		schedule.SnapshotId(start.AddDate(0, 0, 89).Add(12 * time.Hour)),
+	}, last)
+
+	// the newest of each day, week and month
+	policy := kept(schedule.Retention{KeepDaily: 2, KeepWeekly: 2, KeepMonthly: 3})
+	require.Equal(t, []string{
+		"manual-snapshot-1", "imported",
+		// january, february
+		schedule.SnapshotId(start.AddDate(0, 0, 30).Add(12 * time.Hour)),
+		schedule.SnapshotId(start.AddDate(0, 0, 58).Add(12 * time.Hour)),
+		// the end of the previous ISO week (sunday 2026-03-29)
+		schedule.SnapshotId(start.AddDate(0, 0, 87).Add(12 * time.Hour)),
+		// the last two days, the last of which is also the newest of the week and march
+		schedule.SnapshotId(start.AddDate(0, 0, 88).Add(12 * time.Hour)),
+		schedule.SnapshotId(start.AddDate(0, 0, 89).Add(12 * time.Hour)),
+	}, policy)
+	// only keeping as much as before, or everything, does not prune more
+	require.True(t, schedule.Retention{}.Keeps(schedule.Retention{KeepLast: 3}))
+	require.True(t, schedule.Retention{KeepLast: 3, KeepDaily: 1}.Keeps(schedule.Retention{KeepLast: 3}))
+	require.False(t, schedule.Retention{KeepLast: 3}.Keeps(schedule.Retention{}))
+	require.False(t, schedule.Retention{KeepLast: 1}.Keeps(schedule.Retention{KeepLast: 3}))
+	require.False(t, schedule.Retention{KeepLast: 10}.Keeps(schedule.Retention{KeepLast: 3, KeepMonthly: 1}))
+}
+
+type fakeLocation struct {
+	name string
+	ids  []string
+	err  error
+}
+
+func (l *fakeLocation) String() string { return l.name }
+
+func (l *fakeLocation) List(ctx context.Context, bak string) ([]string, error) {
+	return slices.Clone(l.ids), l.err
+}
+
+func (l *fakeLocation) Delete(ctx context.Context, bak string, id string) error {
+	l.ids = slices.DeleteFunc(l.ids, func(existing string) bool { return existing == id })
+	return nil
+}
+
+type fakeRunner struct {
+	notReady  error
+	snapshots []string
+	locations []*fakeLocation
+}
+
+func (r *fakeRunner) Ready(ctx context.Context) error {
+	return r.notReady
+}
+
+func (r *fakeRunner) Snapshot(ctx context.Context, bak string, id string) error {
+	r.snapshots = append(r.snapshots, bak+"/"+id)
+	for _, location := range r.locations {
+		location.ids = append(location.ids, id)
+	}
+	return nil
+}
+
+func (r *fakeRunner) Locations() []schedule.Location {
+	locations := []schedule.Location{}
+	for _, location := range r.locations {
+		locations = append(locations, location)
+	}
+	return locations
+}
+
+func TestRunSchedule(t *testing.T) {
+	store := schedule.NewStore(paths.PanelHome(t.TempDir()))
+	local := &fakeLocation{name: "local", ids: []string{"manual-snapshot-1"}}
+	remote := &fakeLocation{name: "s3"}
+	runner := &fakeRunner{locations: []*fakeLocation{local, remote}}
+	scheduler := schedule.NewScheduler(store, runner)
+	now := time.Date(2026, 10, 16, 3, 0, 0, 0, time.UTC)
+	scheduler.Now = func() time.Time { return now }
+
+	_, err := store.Put(schedule.Schedule{Bak: "age1bak", Cron: "0 3 * * *", Retention: schedule.Retention{KeepLast: 2}})
+	require.NoError(t, err)
+	_, err = store.Put(schedule.Schedule{Bak: "age1bak", Cron: "every day"})
+	require.ErrorContains(t, err, "has 2 fields")
+
+	runner.notReady = fmt.Errorf("treasury is inactive")
+	schedules, err := store.List()
+	require.NoError(t, err)
+	status := scheduler.RunSchedule(context.Background(), schedules[0])
+	require.Equal(t, schedule.ResultSkipped, status.LastResult)
+	require.Equal(t, "treasury is inactive", status.LastError)
+	require.Empty(t, runner.snapshots)
+
+	runner.notReady = nil
+	for day := 0; day < 3; day++ {
+		now = now.AddDate(0, 0, 1)
+		status = scheduler.RunSchedule(context.Background(), schedules[0])
+		require.Equal(t, schedule.ResultSuccess, status.LastResult, status.LastError)
+		require.Equal(t, schedule.SnapshotId(now), status.LastSnapshot)
+		require.Equal(t, now, *status.LastSuccess)
+	}
+	// one from each location
+	require.Equal(t, 2, status.Pruned)
+	require.Len(t, runner.snapshots, 3)
+	// the manual snapshot is never pruned
+	require.Equal(t, []string{"manual-snapshot-1", schedule.SnapshotId(now.AddDate(0, 0, -1)), schedule.SnapshotId(now)}, local.ids)
+	require.Equal(t, []string{schedule.SnapshotId(now.AddDate(0, 0, -1)), schedule.SnapshotId(now)}, remote.ids)
+
+	// a failure in one location does not stop the others
+	remote.err = fmt.Errorf("access denied")
+	now = now.AddDate(0, 0, 1)
+	status = scheduler.RunSchedule(context.Background(), schedules[0])
+	require.Equal(t, schedule.ResultFailed, status.LastResult)
+	require.Contains(t, status.LastError, "was taken, but retention failed")
+	require.Contains(t, status.LastError, "failed to list snapshots in s3: access denied")
+	require.Equal(t, 1, status.Pruned)
+
+	// the status is kept when the schedule is changed
+	require.NoError(t, store.SetStatus("age1bak", status))
+	updated, err := store.Put(schedule.Schedule{Bak: "age1bak", Cron: "@hourly"})
+	require.NoError(t, err)
+	require.Equal(t, status.LastSnapshot, updated.Status.LastSnapshot)
+	require.NoError(t, store.Delete("age1bak"))
+	require.ErrorIs(t, store.Delete("age1bak"), schedule.ErrNotFound)
+}
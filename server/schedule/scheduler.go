@@ -0,0 +1,212 @@
+package schedule
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+)
+
+// A place snapshots are kept, which the retention policy is applied to.
+type Location interface {
+	String() string
+	// Ids of the snapshots for the backup key
+	List(ctx context.Context, bak string) ([]string, error)
+	Delete(ctx context.Context, bak string, id string) error
+}
+
+// Runner takes the snapshots on behalf of the scheduler.
+type Runner interface {
+	// An error if snapshots cannot be taken right now, e.g. the treasury is stopped or restoring
+	Ready(ctx context.Context) error
+	Snapshot(ctx context.Context, bak string, id string) error
+	Locations() []Location
+}
+
+// The next run of a schedule, planned from the expression and jitter it was planned with.
+type plan struct {
+	cron   string
+	jitter time.Duration
+	fire   time.Time
+	start  time.Time
+}
+
+// Scheduler takes the configured snapshots in the background.
+type Scheduler struct {
+	store  *Store
+	runner Runner
+	wake   chan struct{}
+	plans  map[string]plan
+	Now    func() time.Time
+}
+
+func NewScheduler(store *Store, runner Runner) *Scheduler {
+	return &Scheduler{
+		store:  store,
+		runner: runner,
+		wake:   make(chan struct{}, 1),
+		plans:  map[string]plan{},
+		Now:    time.Now,
+	}
+}
+
+func (s *Scheduler) Store() *Store {
+	return s.store
+}
+
+// Plan the schedules again, after they have been changed.
+func (s *Scheduler) Reload() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run the scheduler until the context is done.  Runs are taken one at a time.
+func (s *Scheduler) Run(ctx context.Context) {
+	for {
+		wait := s.tick(ctx)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-s.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// Run any schedules that are due, returning how long to wait until the next one.
+func (s *Scheduler) tick(ctx context.Context) time.Duration {
+	// wake up regularly regardless, in case the clock jumps
+	wait := time.Minute
+	schedules, err := s.store.List()
+	if err != nil {
+		slog.Error("failed to load snapshot schedules", "error", err)
+		return wait
+	}
+	active := map[string]bool{}
+	for _, schedule := range schedules {
+		active[schedule.Bak] = true
+		now := s.Now()
+		p, ok := s.plans[schedule.Bak]
+		if !ok || p.cron != schedule.Cron || p.jitter != schedule.Jitter() {
+			p, err = s.plan(schedule, now)
+			if err != nil {
+				slog.Error("invalid snapshot schedule", "bak", schedule.Bak, "error", err)
+				continue
+			}
+		}
+		if !now.Before(p.start) {
+			schedule.Status = s.RunSchedule(ctx, schedule)
+			// plan from the missed fire time, unless the run took past the following one
+			next, _ := ParseCron(schedule.Cron)
+			p.fire = next.Next(p.fire)
+			if now = s.Now(); p.fire.Before(now) {
+				p.fire = next.Next(now)
+			}
+			p.start = p.fire.Add(randomJitter(p.jitter))
+		}
+		s.plans[schedule.Bak] = p
+		if schedule.Status.NextRun == nil || !schedule.Status.NextRun.Equal(p.start) {
+			start := p.start
+			schedule.Status.NextRun = &start
+			if err := s.store.SetStatus(schedule.Bak, schedule.Status); err != nil {
+				slog.Error("failed to save snapshot schedule status", "bak", schedule.Bak, "error", err)
+			}
+		}
+		wait = min(wait, p.start.Sub(s.Now()))
+	}
+	for bak := range s.plans {
+		if !active[bak] {
+			delete(s.plans, bak)
+		}
+	}
+	return max(wait, 0)
+}
+
+func (s *Scheduler) plan(schedule Schedule, now time.Time) (plan, error) {
+	cron, err := ParseCron(schedule.Cron)
+	if err != nil {
+		return plan{}, err
+	}
+	fire := cron.Next(now)
+	return plan{
+		cron:   schedule.Cron,
+		jitter: schedule.Jitter(),
+		fire:   fire,
+		start:  fire.Add(randomJitter(schedule.Jitter())),
+	}, nil
+}
+
+func randomJitter(jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return 0
+	}
+	return rand.N(jitter)
+}
+
+// Take a snapshot for the schedule and apply its retention policy, returning the new status.
+func (s *Scheduler) RunSchedule(ctx context.Context, schedule Schedule) Status {
+	status := schedule.Status
+	now := s.Now().UTC()
+	status.LastRun = &now
+	status.LastError = ""
+	status.Pruned = 0
+
+	if err := s.runner.Ready(ctx); err != nil {
+		slog.Info("skipping scheduled snapshot", "bak", schedule.Bak, "reason", err)
+		status.LastResult = ResultSkipped
+		status.LastError = err.Error()
+		return status
+	}
+	id := SnapshotId(now)
+	slog.Info("taking scheduled snapshot", "bak", schedule.Bak, "id", id)
+	if err := s.runner.Snapshot(ctx, schedule.Bak, id); err != nil {
+		slog.Error("scheduled snapshot failed", "bak", schedule.Bak, "id", id, "error", err)
+		status.LastResult = ResultFailed
+		status.LastError = err.Error()
+		return status
+	}
+	status.LastResult = ResultSuccess
+	status.LastSuccess = &now
+	status.LastSnapshot = id
+
+	pruned, err := s.prune(ctx, schedule)
+	status.Pruned = pruned
+	if err != nil {
+		slog.Error("failed to apply snapshot retention", "bak", schedule.Bak, "error", err)
+		status.LastResult = ResultFailed
+		status.LastError = fmt.Sprintf("snapshot %s was taken, but retention failed: %v", id, err)
+	}
+	return status
+}
+
+// Apply the retention policy to every location, continuing past failures.
+func (s *Scheduler) prune(ctx context.Context, schedule Schedule) (int, error) {
+	if schedule.Retention.IsZero() {
+		return 0, nil
+	}
+	pruned := 0
+	errs := []error{}
+	for _, location := range s.runner.Locations() {
+		ids, err := location.List(ctx, schedule.Bak)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to list snapshots in %s: %v", location, err))
+			continue
+		}
+		for _, id := range schedule.Retention.Prune(ids) {
+			if err := location.Delete(ctx, schedule.Bak, id); err != nil {
+				errs = append(errs, fmt.Errorf("failed to delete snapshot %s from %s: %v", id, location, err))
+				continue
+			}
+			slog.Info("pruned snapshot", "bak", schedule.Bak, "id", id, "location", location.String())
+			pruned++
+		}
+	}
+	return pruned, errors.Join(errs...)
+}
@@ -0,0 +1,171 @@
+package schedule
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cordialsys/panel/pkg/paths"
+)
+
+var ErrNotFound = errors.New("schedule not found")
+
+type Result string
+
+const (
+	ResultSuccess Result = "success"
+	ResultFailed  Result = "failed"
+	// The treasury was stopped or restoring, so no snapshot was taken
+	ResultSkipped Result = "skipped"
+)
+
+// Recurring snapshots for a backup key.
+type Schedule struct {
+	// Backup key (age recipient) the snapshots are encrypted to
+	Bak string `json:"bak"`
+	// Cron expression in UTC, see `Cron`
+	Cron string `json:"cron"`
+	// Delay each run by a random amount up to this, so nodes do not snapshot in lockstep
+	JitterSeconds uint64    `json:"jitter_seconds,omitempty"`
+	Retention     Retention `json:"retention,omitzero"`
+
+	Status Status `json:"status"`
+}
+
+func (s *Schedule) Jitter() time.Duration {
+	return time.Duration(s.JitterSeconds) * time.Second
+}
+
+func (s *Schedule) Validate() error {
+	if s.Bak == "" {
+		return fmt.Errorf("bak is required")
+	}
+	if _, err := ParseCron(s.Cron); err != nil {
+		return err
+	}
+	return s.Retention.Validate()
+}
+
+type Status struct {
+	NextRun *time.Time `json:"next_run,omitempty"`
+	LastRun *time.Time `json:"last_run,omitempty"`
+	// Last time a snapshot was taken
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastResult  Result     `json:"last_result,omitempty"`
+	// Why the last run failed or was skipped
+	LastError    string `json:"last_error,omitempty"`
+	LastSnapshot string `json:"last_snapshot,omitempty"`
+	// Snapshots removed by the retention policy in the last run
+	Pruned int `json:"pruned,omitempty"`
+}
+
+type schedulesFile struct {
+	Schedules []Schedule `json:"schedules"`
+}
+
+// Store persists the schedules and their status in the panel directory.
+type Store struct {
+	lock     sync.Mutex
+	panelDir paths.PanelHome
+}
+
+func NewStore(panelDir paths.PanelHome) *Store {
+	return &Store{panelDir: panelDir}
+}
+
+func (s *Store) load() ([]Schedule, error) {
+	schedulesBz, err := os.ReadFile(s.panelDir.SchedulesFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Schedule{}, nil
+		}
+		return nil, err
+	}
+	var file schedulesFile
+	if err := json.Unmarshal(schedulesBz, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", s.panelDir.SchedulesFile(), err)
+	}
+	if file.Schedules == nil {
+		file.Schedules = []Schedule{}
+	}
+	return file.Schedules, nil
+}
+
+func (s *Store) save(schedules []Schedule) error {
+	schedulesBz, err := json.MarshalIndent(schedulesFile{Schedules: schedules}, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(s.panelDir.String(), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.panelDir.SchedulesFile(), schedulesBz, 0600)
+}
+
+func (s *Store) List() ([]Schedule, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.load()
+}
+
+// Create or replace the schedule for a backup key, keeping the status of its last run.
+func (s *Store) Put(schedule Schedule) (*Schedule, error) {
+	if err := schedule.Validate(); err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	schedules, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	idx := slices.IndexFunc(schedules, func(existing Schedule) bool { return existing.Bak == schedule.Bak })
+	if idx < 0 {
+		schedule.Status = Status{}
+		schedules = append(schedules, schedule)
+	} else {
+		schedule.Status = schedules[idx].Status
+		// the next run is planned again from the new expression
+		schedule.Status.NextRun = nil
+		schedules[idx] = schedule
+	}
+	if err := s.save(schedules); err != nil {
+		return nil, err
+	}
+	return &schedule, nil
+}
+
+func (s *Store) Delete(bak string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	schedules, err := s.load()
+	if err != nil {
+		return err
+	}
+	idx := slices.IndexFunc(schedules, func(existing Schedule) bool { return existing.Bak == bak })
+	if idx < 0 {
+		return ErrNotFound
+	}
+	return s.save(slices.Delete(schedules, idx, idx+1))
+}
+
+// Record the status of a schedule, if it still exists.
+func (s *Store) SetStatus(bak string, status Status) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	schedules, err := s.load()
+	if err != nil {
+		return err
+	}
+	idx := slices.IndexFunc(schedules, func(existing Schedule) bool { return existing.Bak == bak })
+	if idx < 0 {
+		return ErrNotFound
+	}
+	schedules[idx].Status = status
+	return s.save(schedules)
+}
@@ -1,15 +1,22 @@
 package server
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
 	"runtime/debug"
+	"syscall"
+	"time"
 
-	"filippo.io/age"
 	"github.com/cordialsys/panel/pkg/paths"
-	_ "github.com/cordialsys/panel/pkg/plog"
+	"github.com/cordialsys/panel/pkg/plog"
+	"github.com/cordialsys/panel/pkg/secret"
+	"github.com/cordialsys/panel/server/approvals"
+	"github.com/cordialsys/panel/server/audit"
+	"github.com/cordialsys/panel/server/auth"
 	"github.com/cordialsys/panel/server/endpoints"
 	"github.com/cordialsys/panel/server/panel"
 	"github.com/cordialsys/panel/server/servererrors"
@@ -17,21 +24,26 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/cors"
 )
 
+// Audit event recorded when a cached secret is reloaded with a different value
+const EventSecretChanged = "secret.changed"
+
 // Server represents the panel server
 type Server struct {
 	app      *fiber.App
 	params   *panel.Panel
-	identity *age.X25519Identity
+	auditLog *audit.Log
 	Options
 }
 
 // Options holds server configuration
 type Options struct {
-	ListenAddr     string
-	TreasuryHome   string
-	BinaryDir      string
-	PanelDir       string
+	ListenAddr   string
+	TreasuryHome string
+	BinaryDir    string
+	PanelDir     string
+	// API key to store in the panel directory, or a reference to load it from
 	ApiKey         string
+	ApiKeyRef      secret.Secret
 	SupervisorHome string
 	Triples        uint64
 	BackupDir      string
@@ -39,42 +51,88 @@ type Options struct {
 	ApiNode        bool
 	TreasuryUser   string
 	WebDir         string
+	// Pass secrets to cord/signer in the environment, for versions that cannot read them from a pipe
+	SecretsInEnv bool
+	// Cache remote secrets (vault, gcp, aws) for this long, 0 to disable
+	SecretCacheTtl time.Duration
+	// Use cached secrets past their TTL if the secret manager cannot be reached
+	SecretCacheStaleOnError bool
+	// How long past their TTL cached secrets may be used, defaults to `secret.DefaultMaxStale`
+	SecretCacheMaxStale time.Duration
+
+	// TLS certificate and key to serve with.  A self-signed certificate is generated if not set.
+	TlsCert string
+	TlsKey  string
+	// If set, clients must present a certificate signed by this CA.
+	ClientCA string
+	// Serve plain HTTP, e.g. when behind a TLS terminating proxy.
+	NoTls bool
 }
 
 func loadPanel(panelDir paths.PanelHome) (*panel.Panel, bool, error) {
-	var existingPanel panel.Panel
 	if _, err := os.Stat(panelDir.PanelFile()); err == nil {
-		panelBz, err := os.ReadFile(panelDir.PanelFile())
-		if err != nil {
-			return nil, false, err
-		}
-		err = json.Unmarshal(panelBz, &existingPanel)
+		existingPanel, err := panel.Load(panelDir)
 		if err != nil {
 			return nil, false, err
 		}
-		return &existingPanel, true, nil
+		return existingPanel, true, nil
 	}
 	return nil, false, nil
 }
 
-func loadIdentity(panelDir paths.PanelHome) (*age.X25519Identity, bool, error) {
-	if _, err := os.Stat(panelDir.IdentityFile()); err == nil {
-		panelBz, err := os.ReadFile(panelDir.IdentityFile())
-		if err != nil {
-			return nil, false, err
+// The long-lived identity previously used to decrypt submitted secret phrases.  Phrases are now
+// encrypted to ephemeral session recipients, so the identity is removed rather than left to leak.
+func removeLegacyIdentity(panelDir paths.PanelHome) error {
+	err := os.Remove(panelDir.IdentityFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err == nil {
+		slog.Info("removed legacy identity", "path", panelDir.IdentityFile())
+	}
+	return err
+}
+
+// Register the secrets known to the panel for redaction, before anything may log them.
+// Loading a secret registers it.
+func registerSecrets(params *panel.Panel) {
+	for _, user := range params.Users {
+		plog.AddSecret(user.WebInvite, user.CliInvite)
+	}
+	if params.HasApiKey() {
+		if _, err := params.LoadApiKey(); err != nil {
+			slog.Warn("failed to load API key", "error", err)
 		}
-		identity, err := age.ParseX25519Identity(string(panelBz))
+	}
+	if !params.EarSecret.IsZero() {
+		earSecret, err := params.EarSecret.Load()
 		if err != nil {
-			return nil, false, err
+			slog.Warn("failed to load EAR secret", "error", err)
 		}
-		return identity, true, nil
+		plog.AddSecret(endpoints.FormatMnemonic(earSecret))
 	}
-	return nil, false, nil
 }
 
-func saveIdentity(panelDir paths.PanelHome, identity *age.X25519Identity) error {
-	identityBz := identity.String()
-	return os.WriteFile(panelDir.IdentityFile(), []byte(identityBz), 0644)
+// Cache remote secrets, recording an audit event when one is found to have changed remotely
+// (e.g. rotated outside of the panel).
+func newSecretResolver(args Options, auditLog *audit.Log) *secret.Resolver {
+	resolver := secret.NewResolver(args.SecretCacheTtl)
+	resolver.StaleOnError = args.SecretCacheStaleOnError
+	if args.SecretCacheMaxStale > 0 {
+		resolver.MaxStale = args.SecretCacheMaxStale
+	}
+	resolver.OnChange = func(ref secret.Secret) {
+		secretType, _ := ref.Type()
+		slog.Warn("secret value changed remotely", "type", secretType)
+		_, err := auditLog.AppendEvent(EventSecretChanged, map[string]any{
+			"type": secretType,
+			"ref":  plog.Redact(string(ref)),
+		})
+		if err != nil {
+			slog.Error("failed to record secret change", "error", err)
+		}
+	}
+	return resolver
 }
 
 // New creates a new server instance
@@ -100,8 +158,15 @@ func New(args Options) *Server {
 	if args.PanelDir != "" {
 		params.PanelDir = paths.PanelHome(args.PanelDir)
 	}
+	// `keyring:<id>` secrets, including the sealed-state key, resolve from the panel directory
+	secret.KeyringHome = params.PanelDir
+	if args.ApiKeyRef != "" {
+		params.ApiKeyRef = args.ApiKeyRef
+	}
 	if args.ApiKey != "" {
-		params.ApiKey = args.ApiKey
+		if err := params.StoreApiKey(args.ApiKey); err != nil {
+			slog.Error("failed to store API key", "error", err)
+		}
 	}
 	if args.SupervisorHome != "" {
 		params.SupervisorHome = paths.SupervisorHome(args.SupervisorHome)
@@ -123,7 +188,8 @@ func New(args Options) *Server {
 
 	existingPanel, exists, err := loadPanel(params.PanelDir)
 	if err != nil {
-		slog.Error("failed to load panel", "error", err)
+		// do not overwrite the existing panel, e.g. if the sealed-state secret is not available
+		panic(fmt.Errorf("failed to load panel: %v", err))
 	}
 	if exists {
 		// load latest panel configuration
@@ -152,6 +218,17 @@ func New(args Options) *Server {
 		}
 		params = existingPanel
 
+		migrated, err := params.MigrateApiKey()
+		if err != nil {
+			slog.Error("failed to migrate API key", "error", err)
+		}
+		if migrated {
+			slog.Info("moved plaintext API key out of panel configuration", "path", params.PanelDir.ApiKeyFile())
+			if err := panel.Save(params); err != nil {
+				slog.Error("failed to save panel", "error", err)
+			}
+		}
+
 	} else {
 		// write out so information is saved + env is accessible by systemd services
 		slog.Info("saving new panel", "path", params.PanelDir.PanelFile())
@@ -161,19 +238,24 @@ func New(args Options) *Server {
 		}
 	}
 
-	identity, exists, err := loadIdentity(params.PanelDir)
+	if err := removeLegacyIdentity(params.PanelDir); err != nil {
+		slog.Error("failed to remove legacy identity", "error", err)
+	}
+	secret.DefaultVaultAuth = params.Vault
+	auditLog := audit.Open(params.PanelDir)
+	if args.SecretCacheTtl > 0 {
+		secret.DefaultResolver = newSecretResolver(args, auditLog)
+	}
+	registerSecrets(params)
+	params.SecretsInEnv = args.SecretsInEnv
+
+	// Create the first admin token on first boot, so the local CLI can authenticate.
+	created, err := auth.EnsureInitial(params.PanelDir)
 	if err != nil {
-		slog.Error("failed to load identity", "error", err)
+		slog.Error("failed to create initial admin token", "error", err)
 	}
-	if !exists {
-		identity, err = age.GenerateX25519Identity()
-		if err != nil {
-			panic(err)
-		}
-		err = saveIdentity(params.PanelDir, identity)
-		if err != nil {
-			slog.Error("failed to save identity", "error", err)
-		}
+	if created {
+		slog.Info("created initial admin token", "path", params.PanelDir.AdminTokenFile())
 	}
 
 	// Add the binary path to the PATH environment variable, so any `exec`'d processes
@@ -188,7 +270,7 @@ func New(args Options) *Server {
 	return &Server{
 		app,
 		params,
-		identity,
+		auditLog,
 		args,
 	}
 }
@@ -197,9 +279,10 @@ func New(args Options) *Server {
 func (s *Server) setupRoutes() {
 	// Add CORS middleware for development
 	s.app.Use(cors.New(cors.Config{
-		AllowOrigins: "http://localhost:3000,https://localhost:3000",
-		AllowMethods: "GET,POST,HEAD,PUT,DELETE,PATCH,OPTIONS",
-		AllowHeaders: "Origin,Content-Type,Accept,Authorization",
+		AllowOrigins:  "http://localhost:3000,https://localhost:3000",
+		AllowMethods:  "GET,POST,HEAD,PUT,DELETE,PATCH,OPTIONS",
+		AllowHeaders:  "Origin,Content-Type,Accept,Authorization," + approvals.HeaderApproval,
+		ExposeHeaders: approvals.HeaderApproval,
 	}))
 
 	// Add middleware
@@ -220,40 +303,61 @@ func (s *Server) setupRoutes() {
 		return c.Next()
 	})
 
-	// Health check
+	// Health check, does not require authentication.
+	// If a token is passed, it is verified so clients can use this to check their credentials.
 	s.app.Get("/health", func(c *fiber.Ctx) error {
+		if token, ok := auth.BearerToken(c); ok {
+			if _, err := auth.Verify(s.params.PanelDir, token); err != nil {
+				return servererrors.Unauthorizedf("invalid admin token")
+			}
+		}
 		return c.SendString("OK")
 	})
 
-	api := s.app.Group("/v1")
+	// All API endpoints require an admin token, and all state-changing requests are audited
+	api := s.app.Group("/v1", auth.New(s.params.PanelDir), audit.New(s.auditLog))
+
+	// Each endpoint requires a minimum role of the caller
+	viewer := auth.Require(auth.RoleViewer)
+	operator := auth.Require(auth.RoleOperator)
+	custodian := auth.Require(auth.RoleCustodian)
 
 	// Root endpoint
-	api.Get("/", func(c *fiber.Ctx) error {
+	api.Get("/", viewer, func(c *fiber.Ctx) error {
 		return c.JSON(fiber.Map{
 			"message": "Welcome to the Panel Server",
 			"status":  "running",
 		})
 	})
-	endpointHandler := endpoints.NewEndpoints(s.params, s.identity)
+	endpointHandler := endpoints.NewEndpoints(s.params)
+
+	// Take scheduled snapshots in the background (see /backup/schedule)
+	go endpointHandler.Scheduler().Run(context.Background())
+
+	// Irreversible operations require a second admin to approve (see /approvals)
+	approvalStore := endpointHandler.Approvals()
+	twoPerson := func(action string) fiber.Handler {
+		return approvals.Require(approvalStore, action, nil)
+	}
 
 	// POST /activate/api-key {api-key}
 	// - test API key, then store it
 	// - indicate if this treasury has connector enabled or not.
-	api.Post("/activate/api-key", endpointHandler.ActivateApiKey)
+	api.Post("/activate/api-key", custodian, endpointHandler.ActivateApiKey)
 
 	// POST /activate/binaries
 	// - download binaries needed (treasury, cord, signer)
-	api.Post("/activate/binaries", endpointHandler.ActivateBinaries)
+	api.Post("/activate/binaries", operator, endpointHandler.ActivateBinaries)
 
 	// POST /activate/network
 	// - Enrolls the VPN
-	api.Post("/activate/network", endpointHandler.ActivateNetwork)
+	api.Post("/activate/network", operator, endpointHandler.ActivateNetwork)
 
 	// - Configure the backup keys (warning: this may only be done once, otherwise have to start over.)
-	api.Post("/activate/backup", endpointHandler.ActivateBackup)
+	api.Post("/activate/backup", custodian, endpointHandler.ActivateBackup)
 
 	// - Configure OTEL collection (optional, defaults to true)
-	api.Post("/activate/otel", endpointHandler.ActivateOtel)
+	api.Post("/activate/otel", operator, endpointHandler.ActivateOtel)
 
 	// - Check if the node is activated
 	// api.Post("/activate/check", endpointHandler.IsActivated)
@@ -263,7 +367,7 @@ func (s *Server) setupRoutes() {
 	// - Generate a treasury, if not yet generated (error if there is a treasury already).
 	// - Update the admin resource
 	// - may use backup API to download a snapshot
-	api.Post("/treasury", endpointHandler.GenerateTreasury)
+	api.Post("/treasury", custodian, endpointHandler.GenerateTreasury)
 
 	// POST /treasury/snapshot
 	// - generate a snapshot on demand (treasury must be completed)
@@ -272,30 +376,38 @@ func (s *Server) setupRoutes() {
 
 	// Also have DELETE /treasury
 	// - Deletes locally
-	api.Delete("/treasury", endpointHandler.DeleteTreasury)
+	// - Deleting the supervisor config as well requires approval
+	api.Delete("/treasury", custodian, approvals.Require(approvalStore, "delete treasury and supervisor config", func(c *fiber.Ctx) bool {
+		_, deleteSupervisor := c.Queries()["supervisor"]
+		return deleteSupervisor
+	}), endpointHandler.DeleteTreasury)
 
 	// POST /treasury/complete
 	// - Try to complete the treasury, returning `FAILED_PRECONDITION` if not all nodes are updated yet.
 	// - Run peer setup user Node.host fields
 	// - Run `cord genesis complete`
 	// - Run `cord use-image ...`
-	api.Post("/treasury/complete", endpointHandler.PostTreasuryComplete)
-	api.Post("/treasury/complete-and-start", endpointHandler.PostTreasuryCompleteAndStart)
+	api.Post("/treasury/complete", operator, endpointHandler.PostTreasuryComplete)
+	api.Post("/treasury/complete-and-start", operator, endpointHandler.PostTreasuryCompleteAndStart)
 
 	// Get the treasury init file produced (not really needed, but for debugging)
-	api.Get("/treasury/init", endpointHandler.GetTreasuryInit)
+	api.Get("/treasury/init", viewer, endpointHandler.GetTreasuryInit)
 
 	// Get the panel settings.  Some of these are set from activation endpoints, others are set by VM/cli-args.
-	api.Get("/panel", endpointHandler.GetPanel)
+	api.Get("/panel", viewer, endpointHandler.GetPanel)
 	// EAR management
-	api.Put("/panel/ear", endpointHandler.SetEncryptionAtRest)
-	api.Delete("/panel/ear", endpointHandler.DeleteEncryptionAtRest)
+	api.Put("/panel/ear", custodian, endpointHandler.SetEncryptionAtRest)
+	api.Delete("/panel/ear", custodian, twoPerson("delete encryption at rest"), endpointHandler.DeleteEncryptionAtRest)
+	// Generate a new EAR phrase, store it in the secret backend and re-encrypt signer.db
+	api.Post("/panel/ear/rotate", custodian, endpointHandler.RotateEncryptionAtRest)
+	// Gate for the local `panel reset` command
+	api.Post("/panel/reset", custodian, twoPerson("reset panel"), endpointHandler.ApproveReset)
 
 	/// USER MANAGEMENT
 	// - Available users can be seen from the admin API
 	// - The user can select users by posting them to the Panel resource
 	// Transparently forwards to the admin API
-	api.Get("/admin/users", endpointHandler.AdminUsers)
+	api.Get("/admin/users", operator, endpointHandler.AdminUsers)
 
 	// This activates the target blueprint
 	// - Generates /etc/panel/blueprint.csl
@@ -305,31 +417,31 @@ func (s *Server) setupRoutes() {
 	// - Starts blueprint.service (runs `treasury script -f /etc/panel/blueprint.csl`)
 	// - Waiting for blueprint.service to finish
 	// (can see output from /services/blueprint.service/logs)
-	api.Post("/panel/seal", endpointHandler.SealPanel)
+	api.Post("/panel/seal", custodian, endpointHandler.SealPanel)
 
 	// Get treasury resource from the node's treasury API
-	api.Get("/treasury", endpointHandler.GetTreasury)
+	api.Get("/treasury", viewer, endpointHandler.GetTreasury)
 	// Get treasury health endpoint
-	api.Get("/treasury/healthy", endpointHandler.GetTreasuryHealth)
+	api.Get("/treasury/healthy", viewer, endpointHandler.GetTreasuryHealth)
 	// Get configured treasury image
-	api.Get("/treasury/image", endpointHandler.GetSupervisorImage)
+	api.Get("/treasury/image", viewer, endpointHandler.GetSupervisorImage)
 	// Set treasury image, possibly overriding the existing image
-	api.Post("/treasury/image", endpointHandler.PostSupervisorImage)
+	api.Post("/treasury/image", custodian, endpointHandler.PostSupervisorImage)
 	// Delete the current treasury image (possibly reseting to the treasury initial version if regenerating the treasury.)
-	api.Delete("/treasury/image", endpointHandler.DeleteSupervisorImage)
+	api.Delete("/treasury/image", custodian, endpointHandler.DeleteSupervisorImage)
 	// Get treasury config ($TREASURY_HOME/treasury.toml)
-	api.Get("/treasury/config", endpointHandler.GetTreasuryConfig)
+	api.Get("/treasury/config", viewer, endpointHandler.GetTreasuryConfig)
 	// Useful for re-syncing the peers based on the admin API, or manual input.
-	api.Post("/treasury/peers/sync", endpointHandler.SyncTreasuryPeers)
+	api.Post("/treasury/peers/sync", operator, endpointHandler.SyncTreasuryPeers)
 
-	// Not needed, but may be useful for debugging.
-	api.Get("/exists", endpointHandler.Stat)
-	api.Get("/ls", endpointHandler.Ls)
+	// Useful for debugging installs: metadata of files within the panel managed directories only.
+	api.Get("/diagnostics/files", operator, endpointHandler.ListDiagnosticsRoots)
+	api.Get("/diagnostics/files/:root", operator, endpointHandler.ListDiagnosticsFiles)
 
 	// Download binaries + verify signatures
-	api.Get("/binaries/:binary", endpointHandler.GetBinaryVersion)
-	api.Get("/binaries", endpointHandler.GetBinaryVersions)
-	api.Post("/binaries/:binary/versions/:version/install", endpointHandler.Install)
+	api.Get("/binaries/:binary", viewer, endpointHandler.GetBinaryVersion)
+	api.Get("/binaries", viewer, endpointHandler.GetBinaryVersions)
+	api.Post("/binaries/:binary/versions/:version/install", operator, endpointHandler.Install)
 
 	// Generate start/stop/restart service endpoints
 	// Available services:
@@ -337,44 +449,76 @@ func (s *Server) setupRoutes() {
 	// - start-treasury.service (keeps trying to complete install, waiting on all peers to activate).
 	// - docker.service (for troubleshooting)
 	// - panel.service (readonly)
-	api.Post("/services/:service/:action", endpointHandler.UpdateService)
-	api.Get("/services/:service", endpointHandler.GetService)
-	api.Get("/services/:service/logs", endpointHandler.GetServiceLogs)
-	api.Get("/containers/:container/logs", endpointHandler.GetContainerLogs)
-	api.Get("/services", endpointHandler.ListServices)
-	api.Get("/logs", endpointHandler.Logs) // redundant with service logs if panel is running via systemd
+	api.Post("/services/:service/:action", operator, endpointHandler.UpdateService)
+	api.Get("/services/:service", viewer, endpointHandler.GetService)
+	api.Get("/services/:service/logs", viewer, endpointHandler.GetServiceLogs)
+	api.Get("/containers/:container/logs", viewer, endpointHandler.GetContainerLogs)
+	api.Get("/services", viewer, endpointHandler.ListServices)
+	api.Get("/logs", operator, endpointHandler.Logs) // redundant with service logs if panel is running via systemd
 
 	///// BOOTC - for managing VM updates
 	// Get bootc status (`bootc status --format json`)
-	api.Get("/bootc/status", endpointHandler.BootcStatus)
+	api.Get("/bootc/status", viewer, endpointHandler.BootcStatus)
 	// Check if an update is available, but don't stage it (`bootc upgrade --check`)
-	api.Post("/bootc/upgrade/check", endpointHandler.BootcCheck)
+	api.Post("/bootc/upgrade/check", operator, endpointHandler.BootcCheck)
 	// Stage an update for next boot (`bootc upgrade`)
-	api.Post("/bootc/upgrade/stage", endpointHandler.BootcStage)
+	api.Post("/bootc/upgrade/stage", operator, endpointHandler.BootcStage)
 	// Apply an update, rebooting the VM (`bootc upgrade --apply`)
-	api.Post("/bootc/upgrade/apply", endpointHandler.BootcUpgradeApply)
+	api.Post("/bootc/upgrade/apply", custodian, endpointHandler.BootcUpgradeApply)
 	// Stage a rollback for next boot (`bootc rollback`)
-	api.Post("/bootc/rollback/stage", endpointHandler.BootcRollbackStage)
+	api.Post("/bootc/rollback/stage", operator, endpointHandler.BootcRollbackStage)
 	// Apply a rollback, rebooting the VM (`bootc rollback --apply`)
-	api.Post("/bootc/rollback/apply", endpointHandler.BootcRollbackApply)
+	api.Post("/bootc/rollback/apply", custodian, twoPerson("apply bootc rollback"), endpointHandler.BootcRollbackApply)
 
 	// Backup / recovery
-	api.Get("/s3/objects", endpointHandler.ListObjects)
-	api.Get("/s3/object", endpointHandler.DownloadObject)
-
+	api.Get("/s3/objects", operator, endpointHandler.ListObjects)
+	api.Get("/s3/object", operator, endpointHandler.DownloadObject)
+
+	// snapshots in the backup bucket, with the info of each
+	api.Get("/backup/snapshots", viewer, endpointHandler.ListBackupSnapshots)
+	// sign and write the missing sidecars of snapshots
+	api.Post("/backup/snapshots/sidecars", operator, endpointHandler.BackfillSidecars)
+	// endorse the sidecar signing key with a bak, so a rebuilt panel trusts the sidecars
+	api.Post("/backup/snapshots/endorse", custodian, endpointHandler.EndorseSigningKey)
 	// import a snapshot
-	api.Put("/backup/snapshot/:id", endpointHandler.UploadSnapshot)
+	api.Put("/backup/snapshot/:id", operator, endpointHandler.UploadSnapshot)
 	// generate a snapshot
-	api.Post("/backup/snapshot/:id", endpointHandler.TakeSnapshot)
+	api.Post("/backup/snapshot/:id", operator, endpointHandler.TakeSnapshot)
+	// keep snapshots and key backups in an S3-compatible bucket instead of the backup service
+	api.Put("/backup/destination", custodian, twoPerson("change backup destination"), endpointHandler.SetBackupDestination)
+	api.Delete("/backup/destination", custodian, twoPerson("change backup destination"), endpointHandler.DeleteBackupDestination)
+	api.Post("/backup/destination/test", operator, endpointHandler.TestBackupDestination)
+	// further destinations (directories or buckets) that uploads are copied to
+	api.Put("/backup/replicas/:name", custodian, twoPerson("change backup replica"), endpointHandler.PutBackupReplica)
+	api.Delete("/backup/replicas/:name", custodian, twoPerson("change backup replica"), endpointHandler.DeleteBackupReplica)
+	api.Get("/backup/replication", viewer, endpointHandler.GetReplication)
+	api.Post("/backup/reconcile", operator, endpointHandler.ReconcileBackups)
+	// recurring snapshots per backup key, with a retention policy and the status of the last run
+	api.Get("/backup/schedule", viewer, endpointHandler.ListSchedules)
+	// retention prunes the bucket and the local snapshots, so pruning more needs approval
+	scheduleApproval := approvals.Require(approvalStore, "change snapshot schedule", endpointHandler.ScheduleNeedsApproval)
+	api.Put("/backup/schedule/:bak", custodian, scheduleApproval, endpointHandler.PutSchedule)
+	api.Delete("/backup/schedule/:bak", custodian, scheduleApproval, endpointHandler.DeleteSchedule)
+	// Mint an ephemeral recipient to encrypt a secret phrase to, for one of the restore operations
+	api.Post("/sessions/recipient", custodian, endpointHandler.CreateSessionRecipient)
 	// restore from a (uploaded) snapshot
-	api.Post("/backup/restore", endpointHandler.RestoreFromSnapshot)
+	api.Post("/backup/restore", custodian, endpointHandler.HoldSessionForApproval, twoPerson("restore from snapshot"), endpointHandler.RestoreFromSnapshot)
 	// restore missing keys
-	api.Post("/backup/restore-missing-keys", endpointHandler.RestoreMissingKeys)
+	api.Post("/backup/restore-missing-keys", custodian, endpointHandler.RestoreMissingKeys)
+
+	// Two-person approvals for irreversible operations
+	api.Get("/approvals", viewer, endpointHandler.ListApprovals)
+	api.Get("/approvals/:id", viewer, endpointHandler.GetApproval)
+	api.Post("/approvals/:id/approve", custodian, endpointHandler.Approve)
+	api.Delete("/approvals/:id", operator, endpointHandler.CancelApproval)
+
+	// Audit log of state-changing requests (`panel audit verify` checks the hash chain)
+	api.Get("/audit", operator, endpointHandler.ListAudit)
 
 	// TODO:
 	// - More endpoints to manage vpn/netbird?
 
-	api.Get("/test-panic", func(c *fiber.Ctx) error {
+	api.Get("/test-panic", operator, func(c *fiber.Ctx) error {
 		panic("test panic")
 	})
 
@@ -387,10 +531,56 @@ func (s *Server) setupRoutes() {
 
 }
 
-// Start begins listening for requests
+// Start begins listening for requests, until SIGINT or SIGTERM
 func (s *Server) Start() error {
 	s.setupRoutes()
+	s.shutdownOnSignal()
+	defer func() {
+		// zero the cached secrets before exiting
+		if secret.DefaultResolver != nil {
+			secret.DefaultResolver.Purge()
+		}
+	}()
+	return s.listen()
+}
+
+func (s *Server) shutdownOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		slog.Info("shutting down", "signal", sig.String())
+		if err := s.app.Shutdown(); err != nil {
+			slog.Error("failed to shut down", "error", err)
+		}
+	}()
+}
+
+func (s *Server) listen() error {
+
+	if s.NoTls {
+		slog.Warn("TLS is disabled, serving plain HTTP")
+		fmt.Printf("Starting server on %s\n", s.ListenAddr)
+		return s.app.Listen(s.ListenAddr)
+	}
+
+	cert, err := LoadOrGenerateCertificate(s.params.PanelDir, s.TlsCert, s.TlsKey)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	tlsConfig, err := newTlsConfig(cert, s.ClientCA)
+	if err != nil {
+		return err
+	}
+	ln, err := tls.Listen("tcp", s.ListenAddr, tlsConfig)
+	if err != nil {
+		return err
+	}
+	if s.ClientCA != "" {
+		slog.Info("requiring client certificates", "ca", s.ClientCA)
+	}
 
 	fmt.Printf("Starting server on %s\n", s.ListenAddr)
-	return s.app.Listen(s.ListenAddr)
+	fmt.Printf("TLS certificate fingerprint (sha256): %s\n", Fingerprint(cert))
+	return s.app.Listener(ln)
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/cordialsys/panel/pkg/plog"
 	"github.com/gofiber/fiber/v2"
 )
 
@@ -18,8 +19,13 @@ type ErrorResponse struct {
 func (e *ErrorResponse) Error() string {
 	return fmt.Sprintf("code: %d, status: %s, message: %s", e.Code, e.Status, e.Message)
 }
+func (e *ErrorResponse) HttpStatus() int {
+	return e.httpStatus
+}
 func (e *ErrorResponse) Send(c *fiber.Ctx) error {
 	c.Status(e.httpStatus)
+	// secrets may have been registered since the error was created
+	e.Message = plog.Redact(e.Message)
 	return c.JSON(e)
 }
 
@@ -147,7 +153,7 @@ func sendError(httpStatus int, message string) error {
 	return &ErrorResponse{
 		Code:       code,
 		Status:     status,
-		Message:    message,
+		Message:    plog.Redact(message),
 		httpStatus: httpStatus,
 	}
 }
@@ -158,7 +164,7 @@ func sendGrpcError(httpStatus int, grpcCode GrpcCode, message string) error {
 	return &ErrorResponse{
 		Code:       grpcCode,
 		Status:     status,
-		Message:    message,
+		Message:    plog.Redact(message),
 		httpStatus: httpStatus,
 	}
 }
@@ -186,6 +192,11 @@ func Forbiddenf(format string, args ...interface{}) error {
 	return NewErrorf(http.StatusForbidden, format, args...)
 }
 
+// PermissionDeniedf sends a 403 Forbidden error with the PermissionDenied code and formatted message
+func PermissionDeniedf(format string, args ...interface{}) error {
+	return NewGrpcErrorf(http.StatusForbidden, CodePermissionDenied, format, args...)
+}
+
 // NotFoundf sends a 404 Not Found error with formatted message
 func NotFoundf(format string, args ...interface{}) error {
 	return NewErrorf(http.StatusNotFound, format, args...)
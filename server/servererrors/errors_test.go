@@ -0,0 +1,40 @@
+package servererrors_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cordialsys/panel/pkg/plog"
+	"github.com/cordialsys/panel/server/servererrors"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorsAreRedacted(t *testing.T) {
+	earPhrase := "abandon ability able about above absent absorb abstract absurd abuse access accident"
+	plog.AddSecret(earPhrase)
+
+	err := servererrors.InternalErrorf("failed to run `cord`: %v", "SIGNER_EAR_PHRASE="+earPhrase)
+	require.NotContains(t, err.Error(), earPhrase)
+	require.Contains(t, err.Error(), plog.Redacted)
+
+	// secrets registered after the error was created are redacted when sent
+	apiKey := "dGVzdC1rZXk6c2VjcmV0LWFwaS1rZXk="
+	late := servererrors.BadRequestf("invalid api key %s", apiKey)
+	plog.AddSecret(apiKey)
+
+	app := fiber.New()
+	app.Get("/", func(c *fiber.Ctx) error {
+		return late.(*servererrors.ErrorResponse).Send(c)
+	})
+	resp, err := app.Test(httptest.NewRequest("GET", "/", nil))
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NotContains(t, string(body), apiKey)
+	var errResp servererrors.ErrorResponse
+	require.NoError(t, json.Unmarshal(body, &errResp))
+	require.Equal(t, "invalid api key "+plog.Redacted, errResp.Message)
+}
@@ -0,0 +1,160 @@
+package sessions
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+	"github.com/cordialsys/panel/pkg/nonce"
+)
+
+// How long a session recipient may be used for, unless held for an approval request (see `Hold`).
+const DefaultTTL = 5 * time.Minute
+
+// Bound the number of live sessions of each token, as they are only held in memory.
+const MaxSessionsPerToken = 8
+
+// The operation that a session recipient may be used for.
+type Operation string
+
+const (
+	OperationRestoreSnapshot    Operation = "restore-snapshot"
+	OperationRestoreMissingKeys Operation = "restore-missing-keys"
+	OperationEndorseSigningKey  Operation = "endorse-signing-key"
+)
+
+var Operations = []Operation{OperationRestoreSnapshot, OperationRestoreMissingKeys, OperationEndorseSigningKey}
+
+func (op Operation) Valid() bool {
+	return slices.Contains(Operations, op)
+}
+
+var ErrNotFound = errors.New("session not found or expired")
+
+// An ephemeral age recipient for submitting an encrypted secret for a single operation.
+// The identity is only ever held in memory, and is dropped after use or on expiry.
+type Session struct {
+	Id         string    `json:"session_id"`
+	Operation  Operation `json:"operation"`
+	Recipient  string    `json:"recipient"`
+	ExpireTime time.Time `json:"expire_time"`
+
+	// Only the token that created the session may use it
+	tokenId  string
+	identity *age.X25519Identity
+	timer    *time.Timer
+	// The approval request the session is held for
+	approvalId string
+}
+
+type Store struct {
+	lock     sync.Mutex
+	sessions map[string]*Session
+	TTL      time.Duration
+}
+
+func NewStore() *Store {
+	return &Store{sessions: map[string]*Session{}, TTL: DefaultTTL}
+}
+
+// Mint a new session recipient for the operation, owned by the given token.
+func (s *Store) Create(operation Operation, tokenId string) (*Session, error) {
+	if !operation.Valid() {
+		return nil, fmt.Errorf("invalid operation %q, must be one of %v", operation, Operations)
+	}
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	owned := 0
+	for _, session := range s.sessions {
+		if session.tokenId == tokenId {
+			owned++
+		}
+	}
+	if owned >= MaxSessionsPerToken {
+		return nil, fmt.Errorf("too many active sessions for this token, try again in %v", s.TTL)
+	}
+	session := &Session{
+		Id:         nonce.NewString(),
+		Operation:  operation,
+		Recipient:  identity.Recipient().String(),
+		ExpireTime: time.Now().UTC().Add(s.TTL),
+		tokenId:    tokenId,
+		identity:   identity,
+	}
+	id := session.Id
+	session.timer = time.AfterFunc(s.TTL, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		delete(s.sessions, id)
+	})
+	s.sessions[id] = session
+	return session, nil
+}
+
+// Keep a session until the approval request it was submitted with expires, as the approved
+// request is retried with the same body (the session is part of the body hash).  Only the owner's
+// sessions may be held, and only for later than they already expire.
+func (s *Store) Hold(id string, tokenId string, approvalId string, until time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	session, ok := s.sessions[id]
+	if !ok || time.Now().After(session.ExpireTime) {
+		return ErrNotFound
+	}
+	if session.tokenId != tokenId {
+		return fmt.Errorf("session was created by a different token")
+	}
+	session.approvalId = approvalId
+	if until.After(session.ExpireTime) {
+		session.ExpireTime = until.UTC()
+		session.timer.Reset(time.Until(until))
+	}
+	return nil
+}
+
+// Drop the sessions held for an approval request, e.g. once it is cancelled.
+func (s *Store) Release(approvalId string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for id, session := range s.sessions {
+		if session.approvalId == approvalId {
+			session.timer.Stop()
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// Remove the session and return its identity.  Once taken by its owner, the session is
+// removed even if it is for another operation, so a session is never tried twice.
+func (s *Store) Take(id string, operation Operation, tokenId string) (*age.X25519Identity, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	session, ok := s.sessions[id]
+	if !ok || time.Now().After(session.ExpireTime) {
+		return nil, ErrNotFound
+	}
+	if session.tokenId != tokenId {
+		return nil, fmt.Errorf("session was created by a different token")
+	}
+	delete(s.sessions, id)
+	session.timer.Stop()
+	if session.Operation != operation {
+		return nil, fmt.Errorf("session is for %s, not %s", session.Operation, operation)
+	}
+	return session.identity, nil
+}
+
+// Number of live sessions.
+func (s *Store) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.sessions)
+}
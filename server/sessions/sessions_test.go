@@ -0,0 +1,101 @@
+package sessions_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/cordialsys/panel/server/sessions"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionRecipient(t *testing.T) {
+	store := sessions.NewStore()
+
+	_, err := store.Create("reset", "alice")
+	require.Error(t, err)
+
+	session, err := store.Create(sessions.OperationRestoreSnapshot, "alice")
+	require.NoError(t, err)
+	recipient, err := age.ParseX25519Recipient(session.Recipient)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	writer, err := age.Encrypt(&buf, recipient)
+	require.NoError(t, err)
+	_, err = writer.Write([]byte("secret phrase"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	// only the creator may use it, and doing so does not consume it
+	_, err = store.Take(session.Id, sessions.OperationRestoreSnapshot, "bob")
+	require.Error(t, err)
+
+	identity, err := store.Take(session.Id, sessions.OperationRestoreSnapshot, "alice")
+	require.NoError(t, err)
+	reader, err := age.Decrypt(&buf, identity)
+	require.NoError(t, err)
+	plaintext, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, "secret phrase", string(plaintext))
+
+	// single use
+	_, err = store.Take(session.Id, sessions.OperationRestoreSnapshot, "alice")
+	require.ErrorIs(t, err, sessions.ErrNotFound)
+
+	// bound to the operation, and dropped on misuse
+	session, err = store.Create(sessions.OperationRestoreMissingKeys, "alice")
+	require.NoError(t, err)
+	_, err = store.Take(session.Id, sessions.OperationRestoreSnapshot, "alice")
+	require.ErrorContains(t, err, "restore-missing-keys")
+	_, err = store.Take(session.Id, sessions.OperationRestoreMissingKeys, "alice")
+	require.ErrorIs(t, err, sessions.ErrNotFound)
+	require.Equal(t, 0, store.Len())
+}
+
+func TestSessionExpiry(t *testing.T) {
+	store := sessions.NewStore()
+	store.TTL = 10 * time.Millisecond
+	session, err := store.Create(sessions.OperationRestoreSnapshot, "alice")
+	require.NoError(t, err)
+	require.Equal(t, 1, store.Len())
+	require.Eventually(t, func() bool { return store.Len() == 0 }, time.Second, 5*time.Millisecond)
+	_, err = store.Take(session.Id, sessions.OperationRestoreSnapshot, "alice")
+	require.ErrorIs(t, err, sessions.ErrNotFound)
+
+	// sessions are capped per token, so one token cannot use up the sessions of others
+	store.TTL = time.Hour
+	for i := 0; i < sessions.MaxSessionsPerToken; i++ {
+		_, err := store.Create(sessions.OperationRestoreSnapshot, "alice")
+		require.NoError(t, err)
+	}
+	_, err = store.Create(sessions.OperationRestoreSnapshot, "alice")
+	require.ErrorContains(t, err, "too many active sessions")
+	_, err = store.Create(sessions.OperationRestoreSnapshot, "bob")
+	require.NoError(t, err)
+}
+
+func TestSessionHold(t *testing.T) {
+	store := sessions.NewStore()
+	store.TTL = 10 * time.Millisecond
+	held, err := store.Create(sessions.OperationRestoreSnapshot, "alice")
+	require.NoError(t, err)
+	cancelled, err := store.Create(sessions.OperationRestoreSnapshot, "alice")
+	require.NoError(t, err)
+
+	// only the owner may hold a session
+	require.Error(t, store.Hold(held.Id, "bob", "approval-1", time.Now().Add(time.Hour)))
+	require.NoError(t, store.Hold(held.Id, "alice", "approval-1", time.Now().Add(time.Hour)))
+	require.NoError(t, store.Hold(cancelled.Id, "alice", "approval-2", time.Now().Add(time.Hour)))
+
+	// held sessions outlive the TTL, until their approval request is released
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, 2, store.Len())
+	store.Release("approval-2")
+	require.Equal(t, 1, store.Len())
+	_, err = store.Take(cancelled.Id, sessions.OperationRestoreSnapshot, "alice")
+	require.ErrorIs(t, err, sessions.ErrNotFound)
+	_, err = store.Take(held.Id, sessions.OperationRestoreSnapshot, "alice")
+	require.NoError(t, err)
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"time"
+
+	"github.com/cordialsys/panel/pkg/client"
+	"github.com/cordialsys/panel/pkg/paths"
+)
+
+const selfSignedValidity = 10 * 365 * 24 * time.Hour
+
+// Load the operator supplied certificate, or generate (once) a self-signed certificate in the panel directory.
+func LoadOrGenerateCertificate(panelDir paths.PanelHome, certFile string, keyFile string) (tls.Certificate, error) {
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return tls.Certificate{}, fmt.Errorf("both --tls-cert and --tls-key must be set")
+		}
+		return tls.LoadX509KeyPair(certFile, keyFile)
+	}
+
+	if _, err := os.Stat(panelDir.TlsCertFile()); err == nil {
+		return tls.LoadX509KeyPair(panelDir.TlsCertFile(), panelDir.TlsKeyFile())
+	}
+
+	slog.Info("generating self-signed certificate", "path", panelDir.TlsCertFile())
+	certPem, keyPem, err := generateSelfSigned()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	err = os.MkdirAll(panelDir.String(), 0755)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	// write the key first so a partial write never leaves a certificate without its key
+	if err := os.WriteFile(panelDir.TlsKeyFile(), keyPem, 0600); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(panelDir.TlsCertFile(), certPem, 0644); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPem, keyPem)
+}
+
+func generateSelfSigned() (certPem []byte, keyPem []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	dnsNames := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" && hostname != "localhost" {
+		dnsNames = append(dnsNames, hostname)
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "panel"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		// mark as a CA so the certificate may be used directly as a trust root by clients
+		IsCA:        true,
+		DNSNames:    dnsNames,
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPem = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return certPem, keyPem, nil
+}
+
+// Returns the SHA-256 fingerprint of the leaf certificate
+func Fingerprint(cert tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+	return client.CertificateFingerprint(cert.Certificate[0])
+}
+
+func newTlsConfig(cert tls.Certificate, clientCaFile string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if clientCaFile != "" {
+		caBz, err := os.ReadFile(clientCaFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBz) {
+			return nil, fmt.Errorf("no certificates found in client CA %s", clientCaFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
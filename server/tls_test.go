@@ -0,0 +1,77 @@
+package server_test
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/cordialsys/panel/pkg/client"
+	"github.com/cordialsys/panel/pkg/paths"
+	"github.com/cordialsys/panel/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadOrGenerateCertificate(t *testing.T) {
+	panelDir := paths.PanelHome(t.TempDir())
+
+	cert, err := server.LoadOrGenerateCertificate(panelDir, "", "")
+	require.NoError(t, err)
+	require.NotEmpty(t, server.Fingerprint(cert))
+
+	keyStat, err := os.Stat(panelDir.TlsKeyFile())
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), keyStat.Mode().Perm())
+
+	// the certificate is persisted and reused
+	again, err := server.LoadOrGenerateCertificate(panelDir, "", "")
+	require.NoError(t, err)
+	require.Equal(t, server.Fingerprint(cert), server.Fingerprint(again))
+
+	// operator supplied certificate takes precedence
+	loaded, err := server.LoadOrGenerateCertificate(paths.PanelHome(t.TempDir()), panelDir.TlsCertFile(), panelDir.TlsKeyFile())
+	require.NoError(t, err)
+	require.Equal(t, server.Fingerprint(cert), server.Fingerprint(loaded))
+
+	_, err = server.LoadOrGenerateCertificate(panelDir, panelDir.TlsCertFile(), "")
+	require.Error(t, err)
+}
+
+func TestClientTls(t *testing.T) {
+	panelDir := paths.PanelHome(t.TempDir())
+	cert, err := server.LoadOrGenerateCertificate(panelDir, "", "")
+	require.NoError(t, err)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	ts.StartTLS()
+	defer ts.Close()
+	remote, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	// pinned fingerprint
+	c, err := client.NewClient(remote, client.ClientOptions{Fingerprint: server.Fingerprint(cert)})
+	require.NoError(t, err)
+	require.NoError(t, c.Health())
+
+	// the self-signed certificate may be used as a CA
+	c, err = client.NewClient(remote, client.ClientOptions{CaFile: panelDir.TlsCertFile()})
+	require.NoError(t, err)
+	require.NoError(t, c.Health())
+
+	// wrong fingerprint
+	otherCert, err := server.LoadOrGenerateCertificate(paths.PanelHome(t.TempDir()), "", "")
+	require.NoError(t, err)
+	c, err = client.NewClient(remote, client.ClientOptions{Fingerprint: server.Fingerprint(otherCert)})
+	require.NoError(t, err)
+	require.Error(t, c.Health())
+
+	// not trusted by default
+	c, err = client.NewClient(remote, client.ClientOptions{})
+	require.NoError(t, err)
+	require.Error(t, c.Health())
+}
@@ -1,10 +1,11 @@
 import { useState, useEffect, useRef } from "react";
-import * as age from "age-encryption";
 
 import { PanelInfo } from "../utils/types";
 import {
+  ApprovalRequiredError,
   panelApiClient,
   RestoreMissingKeysResponse,
+  RestoreSnapshotRequest,
   S3ListResponse,
 } from "../utils/panel-client";
 import RestoreMissingKeysTab from "./RestoreMissingKeysTab";
@@ -37,6 +38,11 @@ export default function BackupRestoreTab({ panelInfo }: Props) {
   const [restoreProgress, setRestoreProgress] = useState<string[]>([]);
   const [missingKeysResult, setMissingKeysResult] =
     useState<RestoreMissingKeysResponse | null>(null);
+  // A restore waiting for approval: the exact request must be sent again once approved
+  const [pendingRestore, setPendingRestore] = useState<{
+    request: RestoreSnapshotRequest;
+    approvalId: string;
+  } | null>(null);
   const [showAdvanced, setShowAdvanced] = useState(false);
   const [status, setStatus] = useState<{
     type: "success" | "error" | "info" | null;
@@ -209,7 +215,7 @@ export default function BackupRestoreTab({ panelInfo }: Props) {
 
   // Restore from selected snapshot
   const handleRestore = async () => {
-    if (!selectedSnapshot || !panelInfo?.recipient) {
+    if (!selectedSnapshot) {
       setStatus({
         type: "error",
         message: "Missing required information for restore.",
@@ -231,22 +237,61 @@ export default function BackupRestoreTab({ panelInfo }: Props) {
     setMissingKeysResult(null);
 
     try {
-      // Encrypt mnemonic using age encryption
-      const encrypter = new age.Encrypter();
-      encrypter.addRecipient(panelInfo.recipient);
-      const encryptedBytes = await encrypter.encrypt(mnemonic);
-
-      // Convert to base64 string for API transmission
-      const encryptedMnemonic = btoa(
-        String.fromCharCode.apply(null, Array.from(encryptedBytes))
-      );
-
-      // Step 1: Restore from snapshot
+      // Step 1: Restore from snapshot, once a second admin approved it
+      if (pendingRestore) {
+        const approval = await panelApiClient.getApproval(
+          pendingRestore.approvalId
+        );
+        if (approval.state === "pending") {
+          setRestoreProgress((prev) => [
+            ...prev,
+            `⏳ Approval request ${approval.id} is still pending (expires ${new Date(
+              approval.expire_time
+            ).toLocaleString()})`,
+          ]);
+          setStatus({
+            type: "info",
+            message: `Waiting for a second admin to approve request ${approval.id}.`,
+          });
+          return;
+        }
+        if (approval.state !== "approved") {
+          setPendingRestore(null);
+          throw new Error(
+            `approval request ${approval.id} is ${approval.state}, restore again to request a new approval`
+          );
+        }
+      }
       setRestoreProgress((prev) => [...prev, "🔄 Restoring from snapshot..."]);
-      await panelApiClient.restoreFromSnapshot({
+      const request = pendingRestore?.request ?? {
         s3_key: selectedSnapshot,
-        encrypted_secret_phrase: encryptedMnemonic,
-      });
+        ...(await panelApiClient.encryptSecretPhrase(
+          "restore-snapshot",
+          mnemonic
+        )),
+      };
+      try {
+        await panelApiClient.restoreFromSnapshot(
+          request,
+          pendingRestore?.approvalId
+        );
+      } catch (error) {
+        if (!(error instanceof ApprovalRequiredError)) {
+          throw error;
+        }
+        setPendingRestore({ request, approvalId: error.approvalId });
+        setRestoreProgress((prev) => [
+          ...prev,
+          `⏳ Restore requires approval from a second admin: approval request ${error.approvalId}`,
+          `   Approve with \`panel approvals approve ${error.approvalId}\`, then retry the restore`,
+        ]);
+        setStatus({
+          type: "info",
+          message: `Restore requires approval: ask a second admin to approve request ${error.approvalId}, then retry.`,
+        });
+        return;
+      }
+      setPendingRestore(null);
       setRestoreProgress((prev) => [
         ...prev,
         "✅ Snapshot restored successfully",
@@ -257,9 +302,12 @@ export default function BackupRestoreTab({ panelInfo }: Props) {
         ...prev,
         "🔄 Checking for missing keys...",
       ]);
-      const missingKeysResponse = await panelApiClient.restoreMissingKeys({
-        encrypted_secret_phrase: encryptedMnemonic,
-      });
+      const missingKeysResponse = await panelApiClient.restoreMissingKeys(
+        await panelApiClient.encryptSecretPhrase(
+          "restore-missing-keys",
+          mnemonic
+        )
+      );
       setMissingKeysResult(missingKeysResponse);
       setRestoreProgress((prev) => [
         ...prev,
@@ -289,6 +337,7 @@ export default function BackupRestoreTab({ panelInfo }: Props) {
       setSelectedSnapshot(null);
     } catch (error) {
       console.error("Failed to restore:", error);
+      setPendingRestore(null);
       setRestoreProgress((prev) => [...prev, `❌ Error: ${error}`]);
       setStatus({
         type: "error",
@@ -299,6 +348,13 @@ export default function BackupRestoreTab({ panelInfo }: Props) {
     }
   };
 
+  // An approval is bound to the snapshot it was requested for
+  useEffect(() => {
+    if (pendingRestore && pendingRestore.request.s3_key !== selectedSnapshot) {
+      setPendingRestore(null);
+    }
+  }, [selectedSnapshot, pendingRestore]);
+
   // Filter snapshots based on search term
   useEffect(() => {
     if (!searchTerm.trim()) {
@@ -801,7 +857,11 @@ export default function BackupRestoreTab({ panelInfo }: Props) {
                 }}
               >
                 {restoring && <span className="loading"></span>}
-                {restoring ? "Restoring..." : "🔄 Restore Treasury"}
+                {restoring
+                  ? "Restoring..."
+                  : pendingRestore
+                  ? "🔄 Retry Approved Restore"
+                  : "🔄 Restore Treasury"}
               </button>
               <button
                 className="btn secondary"
@@ -810,6 +870,7 @@ export default function BackupRestoreTab({ panelInfo }: Props) {
                   setMnemonic("");
                   setRestoreProgress([]);
                   setMissingKeysResult(null);
+                  setPendingRestore(null);
                 }}
                 disabled={restoring}
               >
@@ -874,7 +935,7 @@ export default function BackupRestoreTab({ panelInfo }: Props) {
         {showAdvanced && <RestoreMissingKeysTab panelInfo={panelInfo} />}
       </div>
 
-      {/* Footer - Panel Identity Info */}
+      {/* Footer - secret phrase handling */}
       <div
         style={{
           marginTop: "2rem",
@@ -882,28 +943,12 @@ export default function BackupRestoreTab({ panelInfo }: Props) {
           backgroundColor: "#f8f9fa",
           border: "1px solid #dee2e6",
           borderRadius: "4px",
-          fontSize: "0.85rem",
+          fontSize: "0.8rem",
+          color: "#6c757d",
         }}
       >
-        <div style={{ marginBottom: "0.5rem" }}>
-          <strong>Panel Identity</strong>
-        </div>
-        <div
-          style={{
-            fontFamily: "monospace",
-            fontSize: "0.8rem",
-            color: "#495057",
-            wordBreak: "break-all",
-          }}
-        >
-          {panelInfo?.recipient || "Not available"}
-        </div>
-        <div
-          style={{ marginTop: "0.5rem", fontSize: "0.8rem", color: "#6c757d" }}
-        >
-          The secret phrase will be transmitted securely to the Panel's identity
-          for restoration, but never saved.
-        </div>
+        The secret phrase is encrypted to a single-use key that the Panel holds
+        only in memory for this restoration, and is never saved.
       </div>
     </div>
   );
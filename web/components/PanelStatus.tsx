@@ -80,20 +80,6 @@ export default function PanelStatus({ panelInfo }: Props) {
         <div>
           <strong>State:</strong> {panelInfo.state}
         </div>
-        <div style={{ gridColumn: "1 / -1" }}>
-          <strong>Panel Identity:</strong>
-          <div
-            style={{
-              fontFamily: "monospace",
-              fontSize: "0.75rem",
-              color: "#6c757d",
-              wordBreak: "break-all",
-              marginTop: "0.25rem",
-            }}
-          >
-            {panelInfo.recipient || "Not available"}
-          </div>
-        </div>
         {panelInfo.baks && panelInfo.baks.length > 0 && (
           <div style={{ gridColumn: "1 / -1" }}>
             <strong>Backup Keys</strong>
@@ -1,8 +1,8 @@
 import { useState, useEffect, useRef } from "react";
 import { getApiHost } from "../utils/api";
-import * as age from "age-encryption";
 import { PanelInfo } from "../utils/types";
 import {
+  authHeaders,
   panelApiClient,
   RestoreMissingKeysResponse,
 } from "../utils/panel-client";
@@ -98,7 +98,8 @@ export default function RestoreMissingKeysTab({ panelInfo }: Props) {
         }
 
         const response = await fetch(
-          `${getApiHost()}/v1/s3/objects?${queryParams}`
+          `${getApiHost()}/v1/s3/objects?${queryParams}`,
+          { headers: authHeaders() }
         );
 
         if (!response.ok) {
@@ -162,14 +163,6 @@ export default function RestoreMissingKeysTab({ panelInfo }: Props) {
 
   // Handle restore missing keys
   const handleRestoreMissingKeys = async () => {
-    if (!panelInfo?.recipient) {
-      setStatus({
-        type: "error",
-        message: "Panel recipient not available.",
-      });
-      return;
-    }
-
     if (!mnemonic.trim()) {
       setStatus({
         type: "error",
@@ -183,20 +176,14 @@ export default function RestoreMissingKeysTab({ panelInfo }: Props) {
     setRestoreResult(null);
 
     try {
-      // Encrypt mnemonic using age encryption
-      const encrypter = new age.Encrypter();
-      encrypter.addRecipient(panelInfo.recipient);
-      const encryptedBytes = await encrypter.encrypt(mnemonic);
-
-      // Convert to base64 string for API transmission
-      const encryptedMnemonic = btoa(
-        String.fromCharCode.apply(null, Array.from(encryptedBytes))
+      // Encrypt mnemonic to a single-use session recipient
+      const result = await panelApiClient.restoreMissingKeys(
+        await panelApiClient.encryptSecretPhrase(
+          "restore-missing-keys",
+          mnemonic
+        )
       );
 
-      const result = await panelApiClient.restoreMissingKeys({
-        encrypted_secret_phrase: encryptedMnemonic,
-      });
-
       setRestoreResult(result);
       setStatus({
         type: "success",
@@ -1,3 +1,4 @@
+import * as age from "age-encryption";
 import { PanelInfo, HealthInfo } from "./types";
 
 export interface S3Object {
@@ -48,21 +49,64 @@ export interface SetEncryptionAtRestRequest {
   ear_secret: string;
 }
 
-export interface RestoreSnapshotRequest {
-  s3_key: string;
-  encrypted_secret_phrase: string;
+export type SessionOperation = "restore-snapshot" | "restore-missing-keys";
+
+export interface SessionRecipient {
+  session_id: string;
+  operation: SessionOperation;
+  recipient: string;
+  expire_time: string;
 }
 
-export interface RestoreMissingKeysRequest {
+export interface EncryptedSecretPhrase {
+  session_id: string;
   encrypted_secret_phrase: string;
 }
 
+export interface RestoreSnapshotRequest extends EncryptedSecretPhrase {
+  s3_key: string;
+}
+
+export interface RestoreMissingKeysRequest extends EncryptedSecretPhrase {}
+
 export interface RestoreMissingKeysResponse {
   active_keys: number;
   backed_up_keys: number;
   imported_keys: number;
 }
 
+export type ApprovalState =
+  | "pending"
+  | "approved"
+  | "executed"
+  | "cancelled"
+  | "expired";
+
+export interface Approval {
+  id: string;
+  action: string;
+  state: ApprovalState;
+  requested_by: { token_id: string; name: string };
+  approved_by?: { token_id: string; name: string };
+  create_time: string;
+  expire_time: string;
+}
+
+// Header used to execute a request once a second admin has approved it.
+export const APPROVAL_HEADER = "X-Panel-Approval";
+
+// Thrown when the panel created an approval request instead of running the call. The same call
+// (with the same body) must be repeated with the approval id once it is approved.
+export class ApprovalRequiredError extends Error {
+  approvalId: string;
+
+  constructor(approvalId: string, message: string) {
+    super(message);
+    this.name = "ApprovalRequiredError";
+    this.approvalId = approvalId;
+  }
+}
+
 export interface BootcStatusResponse {
   [key: string]: any;
 }
@@ -98,6 +142,26 @@ export interface ServiceInfo {
 
 export type ServiceName = "treasury.service" | "start-treasury.service";
 
+const TOKEN_STORAGE_KEY = "panel_token";
+
+// Admin token for the panel API. May be passed once via `?token=` and is then remembered.
+export const getPanelToken = (): string | null => {
+  if (typeof window === "undefined") {
+    return null;
+  }
+  const fromUrl = new URLSearchParams(window.location.search).get("token");
+  if (fromUrl) {
+    window.localStorage.setItem(TOKEN_STORAGE_KEY, fromUrl);
+    return fromUrl;
+  }
+  return window.localStorage.getItem(TOKEN_STORAGE_KEY);
+};
+
+export const authHeaders = (): Record<string, string> => {
+  const token = getPanelToken();
+  return token ? { Authorization: `Bearer ${token}` } : {};
+};
+
 export class PanelApiClient {
   private apiHost: string;
 
@@ -120,13 +184,18 @@ export class PanelApiClient {
   ): Promise<T> {
     const url = `${this.apiHost}${endpoint}`;
     const response = await fetch(url, {
+      ...options,
       headers: {
         "Content-Type": "application/json",
+        ...authHeaders(),
         ...options.headers,
       },
-      ...options,
     });
 
+    const approvalId = response.headers.get(APPROVAL_HEADER);
+    if (response.status === 428 && approvalId) {
+      throw new ApprovalRequiredError(approvalId, await response.text());
+    }
     if (!response.ok) {
       const error = await response.text();
       throw new Error(error || `HTTP ${response.status}`);
@@ -146,11 +215,12 @@ export class PanelApiClient {
   ): Promise<string> {
     const url = `${this.apiHost}${endpoint}`;
     const response = await fetch(url, {
+      ...options,
       headers: {
         "Content-Type": "application/json",
+        ...authHeaders(),
         ...options.headers,
       },
-      ...options,
     });
 
     // if (!response.ok) {
@@ -187,7 +257,9 @@ export class PanelApiClient {
 
   async getTreasuryHealth(verbose: boolean = true): Promise<HealthInfo> {
     const query = verbose ? "?verbose" : "";
-    const response = await fetch(`${this.apiHost}/v1/treasury/healthy${query}`);
+    const response = await fetch(`${this.apiHost}/v1/treasury/healthy${query}`, {
+      headers: authHeaders(),
+    });
     return {
       status_code: response.status,
       json: await response.json(),
@@ -289,10 +361,42 @@ export class PanelApiClient {
     });
   }
 
-  async restoreFromSnapshot(request: RestoreSnapshotRequest): Promise<void> {
+  async createSessionRecipient(
+    operation: SessionOperation
+  ): Promise<SessionRecipient> {
+    return this.makeRequest<SessionRecipient>("/v1/sessions/recipient", {
+      method: "POST",
+      body: JSON.stringify({ operation }),
+    });
+  }
+
+  // Encrypt a secret phrase to a new session recipient, which the panel drops after one use
+  async encryptSecretPhrase(
+    operation: SessionOperation,
+    secretPhrase: string
+  ): Promise<EncryptedSecretPhrase> {
+    const session = await this.createSessionRecipient(operation);
+    const encrypter = new age.Encrypter();
+    encrypter.addRecipient(session.recipient);
+    const encryptedBytes = await encrypter.encrypt(secretPhrase);
+    return {
+      session_id: session.session_id,
+      encrypted_secret_phrase: btoa(
+        String.fromCharCode.apply(null, Array.from(encryptedBytes))
+      ),
+    };
+  }
+
+  // Restore requires approval: the first call throws ApprovalRequiredError, and the same request
+  // (encrypted to the same session) is sent again with the approval id once approved.
+  async restoreFromSnapshot(
+    request: RestoreSnapshotRequest,
+    approvalId?: string
+  ): Promise<void> {
     await this.makeRequest("/v1/backup/restore", {
       method: "POST",
       body: JSON.stringify(request),
+      headers: approvalId ? { [APPROVAL_HEADER]: approvalId } : {},
     });
   }
 
@@ -341,6 +445,7 @@ export class PanelApiClient {
       body: file,
       headers: {
         "Content-Type": "application/octet-stream",
+        ...authHeaders(),
       },
     });
 
@@ -375,6 +480,13 @@ export class PanelApiClient {
     await this.makeRequest("/v1/bootc/rollback/apply", { method: "POST" });
   }
 
+  // Approvals
+  async getApproval(approvalId: string): Promise<Approval> {
+    return this.makeRequest<Approval>(
+      `/v1/approvals/${encodeURIComponent(approvalId)}`
+    );
+  }
+
   // Admin/Users Management
   async getAdminUsers(pageToken?: string): Promise<UsersResponse> {
     const params = new URLSearchParams();
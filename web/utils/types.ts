@@ -31,7 +31,6 @@ export interface PanelInfo {
   otel_enabled: boolean;
   treasury_size?: number;
   state: "inactive" | "generated" | "active" | "sealed" | "stopped";
-  recipient: string;
   ear_secret: string;
   users?: User[];
   blueprint?: "production" | "demo";